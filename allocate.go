@@ -0,0 +1,115 @@
+package main
+
+import "sort"
+
+// allocation is the share of a site's power given to a car.
+type allocation struct {
+	c     car
+	power float64
+}
+
+// wantsSolar tells if car c should get a share of the solar power.
+func (c car) wantsSolar() bool {
+	if !c.IsPluggedIn {
+		return false
+	}
+	if c.IsCharging {
+		return c.IsChargingBySolar || c.IsChargingByGrid
+	}
+	return c.ChargeLimit-c.BatteryLevel > startChargeDiff
+}
+
+func (c car) minChargingPower() float64 {
+	return float64(c.minChargeAmps()) * c.chargerVoltage() * c.chargerPhases()
+}
+
+// maxChargingPower returns the most power the car can take, or zero if it
+// is unknown.
+func (c car) maxChargingPower() float64 {
+	return float64(c.MaxChargeAmps) * c.chargerVoltage() * c.chargerPhases()
+}
+
+// sitePower is the power at site s that can be shared among cars, which is
+// the surplus plus whatever the cars are charging by solar already. Cars
+// charging manually or from the grid are not the surplus's to share.
+func sitePower(s site, cars []car) float64 {
+	if !s.GridMetered {
+		return s.SolarPower
+	}
+	power := s.GridExport - s.GridImport
+	for _, c := range cars {
+		if c.IsCharging && c.IsChargingBySolar {
+			power += c.chargingPower()
+		}
+	}
+	return power
+}
+
+// allocatePower divides the power of site s among the cars at the site.
+// Cars are served by priority and then by how far they are from their
+// charge limit. Every car that can be served gets its minimum charging power
+// first, the rest is then handed out in the same order up to each car's
+// maximum. When not even one car can get its minimum the first car gets it
+// all so that the site thresholds decide as for a single car.
+//
+// The allocations are ordered so that cars that are to use less power come
+// first, applying them in order never makes the cars draw more than the site
+// power.
+func allocatePower(s site, cars []car) []allocation {
+	ordered := make([]car, len(cars))
+	copy(ordered, cars)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Priority != ordered[j].Priority {
+			return ordered[i].Priority > ordered[j].Priority
+		}
+		return ordered[i].ChargeLimit-ordered[i].BatteryLevel > ordered[j].ChargeLimit-ordered[j].BatteryLevel
+	})
+
+	pool := sitePower(s, cars)
+	shares := make([]float64, len(ordered))
+	served := make([]bool, len(ordered))
+	anyServed := false
+	for i, c := range ordered {
+		if c.wantsSolar() && pool >= c.minChargingPower() {
+			shares[i] = c.minChargingPower()
+			served[i] = true
+			anyServed = true
+			pool -= shares[i]
+		}
+	}
+	if anyServed {
+		for i, c := range ordered {
+			if !served[i] {
+				continue
+			}
+			extra := pool
+			if max := c.maxChargingPower(); max > 0 && shares[i]+extra > max {
+				extra = max - shares[i]
+			}
+			if extra > 0 {
+				shares[i] += extra
+				pool -= extra
+			}
+		}
+	} else {
+		for i, c := range ordered {
+			if c.wantsSolar() {
+				shares[i] = pool
+				break
+			}
+		}
+	}
+
+	allocations := make([]allocation, len(ordered))
+	for i, c := range ordered {
+		allocations[i] = allocation{c: c, power: shares[i]}
+	}
+	sort.SliceStable(allocations, func(i, j int) bool {
+		return allocations[i].decreases() && !allocations[j].decreases()
+	})
+	return allocations
+}
+
+func (al allocation) decreases() bool {
+	return al.c.IsCharging && al.power < al.c.chargingPower()
+}
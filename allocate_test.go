@@ -0,0 +1,110 @@
+package main
+
+import "testing"
+
+func TestAllocatePower(t *testing.T) {
+	plugged := func(id int64, priority int, level int32) car {
+		return car{CarID: id, Priority: priority, BatteryLevel: level, ChargeLimit: 80, IsPluggedIn: true,
+			ChargerVoltage: 230, ChargerPhases: 1, MinChargeAmps: 6, MaxChargeAmps: 16}
+	}
+	charging := func(c car, amps int32) car {
+		c.IsCharging = true
+		c.IsChargingBySolar = true
+		c.ChargerActualCurrent = amps
+		c.ChargeAmps = amps
+		return c
+	}
+	manual := func(c car, amps int32) car {
+		c = charging(c, amps)
+		c.IsChargingBySolar = false
+		return c
+	}
+	tests := []struct {
+		name string
+		s    site
+		cars []car
+		want map[int64]float64
+	}{
+		{
+			name: "single car gets everything",
+			s:    site{SolarPower: 3000.0},
+			cars: []car{plugged(1, 0, 50)},
+			want: map[int64]float64{1: 3000.0},
+		},
+		{
+			name: "single car below minimum still gets the power",
+			s:    site{SolarPower: 1000.0},
+			cars: []car{plugged(1, 0, 50)},
+			want: map[int64]float64{1: 1000.0},
+		},
+		{
+			name: "only one car fits, larger deficit wins",
+			s:    site{SolarPower: 2000.0},
+			cars: []car{plugged(1, 0, 60), plugged(2, 0, 20)},
+			want: map[int64]float64{1: 0.0, 2: 2000.0},
+		},
+		{
+			name: "only one car fits, priority wins",
+			s:    site{SolarPower: 2000.0},
+			cars: []car{plugged(1, 1, 60), plugged(2, 0, 20)},
+			want: map[int64]float64{1: 2000.0, 2: 0.0},
+		},
+		{
+			name: "both get minimum and the rest goes by priority",
+			s:    site{SolarPower: 4000.0},
+			cars: []car{plugged(1, 0, 60), plugged(2, 1, 20)},
+			want: map[int64]float64{1: 1380.0, 2: 2620.0},
+		},
+		{
+			name: "maximum is respected",
+			s:    site{SolarPower: 6000.0},
+			cars: []car{plugged(1, 1, 60), plugged(2, 0, 20)},
+			want: map[int64]float64{1: 3680.0, 2: 2320.0},
+		},
+		{
+			name: "cars that are full or unplugged get nothing",
+			s:    site{SolarPower: 6000.0},
+			cars: []car{plugged(1, 0, 78), {CarID: 2, BatteryLevel: 20, ChargeLimit: 80}},
+			want: map[int64]float64{1: 0.0, 2: 0.0},
+		},
+		{
+			name: "charging power counts on metered sites",
+			s:    site{SolarPower: 6000.0, GridMetered: true, GridExport: 1500.0},
+			cars: []car{charging(plugged(1, 0, 60), 10), plugged(2, 0, 20)},
+			want: map[int64]float64{1: 1380.0, 2: 2420.0},
+		},
+		{
+			name: "manual charging is not shared",
+			s:    site{SolarPower: 6000.0, GridMetered: true, GridExport: 1500.0},
+			cars: []car{manual(plugged(1, 0, 60), 10), plugged(2, 0, 20)},
+			want: map[int64]float64{1: 0.0, 2: 1500.0},
+		},
+	}
+
+	for _, test := range tests {
+		allocations := allocatePower(test.s, test.cars)
+		if len(allocations) != len(test.cars) {
+			t.Fatalf("%s: expected %d allocations but got %v+", test.name, len(test.cars), allocations)
+		}
+		for _, al := range allocations {
+			if want := test.want[al.c.CarID]; al.power != want {
+				t.Errorf("%s: car %d want %f got %f", test.name, al.c.CarID, want, al.power)
+			}
+		}
+	}
+}
+
+func TestAllocatePowerDecreasesFirst(t *testing.T) {
+	cars := []car{
+		{CarID: 1, Priority: 1, BatteryLevel: 20, ChargeLimit: 80, IsPluggedIn: true},
+		{CarID: 2, BatteryLevel: 50, ChargeLimit: 80, IsPluggedIn: true, IsCharging: true, IsChargingBySolar: true,
+			ChargerActualCurrent: 10, ChargerVoltage: 230, ChargerPhases: 1},
+	}
+	allocations := allocatePower(site{SolarPower: 2000.0}, cars)
+	if allocations[0].c.CarID != 2 || allocations[0].power != 0.0 {
+		t.Fatalf("Expected car 2 to be stopped first but got %v+", allocations)
+	}
+	if allocations[1].c.CarID != 1 || allocations[1].power != 2000.0 {
+		t.Fatalf("Expected car 1 to get the power but got %v+", allocations)
+	}
+}
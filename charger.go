@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errChargerUnauthorized is returned by charger clouds for a token that has
+// expired or been revoked.
+var errChargerUnauthorized = errors.New("Charger token rejected")
+
+// chargerLogin is the access token of a charger cloud. It is shared by all
+// clients of a car so the charger is not logged in to for every request.
+type chargerLogin struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// authorized calls f with a token, logging in with authenticate when there
+// is none or it has expired. A rejected token is replaced and f retried
+// once. A zero lifetime from authenticate keeps the token until rejected.
+func (l *chargerLogin) authorized(ctx context.Context, authenticate func(ctx context.Context) (string, time.Duration, error), f func(token string) error) error {
+	token, err := l.get(ctx, authenticate, false)
+	if err != nil {
+		return err
+	}
+	err = f(token)
+	if err != errChargerUnauthorized {
+		return err
+	}
+	token, err = l.get(ctx, authenticate, true)
+	if err != nil {
+		return err
+	}
+	return f(token)
+}
+
+func (l *chargerLogin) get(ctx context.Context, authenticate func(ctx context.Context) (string, time.Duration, error), renew bool) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !renew && l.token != "" && (l.expiry.IsZero() || time.Now().Before(l.expiry)) {
+		return l.token, nil
+	}
+	token, lifetime, err := authenticate(ctx)
+	if err != nil {
+		return "", err
+	}
+	l.token = token
+	l.expiry = time.Time{}
+	if lifetime > 0 {
+		// Renew a minute early so the token does not expire in flight.
+		l.expiry = time.Now().Add(lifetime - time.Minute)
+	}
+	return l.token, nil
+}
+
+// chargerControl charges a car through its wall charger. The car's own api,
+// when it has one, is still read for the battery level and position, but
+// the charger tells if the car is plugged in and charging. Without the car's
+// api, when it fails or when the car sleeps, the stored battery level and
+// position are kept.
+type chargerControl struct {
+	car     carClient
+	charger carClient
+	c       car
+}
+
+func (cc chargerControl) getCarData(ctx context.Context, carID int64) (*carData, error) {
+	charger, err := cc.charger.getCarData(ctx, carID)
+	if err != nil {
+		return nil, err
+	}
+	data := carData{
+		BatteryLevel: cc.c.BatteryLevel,
+		Longitude:    cc.c.Longitude,
+		Latitude:     cc.c.Latitude,
+		ChargeLimit:  cc.c.ChargeLimit,
+	}
+	if data.ChargeLimit == 0 {
+		data.ChargeLimit = 100
+	}
+	if cc.car != nil && !cc.carAsleep(ctx, carID) {
+		if car, err := cc.car.getCarData(ctx, carID); err == nil {
+			data = *car
+		} else {
+			fmt.Printf("Failed to read car %d, using its charger: %v\n", carID, err)
+		}
+	}
+	data.IsCharging = charger.IsCharging
+	data.IsPluggedIn = charger.IsPluggedIn
+	data.ChargeAmps = charger.ChargeAmps
+	data.ChargerActualCurrent = charger.ChargerActualCurrent
+	if charger.ChargerPhases > 0 {
+		data.ChargerVoltage = charger.ChargerVoltage
+		data.ChargerPhases = charger.ChargerPhases
+	}
+	return &data, nil
+}
+
+// carAsleep tells if the car sleeps, it is not woken as the charger is read
+// instead.
+func (cc chargerControl) carAsleep(ctx context.Context, carID int64) bool {
+	sc, ok := cc.car.(sleepingCar)
+	if !ok {
+		return false
+	}
+	state, err := sc.vehicleState(ctx, carID)
+	return err == nil && state != "online"
+}
+
+func (cc chargerControl) startCharging(ctx context.Context, carID int64) error {
+	return cc.charger.startCharging(ctx, carID)
+}
+
+func (cc chargerControl) stopCharging(ctx context.Context, carID int64) error {
+	return cc.charger.stopCharging(ctx, carID)
+}
+
+func (cc chargerControl) setChargingAmps(ctx context.Context, carID int64, amps int32) error {
+	return cc.charger.setChargingAmps(ctx, carID, amps)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type testCarData struct {
+	data *carData
+	err  error
+}
+
+func (c testCarData) getCarData(ctx context.Context, CarID int64) (*carData, error) {
+	return c.data, c.err
+}
+
+func (c testCarData) startCharging(ctx context.Context, CarID int64) error {
+	return errors.New("startCharging")
+}
+
+func (c testCarData) stopCharging(ctx context.Context, CarID int64) error {
+	return errors.New("stopCharging")
+}
+
+func (c testCarData) setChargingAmps(ctx context.Context, CarID int64, amps int32) error {
+	return errors.New("setChargingAmps")
+}
+
+func TestChargerControl(t *testing.T) {
+	charger := testCarData{data: &carData{IsCharging: true, IsPluggedIn: true, ChargeAmps: 10, ChargerActualCurrent: 10, ChargerVoltage: 230, ChargerPhases: 3}}
+	teslaData := &carData{BatteryLevel: 55, Longitude: 18.1, Latitude: 59.3, ChargeLimit: 80, ChargerVoltage: 2}
+	stored := car{BatteryLevel: 40, Longitude: 18.2, Latitude: 59.4}
+	tests := []struct {
+		car  carClient
+		want carData
+	}{
+		{car: nil, want: carData{BatteryLevel: 40, Longitude: 18.2, Latitude: 59.4, ChargeLimit: 100, IsCharging: true, IsPluggedIn: true, ChargeAmps: 10, ChargerActualCurrent: 10, ChargerVoltage: 230, ChargerPhases: 3}},
+		{car: testCarData{data: teslaData}, want: carData{BatteryLevel: 55, Longitude: 18.1, Latitude: 59.3, ChargeLimit: 80, IsCharging: true, IsPluggedIn: true, ChargeAmps: 10, ChargerActualCurrent: 10, ChargerVoltage: 230, ChargerPhases: 3}},
+		{car: testCarData{err: errors.New("vehicle unavailable")}, want: carData{BatteryLevel: 40, Longitude: 18.2, Latitude: 59.4, ChargeLimit: 100, IsCharging: true, IsPluggedIn: true, ChargeAmps: 10, ChargerActualCurrent: 10, ChargerVoltage: 230, ChargerPhases: 3}},
+	}
+
+	for _, test := range tests {
+		cc := chargerControl{car: test.car, charger: charger, c: stored}
+		data, err := cc.getCarData(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("Didnt expect error %v", err)
+		}
+		if *data != test.want {
+			t.Fatalf("Expected %+v but was %+v", test.want, *data)
+		}
+	}
+
+	cc := chargerControl{car: testCarVendor{}, charger: charger}
+	if err := cc.startCharging(context.Background(), 1); err == nil || err.Error() != "startCharging" {
+		t.Fatalf("Expected start through the charger got %v", err)
+	}
+	if err := cc.setChargingAmps(context.Background(), 1, 6); err == nil || err.Error() != "setChargingAmps" {
+		t.Fatalf("Expected current set through the charger got %v", err)
+	}
+	cc.charger = testCarData{err: errors.New("offline")}
+	if _, err := cc.getCarData(context.Background(), 1); err == nil {
+		t.Fatalf("Expected error when the charger can not be read")
+	}
+}
+
+func TestChargerLogin(t *testing.T) {
+	logins := 0
+	authenticate := func(ctx context.Context) (string, time.Duration, error) {
+		logins++
+		return "token", time.Hour, nil
+	}
+	l := &chargerLogin{}
+	calls := 0
+	f := func(token string) error {
+		calls++
+		if calls == 3 {
+			return errChargerUnauthorized
+		}
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		if err := l.authorized(context.Background(), authenticate, f); err != nil {
+			t.Fatalf("Didnt expect error %v", err)
+		}
+	}
+	if logins != 2 || calls != 4 {
+		t.Fatalf("Expected 2 logins and 4 calls got %d and %d", logins, calls)
+	}
+
+	l.expiry = time.Now().Add(-time.Second)
+	l.authorized(context.Background(), authenticate, f)
+	if logins != 3 {
+		t.Fatalf("Expected an expired token to be renewed, %d logins", logins)
+	}
+}
+
+func TestCreateChargerClient(t *testing.T) {
+	a := realApp{logins: map[string]*chargerLogin{}}
+	for _, vendor := range []string{"go-e", "Easee", "Wallbox"} {
+		cc, err := a.createCarClient(car{ChargerVendor: vendor, documentId: "car1"})
+		if err != nil {
+			t.Fatalf("Didnt expect error for %s %v", vendor, err)
+		}
+		if control, ok := cc.(chargerControl); !ok || control.car != nil {
+			t.Fatalf("Expected charger control without a car api for %s got %+v", vendor, cc)
+		}
+	}
+	if _, err := a.createCarClient(car{ChargerVendor: "Unknown"}); err == nil {
+		t.Fatalf("Expected error for an unknown charger vendor")
+	}
+	if _, err := a.createCarClient(car{ChargerVendor: "OCPP"}); err == nil {
+		t.Fatalf("Expected error for OCPP without a central system")
+	}
+	if a.chargerLogin(car{documentId: "car1"}) != a.logins["car1"] {
+		t.Fatalf("Expected the login of a car to be shared")
+	}
+}
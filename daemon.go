@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// defaultPollInterval is how often sites and cars are read unless they have
+// an interval of their own.
+const defaultPollInterval = time.Hour
+
+const (
+	// minDaemonTick keeps very short poll intervals from hammering the
+	// vendor apis.
+	minDaemonTick = 10 * time.Second
+	// overloadedVendorInterval is how often the vendor of an overloaded
+	// site without a grid meter is read, its api may be rate limited.
+	overloadedVendorInterval = time.Minute
+	// drivingPollInterval is how often a car last seen driving is read, its
+	// charging is left alone until it is seen parked.
+	drivingPollInterval = 5 * time.Minute
+	// maxDaemonTick is the schedule of the cloud function, charging is
+	// decided at least this often.
+	maxDaemonTick = 5 * time.Minute
+	// planInterval is how often the daemon updates the charge plans.
+	planInterval = 15 * time.Minute
+)
+
+func pollInterval(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (s site) pollInterval() time.Duration {
+	return pollInterval(s.PollSeconds)
+}
+
+// pollInterval of a car is shorter while it was last seen driving, so that
+// it is controlled soon after it has parked.
+func (c car) pollInterval() time.Duration {
+	i := pollInterval(c.PollSeconds)
+	if c.driving() && i > drivingPollInterval {
+		return drivingPollInterval
+	}
+	return i
+}
+
+// pollDue tells if data last read at lastUpdated should be read again.
+func pollDue(lastUpdated time.Time, interval time.Duration, now time.Time) bool {
+	return lastUpdated.IsZero() || now.After(lastUpdated.Add(interval))
+}
+
+// daemonTick is how often the daemon has to run to read the sites and cars
+// at their poll intervals. The grid meters of sites with an overloaded main
+// fuse are read as often as possible until the charging is lowered.
+func daemonTick(sites []site, cars []car) time.Duration {
+	tick := maxDaemonTick
+	for _, s := range sites {
+		if s.overloaded() {
+			return minDaemonTick
+		}
+		if i := s.pollInterval(); i < tick {
+			tick = i
+		}
+	}
+	for _, c := range cars {
+		if i := c.pollInterval(); i < tick {
+			tick = i
+		}
+	}
+	if tick < minDaemonTick {
+		return minDaemonTick
+	}
+	return tick
+}
+
+// runCycle reads the sites and cars that are due, updates the charge plans
+// if plan is set and starts, stops or adjusts the charging of the cars.
+func runCycle(a solarChargeTesla, plan bool, ctx context.Context) ([]site, []car, error) {
+	sites, err := readSites(a, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	cars, err := readCars(a, sites, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if plan {
+		cars = planCharging(a, sites, cars, ctx)
+	}
+	investigate(a, sites, cars, ctx)
+	return sites, cars, nil
+}
+
+// runDaemon runs a cycle on every tick until ctx is cancelled. The tick
+// follows the shortest poll interval of the sites and cars.
+func runDaemon(a solarChargeTesla, ctx context.Context) {
+	tick := maxDaemonTick
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	var planned time.Time
+	for {
+		plan := time.Since(planned) >= planInterval
+		sites, cars, err := runCycle(a, plan, ctx)
+		if err != nil {
+			log.Printf("Cycle failed: %v", err)
+		} else {
+			if plan {
+				planned = time.Now()
+			}
+			if next := daemonTick(sites, cars); next != tick {
+				tick = next
+				ticker.Reset(tick)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
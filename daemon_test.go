@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPollDue(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		lastUpdated time.Time
+		seconds     int
+		want        bool
+	}{
+		{lastUpdated: time.Time{}, seconds: 60, want: true},
+		{lastUpdated: now.Add(-30 * time.Minute), seconds: 0, want: false},
+		{lastUpdated: now.Add(-2 * time.Hour), seconds: 0, want: true},
+		{lastUpdated: now.Add(-30 * time.Second), seconds: 60, want: false},
+		{lastUpdated: now.Add(-90 * time.Second), seconds: 60, want: true},
+	}
+
+	for _, test := range tests {
+		if got := pollDue(test.lastUpdated, pollInterval(test.seconds), now); got != test.want {
+			t.Errorf("Want %v got %v for %v and %d seconds", test.want, got, test.lastUpdated, test.seconds)
+		}
+	}
+}
+
+func TestCarPollInterval(t *testing.T) {
+	tests := []struct {
+		c    car
+		want time.Duration
+	}{
+		{c: car{}, want: defaultPollInterval},
+		{c: car{ShiftState: "P"}, want: defaultPollInterval},
+		{c: car{ShiftState: "D", Speed: 30}, want: drivingPollInterval},
+		{c: car{ShiftState: "D", PollSeconds: 60}, want: time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := test.c.pollInterval(); got != test.want {
+			t.Errorf("Want %v got %v for %+v", test.want, got, test.c)
+		}
+	}
+}
+
+func TestDaemonTick(t *testing.T) {
+	tests := []struct {
+		sites []site
+		cars  []car
+		want  time.Duration
+	}{
+		{want: maxDaemonTick},
+		{sites: []site{{}}, cars: []car{{}}, want: maxDaemonTick},
+		{sites: []site{{PollSeconds: 30}}, cars: []car{{PollSeconds: 600}}, want: 30 * time.Second},
+		{sites: []site{{}}, cars: []car{{PollSeconds: 120}}, want: 2 * time.Minute},
+		{sites: []site{{PollSeconds: 1}}, want: minDaemonTick},
+		{sites: []site{{MainFuseAmps: 25, PhaseCurrents: []float64{27, 3, 3}}}, want: minDaemonTick},
+	}
+
+	for _, test := range tests {
+		if got := daemonTick(test.sites, test.cars); got != test.want {
+			t.Errorf("Want %v got %v for %v and %v", test.want, got, test.sites, test.cars)
+		}
+	}
+}
+
+func TestRunDaemon(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	app := createTestApp(ctx, 1500.0)
+	defer app.close()
+	setupTestSite(app, ctx, 800.0, time.Time{})
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		runDaemon(app, ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Daemon did not stop when cancelled")
+	}
+
+	s, err := app.st.getSite(context.Background(), "site1")
+	if err != nil {
+		t.Fatalf("Failed to read site %v", err)
+	}
+	if s.SolarPower != 1500.0 {
+		t.Fatalf("Want the site polled once before stopping, power %f", s.SolarPower)
+	}
+}
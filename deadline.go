@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultMaxChargeAmps int32 = 16
+
+// gridChargeMargin is added to the time it takes to charge from the grid.
+const gridChargeMargin = 15 * time.Minute
+
+func (c car) maxChargeAmps() int32 {
+	if c.MaxChargeAmps <= 0 {
+		return defaultMaxChargeAmps
+	}
+	return c.MaxChargeAmps
+}
+
+// energyTo returns the energy in Wh needed to charge the car to soc.
+func (c car) energyTo(soc int32) float64 {
+	if soc <= c.BatteryLevel {
+		return 0
+	}
+	return float64(soc-c.BatteryLevel) / 100 * c.batteryCapacity() * 1000
+}
+
+func (s site) location() *time.Location {
+	if s.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// nextReadyBy returns the next time after now that the car should be
+// charged by, readyBy is a time of day such as 07:00 in the site's time zone.
+func nextReadyBy(s site, readyBy string, now time.Time) (time.Time, error) {
+	tod, err := time.Parse("15:04", readyBy)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid ready by time %s: %v", readyBy, err)
+	}
+	local := now.In(s.location())
+	deadline := time.Date(local.Year(), local.Month(), local.Day(), tod.Hour(), tod.Minute(), 0, 0, local.Location())
+	if !deadline.After(local) {
+		deadline = deadline.AddDate(0, 0, 1)
+	}
+	return deadline, nil
+}
+
+// latestGridStart returns the latest time grid charging at full current can
+// start and still reach the car's minimum state of charge by its deadline.
+func latestGridStart(s site, c car, now time.Time) (time.Time, error) {
+	deadline, err := nextReadyBy(s, c.ReadyBy, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return deadline.Add(-gridChargeDuration(c, c.energyTo(c.MinSoC))), nil
+}
+
+// gridChargeDuration is how long it takes to charge energy Wh into car c at
+// full current, including a margin.
+func gridChargeDuration(c car, energy float64) time.Duration {
+	power := float64(c.maxChargeAmps()) * c.chargerVoltage() * c.chargerPhases()
+	hours := energy / power
+	return time.Duration(hours*float64(time.Hour)) + gridChargeMargin
+}
+
+// decideGridCharge charges car c from the grid at full current during the
+// hours of its charge plan, or when it is no longer possible to wait for
+// solar power and still reach the minimum state of charge in time. The
+// second return value is false when the grid is not needed.
+func decideGridCharge(s site, c car, now time.Time) (decision, bool) {
+	if !c.IsPluggedIn || c.ReadyBy == "" || c.BatteryLevel >= c.MinSoC {
+		return decision{}, false
+	}
+	reason := fmt.Sprintf("charging to %d%% by %s", c.MinSoC, c.ReadyBy)
+	if c.inPlan(now) {
+		reason = fmt.Sprintf("cheap hour, %s", reason)
+	} else if latest, err := latestGridStart(s, c, now); err != nil || now.Before(latest) {
+		return decision{}, false
+	}
+	if !c.IsCharging {
+		return decision{action: actionStart, amps: c.maxChargeAmps(), byGrid: true, reason: reason}, true
+	}
+	return decision{action: actionAdjust, amps: c.maxChargeAmps(), byGrid: true, reason: reason}, true
+}
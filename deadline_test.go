@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextReadyBy(t *testing.T) {
+	s := site{TimeZone: "Europe/Stockholm"}
+	loc, _ := time.LoadLocation("Europe/Stockholm")
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{now: time.Date(2021, 6, 1, 22, 0, 0, 0, loc), want: time.Date(2021, 6, 2, 7, 0, 0, 0, loc)},
+		{now: time.Date(2021, 6, 2, 3, 0, 0, 0, loc), want: time.Date(2021, 6, 2, 7, 0, 0, 0, loc)},
+		{now: time.Date(2021, 6, 2, 7, 0, 0, 0, loc), want: time.Date(2021, 6, 3, 7, 0, 0, 0, loc)},
+	}
+
+	for _, test := range tests {
+		deadline, err := nextReadyBy(s, "07:00", test.now.UTC())
+		if err != nil {
+			t.Fatalf("Didnt expect error %v", err)
+		}
+		if !deadline.Equal(test.want) {
+			t.Errorf("Want %v got %v for %v", test.want, deadline, test.now)
+		}
+	}
+
+	if _, err := nextReadyBy(s, "7 am", time.Now()); err == nil {
+		t.Errorf("Expected error for invalid time")
+	}
+}
+
+func TestLatestGridStart(t *testing.T) {
+	now := time.Date(2021, 6, 1, 20, 0, 0, 0, time.UTC)
+	// 20% of 50 kWh at 16 A three phase 230 V is 10 kWh in about 54 minutes.
+	c := car{BatteryLevel: 40, MinSoC: 60, ReadyBy: "07:00", BatteryCapacity: 50, ChargerPhases: 3}
+	latest, err := latestGridStart(site{}, c, now)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	hours := 10000.0 / (16 * 230 * 3)
+	want := time.Date(2021, 6, 2, 7, 0, 0, 0, time.UTC).Add(-time.Duration(hours*float64(time.Hour)) - gridChargeMargin)
+	if !latest.Equal(want) {
+		t.Fatalf("Want %v got %v", want, latest)
+	}
+}
+
+func TestDecideChargeDeadline(t *testing.T) {
+	night := time.Date(2021, 6, 2, 5, 0, 0, 0, time.UTC)
+	evening := time.Date(2021, 6, 1, 20, 0, 0, 0, time.UTC)
+	s := site{StartChargeThreshold: 2000.0, StopChargeThreshold: 1000.0}
+	idle := car{BatteryLevel: 40, ChargeLimit: 80, MinSoC: 60, ReadyBy: "07:00", IsPluggedIn: true}
+	tests := []struct {
+		name   string
+		c      car
+		now    time.Time
+		power  float64
+		want   chargeAction
+		byGrid bool
+	}{
+		{name: "wait for solar", c: idle, now: evening, power: 0.0, want: actionNone},
+		{name: "start grid charging in time", c: idle, now: night, power: 0.0, want: actionStart, byGrid: true},
+		{
+			name:  "minimum reached",
+			c:     car{BatteryLevel: 60, ChargeLimit: 80, MinSoC: 60, ReadyBy: "07:00", IsPluggedIn: true},
+			now:   night,
+			power: 0.0,
+			want:  actionNone,
+		},
+		{
+			name:   "grid takes over from solar",
+			c:      car{BatteryLevel: 40, ChargeLimit: 80, MinSoC: 60, ReadyBy: "07:00", IsPluggedIn: true, IsCharging: true, IsChargingBySolar: true},
+			now:    night,
+			power:  500.0,
+			want:   actionAdjust,
+			byGrid: true,
+		},
+		{
+			name:  "stop grid charging at minimum without solar",
+			c:     car{BatteryLevel: 61, ChargeLimit: 80, MinSoC: 60, ReadyBy: "07:00", IsPluggedIn: true, IsCharging: true, IsChargingByGrid: true},
+			now:   night,
+			power: 0.0,
+			want:  actionStop,
+		},
+		{
+			name:  "solar takes over at minimum",
+			c:     car{BatteryLevel: 61, ChargeLimit: 80, MinSoC: 60, ReadyBy: "07:00", IsPluggedIn: true, IsCharging: true, IsChargingByGrid: true},
+			now:   night,
+			power: 3000.0,
+			want:  actionAdjust,
+		},
+	}
+
+	for _, test := range tests {
+		d := decideCharge(s, test.c, test.power, test.now)
+		if d.action != test.want || d.byGrid != test.byGrid {
+			t.Errorf("%s: want %s by grid %v got %s by grid %v (%s)", test.name, test.want, test.byGrid, d.action, d.byGrid, d.reason)
+		}
+		if d.byGrid && d.amps != defaultMaxChargeAmps {
+			t.Errorf("%s: expected grid charging at %d A got %d", test.name, defaultMaxChargeAmps, d.amps)
+		}
+	}
+}
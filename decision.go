@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/stelund/solarchargetesla/forecast"
+)
+
+// maxPowerSamples bounds the sample window stored on a site.
+const maxPowerSamples = 48
+
+// chargeAction is what the controller does to a car's charging.
+type chargeAction int
+
+const (
+	actionNone chargeAction = iota
+	actionStart
+	actionStop
+	actionAdjust
+)
+
+func (a chargeAction) String() string {
+	switch a {
+	case actionStart:
+		return "start"
+	case actionStop:
+		return "stop"
+	case actionAdjust:
+		return "adjust"
+	}
+	return "none"
+}
+
+// decision is the outcome of deciding how a car should charge, amps is only
+// set when starting or adjusting.
+type decision struct {
+	action chargeAction
+	amps   int32
+	byGrid bool
+	reason string
+}
+
+type powerSample struct {
+	Time  time.Time `firestore:"time"`
+	Power float64   `firestore:"power"`
+}
+
+// addPowerSample appends a sample of the power available at the site and
+// drops samples that are no longer needed to decide if power is sustained.
+// A sample is only added once per site reading.
+func (s site) addPowerSample(power float64, at time.Time) []powerSample {
+	samples := s.PowerSamples
+	if len(samples) > 0 && !samples[len(samples)-1].Time.Before(at) {
+		return samples
+	}
+	samples = append(samples, powerSample{Time: at, Power: power})
+	keep := 1
+	if s.SustainedSamples > keep {
+		keep = s.SustainedSamples
+	}
+	if s.SustainedMinutes > 0 {
+		// One sample before the window is kept as it tells what the power
+		// was at the start of the window.
+		windowStart := at.Add(-time.Duration(s.SustainedMinutes) * time.Minute)
+		inWindow := 0
+		for i := len(samples) - 1; i >= 0; i-- {
+			inWindow++
+			if !samples[i].Time.After(windowStart) {
+				break
+			}
+		}
+		if inWindow > keep {
+			keep = inWindow
+		}
+	}
+	if keep > maxPowerSamples {
+		keep = maxPowerSamples
+	}
+	if keep > len(samples) {
+		keep = len(samples)
+	}
+	return samples[len(samples)-keep:]
+}
+
+// addProductionSample appends a sample of the solar production and drops
+// samples too old to be used by the forecast.
+func (s site) addProductionSample(power float64, at time.Time) []powerSample {
+	samples := []powerSample{}
+	for _, sample := range s.ProductionSamples {
+		if sample.Time.Before(at) && at.Sub(sample.Time) <= forecast.History {
+			samples = append(samples, sample)
+		}
+	}
+	samples = append(samples, powerSample{Time: at, Power: power})
+	if len(samples) > maxPowerSamples {
+		samples = samples[len(samples)-maxPowerSamples:]
+	}
+	return samples
+}
+
+// forecast returns the site's production forecast, scaled by the measured
+// production. The forecast is not usable when it has no scale.
+func (s site) forecast(now time.Time) forecast.Forecast {
+	samples := make([]forecast.Sample, len(s.ProductionSamples))
+	for i, sample := range s.ProductionSamples {
+		samples[i] = forecast.Sample{Time: sample.Time, Power: sample.Power}
+	}
+	return forecast.New(s.Latitude, s.Longitude, samples, now)
+}
+
+func (c car) batteryCapacity() float64 {
+	if c.BatteryCapacity <= 0 {
+		return defaultBatteryCapacity
+	}
+	return c.BatteryCapacity
+}
+
+// energyToLimit returns the energy in Wh needed to charge the car to its
+// charge limit.
+func (c car) energyToLimit() float64 {
+	return c.energyTo(c.ChargeLimit)
+}
+
+// sustained tells if the recorded power samples of the site satisfy holds
+// for the configured number of samples and for the configured duration.
+func (s site) sustained(holds func(float64) bool, now time.Time) bool {
+	samples := s.PowerSamples
+	if s.SustainedSamples > 0 {
+		if len(samples) < s.SustainedSamples {
+			return false
+		}
+		for _, sample := range samples[len(samples)-s.SustainedSamples:] {
+			if !holds(sample.Power) {
+				return false
+			}
+		}
+	}
+	if s.SustainedMinutes > 0 {
+		windowStart := now.Add(-time.Duration(s.SustainedMinutes) * time.Minute)
+		i := len(samples) - 1
+		for ; i >= 0 && holds(samples[i].Power); i-- {
+			if !samples[i].Time.After(windowStart) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// sinceTransition is how long the car has been charging or not charging
+// since the controller last started or stopped it.
+func (c car) sinceTransition(now time.Time) time.Duration {
+	if c.LastChargeTransition.IsZero() {
+		return time.Duration(1<<63 - 1)
+	}
+	return now.Sub(c.LastChargeTransition)
+}
+
+// decideCharge decides what to do with car c at site s when it may use
+// power watts. A car that has to be charged from the grid to reach its
+// minimum in time is, otherwise it is charged by solar power.
+func decideCharge(s site, c car, power float64, now time.Time) decision {
+	if d, ok := decideGridCharge(s, c, now); ok {
+		return d
+	}
+	if c.IsChargingByGrid && c.IsCharging {
+		// The minimum is reached, solar power takes over.
+		c.IsChargingBySolar = true
+	}
+	return decideSolarCharge(s, c, power, now)
+}
+
+// decideSolarCharge decides how to charge car c by solar power. Starting and
+// stopping requires the site power to have been above or below the
+// thresholds for a while, and the car to have charged or paused for the
+// configured minimum time.
+func decideSolarCharge(s site, c car, power float64, now time.Time) decision {
+	if !c.IsCharging && c.IsPluggedIn && power > s.StartChargeThreshold {
+		if c.ChargeLimit-c.BatteryLevel <= startChargeDiff {
+			return decision{action: actionNone, reason: "battery is close to charge limit"}
+		}
+		if !s.sustained(func(p float64) bool { return p > s.StartChargeThreshold }, now) {
+			return decision{action: actionNone, reason: "solar power is not sustained above start threshold"}
+		}
+		if c.sinceTransition(now) < time.Duration(s.MinPauseMinutes)*time.Minute {
+			return decision{action: actionNone, reason: "minimum pause not reached"}
+		}
+		reason := "solar power above start threshold"
+		if f := s.forecast(now); s.Forecast && f.Scale > 0 {
+			// The rest of the site's consumption is assumed to stay as it is.
+			offset := power - s.SolarPower
+			sunset := f.Sunset(now)
+			session := f.Above(s.StopChargeThreshold, offset, now, sunset)
+			if session < time.Duration(s.MinSessionMinutes)*time.Minute {
+				return decision{action: actionNone, reason: fmt.Sprintf("forecast session of %v is too short", session.Round(time.Minute))}
+			}
+			if f.Surplus(offset, now, sunset) >= c.energyToLimit() {
+				reason += ", forecast reaches charge limit"
+			} else {
+				reason += ", forecast does not reach charge limit"
+			}
+		}
+		return decision{action: actionStart, amps: chargingAmps(power, c), reason: reason}
+	} else if c.IsChargingBySolar && c.IsCharging {
+		if power < s.StopChargeThreshold {
+			if !s.sustained(func(p float64) bool { return p < s.StopChargeThreshold }, now) {
+				return decision{action: actionAdjust, amps: chargingAmps(power, c), reason: "solar power is not sustained below stop threshold"}
+			}
+			if c.sinceTransition(now) < time.Duration(s.MinChargeMinutes)*time.Minute {
+				return decision{action: actionAdjust, amps: chargingAmps(power, c), reason: "minimum charging time not reached"}
+			}
+			return decision{action: actionStop, reason: "solar power below stop threshold"}
+		}
+		return decision{action: actionAdjust, amps: chargingAmps(power, c), reason: "following solar power"}
+	}
+	return decision{action: actionNone, reason: "not charging by solar"}
+}
+
+// Overrides of the controller, set by the user in Home Assistant.
+const (
+	overrideAuto  = "auto"
+	overrideOff   = "off"
+	overrideSolar = "solar"
+	overrideGrid  = "grid"
+)
+
+// decideOverride decides how to charge car c when overridden by mode. Off
+// stops any charging, solar charges by solar power only and grid charges
+// at full current. Auto, or an unknown mode, leaves it to decideCharge.
+func decideOverride(mode string, s site, c car, power float64, now time.Time) decision {
+	switch mode {
+	case overrideOff:
+		if c.IsCharging {
+			return decision{action: actionStop, reason: "override off"}
+		}
+		return decision{action: actionNone, reason: "override off"}
+	case overrideSolar:
+		// Grid charging is taken over by solar power.
+		c.IsChargingBySolar = c.IsCharging
+		return decideSolarCharge(s, c, power, now)
+	case overrideGrid:
+		if c.IsCharging {
+			return decision{action: actionAdjust, amps: c.maxChargeAmps(), byGrid: true, reason: "override grid"}
+		}
+		if c.IsPluggedIn && c.BatteryLevel < c.ChargeLimit {
+			return decision{action: actionStart, amps: c.maxChargeAmps(), byGrid: true, reason: "override grid"}
+		}
+		return decision{action: actionNone, reason: "override grid, car can not charge"}
+	}
+	return decideCharge(s, c, power, now)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stelund/solarchargetesla/forecast"
+)
+
+func samplesOf(now time.Time, interval time.Duration, powers ...float64) []powerSample {
+	samples := []powerSample{}
+	for i, p := range powers {
+		samples = append(samples, powerSample{Time: now.Add(-time.Duration(len(powers)-1-i) * interval), Power: p})
+	}
+	return samples
+}
+
+func TestDecideCharge(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	idle := car{BatteryLevel: 40, ChargeLimit: 80, IsPluggedIn: true}
+	charging := car{BatteryLevel: 40, ChargeLimit: 80, IsPluggedIn: true, IsCharging: true, IsChargingBySolar: true}
+	tests := []struct {
+		name  string
+		s     site
+		c     car
+		power float64
+		want  chargeAction
+	}{
+		{
+			name:  "start without hysteresis",
+			s:     site{StartChargeThreshold: 2000.0},
+			c:     idle,
+			power: 3000.0,
+			want:  actionStart,
+		},
+		{
+			name:  "start needs sustained samples",
+			s:     site{StartChargeThreshold: 2000.0, SustainedSamples: 3, PowerSamples: samplesOf(now, 5*time.Minute, 1500.0, 3000.0, 3000.0)},
+			c:     idle,
+			power: 3000.0,
+			want:  actionNone,
+		},
+		{
+			name:  "start with sustained samples",
+			s:     site{StartChargeThreshold: 2000.0, SustainedSamples: 3, PowerSamples: samplesOf(now, 5*time.Minute, 1500.0, 3000.0, 3000.0, 3000.0)},
+			c:     idle,
+			power: 3000.0,
+			want:  actionStart,
+		},
+		{
+			name:  "start needs sustained minutes",
+			s:     site{StartChargeThreshold: 2000.0, SustainedMinutes: 20, PowerSamples: samplesOf(now, 5*time.Minute, 1500.0, 3000.0, 3000.0, 3000.0)},
+			c:     idle,
+			power: 3000.0,
+			want:  actionNone,
+		},
+		{
+			name:  "start with sustained minutes",
+			s:     site{StartChargeThreshold: 2000.0, SustainedMinutes: 15, PowerSamples: samplesOf(now, 5*time.Minute, 1500.0, 3000.0, 3000.0, 3000.0, 3000.0)},
+			c:     idle,
+			power: 3000.0,
+			want:  actionStart,
+		},
+		{
+			name:  "start needs minimum pause",
+			s:     site{StartChargeThreshold: 2000.0, MinPauseMinutes: 30},
+			c:     car{BatteryLevel: 40, ChargeLimit: 80, IsPluggedIn: true, LastChargeTransition: now.Add(-10 * time.Minute)},
+			power: 3000.0,
+			want:  actionNone,
+		},
+		{
+			name:  "start after minimum pause",
+			s:     site{StartChargeThreshold: 2000.0, MinPauseMinutes: 30},
+			c:     car{BatteryLevel: 40, ChargeLimit: 80, IsPluggedIn: true, LastChargeTransition: now.Add(-40 * time.Minute)},
+			power: 3000.0,
+			want:  actionStart,
+		},
+		{
+			name:  "stop without hysteresis",
+			s:     site{StopChargeThreshold: 1000.0},
+			c:     charging,
+			power: 500.0,
+			want:  actionStop,
+		},
+		{
+			name:  "stop needs sustained samples",
+			s:     site{StopChargeThreshold: 1000.0, SustainedSamples: 2, PowerSamples: samplesOf(now, 5*time.Minute, 2000.0, 500.0)},
+			c:     charging,
+			power: 500.0,
+			want:  actionAdjust,
+		},
+		{
+			name:  "stop with sustained samples",
+			s:     site{StopChargeThreshold: 1000.0, SustainedSamples: 2, PowerSamples: samplesOf(now, 5*time.Minute, 2000.0, 500.0, 500.0)},
+			c:     charging,
+			power: 500.0,
+			want:  actionStop,
+		},
+		{
+			name:  "stop needs minimum charging time",
+			s:     site{StopChargeThreshold: 1000.0, MinChargeMinutes: 15},
+			c:     car{BatteryLevel: 40, ChargeLimit: 80, IsPluggedIn: true, IsCharging: true, IsChargingBySolar: true, LastChargeTransition: now.Add(-5 * time.Minute)},
+			power: 500.0,
+			want:  actionAdjust,
+		},
+		{
+			name:  "adjust while charging",
+			s:     site{StopChargeThreshold: 1000.0},
+			c:     charging,
+			power: 3000.0,
+			want:  actionAdjust,
+		},
+		{
+			name:  "leave cars not charging by solar",
+			s:     site{StopChargeThreshold: 1000.0},
+			c:     car{IsPluggedIn: true, IsCharging: true},
+			power: 500.0,
+			want:  actionNone,
+		},
+	}
+
+	for _, test := range tests {
+		d := decideCharge(test.s, test.c, test.power, now)
+		if d.action != test.want {
+			t.Errorf("%s: want %s got %s (%s)", test.name, test.want, d.action, d.reason)
+		}
+	}
+}
+
+func TestAddPowerSample(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := site{SustainedSamples: 2, PowerSamples: samplesOf(now, time.Hour, 1.0, 2.0, 3.0)}
+	samples := s.addPowerSample(4.0, now.Add(time.Hour))
+	if len(samples) != 2 || samples[0].Power != 3.0 || samples[1].Power != 4.0 {
+		t.Fatalf("Expected the last two samples but got %v+", samples)
+	}
+
+	samples = s.addPowerSample(4.0, now)
+	if len(samples) != 3 {
+		t.Fatalf("Expected no sample to be added for the same reading but got %v+", samples)
+	}
+
+	s = site{SustainedMinutes: 90, PowerSamples: samplesOf(now, time.Hour, 1.0, 2.0, 3.0)}
+	samples = s.addPowerSample(4.0, now.Add(time.Hour))
+	if len(samples) != 3 || samples[0].Power != 2.0 {
+		t.Fatalf("Expected samples covering 90 minutes but got %v+", samples)
+	}
+}
+
+func TestDecideChargeForecast(t *testing.T) {
+	// Stockholm, solar noon is close to 11:00 UTC.
+	s := site{Latitude: 59.33, Longitude: 18.07, StartChargeThreshold: 2000.0, StopChargeThreshold: 1500.0,
+		Forecast: true, MinSessionMinutes: 60}
+	c := car{BatteryLevel: 40, ChargeLimit: 80, IsPluggedIn: true}
+	clearSky := func(at time.Time, scale float64) []powerSample {
+		samples := []powerSample{}
+		for i := 0; i < 3; i++ {
+			sampleAt := at.Add(-time.Duration(i) * time.Hour)
+			samples = append(samples, powerSample{Time: sampleAt, Power: scale * forecast.ClearSky(s.Latitude, s.Longitude, sampleAt)})
+		}
+		return samples
+	}
+
+	noon := time.Date(2021, 6, 21, 11, 0, 0, 0, time.UTC)
+	s.ProductionSamples = clearSky(noon, 4)
+	s.SolarPower = s.ProductionSamples[0].Power
+	d := decideCharge(s, c, s.SolarPower, noon)
+	if d.action != actionStart {
+		t.Fatalf("Expected start at noon but got %s (%s)", d.action, d.reason)
+	}
+
+	evening := time.Date(2021, 6, 21, 17, 0, 0, 0, time.UTC)
+	s.ProductionSamples = clearSky(evening, 7)
+	s.SolarPower = s.ProductionSamples[0].Power
+	if s.SolarPower <= s.StartChargeThreshold {
+		t.Fatalf("Test setup needs power above start threshold, was %f", s.SolarPower)
+	}
+	d = decideCharge(s, c, s.SolarPower, evening)
+	if d.action != actionNone {
+		t.Fatalf("Expected short evening session not to start but got %s (%s)", d.action, d.reason)
+	}
+
+	s.MinSessionMinutes = 0
+	d = decideCharge(s, c, s.SolarPower, evening)
+	if d.action != actionStart {
+		t.Fatalf("Expected start without minimum session but got %s (%s)", d.action, d.reason)
+	}
+}
+
+func TestEnergyToLimit(t *testing.T) {
+	c := car{BatteryLevel: 40, ChargeLimit: 80}
+	if c.energyToLimit() != 30000.0 {
+		t.Fatalf("Expected 30 kWh with default capacity but was %f", c.energyToLimit())
+	}
+	c.BatteryCapacity = 50
+	if c.energyToLimit() != 20000.0 {
+		t.Fatalf("Expected 20 kWh but was %f", c.energyToLimit())
+	}
+	c.BatteryLevel = 90
+	if c.energyToLimit() != 0 {
+		t.Fatalf("Expected no energy above limit but was %f", c.energyToLimit())
+	}
+}
+
+func TestDecideOverride(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := site{StartChargeThreshold: 1500, StopChargeThreshold: 1000}
+	tests := []struct {
+		mode   string
+		c      car
+		power  float64
+		action chargeAction
+		byGrid bool
+	}{
+		{mode: overrideOff, c: car{IsCharging: true, IsChargingBySolar: true}, power: 5000, action: actionStop},
+		{mode: overrideOff, c: car{IsCharging: false, IsPluggedIn: true, BatteryLevel: 40, ChargeLimit: 80}, power: 5000, action: actionNone},
+		{mode: overrideGrid, c: car{IsPluggedIn: true, BatteryLevel: 40, ChargeLimit: 80}, power: 0, action: actionStart, byGrid: true},
+		{mode: overrideGrid, c: car{IsPluggedIn: true, BatteryLevel: 80, ChargeLimit: 80}, power: 0, action: actionNone},
+		{mode: overrideGrid, c: car{IsCharging: true, IsChargingBySolar: true}, power: 0, action: actionAdjust, byGrid: true},
+		{mode: overrideSolar, c: car{IsCharging: true, IsChargingByGrid: true, ReadyBy: "13:00", MinSoC: 90, BatteryLevel: 40, ChargeLimit: 95, IsPluggedIn: true}, power: 500, action: actionStop},
+		{mode: overrideAuto, c: car{IsCharging: true, IsChargingByGrid: true, ReadyBy: "13:00", MinSoC: 90, BatteryLevel: 40, ChargeLimit: 95, IsPluggedIn: true}, power: 500, action: actionAdjust, byGrid: true},
+		{mode: overrideAuto, c: car{IsPluggedIn: true, BatteryLevel: 40, ChargeLimit: 80}, power: 2000, action: actionStart},
+	}
+
+	for _, test := range tests {
+		d := decideOverride(test.mode, s, test.c, test.power, now)
+		if d.action != test.action || d.byGrid != test.byGrid {
+			t.Errorf("Want %v by grid %v got %v by grid %v (%s) for %s and car %+v", test.action, test.byGrid, d.action, d.byGrid, d.reason, test.mode, test.c)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Package dsmr reads DSMR 4 and 5 telegrams from the P1 port of smart
+// electricity meters.
+package dsmr
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// OBIS references of the instantaneous power and current objects.
+const (
+	VersionOBIS = "1-3:0.2.8"
+	// Belgian meters use their own version object.
+	VersionBEOBIS    = "0-0:96.1.4"
+	TimestampOBIS    = "0-0:1.0.0"
+	PowerImportOBIS  = "1-0:1.7.0"
+	PowerExportOBIS  = "1-0:2.7.0"
+	PowerImportL1    = "1-0:21.7.0"
+	PowerImportL2    = "1-0:41.7.0"
+	PowerImportL3    = "1-0:61.7.0"
+	PowerExportL1    = "1-0:22.7.0"
+	PowerExportL2    = "1-0:42.7.0"
+	PowerExportL3    = "1-0:62.7.0"
+	CurrentL1        = "1-0:31.7.0"
+	CurrentL2        = "1-0:51.7.0"
+	CurrentL3        = "1-0:71.7.0"
+	VoltageL1        = "1-0:32.7.0"
+	VoltageL2        = "1-0:52.7.0"
+	VoltageL3        = "1-0:72.7.0"
+	maxTelegramBytes = 16 * 1024
+)
+
+// Telegram is a parsed telegram. Objects holds the values of each OBIS
+// reference, an object can have several values in parentheses.
+type Telegram struct {
+	Header  string
+	Objects map[string][]string
+}
+
+// CRC16 is the CRC-16/ARC checksum telegrams end with, computed from the
+// leading / up to and including the !.
+func CRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Parse parses one telegram, from / up to the checksum after !, and
+// validates its checksum.
+func Parse(data []byte) (*Telegram, error) {
+	start := bytes.IndexByte(data, '/')
+	end := bytes.IndexByte(data, '!')
+	if start < 0 || end < start {
+		return nil, errors.New("dsmr: no telegram")
+	}
+	crcHex := strings.TrimSpace(string(data[end+1:]))
+	if len(crcHex) < 4 {
+		return nil, errors.New("dsmr: telegram without checksum")
+	}
+	crc, err := strconv.ParseUint(crcHex[:4], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("dsmr: invalid checksum %s", crcHex)
+	}
+	if got := CRC16(data[start : end+1]); got != uint16(crc) {
+		return nil, fmt.Errorf("dsmr: checksum %04X does not match %04X", got, crc)
+	}
+
+	lines := strings.Split(string(data[start:end]), "\n")
+	t := &Telegram{Header: strings.TrimSpace(lines[0][1:]), Objects: map[string][]string{}}
+	var obis string
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		// Values, like a long power failure log, may continue on the next
+		// line.
+		if !strings.HasPrefix(line, "(") {
+			i := strings.IndexByte(line, '(')
+			if i < 0 {
+				return nil, fmt.Errorf("dsmr: invalid line %s", line)
+			}
+			obis = line[:i]
+			line = line[i:]
+		} else if obis == "" {
+			return nil, fmt.Errorf("dsmr: invalid line %s", line)
+		}
+		for line != "" {
+			if line[0] != '(' {
+				return nil, fmt.Errorf("dsmr: invalid line %s", line)
+			}
+			j := strings.IndexByte(line, ')')
+			if j < 0 {
+				return nil, fmt.Errorf("dsmr: unterminated value in %s", line)
+			}
+			t.Objects[obis] = append(t.Objects[obis], line[1:j])
+			line = line[j+1:]
+		}
+	}
+	return t, nil
+}
+
+// Version is the DSMR version, such as 50 for DSMR 5.0.
+func (t *Telegram) Version() string {
+	if v, ok := t.Objects[VersionOBIS]; ok && len(v) > 0 {
+		return v[0]
+	}
+	if v, ok := t.Objects[VersionBEOBIS]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Value returns the numeric value of obis converted to the base unit, W, A
+// or V. Values in kW are converted to W.
+func (t *Telegram) Value(obis string) (float64, bool, error) {
+	values, ok := t.Objects[obis]
+	if !ok || len(values) == 0 {
+		return 0, false, nil
+	}
+	raw := values[len(values)-1]
+	unit := ""
+	if i := strings.IndexByte(raw, '*'); i >= 0 {
+		raw, unit = raw[:i], raw[i+1:]
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("dsmr: invalid value %s for %s", values[len(values)-1], obis)
+	}
+	if strings.HasPrefix(unit, "k") {
+		v *= 1000
+	}
+	return v, true, nil
+}
+
+// Reading is the instantaneous power in W, import and export are both
+// positive, per phase current in A and voltage in V. Phases the meter does
+// not report are zero.
+type Reading struct {
+	Import       float64
+	Export       float64
+	PhaseImport  [3]float64
+	PhaseExport  [3]float64
+	PhaseCurrent [3]float64
+	PhaseVoltage [3]float64
+}
+
+// Reading returns the instantaneous values of the telegram.
+func (t *Telegram) Reading() (Reading, error) {
+	var r Reading
+	var found bool
+	var err error
+	fields := []struct {
+		obis string
+		v    *float64
+	}{
+		{PowerImportOBIS, &r.Import},
+		{PowerExportOBIS, &r.Export},
+		{PowerImportL1, &r.PhaseImport[0]},
+		{PowerImportL2, &r.PhaseImport[1]},
+		{PowerImportL3, &r.PhaseImport[2]},
+		{PowerExportL1, &r.PhaseExport[0]},
+		{PowerExportL2, &r.PhaseExport[1]},
+		{PowerExportL3, &r.PhaseExport[2]},
+		{CurrentL1, &r.PhaseCurrent[0]},
+		{CurrentL2, &r.PhaseCurrent[1]},
+		{CurrentL3, &r.PhaseCurrent[2]},
+		{VoltageL1, &r.PhaseVoltage[0]},
+		{VoltageL2, &r.PhaseVoltage[1]},
+		{VoltageL3, &r.PhaseVoltage[2]},
+	}
+	for i, f := range fields {
+		var ok bool
+		*f.v, ok, err = t.Value(f.obis)
+		if err != nil {
+			return Reading{}, err
+		}
+		if i < 2 && ok {
+			found = true
+		}
+	}
+	if !found {
+		return Reading{}, errors.New("dsmr: no instantaneous power in telegram")
+	}
+	return r, nil
+}
+
+// Reader reads telegrams from a P1 port, a serial device or a tcp
+// connection to ser2net.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader reads telegrams from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, maxTelegramBytes)}
+}
+
+// Read reads the next complete telegram. Data before its / is skipped, so
+// reading can start in the middle of a telegram.
+func (r *Reader) Read() (*Telegram, error) {
+	if _, err := r.r.ReadBytes('/'); err != nil {
+		return nil, err
+	}
+	data := []byte{'/'}
+	for {
+		line, err := r.r.ReadBytes('\n')
+		data = append(data, line...)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxTelegramBytes {
+			return nil, errors.New("dsmr: telegram too long")
+		}
+		if line[0] == '!' {
+			return Parse(data)
+		}
+	}
+}
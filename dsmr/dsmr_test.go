@@ -0,0 +1,158 @@
+package dsmr
+
+import (
+	"strings"
+	"testing"
+)
+
+// A three phase DSMR 5 meter exporting.
+const telegram5 = "/ISk5\\2MT382-1000\r\n" +
+	"\r\n" +
+	"1-3:0.2.8(50)\r\n" +
+	"0-0:1.0.0(210501120003S)\r\n" +
+	"0-0:96.1.1(4B384547303034303436333935353037)\r\n" +
+	"1-0:1.8.1(012345.678*kWh)\r\n" +
+	"1-0:1.8.2(023456.789*kWh)\r\n" +
+	"1-0:2.8.1(003456.123*kWh)\r\n" +
+	"1-0:2.8.2(004567.234*kWh)\r\n" +
+	"0-0:96.14.0(0002)\r\n" +
+	"1-0:1.7.0(00.000*kW)\r\n" +
+	"1-0:2.7.0(02.412*kW)\r\n" +
+	"0-0:96.7.21(00004)\r\n" +
+	"0-0:96.7.9(00002)\r\n" +
+	"1-0:99.97.0(2)(0-0:96.7.19)(101208152415W)(0000000240*s)(101208151004W)(0000000301*s)\r\n" +
+	"1-0:32.32.0(00002)\r\n" +
+	"1-0:32.36.0(00000)\r\n" +
+	"0-0:96.13.0()\r\n" +
+	"1-0:32.7.0(232.1*V)\r\n" +
+	"1-0:52.7.0(231.4*V)\r\n" +
+	"1-0:72.7.0(233.0*V)\r\n" +
+	"1-0:31.7.0(004*A)\r\n" +
+	"1-0:51.7.0(002*A)\r\n" +
+	"1-0:71.7.0(005*A)\r\n" +
+	"1-0:21.7.0(00.000*kW)\r\n" +
+	"1-0:41.7.0(00.120*kW)\r\n" +
+	"1-0:61.7.0(00.000*kW)\r\n" +
+	"1-0:22.7.0(00.980*kW)\r\n" +
+	"1-0:42.7.0(00.000*kW)\r\n" +
+	"1-0:62.7.0(01.552*kW)\r\n" +
+	"0-1:24.1.0(003)\r\n" +
+	"0-1:96.1.0(3232323241424344313233343536373839)\r\n" +
+	"0-1:24.2.1(210501120000S)(01234.567*m3)\r\n" +
+	"!A7DC\r\n"
+
+// A single phase DSMR 4.2 meter importing at night.
+const telegram4 = "/KFM5KAIFA-METER\r\n" +
+	"\r\n" +
+	"1-3:0.2.8(42)\r\n" +
+	"0-0:1.0.0(210501230010S)\r\n" +
+	"0-0:96.1.1(4530303235303030303537353930333134)\r\n" +
+	"1-0:1.8.1(001581.123*kWh)\r\n" +
+	"1-0:1.8.2(001435.706*kWh)\r\n" +
+	"1-0:2.8.1(000000.000*kWh)\r\n" +
+	"1-0:2.8.2(000000.000*kWh)\r\n" +
+	"0-0:96.14.0(0001)\r\n" +
+	"1-0:1.7.0(00.702*kW)\r\n" +
+	"1-0:2.7.0(00.000*kW)\r\n" +
+	"0-0:96.7.21(00006)\r\n" +
+	"0-0:96.7.9(00003)\r\n" +
+	"1-0:99.97.0(1)(0-0:96.7.19)(000101000001W)(2147483647*s)\r\n" +
+	"1-0:32.32.0(00000)\r\n" +
+	"1-0:32.36.0(00000)\r\n" +
+	"0-0:96.13.1()\r\n" +
+	"0-0:96.13.0()\r\n" +
+	"1-0:31.7.0(003*A)\r\n" +
+	"1-0:21.7.0(00.702*kW)\r\n" +
+	"1-0:22.7.0(00.000*kW)\r\n" +
+	"!11F7\r\n"
+
+func TestCRC16(t *testing.T) {
+	if crc := CRC16([]byte("123456789")); crc != 0xbb3d {
+		t.Fatalf("Want check value BB3D got %04X", crc)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		telegram string
+		header   string
+		version  string
+		want     Reading
+	}{
+		{telegram: telegram5, header: "ISk5\\2MT382-1000", version: "50", want: Reading{
+			Export:       2412,
+			PhaseImport:  [3]float64{0, 120, 0},
+			PhaseExport:  [3]float64{980, 0, 1552},
+			PhaseCurrent: [3]float64{4, 2, 5},
+			PhaseVoltage: [3]float64{232.1, 231.4, 233.0},
+		}},
+		{telegram: telegram4, header: "KFM5KAIFA-METER", version: "42", want: Reading{
+			Import:       702,
+			PhaseImport:  [3]float64{702, 0, 0},
+			PhaseCurrent: [3]float64{3, 0, 0},
+		}},
+	}
+
+	for _, test := range tests {
+		tg, err := Parse([]byte(test.telegram))
+		if err != nil {
+			t.Fatalf("Didnt expect error parsing %v", err)
+		}
+		if tg.Header != test.header || tg.Version() != test.version {
+			t.Fatalf("Unexpected header %s and version %s", tg.Header, tg.Version())
+		}
+		r, err := tg.Reading()
+		if err != nil {
+			t.Fatalf("Didnt expect error reading %v", err)
+		}
+		if r != test.want {
+			t.Fatalf("Want %+v got %+v", test.want, r)
+		}
+	}
+
+	tg, _ := Parse([]byte(telegram5))
+	if gas := tg.Objects["0-1:24.2.1"]; len(gas) != 2 || gas[1] != "01234.567*m3" {
+		t.Fatalf("Unexpected gas reading %v", gas)
+	}
+	if log := tg.Objects["1-0:99.97.0"]; len(log) != 6 {
+		t.Fatalf("Unexpected power failure log %v", log)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		strings.Replace(telegram5, "02.412", "02.413", 1),
+		strings.Replace(telegram5, "!A7DC", "!", 1),
+		strings.Replace(telegram5, "!A7DC", "!XYZW", 1),
+	}
+
+	for _, test := range tests {
+		if _, err := Parse([]byte(test)); err == nil {
+			t.Errorf("Expected error parsing %q", test)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	// Reading starts in the middle of a telegram.
+	stream := telegram4[200:] + telegram5 + telegram4
+	r := NewReader(strings.NewReader(stream))
+	tg, err := r.Read()
+	if err != nil {
+		t.Fatalf("Didnt expect error reading %v", err)
+	}
+	if tg.Version() != "50" {
+		t.Fatalf("Expected the first complete telegram got version %s", tg.Version())
+	}
+	tg, err = r.Read()
+	if err != nil {
+		t.Fatalf("Didnt expect error reading %v", err)
+	}
+	if tg.Version() != "42" {
+		t.Fatalf("Expected the second telegram got version %s", tg.Version())
+	}
+	if _, err := r.Read(); err == nil {
+		t.Fatalf("Expected error at end of stream")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+const easeeBaseURL = "https://api.easee.com"
+
+// Operating modes of an Easee charger.
+const (
+	easeeDisconnected  = 1
+	easeeAwaitingStart = 2
+	easeeCharging      = 3
+	easeeCompleted     = 4
+	easeeError         = 5
+	easeeReadyToCharge = 6
+)
+
+type EaseeLoginRequest struct {
+	UserName string `json:"userName"`
+	Password string `json:"password"`
+}
+
+type EaseeLoginResponse struct {
+	AccessToken  string `json:"accessToken"`
+	ExpiresIn    int    `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// EaseeState is the part of a charger's state that is used. The currents of
+// the phases are InCurrentT3 to T5, power is in kW.
+type EaseeState struct {
+	ChargerOpMode         int     `json:"chargerOpMode"`
+	TotalPower            float64 `json:"totalPower"`
+	DynamicChargerCurrent float64 `json:"dynamicChargerCurrent"`
+	InCurrentT3           float64 `json:"inCurrentT3"`
+	InCurrentT4           float64 `json:"inCurrentT4"`
+	InCurrentT5           float64 `json:"inCurrentT5"`
+	Voltage               float64 `json:"voltage"`
+}
+
+type EaseeSettings struct {
+	DynamicChargerCurrent float64 `json:"dynamicChargerCurrent"`
+}
+
+// easeeClient controls an Easee charger through the Easee cloud. Charging is
+// paused and resumed, which works whether the charger needs authorization or
+// not, and the current is set as the dynamic charger current.
+type easeeClient struct {
+	baseURL  string
+	id       string
+	username string
+	password string
+	login    *chargerLogin
+}
+
+func (e easeeClient) authenticate(ctx context.Context) (string, time.Duration, error) {
+	var r EaseeLoginResponse
+	err := e.do(ctx, "POST", "/api/accounts/login", "", EaseeLoginRequest{UserName: e.username, Password: e.password}, &r)
+	if err != nil {
+		return "", 0, err
+	}
+	return r.AccessToken, time.Duration(r.ExpiresIn) * time.Second, nil
+}
+
+func (e easeeClient) do(ctx context.Context, method string, path string, token string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, e.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errChargerUnauthorized
+	}
+	if resp.StatusCode >= 400 {
+		return errors.New(fmt.Sprintf("Status code %d from Easee %s", resp.StatusCode, path))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (e easeeClient) request(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	if e.id == "" {
+		return errors.New("No charger id for Easee charger")
+	}
+	return e.login.authorized(ctx, e.authenticate, func(token string) error {
+		return e.do(ctx, method, path, token, body, v)
+	})
+}
+
+func (e easeeClient) getCarData(ctx context.Context, carID int64) (*carData, error) {
+	var st EaseeState
+	err := e.request(ctx, "GET", fmt.Sprintf("/api/chargers/%s/state", e.id), nil, &st)
+	if err != nil {
+		return nil, err
+	}
+	data := carData{
+		IsCharging: st.ChargerOpMode == easeeCharging,
+		IsPluggedIn: st.ChargerOpMode == easeeAwaitingStart || st.ChargerOpMode == easeeCharging ||
+			st.ChargerOpMode == easeeCompleted || st.ChargerOpMode == easeeReadyToCharge,
+		ChargeAmps: int32(math.Round(st.DynamicChargerCurrent)),
+	}
+	current := 0.0
+	for _, i := range []float64{st.InCurrentT3, st.InCurrentT4, st.InCurrentT5} {
+		current = math.Max(current, i)
+		if i >= 1 {
+			data.ChargerPhases++
+		}
+	}
+	data.ChargerActualCurrent = int32(math.Round(current))
+	if data.ChargerPhases > 0 {
+		data.ChargerVoltage = int32(math.Round(st.Voltage))
+	}
+	return &data, nil
+}
+
+func (e easeeClient) startCharging(ctx context.Context, carID int64) error {
+	return e.request(ctx, "POST", fmt.Sprintf("/api/chargers/%s/commands/resume_charging", e.id), nil, nil)
+}
+
+func (e easeeClient) stopCharging(ctx context.Context, carID int64) error {
+	return e.request(ctx, "POST", fmt.Sprintf("/api/chargers/%s/commands/pause_charging", e.id), nil, nil)
+}
+
+func (e easeeClient) setChargingAmps(ctx context.Context, carID int64, amps int32) error {
+	settings := EaseeSettings{DynamicChargerCurrent: float64(amps)}
+	return e.request(ctx, "POST", fmt.Sprintf("/api/chargers/%s/settings", e.id), settings, nil)
+}
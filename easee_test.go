@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const easeeChargingState = `{
+	"chargerOpMode": 3,
+	"totalPower": 7.359,
+	"sessionEnergy": 4.12,
+	"dynamicChargerCurrent": 11,
+	"outputCurrent": 11,
+	"inCurrentT2": 0,
+	"inCurrentT3": 10.62,
+	"inCurrentT4": 10.71,
+	"inCurrentT5": 10.58,
+	"voltage": 229.8,
+	"isOnline": true
+}`
+
+const easeeAwaitingState = `{"chargerOpMode": 2, "totalPower": 0, "dynamicChargerCurrent": 32, "inCurrentT3": 0, "inCurrentT4": 0, "inCurrentT5": 0, "voltage": 231.2}`
+
+const easeeDisconnectedState = `{"chargerOpMode": 1, "totalPower": 0, "dynamicChargerCurrent": 32, "voltage": 231.2}`
+
+// easeeServer is a fake Easee cloud that expires its token after a number of
+// requests.
+type easeeServer struct {
+	t        *testing.T
+	state    string
+	logins   int
+	requests []string
+	settings EaseeSettings
+	uses     int
+}
+
+func (e *easeeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/accounts/login" {
+		var login EaseeLoginRequest
+		json.NewDecoder(r.Body).Decode(&login)
+		if login.UserName != "user@example.com" || login.Password != "secret" {
+			w.WriteHeader(400)
+			return
+		}
+		e.logins++
+		e.uses = 0
+		fmt.Fprintf(w, `{"accessToken": "token%d", "expiresIn": 86400, "refreshToken": "refresh"}`, e.logins)
+		return
+	}
+	if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token%d", e.logins) || e.uses >= 3 {
+		w.WriteHeader(401)
+		return
+	}
+	e.uses++
+	e.requests = append(e.requests, r.Method+" "+r.URL.Path)
+	switch r.URL.Path {
+	case "/api/chargers/EH123456/state":
+		fmt.Fprint(w, e.state)
+	case "/api/chargers/EH123456/settings":
+		json.NewDecoder(r.Body).Decode(&e.settings)
+		w.WriteHeader(202)
+	case "/api/chargers/EH123456/commands/resume_charging", "/api/chargers/EH123456/commands/pause_charging":
+		w.WriteHeader(202)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func newEaseeClient(url string) easeeClient {
+	return easeeClient{baseURL: url, id: "EH123456", username: "user@example.com", password: "secret", login: &chargerLogin{}}
+}
+
+func TestEaseeGetCarData(t *testing.T) {
+	tests := []struct {
+		state string
+		want  carData
+	}{
+		{state: easeeChargingState, want: carData{IsCharging: true, IsPluggedIn: true, ChargeAmps: 11, ChargerActualCurrent: 11, ChargerVoltage: 230, ChargerPhases: 3}},
+		{state: easeeAwaitingState, want: carData{IsPluggedIn: true, ChargeAmps: 32}},
+		{state: easeeDisconnectedState, want: carData{ChargeAmps: 32}},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(&easeeServer{t: t, state: test.state})
+		c := newEaseeClient(server.URL)
+		data, err := c.getCarData(context.Background(), 0)
+		server.Close()
+		if err != nil {
+			t.Fatalf("Didnt expect error reading Easee %v", err)
+		}
+		if *data != test.want {
+			t.Fatalf("Expected %+v but was %+v", test.want, *data)
+		}
+	}
+}
+
+func TestEaseeCommands(t *testing.T) {
+	ctx := context.Background()
+	fake := &easeeServer{t: t, state: easeeAwaitingState}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c := newEaseeClient(server.URL)
+
+	if err := c.setChargingAmps(ctx, 0, 9); err != nil {
+		t.Fatalf("Failed to set current %v", err)
+	}
+	if err := c.startCharging(ctx, 0); err != nil {
+		t.Fatalf("Failed to start %v", err)
+	}
+	if err := c.stopCharging(ctx, 0); err != nil {
+		t.Fatalf("Failed to stop %v", err)
+	}
+	// The token is rejected now and logged in to again.
+	if _, err := c.getCarData(ctx, 0); err != nil {
+		t.Fatalf("Failed to read state after the token was rejected %v", err)
+	}
+	if fake.settings.DynamicChargerCurrent != 9 {
+		t.Fatalf("Expected dynamic charger current 9 got %+v", fake.settings)
+	}
+	want := []string{
+		"POST /api/chargers/EH123456/settings",
+		"POST /api/chargers/EH123456/commands/resume_charging",
+		"POST /api/chargers/EH123456/commands/pause_charging",
+		"GET /api/chargers/EH123456/state",
+	}
+	if fmt.Sprint(fake.requests) != fmt.Sprint(want) {
+		t.Fatalf("Expected requests %v got %v", want, fake.requests)
+	}
+	if fake.logins != 2 {
+		t.Fatalf("Expected 2 logins got %d", fake.logins)
+	}
+
+	c.password = "wrong"
+	c.login = &chargerLogin{}
+	if _, err := c.getCarData(ctx, 0); err == nil {
+		t.Fatalf("Expected error with the wrong password")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const enphaseProductionPath = "/production.json"
+
+// envoyClient reads Envoys over https. Their certificate is self signed for
+// the serial number rather than the address, so it cannot be verified, the
+// token authenticates the request instead. It is only used for the Envoy's
+// own https address and refuses redirects to any other host. The client is
+// shared so that polling reuses its connection to the Envoy.
+var envoyClient = &http.Client{
+	Transport: &http.Transport{
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != via[0].URL.Host {
+			return errors.New(fmt.Sprintf("Envoy redirected to %s", req.URL.Host))
+		}
+		return nil
+	},
+}
+
+// EnphaseMeasurement is one reading of /production.json, either of the
+// inverters or of a metering channel (eim) in watts.
+type EnphaseMeasurement struct {
+	Type            string  `json:"type"`
+	ActiveCount     int     `json:"activeCount"`
+	MeasurementType string  `json:"measurementType"`
+	ReadingTime     int64   `json:"readingTime"`
+	WNow            float64 `json:"wNow"`
+	WhLifetime      float64 `json:"whLifetime"`
+}
+
+type EnphaseProduction struct {
+	Production  []EnphaseMeasurement `json:"production"`
+	Consumption []EnphaseMeasurement `json:"consumption"`
+}
+
+// enphaseClient reads an Enphase Envoy on the local network. Envoys with
+// firmware 7 and later require a token and only serve https with a self
+// signed certificate.
+type enphaseClient struct {
+	host  string
+	token string
+}
+
+func (e enphaseClient) baseURL() string {
+	if strings.Contains(e.host, "://") {
+		return e.host
+	}
+	if e.token != "" {
+		return "https://" + e.host
+	}
+	return "http://" + e.host
+}
+
+func (e enphaseClient) getProduction(ctx context.Context) (*EnphaseProduction, error) {
+	if e.host == "" {
+		return nil, errors.New("No host for Enphase site")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", e.baseURL()+enphaseProductionPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := http.DefaultClient
+	if e.token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", e.token))
+		if req.URL.Scheme == "https" {
+			client = envoyClient
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, errors.New(fmt.Sprintf("Status code %d when fetching production", resp.StatusCode))
+	}
+	var p EnphaseProduction
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func enphaseMeasurement(ms []EnphaseMeasurement, measurementType string) (float64, bool) {
+	for _, m := range ms {
+		if m.Type == "eim" && m.MeasurementType == measurementType && m.ActiveCount > 0 {
+			return m.WNow, true
+		}
+	}
+	return 0, false
+}
+
+// production is the metered production, or that reported by the inverters
+// when the Envoy has no production meter.
+func (p EnphaseProduction) production() (float64, error) {
+	if w, ok := enphaseMeasurement(p.Production, "production"); ok {
+		return w, nil
+	}
+	for _, m := range p.Production {
+		if m.Type == "inverters" {
+			return m.WNow, nil
+		}
+	}
+	return 0, errors.New("No production in Enphase reading")
+}
+
+func (e enphaseClient) getCurrentPower(ctx context.Context) (float64, error) {
+	p, err := e.getProduction(ctx)
+	if err != nil {
+		return 0, err
+	}
+	w, err := p.production()
+	if err != nil {
+		return 0, err
+	}
+	// The meters report a small negative production at night.
+	if w < 0 {
+		return 0, nil
+	}
+	return w, nil
+}
+
+// getPowerFlow requires consumption meters, net consumption is positive when
+// importing from the grid.
+func (e enphaseClient) getPowerFlow(ctx context.Context) (*powerFlow, error) {
+	p, err := e.getProduction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	production, err := p.production()
+	if err != nil {
+		return nil, err
+	}
+	if production < 0 {
+		production = 0
+	}
+	net, ok := enphaseMeasurement(p.Consumption, "net-consumption")
+	if !ok {
+		return nil, errors.New("No grid meter in power flow")
+	}
+	flow := powerFlow{Production: production}
+	if total, ok := enphaseMeasurement(p.Consumption, "total-consumption"); ok {
+		flow.Consumption = total
+	} else {
+		flow.Consumption = production + net
+	}
+	if net > 0 {
+		flow.GridImport = net
+	} else {
+		flow.GridExport = -net
+	}
+	return &flow, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func enphaseHandler(token string, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != enphaseProductionPath {
+			w.WriteHeader(404)
+			return
+		}
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(401)
+			return
+		}
+		fmt.Fprint(w, body)
+	})
+}
+
+const enphaseMetered = `{
+	"production": [
+		{"type": "inverters", "activeCount": 16, "readingTime": 1619863203, "wNow": 3790, "whLifetime": 14823050},
+		{"type": "eim", "activeCount": 1, "measurementType": "production", "readingTime": 1619863205, "wNow": 3812.571, "whLifetime": 14901213.6, "varhLeadLifetime": 0.021, "rmsCurrent": 16.41, "rmsVoltage": 241.2, "pwrFactor": 0.99}
+	],
+	"consumption": [
+		{"type": "eim", "activeCount": 1, "measurementType": "total-consumption", "readingTime": 1619863205, "wNow": 1240.112, "whLifetime": 9632120.1, "rmsCurrent": 12.2, "rmsVoltage": 241.3},
+		{"type": "eim", "activeCount": 1, "measurementType": "net-consumption", "readingTime": 1619863205, "wNow": -2572.459, "whLifetime": 3512014.3, "rmsCurrent": 4.2, "rmsVoltage": 241.3}
+	],
+	"storage": [
+		{"type": "acb", "activeCount": 0, "readingTime": 0, "wNow": 0, "whNow": 0, "state": "idle"}
+	]
+}`
+
+const enphaseNight = `{
+	"production": [
+		{"type": "inverters", "activeCount": 16, "readingTime": 1619899203, "wNow": 0, "whLifetime": 14842050},
+		{"type": "eim", "activeCount": 1, "measurementType": "production", "readingTime": 1619899205, "wNow": -3.412, "whLifetime": 14920213.6}
+	],
+	"consumption": [
+		{"type": "eim", "activeCount": 1, "measurementType": "net-consumption", "readingTime": 1619899205, "wNow": 702.5, "whLifetime": 3512914.3}
+	],
+	"storage": []
+}`
+
+const enphaseInvertersOnly = `{
+	"production": [
+		{"type": "inverters", "activeCount": 12, "readingTime": 1619863203, "wNow": 2610, "whLifetime": 9823050}
+	],
+	"storage": []
+}`
+
+func TestEnphaseGetCurrentPower(t *testing.T) {
+	tests := []struct {
+		body string
+		want float64
+	}{
+		{body: enphaseMetered, want: 3812.571},
+		{body: enphaseNight, want: 0},
+		{body: enphaseInvertersOnly, want: 2610},
+	}
+
+	for _, test := range tests {
+		ts := httptest.NewServer(enphaseHandler("", test.body))
+		c := enphaseClient{host: ts.URL}
+		power, err := c.getCurrentPower(context.Background())
+		ts.Close()
+		if err != nil {
+			t.Fatalf("Didnt expect error fetching current power %v", err)
+		}
+		if power != test.want {
+			t.Fatalf("Expected power %f but was %f", test.want, power)
+		}
+	}
+}
+
+func TestEnphaseGetPowerFlow(t *testing.T) {
+	tests := []struct {
+		body string
+		want powerFlow
+	}{
+		{body: enphaseMetered, want: powerFlow{Production: 3812.571, Consumption: 1240.112, GridExport: 2572.459}},
+		{body: enphaseNight, want: powerFlow{Consumption: 702.5, GridImport: 702.5}},
+	}
+
+	for _, test := range tests {
+		ts := httptest.NewServer(enphaseHandler("", test.body))
+		c := enphaseClient{host: ts.URL}
+		flow, err := c.getPowerFlow(context.Background())
+		ts.Close()
+		if err != nil {
+			t.Fatalf("Didnt expect error fetching power flow %v", err)
+		}
+		if *flow != test.want {
+			t.Fatalf("Expected %+v but was %+v", test.want, *flow)
+		}
+	}
+
+	ts := httptest.NewServer(enphaseHandler("", enphaseInvertersOnly))
+	defer ts.Close()
+	if _, err := (enphaseClient{host: ts.URL}).getPowerFlow(context.Background()); err == nil {
+		t.Fatalf("Expected error for power flow without meters")
+	}
+}
+
+func TestEnphaseToken(t *testing.T) {
+	ts := httptest.NewTLSServer(enphaseHandler("envoy-token", enphaseMetered))
+	defer ts.Close()
+
+	c := enphaseClient{host: ts.URL, token: "envoy-token"}
+	power, err := c.getCurrentPower(context.Background())
+	if err != nil {
+		t.Fatalf("Didnt expect error fetching current power with token %v", err)
+	}
+	if power != 3812.571 {
+		t.Fatalf("Expected power 3812.571 but was %f", power)
+	}
+
+	c = enphaseClient{host: ts.URL, token: "wrong-token"}
+	if _, err := c.getCurrentPower(context.Background()); err == nil {
+		t.Fatalf("Expected error with wrong token")
+	}
+
+	// The certificate is only left unverified for the Envoy itself.
+	redirect := httptest.NewTLSServer(http.RedirectHandler(ts.URL+enphaseProductionPath, http.StatusFound))
+	defer redirect.Close()
+	c = enphaseClient{host: redirect.URL, token: "envoy-token"}
+	if _, err := c.getCurrentPower(context.Background()); err == nil {
+		t.Fatalf("Expected error when redirected to another host")
+	}
+}
+
+func TestEnphaseBaseURL(t *testing.T) {
+	if u := (enphaseClient{host: "envoy.local"}).baseURL(); u != "http://envoy.local" {
+		t.Fatalf("Unexpected base url %s", u)
+	}
+	if u := (enphaseClient{host: "envoy.local", token: "t"}).baseURL(); u != "https://envoy.local" {
+		t.Fatalf("Unexpected base url %s", u)
+	}
+}
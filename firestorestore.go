@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type firestoreStore struct {
+	fc *firestore.Client
+}
+
+func newFirestoreStore(ctx context.Context, projectID string) (*firestoreStore, error) {
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreStore{fc: client}, nil
+}
+
+func (fs *firestoreStore) listSites(ctx context.Context) ([]site, error) {
+	iter := fs.fc.Collection("sites").Documents(ctx)
+	sites := []site{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var s site
+		err = snap.DataTo(&s)
+		if err != nil {
+			return nil, err
+		}
+		s.documentId = snap.Ref.ID
+		sites = append(sites, s)
+	}
+	return sites, nil
+}
+
+func (fs *firestoreStore) listCars(ctx context.Context) ([]car, error) {
+	iter := fs.fc.Collection("cars").Documents(ctx)
+	cars := []car{}
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var c car
+		err = snap.DataTo(&c)
+		if err != nil {
+			return nil, err
+		}
+		c.documentId = snap.Ref.ID
+		cars = append(cars, c)
+	}
+	return cars, nil
+}
+
+func notFound(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return errNotFound
+	}
+	return err
+}
+
+func (fs *firestoreStore) getSite(ctx context.Context, id string) (site, error) {
+	var s site
+	snap, err := fs.fc.Collection("sites").Doc(id).Get(ctx)
+	if err != nil {
+		return s, notFound(err)
+	}
+	err = snap.DataTo(&s)
+	s.documentId = id
+	return s, err
+}
+
+func (fs *firestoreStore) getCar(ctx context.Context, id string) (car, error) {
+	var c car
+	snap, err := fs.fc.Collection("cars").Doc(id).Get(ctx)
+	if err != nil {
+		return c, notFound(err)
+	}
+	err = snap.DataTo(&c)
+	c.documentId = id
+	return c, err
+}
+
+func (fs *firestoreStore) setSite(ctx context.Context, s site) error {
+	_, err := fs.fc.Collection("sites").Doc(s.documentId).Set(ctx, s)
+	return err
+}
+
+func (fs *firestoreStore) setCar(ctx context.Context, c car) error {
+	_, err := fs.fc.Collection("cars").Doc(c.documentId).Set(ctx, c)
+	return err
+}
+
+func firestoreUpdates(f fields) []firestore.Update {
+	updates := []firestore.Update{}
+	for path, value := range f {
+		updates = append(updates, firestore.Update{Path: path, Value: value})
+	}
+	return updates
+}
+
+func (fs *firestoreStore) updateSite(ctx context.Context, id string, f fields) error {
+	_, err := fs.fc.Collection("sites").Doc(id).Update(ctx, firestoreUpdates(f))
+	return notFound(err)
+}
+
+func (fs *firestoreStore) updateCar(ctx context.Context, id string, f fields) error {
+	_, err := fs.fc.Collection("cars").Doc(id).Update(ctx, firestoreUpdates(f))
+	return notFound(err)
+}
+
+func (fs *firestoreStore) close() error {
+	return fs.fc.Close()
+}
@@ -0,0 +1,138 @@
+// Package forecast estimates the solar production of a site for the rest of
+// a day. Production is modelled as clear sky irradiance at the site's
+// location scaled by how the measured production compares to the model.
+package forecast
+
+import (
+	"math"
+	"time"
+)
+
+// History is how far back measured production is used to scale the model.
+const History = 3 * time.Hour
+
+// step is the resolution used when integrating or searching the forecast.
+const step = 5 * time.Minute
+
+// minIrradiance is the clear sky irradiance below which samples are not used
+// for scaling, close to sunrise and sunset the ratio is too noisy.
+const minIrradiance = 100.0
+
+// Sample is measured production in watts.
+type Sample struct {
+	Time  time.Time
+	Power float64
+}
+
+// Forecast of a site's production.
+type Forecast struct {
+	Latitude  float64
+	Longitude float64
+	// Scale converts clear sky irradiance in W/m2 to production in W.
+	Scale float64
+}
+
+func radians(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+// CosZenith returns the cosine of the solar zenith angle at a location,
+// using the NOAA approximation of the sun's position.
+func CosZenith(lat float64, lon float64, t time.Time) float64 {
+	t = t.UTC()
+	hour := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	g := 2 * math.Pi / 365 * (float64(t.YearDay()-1) + (hour-12)/24)
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(g) - 0.032077*math.Sin(g) -
+		0.014615*math.Cos(2*g) - 0.040849*math.Sin(2*g))
+	decl := 0.006918 - 0.399912*math.Cos(g) + 0.070257*math.Sin(g) -
+		0.006758*math.Cos(2*g) + 0.000907*math.Sin(2*g) -
+		0.002697*math.Cos(3*g) + 0.00148*math.Sin(3*g)
+	solarMinutes := hour*60 + eqTime + 4*lon
+	hourAngle := radians(solarMinutes/4 - 180)
+	return math.Sin(radians(lat))*math.Sin(decl) + math.Cos(radians(lat))*math.Cos(decl)*math.Cos(hourAngle)
+}
+
+// ClearSky returns the global horizontal irradiance in W/m2 under a clear
+// sky according to the Haurwitz model.
+func ClearSky(lat float64, lon float64, t time.Time) float64 {
+	cz := CosZenith(lat, lon, t)
+	if cz <= 0 {
+		return 0
+	}
+	return 1098 * cz * math.Exp(-0.059/cz)
+}
+
+// New creates a forecast for a location scaled by the samples measured
+// during History before now.
+func New(lat float64, lon float64, samples []Sample, now time.Time) Forecast {
+	f := Forecast{Latitude: lat, Longitude: lon}
+	sum := 0.0
+	n := 0
+	for _, s := range samples {
+		if s.Time.After(now) || now.Sub(s.Time) > History {
+			continue
+		}
+		irradiance := ClearSky(lat, lon, s.Time)
+		if irradiance < minIrradiance {
+			continue
+		}
+		sum += s.Power / irradiance
+		n++
+	}
+	if n > 0 {
+		f.Scale = sum / float64(n)
+	}
+	return f
+}
+
+// Power returns the forecast production in watts at t.
+func (f Forecast) Power(t time.Time) float64 {
+	return f.Scale * ClearSky(f.Latitude, f.Longitude, t)
+}
+
+// Energy returns the forecast production in Wh between from and to.
+func (f Forecast) Energy(from time.Time, to time.Time) float64 {
+	return f.Surplus(0, from, to)
+}
+
+// Surplus returns the energy in Wh between from and to when offset watts
+// are added to the forecast production, counting only positive power.
+func (f Forecast) Surplus(offset float64, from time.Time, to time.Time) float64 {
+	energy := 0.0
+	for t := from; t.Before(to); t = t.Add(step) {
+		d := step
+		if t.Add(d).After(to) {
+			d = to.Sub(t)
+		}
+		if p := f.Power(t.Add(d/2)) + offset; p > 0 {
+			energy += p * d.Hours()
+		}
+	}
+	return energy
+}
+
+// Sunset returns the first time after from when the sun is below the
+// horizon, searching at most a day ahead.
+func (f Forecast) Sunset(from time.Time) time.Time {
+	for t := from; t.Before(from.Add(24 * time.Hour)); t = t.Add(step) {
+		if CosZenith(f.Latitude, f.Longitude, t) <= 0 {
+			return t
+		}
+	}
+	return from.Add(24 * time.Hour)
+}
+
+// Above returns for how long after from the forecast production plus offset
+// stays above threshold, looking no further than to.
+func (f Forecast) Above(threshold float64, offset float64, from time.Time, to time.Time) time.Duration {
+	t := from
+	for ; t.Before(to); t = t.Add(step) {
+		if f.Power(t)+offset <= threshold {
+			break
+		}
+	}
+	if t.After(to) {
+		t = to
+	}
+	return t.Sub(from)
+}
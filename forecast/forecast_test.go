@@ -0,0 +1,98 @@
+package forecast
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Stockholm
+const (
+	lat = 59.33
+	lon = 18.07
+)
+
+func TestClearSky(t *testing.T) {
+	noon := time.Date(2021, 6, 21, 11, 0, 0, 0, time.UTC)
+	midnight := time.Date(2021, 6, 21, 23, 0, 0, 0, time.UTC)
+	winterNoon := time.Date(2021, 12, 21, 11, 0, 0, 0, time.UTC)
+
+	if ClearSky(lat, lon, midnight) != 0 {
+		t.Errorf("Expected no irradiance at midnight but was %f", ClearSky(lat, lon, midnight))
+	}
+	summer := ClearSky(lat, lon, noon)
+	if summer < 750 || summer > 950 {
+		t.Errorf("Unexpected summer noon irradiance %f", summer)
+	}
+	winter := ClearSky(lat, lon, winterNoon)
+	if winter < 50 || winter > 200 {
+		t.Errorf("Unexpected winter noon irradiance %f", winter)
+	}
+	// The sun is highest around solar noon, which is close to 11:00 UTC
+	// in Stockholm.
+	if ClearSky(lat, lon, noon.Add(-3*time.Hour)) >= summer || ClearSky(lat, lon, noon.Add(3*time.Hour)) >= summer {
+		t.Errorf("Expected irradiance to peak around solar noon")
+	}
+}
+
+func TestNewScalesToSamples(t *testing.T) {
+	now := time.Date(2021, 6, 21, 10, 0, 0, 0, time.UTC)
+	samples := []Sample{}
+	for i := 0; i < 6; i++ {
+		at := now.Add(-time.Duration(i) * 30 * time.Minute)
+		samples = append(samples, Sample{Time: at, Power: 5 * ClearSky(lat, lon, at)})
+	}
+	// Too old to be used.
+	samples = append(samples, Sample{Time: now.Add(-5 * time.Hour), Power: 100000.0})
+
+	f := New(lat, lon, samples, now)
+	if math.Abs(f.Scale-5) > 1e-9 {
+		t.Fatalf("Expected scale 5 but was %f", f.Scale)
+	}
+	at := now.Add(2 * time.Hour)
+	if math.Abs(f.Power(at)-5*ClearSky(lat, lon, at)) > 1e-9 {
+		t.Fatalf("Unexpected forecast power %f", f.Power(at))
+	}
+
+	f = New(lat, lon, nil, now)
+	if f.Power(at) != 0 {
+		t.Fatalf("Expected no forecast without samples but was %f", f.Power(at))
+	}
+}
+
+func TestEnergy(t *testing.T) {
+	f := Forecast{Latitude: lat, Longitude: lon, Scale: 10}
+	day := time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC)
+	energy := f.Energy(day, day.Add(24*time.Hour))
+	// About 8 kWh/m2 of clear sky irradiation on midsummer in Stockholm.
+	if energy < 60000 || energy > 100000 {
+		t.Fatalf("Unexpected energy %f", energy)
+	}
+	if f.Energy(day, day.Add(time.Hour)) != 0 {
+		t.Fatalf("Expected no energy during the night")
+	}
+	surplus := f.Surplus(-1000, day, day.Add(24*time.Hour))
+	// Consumption during the night does not count against the surplus.
+	if surplus >= energy || surplus <= energy-24000 {
+		t.Fatalf("Expected surplus between energy and energy minus consumption but was %f", surplus)
+	}
+}
+
+func TestAboveAndSunset(t *testing.T) {
+	f := Forecast{Latitude: lat, Longitude: lon, Scale: 5}
+	afternoon := time.Date(2021, 6, 21, 15, 0, 0, 0, time.UTC)
+	sunset := f.Sunset(afternoon)
+	if sunset.Hour() < 19 || sunset.Hour() > 20 {
+		t.Fatalf("Unexpected sunset %v", sunset)
+	}
+	above := f.Above(2000, 0, afternoon, sunset)
+	if above <= 0 || above >= sunset.Sub(afternoon) {
+		t.Fatalf("Unexpected time above threshold %v", above)
+	}
+	if f.Above(2000, -10000, afternoon, sunset) != 0 {
+		t.Fatalf("Expected no time above threshold with a large offset")
+	}
+	if f.Above(0, 1, afternoon, afternoon.Add(time.Hour)) != time.Hour {
+		t.Fatalf("Expected time above to be limited")
+	}
+}
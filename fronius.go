@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const froniusPowerFlowPath = "/solar_api/v1/GetPowerFlowRealtimeData.fcgi"
+
+type FroniusStatus struct {
+	Code        int    `json:"Code"`
+	Reason      string `json:"Reason"`
+	UserMessage string `json:"UserMessage"`
+}
+
+type FroniusHead struct {
+	Status    FroniusStatus `json:"Status"`
+	Timestamp string        `json:"Timestamp"`
+}
+
+// FroniusSite is the power flow of the whole site in watts. Values are null
+// when the component is missing, such as P_Grid without a meter or P_PV at
+// night.
+type FroniusSite struct {
+	Mode          string   `json:"Mode"`
+	MeterLocation string   `json:"Meter_Location"`
+	PGrid         *float64 `json:"P_Grid"`
+	PLoad         *float64 `json:"P_Load"`
+	PAkku         *float64 `json:"P_Akku"`
+	PPV           *float64 `json:"P_PV"`
+}
+
+type FroniusPowerFlowData struct {
+	Site FroniusSite `json:"Site"`
+}
+
+type FroniusPowerFlowBody struct {
+	Data FroniusPowerFlowData `json:"Data"`
+}
+
+type FroniusPowerFlowResponse struct {
+	Body FroniusPowerFlowBody `json:"Body"`
+	Head FroniusHead          `json:"Head"`
+}
+
+// froniusClient reads the Solar API of a Fronius inverter on the local
+// network. The api has no authentication.
+type froniusClient struct {
+	host string
+}
+
+func (f froniusClient) baseURL() string {
+	if strings.Contains(f.host, "://") {
+		return f.host
+	}
+	return "http://" + f.host
+}
+
+func (f froniusClient) getPowerFlowData(ctx context.Context) (*FroniusSite, error) {
+	if f.host == "" {
+		return nil, errors.New("No host for Fronius site")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", f.baseURL()+froniusPowerFlowPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, errors.New(fmt.Sprintf("Status code %d when fetching power flow", resp.StatusCode))
+	}
+	var r FroniusPowerFlowResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Head.Status.Code != 0 {
+		return nil, errors.New(fmt.Sprintf("Fronius status %d: %s", r.Head.Status.Code, r.Head.Status.Reason))
+	}
+	return &r.Body.Data.Site, nil
+}
+
+func (f froniusClient) getCurrentPower(ctx context.Context) (float64, error) {
+	site, err := f.getPowerFlowData(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if site.PPV == nil {
+		return 0, nil
+	}
+	return *site.PPV, nil
+}
+
+// getPowerFlow reads the realtime power flow. Fronius reports grid power as
+// positive when importing and load as negative when consuming.
+func (f froniusClient) getPowerFlow(ctx context.Context) (*powerFlow, error) {
+	site, err := f.getPowerFlowData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if site.PGrid == nil || site.PLoad == nil {
+		return nil, errors.New("No grid meter in power flow")
+	}
+	flow := powerFlow{
+		Consumption: -*site.PLoad,
+	}
+	if site.PPV != nil {
+		flow.Production = *site.PPV
+	}
+	if *site.PGrid > 0 {
+		flow.GridImport = *site.PGrid
+	} else {
+		flow.GridExport = -*site.PGrid
+	}
+	return &flow, nil
+}
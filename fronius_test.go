@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newFroniusServer(t *testing.T, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != froniusPowerFlowPath {
+			w.WriteHeader(404)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+}
+
+const froniusExporting = `{
+	"Body": {
+		"Data": {
+			"Inverters": {
+				"1": {"DT": 1, "E_Day": 8430, "E_Total": 12514100, "E_Year": 1785200, "P": 3821}
+			},
+			"Site": {
+				"E_Day": 8430,
+				"E_Total": 12514100,
+				"E_Year": 1785200,
+				"Meter_Location": "grid",
+				"Mode": "meter",
+				"P_Akku": null,
+				"P_Grid": -2410.6,
+				"P_Load": -1410.4,
+				"P_PV": 3821,
+				"rel_Autonomy": 100,
+				"rel_SelfConsumption": 36.9
+			},
+			"Version": "12"
+		}
+	},
+	"Head": {
+		"RequestArguments": {},
+		"Status": {"Code": 0, "Reason": "", "UserMessage": ""},
+		"Timestamp": "2021-05-01T12:00:03+02:00"
+	}
+}`
+
+const froniusImportingAtNight = `{
+	"Body": {
+		"Data": {
+			"Inverters": {},
+			"Site": {
+				"E_Day": null,
+				"E_Total": null,
+				"E_Year": null,
+				"Meter_Location": "grid",
+				"Mode": "meter",
+				"P_Akku": null,
+				"P_Grid": 612.3,
+				"P_Load": -612.3,
+				"P_PV": null,
+				"rel_Autonomy": 0,
+				"rel_SelfConsumption": null
+			},
+			"Version": "12"
+		}
+	},
+	"Head": {
+		"RequestArguments": {},
+		"Status": {"Code": 0, "Reason": "", "UserMessage": ""},
+		"Timestamp": "2021-05-01T23:00:03+02:00"
+	}
+}`
+
+const froniusWithoutMeter = `{
+	"Body": {
+		"Data": {
+			"Inverters": {
+				"1": {"DT": 1, "E_Day": 8430, "E_Total": 12514100, "E_Year": 1785200, "P": 2950}
+			},
+			"Site": {
+				"E_Day": 8430,
+				"E_Total": 12514100,
+				"E_Year": 1785200,
+				"Meter_Location": "unknown",
+				"Mode": "produce-only",
+				"P_Akku": null,
+				"P_Grid": null,
+				"P_Load": null,
+				"P_PV": 2950,
+				"rel_Autonomy": null,
+				"rel_SelfConsumption": null
+			},
+			"Version": "12"
+		}
+	},
+	"Head": {
+		"RequestArguments": {},
+		"Status": {"Code": 0, "Reason": "", "UserMessage": ""},
+		"Timestamp": "2021-05-01T12:00:03+02:00"
+	}
+}`
+
+func TestFroniusGetCurrentPower(t *testing.T) {
+	tests := []struct {
+		body string
+		want float64
+	}{
+		{body: froniusExporting, want: 3821},
+		{body: froniusImportingAtNight, want: 0},
+		{body: froniusWithoutMeter, want: 2950},
+	}
+
+	for _, test := range tests {
+		ts := newFroniusServer(t, test.body)
+		c := froniusClient{host: ts.URL}
+		power, err := c.getCurrentPower(context.Background())
+		ts.Close()
+		if err != nil {
+			t.Fatalf("Didnt expect error fetching current power %v", err)
+		}
+		if power != test.want {
+			t.Fatalf("Expected power %f but was %f", test.want, power)
+		}
+	}
+}
+
+func TestFroniusGetPowerFlow(t *testing.T) {
+	tests := []struct {
+		body string
+		want powerFlow
+	}{
+		{body: froniusExporting, want: powerFlow{Production: 3821, Consumption: 1410.4, GridExport: 2410.6}},
+		{body: froniusImportingAtNight, want: powerFlow{Consumption: 612.3, GridImport: 612.3}},
+	}
+
+	for _, test := range tests {
+		ts := newFroniusServer(t, test.body)
+		c := froniusClient{host: ts.URL}
+		flow, err := c.getPowerFlow(context.Background())
+		ts.Close()
+		if err != nil {
+			t.Fatalf("Didnt expect error fetching power flow %v", err)
+		}
+		if *flow != test.want {
+			t.Fatalf("Expected %+v but was %+v", test.want, *flow)
+		}
+	}
+}
+
+func TestFroniusErrors(t *testing.T) {
+	ts := newFroniusServer(t, froniusWithoutMeter)
+	defer ts.Close()
+	c := froniusClient{host: ts.URL}
+	if _, err := c.getPowerFlow(context.Background()); err == nil {
+		t.Fatalf("Expected error for power flow without meter")
+	}
+
+	failing := newFroniusServer(t, `{
+		"Body": {"Data": {}},
+		"Head": {
+			"RequestArguments": {},
+			"Status": {"Code": 255, "Reason": "Internal error", "UserMessage": ""},
+			"Timestamp": "2021-05-01T12:00:03+02:00"
+		}
+	}`)
+	defer failing.Close()
+	c = froniusClient{host: failing.URL}
+	if _, err := c.getCurrentPower(context.Background()); err == nil {
+		t.Fatalf("Expected error for failing status")
+	}
+
+	if _, err := (froniusClient{}).getCurrentPower(context.Background()); err == nil {
+		t.Fatalf("Expected error without host")
+	}
+}
+
+func TestFroniusBaseURL(t *testing.T) {
+	if u := (froniusClient{host: "192.168.1.20"}).baseURL(); u != "http://192.168.1.20" {
+		t.Fatalf("Unexpected base url %s", u)
+	}
+	if u := (froniusClient{host: "https://inverter.local:8443"}).baseURL(); u != "https://inverter.local:8443" {
+		t.Fatalf("Unexpected base url %s", u)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// overloaded tells if the current of any phase at the grid connection of
+// site s exceeds its main fuse.
+func (s site) overloaded() bool {
+	if s.MainFuseAmps <= 0 {
+		return false
+	}
+	for _, i := range s.PhaseCurrents {
+		if math.Abs(i) > s.MainFuseAmps {
+			return true
+		}
+	}
+	return false
+}
+
+// drawnCurrent is the current car c draws on each of its phases.
+func (c car) drawnCurrent() float64 {
+	if !c.IsCharging {
+		return 0
+	}
+	if c.ChargeAmps > 0 {
+		return float64(c.ChargeAmps)
+	}
+	return float64(c.ChargerActualCurrent)
+}
+
+// fuseShares is the number of cars at a site that share the headroom of its
+// main fuse, the cars that are plugged in.
+func fuseShares(cars []car) int {
+	shares := 0
+	for _, c := range cars {
+		if c.IsPluggedIn || c.IsCharging {
+			shares++
+		}
+	}
+	if shares == 0 {
+		return 1
+	}
+	return shares
+}
+
+// fuseLimit returns the most current car c can charge with without any phase
+// at site s exceeding the main fuse. The car is assumed to charge on the most
+// loaded phase, as it is not known which phases it uses, and the headroom is
+// shared equally by shares cars. The second return value is false when the
+// site has no main fuse or phase currents.
+func fuseLimit(s site, c car, shares int) (int32, bool) {
+	if s.MainFuseAmps <= 0 || len(s.PhaseCurrents) == 0 {
+		return 0, false
+	}
+	loaded := math.Inf(-1)
+	for _, i := range s.PhaseCurrents {
+		loaded = math.Max(loaded, i)
+	}
+	headroom := s.MainFuseAmps - loaded
+	if shares > 1 {
+		headroom /= float64(shares)
+	}
+	limit := math.Floor(c.drawnCurrent() + headroom)
+	if limit < 0 {
+		return 0, true
+	}
+	if limit > float64(c.maxChargeAmps()) {
+		return c.maxChargeAmps(), true
+	}
+	return int32(limit), true
+}
+
+// limitToFuse caps decision d so that car c draws at most limit amps. The car
+// is stopped, or not started, when the limit is below its minimum current,
+// and lowered when it charges above the limit without being told to.
+func limitToFuse(c car, d decision, limit int32) decision {
+	reason := fmt.Sprintf("main fuse limits charging to %d A", limit)
+	switch d.action {
+	case actionStart:
+		if limit < c.minChargeAmps() {
+			return decision{action: actionNone, reason: reason}
+		}
+	case actionAdjust:
+		if limit < c.minChargeAmps() {
+			return decision{action: actionStop, reason: reason}
+		}
+	case actionNone:
+		if !c.IsCharging || c.drawnCurrent() <= float64(limit) {
+			return d
+		}
+		if limit < c.minChargeAmps() {
+			return decision{action: actionStop, reason: reason}
+		}
+		return decision{action: actionAdjust, amps: limit, byGrid: c.IsChargingByGrid, reason: reason}
+	default:
+		return d
+	}
+	if d.amps > limit {
+		d.amps = limit
+		d.reason = fmt.Sprintf("%s, %s", d.reason, reason)
+	}
+	return d
+}
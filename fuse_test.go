@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOverloaded(t *testing.T) {
+	tests := []struct {
+		s    site
+		want bool
+	}{
+		{s: site{PhaseCurrents: []float64{40, 0, 0}}, want: false},
+		{s: site{MainFuseAmps: 25}, want: false},
+		{s: site{MainFuseAmps: 25, PhaseCurrents: []float64{25, 10, 3}}, want: false},
+		{s: site{MainFuseAmps: 25, PhaseCurrents: []float64{12, 25.5, 3}}, want: true},
+		{s: site{MainFuseAmps: 25, PhaseCurrents: []float64{-26, 0, 0}}, want: true},
+	}
+
+	for _, test := range tests {
+		if got := test.s.overloaded(); got != test.want {
+			t.Errorf("Want %v got %v for %v", test.want, got, test.s.PhaseCurrents)
+		}
+	}
+}
+
+func TestFuseLimit(t *testing.T) {
+	tests := []struct {
+		s      site
+		c      car
+		shares int
+		want   int32
+		ok     bool
+	}{
+		{s: site{PhaseCurrents: []float64{10, 10, 10}}, c: car{}, shares: 1, ok: false},
+		{s: site{MainFuseAmps: 25}, c: car{}, shares: 1, ok: false},
+		{s: site{MainFuseAmps: 25, PhaseCurrents: []float64{10, 4, 2}}, c: car{}, shares: 1, want: 15, ok: true},
+		// The car's own current is on the phases already.
+		{s: site{MainFuseAmps: 25, PhaseCurrents: []float64{22, 18, 16}}, c: car{IsCharging: true, ChargeAmps: 13}, shares: 1, want: 16, ok: true},
+		{s: site{MainFuseAmps: 25, PhaseCurrents: []float64{30, 18, 16}}, c: car{IsCharging: true, ChargerActualCurrent: 10}, shares: 1, want: 5, ok: true},
+		{s: site{MainFuseAmps: 25, PhaseCurrents: []float64{32.5, 25, 25}}, c: car{IsCharging: true, ChargeAmps: 6}, shares: 1, want: 0, ok: true},
+		{s: site{MainFuseAmps: 25, PhaseCurrents: []float64{-10, -10, -10}}, c: car{MaxChargeAmps: 32}, shares: 1, want: 32, ok: true},
+		{s: site{MainFuseAmps: 25, PhaseCurrents: []float64{15, 5, 5}}, c: car{IsCharging: true, ChargeAmps: 8}, shares: 2, want: 13, ok: true},
+	}
+
+	for _, test := range tests {
+		limit, ok := fuseLimit(test.s, test.c, test.shares)
+		if limit != test.want || ok != test.ok {
+			t.Errorf("Want %d, %v got %d, %v for site %+v and car %+v", test.want, test.ok, limit, ok, test.s, test.c)
+		}
+	}
+}
+
+func TestLimitToFuse(t *testing.T) {
+	tests := []struct {
+		c     car
+		d     decision
+		limit int32
+		want  decision
+	}{
+		{c: car{}, d: decision{action: actionStart, amps: 10}, limit: 16, want: decision{action: actionStart, amps: 10}},
+		{c: car{}, d: decision{action: actionStart, amps: 16, byGrid: true, reason: "cheap hour"}, limit: 12, want: decision{action: actionStart, amps: 12, byGrid: true, reason: "cheap hour, main fuse limits charging to 12 A"}},
+		{c: car{}, d: decision{action: actionStart, amps: 10}, limit: 3, want: decision{action: actionNone, reason: "main fuse limits charging to 3 A"}},
+		{c: car{IsCharging: true, ChargeAmps: 16}, d: decision{action: actionAdjust, amps: 16, reason: "solar"}, limit: 9, want: decision{action: actionAdjust, amps: 9, reason: "solar, main fuse limits charging to 9 A"}},
+		{c: car{IsCharging: true, ChargeAmps: 16}, d: decision{action: actionAdjust, amps: 16}, limit: 0, want: decision{action: actionStop, reason: "main fuse limits charging to 0 A"}},
+		{c: car{IsCharging: true, ChargeAmps: 16}, d: decision{action: actionStop}, limit: 0, want: decision{action: actionStop}},
+		// Charging the controller did not start is lowered too.
+		{c: car{IsCharging: true, ChargeAmps: 16}, d: decision{action: actionNone}, limit: 10, want: decision{action: actionAdjust, amps: 10, reason: "main fuse limits charging to 10 A"}},
+		{c: car{IsCharging: true, ChargeAmps: 16, IsChargingByGrid: true}, d: decision{action: actionNone}, limit: 10, want: decision{action: actionAdjust, amps: 10, byGrid: true, reason: "main fuse limits charging to 10 A"}},
+		{c: car{IsCharging: true, ChargeAmps: 16}, d: decision{action: actionNone}, limit: 2, want: decision{action: actionStop, reason: "main fuse limits charging to 2 A"}},
+		{c: car{IsCharging: true, ChargeAmps: 8}, d: decision{action: actionNone}, limit: 10, want: decision{action: actionNone}},
+	}
+
+	for _, test := range tests {
+		if got := limitToFuse(test.c, test.d, test.limit); got != test.want {
+			t.Errorf("Want %+v got %+v for car %+v, decision %+v and limit %d", test.want, got, test.c, test.d, test.limit)
+		}
+	}
+}
+
+func TestChargeWithPowerFuse(t *testing.T) {
+	ctx := context.Background()
+	app := createTestApp(ctx, 0)
+	defer app.close()
+
+	c := car{CarID: 1, documentId: "car1", IsCharging: true, IsChargingBySolar: true, ChargeAmps: 16, ChargeLimit: 80, BatteryLevel: 40, IsPluggedIn: true}
+	app.st.setCar(ctx, c)
+	s := site{SolarPower: 10000, MainFuseAmps: 25, PhaseCurrents: []float64{29, 20, 18}}
+	err := chargeWithPower(app, s, c, s.SolarPower, 1, ctx)
+	if err != nil {
+		t.Fatalf("chargeWithPower err: %v", err)
+	}
+	c, err = app.st.getCar(ctx, "car1")
+	if err != nil {
+		t.Fatalf("getCar err: %v", err)
+	}
+	if c.ChargeAmps != 12 {
+		t.Fatalf("ChargeAmps %d should have been lowered to 12", c.ChargeAmps)
+	}
+}
+
+// countingVendor counts the reads of a site's vendor.
+type countingVendor struct {
+	testSolarVendor
+	reads *int
+}
+
+func (v countingVendor) getPowerFlow(ctx context.Context) (*powerFlow, error) {
+	*v.reads++
+	return v.testSolarVendor.getPowerFlow(ctx)
+}
+
+type overloadedApp struct {
+	*testApp
+	vendor countingVendor
+	meter  gridMeter
+}
+
+func (a overloadedApp) createSolarClient(s site) (solarClient, error) {
+	return a.vendor, nil
+}
+
+func (a overloadedApp) createGridMeter(s site) (gridMeter, error) {
+	return a.meter, nil
+}
+
+func TestReadOverloadedSite(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	tests := []struct {
+		name        string
+		meter       gridMeter
+		lastUpdated time.Time
+		wantReads   int
+		wantImport  float64
+	}{
+		{name: "meter", meter: testGridMeter{gridReading{GridImport: 2000, PhaseCurrent: [3]float64{20, 5, 5}}}, lastUpdated: now, wantImport: 2000},
+		{name: "no meter", lastUpdated: now, wantImport: 9000},
+		{name: "no meter read a while ago", lastUpdated: now.Add(-2 * overloadedVendorInterval), wantReads: 1},
+	}
+
+	for _, test := range tests {
+		reads := 0
+		app := overloadedApp{
+			testApp: createTestApp(ctx, 0),
+			vendor:  countingVendor{testSolarVendor: testSolarVendor{solarPower: 3000, consumption: 2000}, reads: &reads},
+			meter:   test.meter,
+		}
+		app.st.setSite(ctx, site{documentId: "site1", SolarPower: 3000, GridImport: 9000, MainFuseAmps: 25,
+			PhaseCurrents: []float64{40, 5, 5}, LastUpdated: test.lastUpdated})
+		sites, err := readSites(app, ctx)
+		if err != nil {
+			t.Fatalf("Didnt expect error %v", err)
+		}
+		stored, _ := app.st.getSite(ctx, "site1")
+		if reads != test.wantReads || sites[0].GridImport != test.wantImport || stored.GridImport != test.wantImport {
+			t.Fatalf("%s: want %d vendor reads and %f import got %d and %+v", test.name, test.wantReads, test.wantImport, reads, stored)
+		}
+		if test.meter != nil && (stored.overloaded() || stored.SolarPower != 3000 || !stored.LastUpdated.Equal(test.lastUpdated)) {
+			t.Fatalf("%s: expected the meter to be read and the vendor poll kept got %+v", test.name, stored)
+		}
+	}
+}
@@ -4,7 +4,10 @@ go 1.15
 
 require (
 	cloud.google.com/go/firestore v1.5.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/pkg/errors v0.9.1
 	github.com/umahmood/haversine v0.0.0-20151105152445-808ab04add26
+	golang.org/x/net v0.0.0-20201224014010-6772e930b67b
 	google.golang.org/api v0.40.0
+	google.golang.org/grpc v1.35.0
 )
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	goeStatusPath = "/api/status"
+	goeSetPath    = "/api/set"
+)
+
+// States of the car connected to a go-e charger.
+const (
+	goeCarIdle     = 1
+	goeCarCharging = 2
+	goeCarWaiting  = 3
+	goeCarComplete = 4
+	goeCarError    = 5
+)
+
+// Force states, neutral lets the charger decide by its own schedule.
+const (
+	goeForceNeutral = 0
+	goeForceOff     = 1
+	goeForceOn      = 2
+)
+
+// GoeStatus is the part of the go-e api v2 status that is used. Energy has
+// the voltage of L1 to N, the current of L1 to L3 and the power of L1 to N
+// and the total, in V, A and W.
+type GoeStatus struct {
+	Car    int       `json:"car"`
+	Amp    int32     `json:"amp"`
+	Force  int       `json:"frc"`
+	Energy []float64 `json:"nrg"`
+}
+
+// goeClient controls a go-e charger through its local http api v2, which has
+// no authentication.
+type goeClient struct {
+	host string
+}
+
+func (g goeClient) baseURL() string {
+	if strings.Contains(g.host, "://") {
+		return strings.TrimRight(g.host, "/")
+	}
+	return "http://" + g.host
+}
+
+func (g goeClient) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	if g.host == "" {
+		return errors.New("No host for go-e charger")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", g.baseURL()+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New(fmt.Sprintf("Status code %d from go-e %s", resp.StatusCode, path))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (g goeClient) getStatus(ctx context.Context) (*GoeStatus, error) {
+	var st GoeStatus
+	err := g.get(ctx, goeStatusPath, url.Values{"filter": {"car,amp,frc,nrg"}}, &st)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// set changes key to value, the charger answers with whether each key was
+// set or an error message.
+func (g goeClient) set(ctx context.Context, key string, value interface{}) error {
+	var r map[string]interface{}
+	err := g.get(ctx, goeSetPath, url.Values{key: {fmt.Sprint(value)}}, &r)
+	if err != nil {
+		return err
+	}
+	if ok, _ := r[key].(bool); !ok {
+		return errors.New(fmt.Sprintf("go-e did not set %s: %v", key, r[key]))
+	}
+	return nil
+}
+
+func (g goeClient) getCarData(ctx context.Context, carID int64) (*carData, error) {
+	st, err := g.getStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data := carData{
+		IsCharging:  st.Car == goeCarCharging,
+		IsPluggedIn: st.Car == goeCarCharging || st.Car == goeCarWaiting || st.Car == goeCarComplete,
+		ChargeAmps:  st.Amp,
+	}
+	if len(st.Energy) >= 7 {
+		current := 0.0
+		for _, i := range st.Energy[4:7] {
+			current = math.Max(current, i)
+			if i >= 1 {
+				data.ChargerPhases++
+			}
+		}
+		data.ChargerActualCurrent = int32(math.Round(current))
+		if data.ChargerPhases > 0 {
+			data.ChargerVoltage = int32(math.Round(st.Energy[0]))
+		}
+	}
+	return &data, nil
+}
+
+func (g goeClient) startCharging(ctx context.Context, carID int64) error {
+	return g.set(ctx, "frc", goeForceOn)
+}
+
+func (g goeClient) stopCharging(ctx context.Context, carID int64) error {
+	return g.set(ctx, "frc", goeForceOff)
+}
+
+func (g goeClient) setChargingAmps(ctx context.Context, carID int64, amps int32) error {
+	return g.set(ctx, "amp", amps)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const goeCharging = `{"car": 2, "amp": 10, "frc": 2, "nrg": [231, 229, 230, 1, 9.8, 9.9, 10.1, 2264, 2267, 2323, 0, 6854, 1, 1, 1, 0]}`
+
+const goeWaiting = `{"car": 3, "amp": 16, "frc": 1, "nrg": [231, 229, 230, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]}`
+
+const goeIdle = `{"car": 1, "amp": 16, "frc": 0, "nrg": [231, 229, 230, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]}`
+
+func newGoeServer(t *testing.T, status string, set map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case goeStatusPath:
+			if r.URL.Query().Get("filter") == "" {
+				t.Errorf("Expected a filter for the status")
+			}
+			fmt.Fprint(w, status)
+		case goeSetPath:
+			for key := range r.URL.Query() {
+				set[key] = r.URL.Query().Get(key)
+				if key == "amp" && r.URL.Query().Get(key) == "40" {
+					fmt.Fprintf(w, `{"%s": "value out of range"}`, key)
+					return
+				}
+				fmt.Fprintf(w, `{"%s": true}`, key)
+			}
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func TestGoeGetCarData(t *testing.T) {
+	tests := []struct {
+		status string
+		want   carData
+	}{
+		{status: goeCharging, want: carData{IsCharging: true, IsPluggedIn: true, ChargeAmps: 10, ChargerActualCurrent: 10, ChargerVoltage: 231, ChargerPhases: 3}},
+		{status: goeWaiting, want: carData{IsPluggedIn: true, ChargeAmps: 16}},
+		{status: goeIdle, want: carData{ChargeAmps: 16}},
+	}
+
+	for _, test := range tests {
+		server := newGoeServer(t, test.status, map[string]string{})
+		c := goeClient{host: server.URL}
+		data, err := c.getCarData(context.Background(), 0)
+		server.Close()
+		if err != nil {
+			t.Fatalf("Didnt expect error reading go-e %v", err)
+		}
+		if *data != test.want {
+			t.Fatalf("Expected %+v but was %+v", test.want, *data)
+		}
+	}
+}
+
+func TestGoeCommands(t *testing.T) {
+	ctx := context.Background()
+	set := map[string]string{}
+	server := newGoeServer(t, goeWaiting, set)
+	defer server.Close()
+	c := goeClient{host: server.URL}
+
+	if err := c.startCharging(ctx, 0); err != nil || set["frc"] != "2" {
+		t.Fatalf("Expected frc 2 to start got %v, %v", set, err)
+	}
+	if err := c.stopCharging(ctx, 0); err != nil || set["frc"] != "1" {
+		t.Fatalf("Expected frc 1 to stop got %v, %v", set, err)
+	}
+	if err := c.setChargingAmps(ctx, 0, 8); err != nil || set["amp"] != "8" {
+		t.Fatalf("Expected amp 8 got %v, %v", set, err)
+	}
+	if err := c.setChargingAmps(ctx, 0, 40); err == nil {
+		t.Fatalf("Expected error for a current the charger does not accept")
+	}
+	if err := (goeClient{}).startCharging(ctx, 0); err == nil {
+		t.Fatalf("Expected error without a host")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// HomeAssistantState is an entity's state from the REST api.
+type HomeAssistantState struct {
+	EntityID   string                 `json:"entity_id"`
+	State      string                 `json:"state"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// homeAssistantClient reads power sensors from Home Assistant and publishes
+// the controller's decisions back as sensor entities.
+type homeAssistantClient struct {
+	baseURL           string
+	token             string
+	productionEntity  string
+	gridEntity        string
+	consumptionEntity string
+}
+
+func newHomeAssistantClient(s site) homeAssistantClient {
+	baseURL := strings.TrimRight(s.HomeAssistantURL, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	return homeAssistantClient{
+		baseURL:           baseURL,
+		token:             s.HomeAssistantToken,
+		productionEntity:  s.ProductionEntity,
+		gridEntity:        s.GridEntity,
+		consumptionEntity: s.ConsumptionEntity,
+	}
+}
+
+func (h homeAssistantClient) request(ctx context.Context, method string, entity string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, h.baseURL+"/api/states/"+entity, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", h.token))
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New(fmt.Sprintf("Status code %d for entity %s", resp.StatusCode, entity))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (h homeAssistantClient) state(ctx context.Context, entity string) (*HomeAssistantState, error) {
+	var st HomeAssistantState
+	err := h.request(ctx, "GET", entity, nil, &st)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// power reads a power sensor in watts, sensors in kW are converted.
+func (h homeAssistantClient) power(ctx context.Context, entity string) (float64, error) {
+	st, err := h.state(ctx, entity)
+	if err != nil {
+		return 0, err
+	}
+	power, err := strconv.ParseFloat(st.State, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Entity %s is %s", entity, st.State))
+	}
+	if unit, _ := st.Attributes["unit_of_measurement"].(string); strings.EqualFold(unit, "kW") {
+		power *= 1000
+	}
+	return power, nil
+}
+
+func (h homeAssistantClient) getCurrentPower(ctx context.Context) (float64, error) {
+	if h.productionEntity == "" {
+		return 0, errors.New("No production entity for Home Assistant site")
+	}
+	return h.power(ctx, h.productionEntity)
+}
+
+// getPowerFlow requires a grid power entity, positive when importing. Without
+// a consumption entity the consumption is derived from production and grid.
+func (h homeAssistantClient) getPowerFlow(ctx context.Context) (*powerFlow, error) {
+	if h.gridEntity == "" {
+		return nil, errors.New("No grid entity for Home Assistant site")
+	}
+	production, err := h.getCurrentPower(ctx)
+	if err != nil {
+		return nil, err
+	}
+	grid, err := h.power(ctx, h.gridEntity)
+	if err != nil {
+		return nil, err
+	}
+	flow := powerFlow{Production: production, Consumption: production + grid}
+	if h.consumptionEntity != "" {
+		flow.Consumption, err = h.power(ctx, h.consumptionEntity)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if grid > 0 {
+		flow.GridImport = grid
+	} else {
+		flow.GridExport = -grid
+	}
+	return &flow, nil
+}
+
+var entityUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// carSlug names car c in entity ids and topics.
+func carSlug(c car) string {
+	name := strings.Trim(entityUnsafe.ReplaceAllString(strings.ToLower(c.Name), "_"), "_")
+	if name == "" {
+		name = strconv.FormatInt(c.CarID, 10)
+	}
+	return name
+}
+
+// entityName is the part of the entity ids published for car c.
+func entityName(c car) string {
+	return "solarchargetesla_" + carSlug(c)
+}
+
+// chargeMode is how car c charges after decision d.
+func chargeMode(c car, d decision) string {
+	switch {
+	case d.action == actionStop:
+		return "idle"
+	case d.action == actionStart || d.action == actionAdjust:
+		if d.byGrid {
+			return "grid"
+		}
+		return "solar"
+	case c.IsChargingByGrid && c.IsCharging:
+		return "grid"
+	case c.IsChargingBySolar && c.IsCharging:
+		return "solar"
+	}
+	return "idle"
+}
+
+// targetAmps is the current car c charges with after decision d.
+func targetAmps(c car, d decision) int32 {
+	switch d.action {
+	case actionStart, actionAdjust:
+		return d.amps
+	case actionStop:
+		return 0
+	}
+	if c.IsCharging {
+		return c.ChargeAmps
+	}
+	return 0
+}
+
+// publish sets sensor.solarchargetesla_<car>_mode, with the action and the
+// reason as attributes, and sensor.solarchargetesla_<car>_amps.
+func (h homeAssistantClient) publish(ctx context.Context, c car, override string, d decision) error {
+	name := entityName(c)
+	err := h.request(ctx, "POST", "sensor."+name+"_mode", HomeAssistantState{
+		State: chargeMode(c, d),
+		Attributes: map[string]interface{}{
+			"friendly_name": fmt.Sprintf("%s charge mode", c.Name),
+			"action":        d.action.String(),
+			"reason":        d.reason,
+			"override":      override,
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return h.request(ctx, "POST", "sensor."+name+"_amps", HomeAssistantState{
+		State: strconv.Itoa(int(targetAmps(c, d))),
+		Attributes: map[string]interface{}{
+			"friendly_name":       fmt.Sprintf("%s target current", c.Name),
+			"unit_of_measurement": "A",
+		},
+	}, nil)
+}
+
+// override reads the car's override entity, typically an input_select with
+// the options auto, off, solar and grid.
+func (h homeAssistantClient) override(ctx context.Context, c car) (string, error) {
+	if c.OverrideEntity == "" {
+		return overrideAuto, nil
+	}
+	st, err := h.state(ctx, c.OverrideEntity)
+	if err != nil {
+		return overrideAuto, err
+	}
+	mode := strings.ToLower(st.State)
+	switch mode {
+	case overrideAuto, overrideOff, overrideSolar, overrideGrid:
+		return mode, nil
+	}
+	return overrideAuto, errors.New(fmt.Sprintf("Unknown override %s in %s", st.State, c.OverrideEntity))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeHomeAssistant struct {
+	mu     sync.Mutex
+	states map[string]HomeAssistantState
+}
+
+func newFakeHomeAssistant(t *testing.T, states map[string]string) (*fakeHomeAssistant, *httptest.Server) {
+	ha := &fakeHomeAssistant{states: map[string]HomeAssistantState{}}
+	for entity, body := range states {
+		var st HomeAssistantState
+		if err := json.Unmarshal([]byte(body), &st); err != nil {
+			t.Fatalf("Invalid state %v", err)
+		}
+		ha.states[entity] = st
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ha-token" {
+			w.WriteHeader(401)
+			return
+		}
+		entity := strings.TrimPrefix(r.URL.Path, "/api/states/")
+		ha.mu.Lock()
+		defer ha.mu.Unlock()
+		switch r.Method {
+		case "GET":
+			st, ok := ha.states[entity]
+			if !ok {
+				w.WriteHeader(404)
+				fmt.Fprint(w, `{"message": "Entity not found."}`)
+				return
+			}
+			json.NewEncoder(w).Encode(st)
+		case "POST":
+			var st HomeAssistantState
+			if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			st.EntityID = entity
+			ha.states[entity] = st
+			w.WriteHeader(201)
+			json.NewEncoder(w).Encode(st)
+		}
+	}))
+	return ha, ts
+}
+
+var haSensors = map[string]string{
+	"sensor.pv_power": `{
+		"entity_id": "sensor.pv_power",
+		"state": "3.412",
+		"attributes": {"unit_of_measurement": "kW", "device_class": "power", "friendly_name": "PV power"},
+		"last_changed": "2021-05-01T10:00:01.512+00:00",
+		"last_updated": "2021-05-01T10:00:01.512+00:00"
+	}`,
+	"sensor.grid_power": `{
+		"entity_id": "sensor.grid_power",
+		"state": "-2012.5",
+		"attributes": {"unit_of_measurement": "W", "device_class": "power", "friendly_name": "Grid power"},
+		"last_changed": "2021-05-01T10:00:02.101+00:00",
+		"last_updated": "2021-05-01T10:00:02.101+00:00"
+	}`,
+	"sensor.house_power": `{
+		"entity_id": "sensor.house_power",
+		"state": "1402",
+		"attributes": {"unit_of_measurement": "W", "device_class": "power", "friendly_name": "House power"},
+		"last_changed": "2021-05-01T10:00:02.101+00:00",
+		"last_updated": "2021-05-01T10:00:02.101+00:00"
+	}`,
+	"sensor.broken_power": `{
+		"entity_id": "sensor.broken_power",
+		"state": "unavailable",
+		"attributes": {"friendly_name": "Broken power"}
+	}`,
+	"input_select.tesla_charging": `{
+		"entity_id": "input_select.tesla_charging",
+		"state": "Off",
+		"attributes": {"options": ["auto", "off", "solar", "grid"]}
+	}`,
+}
+
+func TestHomeAssistantGetCurrentPower(t *testing.T) {
+	_, ts := newFakeHomeAssistant(t, haSensors)
+	defer ts.Close()
+
+	c := newHomeAssistantClient(site{HomeAssistantURL: ts.URL, HomeAssistantToken: "ha-token", ProductionEntity: "sensor.pv_power"})
+	power, err := c.getCurrentPower(context.Background())
+	if err != nil {
+		t.Fatalf("Didnt expect error fetching current power %v", err)
+	}
+	if power != 3412 {
+		t.Fatalf("Expected power 3412 but was %f", power)
+	}
+
+	c.productionEntity = "sensor.broken_power"
+	if _, err := c.getCurrentPower(context.Background()); err == nil {
+		t.Fatalf("Expected error for unavailable sensor")
+	}
+	c.productionEntity = "sensor.missing"
+	if _, err := c.getCurrentPower(context.Background()); err == nil {
+		t.Fatalf("Expected error for missing sensor")
+	}
+}
+
+func TestHomeAssistantGetPowerFlow(t *testing.T) {
+	_, ts := newFakeHomeAssistant(t, haSensors)
+	defer ts.Close()
+
+	tests := []struct {
+		s    site
+		want powerFlow
+	}{
+		{s: site{ProductionEntity: "sensor.pv_power", GridEntity: "sensor.grid_power"}, want: powerFlow{Production: 3412, Consumption: 1399.5, GridExport: 2012.5}},
+		{s: site{ProductionEntity: "sensor.pv_power", GridEntity: "sensor.grid_power", ConsumptionEntity: "sensor.house_power"}, want: powerFlow{Production: 3412, Consumption: 1402, GridExport: 2012.5}},
+		{s: site{ProductionEntity: "sensor.house_power", GridEntity: "sensor.house_power"}, want: powerFlow{Production: 1402, Consumption: 2804, GridImport: 1402}},
+	}
+
+	for _, test := range tests {
+		test.s.HomeAssistantURL = ts.URL
+		test.s.HomeAssistantToken = "ha-token"
+		flow, err := newHomeAssistantClient(test.s).getPowerFlow(context.Background())
+		if err != nil {
+			t.Fatalf("Didnt expect error fetching power flow %v", err)
+		}
+		if *flow != test.want {
+			t.Fatalf("Expected %+v but was %+v", test.want, *flow)
+		}
+	}
+
+	c := newHomeAssistantClient(site{HomeAssistantURL: ts.URL, HomeAssistantToken: "ha-token", ProductionEntity: "sensor.pv_power"})
+	if _, err := c.getPowerFlow(context.Background()); err == nil {
+		t.Fatalf("Expected error without grid entity")
+	}
+}
+
+func TestHomeAssistantPublish(t *testing.T) {
+	ha, ts := newFakeHomeAssistant(t, haSensors)
+	defer ts.Close()
+
+	h := newHomeAssistantClient(site{HomeAssistantURL: ts.URL, HomeAssistantToken: "ha-token"})
+	c := car{Name: "Model 3", CarID: 1234, IsPluggedIn: true}
+	err := h.publish(context.Background(), c, overrideAuto, decision{action: actionStart, amps: 8, reason: "solar power above start threshold"})
+	if err != nil {
+		t.Fatalf("Didnt expect error publishing %v", err)
+	}
+
+	mode := ha.states["sensor.solarchargetesla_model_3_mode"]
+	if mode.State != "solar" || mode.Attributes["action"] != "start" || mode.Attributes["reason"] != "solar power above start threshold" {
+		t.Fatalf("Unexpected mode entity %+v", mode)
+	}
+	amps := ha.states["sensor.solarchargetesla_model_3_amps"]
+	if amps.State != "8" || amps.Attributes["unit_of_measurement"] != "A" {
+		t.Fatalf("Unexpected amps entity %+v", amps)
+	}
+
+	c.IsCharging = true
+	c.IsChargingBySolar = true
+	err = h.publish(context.Background(), c, overrideOff, decision{action: actionStop, reason: "override off"})
+	if err != nil {
+		t.Fatalf("Didnt expect error publishing %v", err)
+	}
+	if mode := ha.states["sensor.solarchargetesla_model_3_mode"]; mode.State != "idle" || mode.Attributes["override"] != "off" {
+		t.Fatalf("Unexpected mode entity %+v", mode)
+	}
+	if amps := ha.states["sensor.solarchargetesla_model_3_amps"]; amps.State != "0" {
+		t.Fatalf("Unexpected amps entity %+v", amps)
+	}
+}
+
+func TestHomeAssistantOverride(t *testing.T) {
+	ha, ts := newFakeHomeAssistant(t, haSensors)
+	defer ts.Close()
+	h := newHomeAssistantClient(site{HomeAssistantURL: ts.URL, HomeAssistantToken: "ha-token"})
+	ctx := context.Background()
+
+	if mode, err := h.override(ctx, car{}); err != nil || mode != overrideAuto {
+		t.Fatalf("Want auto without override entity got %s %v", mode, err)
+	}
+	c := car{OverrideEntity: "input_select.tesla_charging"}
+	if mode, err := h.override(ctx, c); err != nil || mode != overrideOff {
+		t.Fatalf("Want off got %s %v", mode, err)
+	}
+	ha.states["input_select.tesla_charging"] = HomeAssistantState{State: "boost"}
+	if mode, err := h.override(ctx, c); err == nil || mode != overrideAuto {
+		t.Fatalf("Want auto and error for unknown override got %s %v", mode, err)
+	}
+}
+
+func TestEntityName(t *testing.T) {
+	tests := []struct {
+		c    car
+		want string
+	}{
+		{c: car{Name: "Model 3", CarID: 1}, want: "solarchargetesla_model_3"},
+		{c: car{Name: " Röd bil! ", CarID: 1}, want: "solarchargetesla_r_d_bil"},
+		{c: car{CarID: 1234}, want: "solarchargetesla_1234"},
+	}
+
+	for _, test := range tests {
+		if got := entityName(test.c); got != test.want {
+			t.Errorf("Want %s got %s", test.want, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// memoryStore keeps sites and cars in memory, for tests and for running
+// without any database.
+type memoryStore struct {
+	mu    sync.Mutex
+	sites map[string]site
+	cars  map[string]car
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{sites: map[string]site{}, cars: map[string]car{}}
+}
+
+func (ms *memoryStore) listSites(ctx context.Context) ([]site, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ids := []string{}
+	for id := range ms.sites {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	sites := []site{}
+	for _, id := range ids {
+		sites = append(sites, ms.sites[id])
+	}
+	return sites, nil
+}
+
+func (ms *memoryStore) listCars(ctx context.Context) ([]car, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ids := []string{}
+	for id := range ms.cars {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	cars := []car{}
+	for _, id := range ids {
+		cars = append(cars, ms.cars[id])
+	}
+	return cars, nil
+}
+
+func (ms *memoryStore) getSite(ctx context.Context, id string) (site, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	s, ok := ms.sites[id]
+	if !ok {
+		return s, errNotFound
+	}
+	return s, nil
+}
+
+func (ms *memoryStore) getCar(ctx context.Context, id string) (car, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	c, ok := ms.cars[id]
+	if !ok {
+		return c, errNotFound
+	}
+	return c, nil
+}
+
+func (ms *memoryStore) setSite(ctx context.Context, s site) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sites[s.documentId] = s
+	return nil
+}
+
+func (ms *memoryStore) setCar(ctx context.Context, c car) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.cars[c.documentId] = c
+	return nil
+}
+
+func (ms *memoryStore) updateSite(ctx context.Context, id string, f fields) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	s, ok := ms.sites[id]
+	if !ok {
+		return errNotFound
+	}
+	if err := setFields(&s, f); err != nil {
+		return err
+	}
+	ms.sites[id] = s
+	return nil
+}
+
+func (ms *memoryStore) updateCar(ctx context.Context, id string, f fields) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	c, ok := ms.cars[id]
+	if !ok {
+		return errNotFound
+	}
+	if err := setFields(&c, f); err != nil {
+		return err
+	}
+	ms.cars[id] = c
+	return nil
+}
+
+func (ms *memoryStore) close() error {
+	return nil
+}
@@ -0,0 +1,214 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// Broker is a small in-process broker for tests and for running without
+// one. Messages are delivered with QoS 0, retained messages are kept in
+// memory.
+type Broker struct {
+	mu       sync.Mutex
+	ln       net.Listener
+	sessions map[*session]bool
+	retained map[string][]byte
+	wg       sync.WaitGroup
+}
+
+type session struct {
+	conn    net.Conn
+	wmu     sync.Mutex
+	filters []string
+}
+
+func (s *session) write(p packet) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := s.conn.Write(p.encode())
+	return err
+}
+
+// NewBroker listens on address, such as "127.0.0.1:0", and serves until
+// closed.
+func NewBroker(address string) (*Broker, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{ln: ln, sessions: map[*session]bool{}, retained: map[string][]byte{}}
+	b.wg.Add(1)
+	go b.serve()
+	return b, nil
+}
+
+// Addr is the address the broker listens on.
+func (b *Broker) Addr() string {
+	return b.ln.Addr().String()
+}
+
+// Close stops the broker and closes its connections.
+func (b *Broker) Close() error {
+	err := b.ln.Close()
+	b.mu.Lock()
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+// Retained returns the retained message of topic.
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+func (b *Broker) serve() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		s := &session{conn: conn}
+		b.mu.Lock()
+		b.sessions[s] = true
+		b.mu.Unlock()
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.handle(s)
+			conn.Close()
+			b.mu.Lock()
+			delete(b.sessions, s)
+			b.mu.Unlock()
+		}()
+	}
+}
+
+func (b *Broker) handle(s *session) {
+	r := bufio.NewReader(s.conn)
+	p, err := readPacket(r)
+	if err != nil || p.kind != connect {
+		return
+	}
+	rd := reader{b: p.body}
+	protocol := rd.string()
+	level := rd.byte()
+	if rd.err != nil || protocol != "MQTT" || level != 4 {
+		s.write(packet{kind: connack, body: []byte{0, 1}})
+		return
+	}
+	if s.write(packet{kind: connack, body: []byte{0, 0}}) != nil {
+		return
+	}
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.kind {
+		case publish:
+			m, err := parsePublish(p)
+			if err != nil || !ValidTopic(m.topic) {
+				return
+			}
+			if m.qos == 1 {
+				s.write(packet{kind: puback, body: appendUint16(nil, m.packetID)})
+			}
+			b.route(m)
+		case subscribe:
+			b.subscribe(s, p)
+		case unsubscribe:
+			rd := reader{b: p.body}
+			id := rd.uint16()
+			for len(rd.b) > 0 && rd.err == nil {
+				b.unsubscribe(s, rd.string())
+			}
+			s.write(packet{kind: unsuback, body: appendUint16(nil, id)})
+		case pingreq:
+			s.write(packet{kind: pingresp})
+		case disconnect:
+			return
+		}
+	}
+}
+
+func (b *Broker) route(m message) {
+	b.mu.Lock()
+	if m.retain {
+		if len(m.payload) == 0 {
+			delete(b.retained, m.topic)
+		} else {
+			b.retained[m.topic] = m.payload
+		}
+	}
+	receivers := []*session{}
+	for s := range b.sessions {
+		for _, f := range s.filters {
+			if Match(f, m.topic) {
+				receivers = append(receivers, s)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	for _, s := range receivers {
+		s.write(publishPacket(m.topic, m.payload, false))
+	}
+}
+
+func (b *Broker) subscribe(s *session, p packet) {
+	rd := reader{b: p.body}
+	id := rd.uint16()
+	codes := []byte{}
+	filters := []string{}
+	for len(rd.b) > 0 {
+		filter := rd.string()
+		rd.byte()
+		if rd.err != nil {
+			return
+		}
+		if !ValidFilter(filter) {
+			codes = append(codes, 0x80)
+			continue
+		}
+		codes = append(codes, 0)
+		filters = append(filters, filter)
+	}
+	b.mu.Lock()
+	s.filters = append(s.filters, filters...)
+	retained := []message{}
+	for topic, payload := range b.retained {
+		for _, f := range filters {
+			if Match(f, topic) {
+				retained = append(retained, message{topic: topic, payload: payload})
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	s.write(packet{kind: suback, body: append(appendUint16(nil, id), codes...)})
+	for _, m := range retained {
+		s.write(publishPacket(m.topic, m.payload, true))
+	}
+}
+
+func (b *Broker) unsubscribe(s *session, filter string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	filters := []string{}
+	for _, f := range s.filters {
+		if f != filter {
+			filters = append(filters, f)
+		}
+	}
+	s.filters = filters
+}
@@ -0,0 +1,293 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPort of brokers without tls.
+const DefaultPort = "1883"
+
+// DefaultKeepAlive is used when Options has no keep alive.
+const DefaultKeepAlive = 60 * time.Second
+
+// Options of a connection to a broker.
+type Options struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+}
+
+// Handler is called with the messages of a subscription. It is called from
+// the client's reader and must not block.
+type Handler func(topic string, payload []byte)
+
+// ConnectError is the broker refusing the connection.
+type ConnectError struct {
+	Code byte
+}
+
+func (e ConnectError) Error() string {
+	return fmt.Sprintf("mqtt: connection refused with code %d", e.Code)
+}
+
+type subscription struct {
+	filter  string
+	handler Handler
+}
+
+// Client is a connection to a broker. It is safe for concurrent use.
+type Client struct {
+	conn net.Conn
+
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint16
+	subs    []subscription
+	pending map[uint16]chan []byte
+	err     error
+
+	done chan struct{}
+}
+
+// Dial connects to the broker at address, such as tcp://host:1883, tls://host
+// or just host.
+func Dial(ctx context.Context, address string, opts Options) (*Client, error) {
+	useTLS := false
+	if i := strings.Index(address, "://"); i >= 0 {
+		switch address[:i] {
+		case "tcp", "mqtt":
+		case "tls", "ssl", "mqtts":
+			useTLS = true
+		default:
+			return nil, fmt.Errorf("mqtt: unknown scheme in %s", address)
+		}
+		address = address[i+3:]
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := DefaultPort
+		if useTLS {
+			port = "8883"
+		}
+		address = net.JoinHostPort(address, port)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(address)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	c, err := handshake(ctx, conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func handshake(ctx context.Context, conn net.Conn, opts Options) (*Client, error) {
+	keepAlive := opts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = DefaultKeepAlive
+	}
+	var flags byte = 0x02
+	if opts.Username != "" {
+		flags |= 0x80
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = appendUint16(body, uint16(keepAlive/time.Second))
+	body = appendString(body, opts.ClientID)
+	if opts.Username != "" {
+		body = appendString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		body = appendString(body, opts.Password)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+	if _, err := conn.Write(packet{kind: connect, body: body}.encode()); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if p.kind != connack || len(p.body) != 2 {
+		return nil, errors.New("mqtt: expected connack")
+	}
+	if p.body[1] != 0 {
+		return nil, ConnectError{Code: p.body[1]}
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &Client{conn: conn, pending: map[uint16]chan []byte{}, done: make(chan struct{})}
+	go c.read(r, keepAlive)
+	go c.ping(keepAlive)
+	return c, nil
+}
+
+// Done is closed when the connection is lost or closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection was lost, once Done is closed.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close disconnects from the broker.
+func (c *Client) Close() error {
+	c.write(packet{kind: disconnect})
+	return c.conn.Close()
+}
+
+func (c *Client) write(p packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(p.encode())
+	return err
+}
+
+func (c *Client) read(r *bufio.Reader, keepAlive time.Duration) {
+	var err error
+	defer func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		c.conn.Close()
+		close(c.done)
+	}()
+	for {
+		// The broker answers pings within the keep alive.
+		c.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		var p packet
+		p, err = readPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.kind {
+		case publish:
+			var m message
+			m, err = parsePublish(p)
+			if err != nil {
+				return
+			}
+			if m.qos == 1 {
+				c.write(packet{kind: puback, body: appendUint16(nil, m.packetID)})
+			}
+			c.mu.Lock()
+			subs := c.subs
+			c.mu.Unlock()
+			for _, s := range subs {
+				if Match(s.filter, m.topic) {
+					s.handler(m.topic, m.payload)
+				}
+			}
+		case suback, unsuback:
+			rd := reader{b: p.body}
+			id := rd.uint16()
+			c.mu.Lock()
+			ch, ok := c.pending[id]
+			delete(c.pending, id)
+			c.mu.Unlock()
+			if ok {
+				ch <- rd.b
+			}
+		}
+	}
+}
+
+func (c *Client) ping(keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.write(packet{kind: pingreq})
+		}
+	}
+}
+
+// Subscribe subscribes to filter, h is called with each message.
+// Subscriptions are delivered with QoS 0.
+func (c *Client) Subscribe(ctx context.Context, filter string, h Handler) error {
+	if !ValidFilter(filter) {
+		return fmt.Errorf("mqtt: invalid topic filter %s", filter)
+	}
+	ch := make(chan []byte, 1)
+	c.mu.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	c.pending[id] = ch
+	// Added before subscribing as retained messages follow the suback.
+	c.subs = append(append([]subscription{}, c.subs...), subscription{filter: filter, handler: h})
+	c.mu.Unlock()
+
+	body := appendUint16(nil, id)
+	body = appendString(body, filter)
+	body = append(body, 0)
+	if err := c.write(packet{kind: subscribe, flags: 0x02, body: body}); err != nil {
+		return err
+	}
+	select {
+	case codes := <-ch:
+		if len(codes) != 1 || codes[0] == 0x80 {
+			c.mu.Lock()
+			subs := []subscription{}
+			for _, s := range c.subs {
+				if s.filter != filter {
+					subs = append(subs, s)
+				}
+			}
+			c.subs = subs
+			c.mu.Unlock()
+			return fmt.Errorf("mqtt: subscription to %s refused", filter)
+		}
+		return nil
+	case <-c.done:
+		return errors.New("mqtt: connection closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish publishes payload to topic with QoS 0.
+func (c *Client) Publish(ctx context.Context, topic string, payload []byte, retain bool) error {
+	if !ValidTopic(topic) {
+		return fmt.Errorf("mqtt: invalid topic %s", topic)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.write(publishPacket(topic, payload, retain))
+}
@@ -0,0 +1,153 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "a/b", topic: "a/b", want: true},
+		{filter: "a/b", topic: "a/c", want: false},
+		{filter: "a/+", topic: "a/b", want: true},
+		{filter: "a/+", topic: "a/b/c", want: false},
+		{filter: "a/#", topic: "a/b/c", want: true},
+		{filter: "a/#", topic: "a", want: true},
+		{filter: "+/+/power", topic: "shellies/em/power", want: true},
+		{filter: "#", topic: "$SYS/uptime", want: false},
+		{filter: "a/b/c", topic: "a/b", want: false},
+	}
+
+	for _, test := range tests {
+		if got := Match(test.filter, test.topic); got != test.want {
+			t.Errorf("Match(%s, %s) want %v got %v", test.filter, test.topic, test.want, got)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, f := range []string{"a", "a/+/b", "#", "a/#"} {
+		if !ValidFilter(f) {
+			t.Errorf("Filter %s should be valid", f)
+		}
+	}
+	for _, f := range []string{"", "a/#/b", "a+", "a/b#"} {
+		if ValidFilter(f) {
+			t.Errorf("Filter %s should be invalid", f)
+		}
+	}
+	if ValidTopic("a/+") || ValidTopic("") || !ValidTopic("a/b") {
+		t.Errorf("Unexpected topic validity")
+	}
+}
+
+func TestPacketEncoding(t *testing.T) {
+	payload := make([]byte, 20000)
+	p := publishPacket("a/b", payload, true)
+	b := p.encode()
+	if b[0] != publish<<4|1 || b[1] != 0xa5 || b[2] != 0x9c || b[3] != 0x01 {
+		t.Fatalf("Unexpected header % x", b[:4])
+	}
+}
+
+func newTestBroker(t *testing.T) *Broker {
+	b, err := NewBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start broker %v", err)
+	}
+	return b
+}
+
+func dial(t *testing.T, b *Broker, id string) *Client {
+	c, err := Dial(context.Background(), b.Addr(), Options{ClientID: id, Username: "user", Password: "pass", KeepAlive: time.Second})
+	if err != nil {
+		t.Fatalf("Failed to connect %v", err)
+	}
+	return c
+}
+
+func receive(t *testing.T, ch chan string) string {
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No message received")
+	}
+	return ""
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBroker(t)
+	defer b.Close()
+
+	pub := dial(t, b, "pub")
+	defer pub.Close()
+	if err := pub.Publish(ctx, "meter/power", []byte("1234"), true); err != nil {
+		t.Fatalf("Failed to publish %v", err)
+	}
+	// Published messages are routed in order on the connection, a
+	// subscription of the publisher itself tells when the retained message
+	// is stored.
+	sync := make(chan string, 10)
+	if err := pub.Subscribe(ctx, "sync", func(topic string, payload []byte) { sync <- topic }); err != nil {
+		t.Fatalf("Failed to subscribe %v", err)
+	}
+	pub.Publish(ctx, "sync", []byte("1"), false)
+	receive(t, sync)
+
+	sub := dial(t, b, "sub")
+	defer sub.Close()
+	received := make(chan string, 10)
+	err := sub.Subscribe(ctx, "meter/+", func(topic string, payload []byte) {
+		received <- topic + "=" + string(payload)
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe %v", err)
+	}
+	if m := receive(t, received); m != "meter/power=1234" {
+		t.Fatalf("Expected retained message got %s", m)
+	}
+
+	pub.Publish(ctx, "other/power", []byte("1"), false)
+	pub.Publish(ctx, "meter/power", []byte("1500"), false)
+	if m := receive(t, received); m != "meter/power=1500" {
+		t.Fatalf("Expected published message got %s", m)
+	}
+	if payload, ok := b.Retained("meter/power"); !ok || string(payload) != "1234" {
+		t.Fatalf("Retained message should not change by a message without retain %s", payload)
+	}
+
+	if err := sub.Subscribe(ctx, "a/#/b", func(string, []byte) {}); err == nil {
+		t.Fatalf("Expected error for invalid filter")
+	}
+	if err := pub.Publish(ctx, "a/+", nil, false); err == nil {
+		t.Fatalf("Expected error for invalid topic")
+	}
+}
+
+func TestKeepAliveAndClose(t *testing.T) {
+	b := newTestBroker(t)
+	c := dial(t, b, "c")
+	time.Sleep(1500 * time.Millisecond)
+	select {
+	case <-c.Done():
+		t.Fatalf("Connection lost despite pings %v", c.Err())
+	default:
+	}
+
+	b.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Connection not closed with broker")
+	}
+	if err := c.Subscribe(context.Background(), "a", func(string, []byte) {}); err == nil {
+		t.Fatalf("Expected error subscribing on closed connection")
+	}
+}
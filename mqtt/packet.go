@@ -0,0 +1,198 @@
+// Package mqtt is a minimal MQTT 3.1.1 client and broker. Messages are
+// published and delivered with QoS 0, which is what reading meters and
+// publishing state needs.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Packet types.
+const (
+	connect     = 1
+	connack     = 2
+	publish     = 3
+	puback      = 4
+	subscribe   = 8
+	suback      = 9
+	unsubscribe = 10
+	unsuback    = 11
+	pingreq     = 12
+	pingresp    = 13
+	disconnect  = 14
+)
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return packet{}, errors.New("mqtt: malformed remaining length")
+		}
+		d, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length |= int(d&0x7f) << shift
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: b >> 4, flags: b & 0x0f, body: body}, nil
+}
+
+func (p packet) encode() []byte {
+	b := []byte{p.kind<<4 | p.flags}
+	length := len(p.body)
+	for {
+		d := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if length == 0 {
+			break
+		}
+	}
+	return append(b, p.body...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// reader reads the fields of a packet body.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint16() uint16 {
+	if len(r.b) < 2 {
+		r.err = errors.New("mqtt: short packet")
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if len(r.b) < 1 {
+		r.err = errors.New("mqtt: short packet")
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) string() string {
+	n := int(r.uint16())
+	if len(r.b) < n {
+		r.err = errors.New("mqtt: short packet")
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// message is a received publish packet.
+type message struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retain   bool
+	packetID uint16
+}
+
+func parsePublish(p packet) (message, error) {
+	r := reader{b: p.body}
+	m := message{qos: (p.flags >> 1) & 0x03, retain: p.flags&0x01 != 0}
+	m.topic = r.string()
+	if m.qos > 0 {
+		m.packetID = r.uint16()
+	}
+	if r.err != nil {
+		return message{}, r.err
+	}
+	m.payload = r.b
+	return m, nil
+}
+
+func publishPacket(topic string, payload []byte, retain bool) packet {
+	var flags byte
+	if retain {
+		flags = 0x01
+	}
+	body := appendString(nil, topic)
+	return packet{kind: publish, flags: flags, body: append(body, payload...)}
+}
+
+// Match tells if topic matches filter, which may have the wildcards + for
+// one level and # for all remaining levels.
+func Match(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// ValidFilter tells if filter is a valid topic filter.
+func ValidFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(l, "+") && l != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidTopic tells if topic is valid to publish to.
+func ValidTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
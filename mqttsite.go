@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stelund/solarchargetesla/mqtt"
+)
+
+const (
+	defaultMQTTPrefix = "solarchargetesla"
+	// mqttWait is how long to wait for a first value of a topic.
+	mqttWait = 10 * time.Second
+	// mqttMaxAge is how old a value may be, meters publish far more often.
+	mqttMaxAge = 5 * time.Minute
+)
+
+// mqttValue is a number read from an mqtt topic. The payload is either the
+// number itself or json, in which case Path is the dot separated path of the
+// number, such as ENERGY.Power. The number is multiplied by Scale, if set,
+// to convert kW or change the sign.
+type mqttValue struct {
+	Topic string  `firestore:"topic"`
+	Path  string  `firestore:"path"`
+	Scale float64 `firestore:"scale"`
+}
+
+// parse returns the value of payload.
+func (v mqttValue) parse(payload []byte) (float64, error) {
+	var value float64
+	if v.Path == "" {
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			return 0, err
+		}
+		value = f
+	} else {
+		var doc interface{}
+		if err := json.Unmarshal(payload, &doc); err != nil {
+			return 0, err
+		}
+		for _, key := range strings.Split(v.Path, ".") {
+			m, ok := doc.(map[string]interface{})
+			if !ok {
+				return 0, errors.New(fmt.Sprintf("No %s in payload", v.Path))
+			}
+			doc = m[key]
+		}
+		switch n := doc.(type) {
+		case float64:
+			value = n
+		case string:
+			f, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, err
+			}
+			value = f
+		default:
+			return 0, errors.New(fmt.Sprintf("No number at %s in payload", v.Path))
+		}
+	}
+	if v.Scale != 0 {
+		value *= v.Scale
+	}
+	return value, nil
+}
+
+// mqttConfig is the mqtt configuration of a site.
+type mqttConfig struct {
+	broker      string
+	username    string
+	password    string
+	prefix      string
+	production  mqttValue
+	grid        mqttValue
+	consumption mqttValue
+}
+
+func siteMQTTConfig(s site) mqttConfig {
+	prefix := s.MQTTPrefix
+	if prefix == "" {
+		prefix = defaultMQTTPrefix
+	}
+	return mqttConfig{
+		broker:      s.MQTTBroker,
+		username:    s.MQTTUsername,
+		password:    s.MQTTPassword,
+		prefix:      prefix,
+		production:  s.MQTTProduction,
+		grid:        s.MQTTGrid,
+		consumption: s.MQTTConsumption,
+	}
+}
+
+type mqttReading struct {
+	value float64
+	at    time.Time
+}
+
+// mqttSite keeps the latest values of a site's topics and the overrides of
+// the cars. It connects when first used and reconnects when the connection
+// is lost.
+type mqttSite struct {
+	config mqttConfig
+
+	mu        sync.Mutex
+	client    *mqtt.Client
+	readings  map[string]mqttReading
+	overrides map[string]string
+	updated   chan struct{}
+}
+
+func newMQTTSite(config mqttConfig) *mqttSite {
+	return &mqttSite{config: config}
+}
+
+func (m *mqttSite) values() map[string]mqttValue {
+	values := map[string]mqttValue{}
+	if m.config.production.Topic != "" {
+		values["production"] = m.config.production
+	}
+	if m.config.grid.Topic != "" {
+		values["grid"] = m.config.grid
+	}
+	if m.config.consumption.Topic != "" {
+		values["consumption"] = m.config.consumption
+	}
+	return values
+}
+
+// connect connects to the broker unless connected, subscribes to the
+// topics and waits for their retained messages.
+func (m *mqttSite) connect(ctx context.Context) error {
+	m.mu.Lock()
+	client := m.client
+	m.mu.Unlock()
+	if client != nil {
+		select {
+		case <-client.Done():
+		default:
+			return nil
+		}
+	}
+	if m.config.broker == "" {
+		return errors.New("No mqtt broker for site")
+	}
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	clientID := "solarchargetesla-" + hex.EncodeToString(id)
+	client, err := mqtt.Dial(ctx, m.config.broker, mqtt.Options{
+		ClientID: clientID,
+		Username: m.config.username,
+		Password: m.config.password,
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.client = client
+	m.readings = map[string]mqttReading{}
+	m.overrides = map[string]string{}
+	m.updated = make(chan struct{})
+	m.mu.Unlock()
+
+	topics := map[string]bool{}
+	for _, v := range m.values() {
+		topics[v.Topic] = true
+	}
+	for topic := range topics {
+		if err := client.Subscribe(ctx, topic, m.handleValue); err != nil {
+			client.Close()
+			return err
+		}
+	}
+	if err := client.Subscribe(ctx, m.config.prefix+"/+/override", m.handleOverride); err != nil {
+		client.Close()
+		return err
+	}
+	// Brokers send retained messages in order, once the message to the
+	// sync topic is back those of the subscriptions have been received.
+	synced := make(chan struct{}, 1)
+	syncTopic := m.config.prefix + "/sync/" + clientID
+	err = client.Subscribe(ctx, syncTopic, func(string, []byte) {
+		select {
+		case synced <- struct{}{}:
+		default:
+		}
+	})
+	if err == nil {
+		err = client.Publish(ctx, syncTopic, []byte("1"), false)
+	}
+	if err != nil {
+		client.Close()
+		return err
+	}
+	select {
+	case <-synced:
+	case <-ctx.Done():
+		client.Close()
+		return ctx.Err()
+	case <-time.After(mqttWait):
+	}
+	return nil
+}
+
+func (m *mqttSite) handleValue(topic string, payload []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, v := range m.values() {
+		if v.Topic != topic {
+			continue
+		}
+		value, err := v.parse(payload)
+		if err != nil {
+			fmt.Printf("Failed to parse %s from %s: %v\n", name, topic, err)
+			continue
+		}
+		m.readings[name] = mqttReading{value: value, at: time.Now()}
+	}
+	close(m.updated)
+	m.updated = make(chan struct{})
+}
+
+func (m *mqttSite) handleOverride(topic string, payload []byte) {
+	levels := strings.Split(topic, "/")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides[levels[len(levels)-2]] = strings.ToLower(strings.TrimSpace(string(payload)))
+}
+
+// value returns the latest value of name, waiting for one if there is
+// none yet.
+func (m *mqttSite) value(ctx context.Context, name string) (float64, error) {
+	if err := m.connect(ctx); err != nil {
+		return 0, err
+	}
+	timeout := time.NewTimer(mqttWait)
+	defer timeout.Stop()
+	for {
+		m.mu.Lock()
+		r, ok := m.readings[name]
+		updated := m.updated
+		m.mu.Unlock()
+		if ok && time.Since(r.at) <= mqttMaxAge {
+			return r.value, nil
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-timeout.C:
+			if ok {
+				return 0, errors.New(fmt.Sprintf("Stale %s value", name))
+			}
+			return 0, errors.New(fmt.Sprintf("No %s value received", name))
+		}
+	}
+}
+
+func (m *mqttSite) getCurrentPower(ctx context.Context) (float64, error) {
+	if m.config.production.Topic == "" {
+		return 0, errors.New("No production topic for site")
+	}
+	return m.value(ctx, "production")
+}
+
+// getPowerFlow requires a grid topic, positive when importing. Without a
+// consumption topic the consumption is derived from production and grid.
+func (m *mqttSite) getPowerFlow(ctx context.Context) (*powerFlow, error) {
+	if m.config.grid.Topic == "" {
+		return nil, errors.New("No grid topic for site")
+	}
+	production, err := m.getCurrentPower(ctx)
+	if err != nil {
+		return nil, err
+	}
+	grid, err := m.value(ctx, "grid")
+	if err != nil {
+		return nil, err
+	}
+	flow := powerFlow{Production: production, Consumption: production + grid}
+	if m.config.consumption.Topic != "" {
+		flow.Consumption, err = m.value(ctx, "consumption")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if grid > 0 {
+		flow.GridImport = grid
+	} else {
+		flow.GridExport = -grid
+	}
+	return &flow, nil
+}
+
+type mqttCarState struct {
+	Name              string  `json:"name"`
+	BatteryLevel      int32   `json:"batteryLevel"`
+	ChargeLimit       int32   `json:"chargeLimit"`
+	IsPluggedIn       bool    `json:"isPluggedIn"`
+	IsCharging        bool    `json:"isCharging"`
+	IsChargingBySolar bool    `json:"isChargingBySolar"`
+	IsChargingByGrid  bool    `json:"isChargingByGrid"`
+	ChargeAmps        int32   `json:"chargeAmps"`
+	ChargingPower     float64 `json:"chargingPower"`
+	LastUpdated       string  `json:"lastUpdated"`
+}
+
+type mqttDecision struct {
+	Mode     string `json:"mode"`
+	Action   string `json:"action"`
+	Amps     int32  `json:"amps"`
+	Reason   string `json:"reason"`
+	Override string `json:"override"`
+}
+
+// publish publishes the state of car c to <prefix>/<car>/state and the
+// decision to <prefix>/<car>/decision, both retained.
+func (m *mqttSite) publish(ctx context.Context, c car, override string, d decision) error {
+	if err := m.connect(ctx); err != nil {
+		return err
+	}
+	state, err := json.Marshal(mqttCarState{
+		Name:              c.Name,
+		BatteryLevel:      c.BatteryLevel,
+		ChargeLimit:       c.ChargeLimit,
+		IsPluggedIn:       c.IsPluggedIn,
+		IsCharging:        c.IsCharging,
+		IsChargingBySolar: c.IsChargingBySolar,
+		IsChargingByGrid:  c.IsChargingByGrid,
+		ChargeAmps:        c.ChargeAmps,
+		ChargingPower:     c.chargingPower(),
+		LastUpdated:       c.LastUpdated.Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	dec, err := json.Marshal(mqttDecision{
+		Mode:     chargeMode(c, d),
+		Action:   d.action.String(),
+		Amps:     targetAmps(c, d),
+		Reason:   d.reason,
+		Override: override,
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	client := m.client
+	m.mu.Unlock()
+	topic := m.config.prefix + "/" + carSlug(c)
+	if err := client.Publish(ctx, topic+"/state", state, true); err != nil {
+		return err
+	}
+	return client.Publish(ctx, topic+"/decision", dec, true)
+}
+
+// override is the retained payload of <prefix>/<car>/override, auto, off,
+// solar or grid.
+func (m *mqttSite) override(ctx context.Context, c car) (string, error) {
+	if err := m.connect(ctx); err != nil {
+		return overrideAuto, err
+	}
+	m.mu.Lock()
+	mode, ok := m.overrides[carSlug(c)]
+	m.mu.Unlock()
+	if !ok || mode == "" {
+		return overrideAuto, nil
+	}
+	switch mode {
+	case overrideAuto, overrideOff, overrideSolar, overrideGrid:
+		return mode, nil
+	}
+	return overrideAuto, errors.New(fmt.Sprintf("Unknown override %s for car %s", mode, c.Name))
+}
+
+func (m *mqttSite) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		return nil
+	}
+	return m.client.Close()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stelund/solarchargetesla/mqtt"
+)
+
+func TestMQTTValueParse(t *testing.T) {
+	tests := []struct {
+		v       mqttValue
+		payload string
+		want    float64
+	}{
+		{v: mqttValue{}, payload: " 1234.5\n", want: 1234.5},
+		{v: mqttValue{Scale: -1}, payload: "-800", want: 800},
+		{v: mqttValue{Scale: 1000}, payload: "0.5", want: 500},
+		{v: mqttValue{Path: "ENERGY.Power"}, payload: `{"Time": "2021-05-01T12:00:00", "ENERGY": {"Total": 1234.5, "Power": 321}}`, want: 321},
+		{v: mqttValue{Path: "power"}, payload: `{"power": "42.5"}`, want: 42.5},
+	}
+
+	for _, test := range tests {
+		got, err := test.v.parse([]byte(test.payload))
+		if err != nil {
+			t.Fatalf("Didnt expect error parsing %s: %v", test.payload, err)
+		}
+		if got != test.want {
+			t.Errorf("Want %f got %f for %s", test.want, got, test.payload)
+		}
+	}
+
+	for _, payload := range []string{"", "unavailable", `{"ENERGY": {}}`, `{"ENERGY": 3}`} {
+		if _, err := (mqttValue{Path: "ENERGY.Power"}).parse([]byte(payload)); err == nil {
+			t.Errorf("Expected error parsing %s", payload)
+		}
+	}
+}
+
+func newTestBroker(t *testing.T) (*mqtt.Broker, *mqtt.Client) {
+	b, err := mqtt.NewBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start broker %v", err)
+	}
+	c, err := mqtt.Dial(context.Background(), b.Addr(), mqtt.Options{ClientID: "meter"})
+	if err != nil {
+		t.Fatalf("Failed to connect %v", err)
+	}
+	return b, c
+}
+
+func TestMQTTSitePowerFlow(t *testing.T) {
+	ctx := context.Background()
+	b, meter := newTestBroker(t)
+	defer b.Close()
+	defer meter.Close()
+	meter.Publish(ctx, "tele/inverter/SENSOR", []byte(`{"ENERGY": {"Power": 3412}}`), true)
+	meter.Publish(ctx, "shellies/em/emeter/0/power", []byte("-2012.5"), true)
+
+	m := newMQTTSite(siteMQTTConfig(site{
+		MQTTBroker:     b.Addr(),
+		MQTTProduction: mqttValue{Topic: "tele/inverter/SENSOR", Path: "ENERGY.Power"},
+		MQTTGrid:       mqttValue{Topic: "shellies/em/emeter/0/power"},
+	}))
+	defer m.close()
+
+	power, err := m.getCurrentPower(ctx)
+	if err != nil {
+		t.Fatalf("Didnt expect error fetching current power %v", err)
+	}
+	if power != 3412 {
+		t.Fatalf("Expected power 3412 but was %f", power)
+	}
+	flow, err := m.getPowerFlow(ctx)
+	if err != nil {
+		t.Fatalf("Didnt expect error fetching power flow %v", err)
+	}
+	if *flow != (powerFlow{Production: 3412, Consumption: 1399.5, GridExport: 2012.5}) {
+		t.Fatalf("Unexpected power flow %+v", *flow)
+	}
+
+	meter.Publish(ctx, "shellies/em/emeter/0/power", []byte("500"), false)
+	deadline := time.Now().Add(5 * time.Second)
+	for flow.GridImport != 500 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		flow, err = m.getPowerFlow(ctx)
+		if err != nil {
+			t.Fatalf("Didnt expect error fetching power flow %v", err)
+		}
+	}
+	if *flow != (powerFlow{Production: 3412, Consumption: 3912, GridImport: 500}) {
+		t.Fatalf("Unexpected power flow %+v", *flow)
+	}
+
+	noGrid := newMQTTSite(siteMQTTConfig(site{MQTTBroker: b.Addr(), MQTTProduction: mqttValue{Topic: "tele/inverter/SENSOR"}}))
+	defer noGrid.close()
+	if _, err := noGrid.getPowerFlow(ctx); err == nil {
+		t.Fatalf("Expected error without grid topic")
+	}
+}
+
+func TestMQTTSiteWaitsForValue(t *testing.T) {
+	ctx := context.Background()
+	b, meter := newTestBroker(t)
+	defer b.Close()
+	defer meter.Close()
+
+	m := newMQTTSite(siteMQTTConfig(site{MQTTBroker: b.Addr(), MQTTProduction: mqttValue{Topic: "inverter/power"}}))
+	defer m.close()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		meter.Publish(ctx, "inverter/power", []byte("1500"), false)
+	}()
+	power, err := m.getCurrentPower(ctx)
+	if err != nil {
+		t.Fatalf("Didnt expect error waiting for power %v", err)
+	}
+	if power != 1500 {
+		t.Fatalf("Expected power 1500 but was %f", power)
+	}
+
+	cancelled, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	other := newMQTTSite(siteMQTTConfig(site{MQTTBroker: b.Addr(), MQTTProduction: mqttValue{Topic: "other/power"}}))
+	defer other.close()
+	if _, err := other.getCurrentPower(cancelled); err == nil {
+		t.Fatalf("Expected error when no value arrives")
+	}
+}
+
+func TestMQTTSitePublishAndOverride(t *testing.T) {
+	ctx := context.Background()
+	b, user := newTestBroker(t)
+	defer b.Close()
+	defer user.Close()
+	user.Publish(ctx, "home/ev/model_3/override", []byte("grid"), true)
+
+	m := newMQTTSite(siteMQTTConfig(site{MQTTBroker: b.Addr(), MQTTPrefix: "home/ev"}))
+	defer m.close()
+	c := car{Name: "Model 3", BatteryLevel: 40, ChargeLimit: 80, IsPluggedIn: true}
+	mode, err := m.override(ctx, c)
+	if err != nil || mode != overrideGrid {
+		t.Fatalf("Want grid override got %s %v", mode, err)
+	}
+	if mode, err := m.override(ctx, car{Name: "Other"}); err != nil || mode != overrideAuto {
+		t.Fatalf("Want auto without override got %s %v", mode, err)
+	}
+
+	err = m.publish(ctx, c, mode, decision{action: actionStart, amps: 16, byGrid: true, reason: "override grid"})
+	if err != nil {
+		t.Fatalf("Didnt expect error publishing %v", err)
+	}
+	// The publisher's own connection is used to know the messages arrived.
+	m.client.Subscribe(ctx, "home/ev/model_3/decision", func(string, []byte) {})
+
+	payload, ok := b.Retained("home/ev/model_3/decision")
+	if !ok {
+		t.Fatalf("Decision not retained")
+	}
+	var d mqttDecision
+	if err := json.Unmarshal(payload, &d); err != nil {
+		t.Fatalf("Invalid decision %s", payload)
+	}
+	if d != (mqttDecision{Mode: "grid", Action: "start", Amps: 16, Reason: "override grid", Override: "grid"}) {
+		t.Fatalf("Unexpected decision %+v", d)
+	}
+	payload, ok = b.Retained("home/ev/model_3/state")
+	if !ok {
+		t.Fatalf("State not retained")
+	}
+	var st mqttCarState
+	if err := json.Unmarshal(payload, &st); err != nil || st.BatteryLevel != 40 || !st.IsPluggedIn {
+		t.Fatalf("Unexpected state %s", payload)
+	}
+
+	user.Publish(ctx, "home/ev/model_3/override", []byte("turbo"), true)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err = m.override(ctx, c); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err == nil {
+		t.Fatalf("Expected error for unknown override")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+
+	"github.com/stelund/solarchargetesla/ocpp"
+)
+
+// defaultIdTag starts transactions for cars without an id tag of their own.
+const defaultIdTag = "solarchargetesla"
+
+// ocppClient controls a car through the connector of a wall charger that is
+// connected to the central system. The car's battery level and position are
+// not known to the charger, the ones stored for the car are kept.
+type ocppClient struct {
+	cs        *ocpp.CentralSystem
+	id        string
+	connector int
+	idTag     string
+	c         car
+}
+
+func newOCPPClient(cs *ocpp.CentralSystem, c car) ocppClient {
+	client := ocppClient{cs: cs, id: c.ChargePointId, connector: c.ConnectorId, idTag: c.IdTag, c: c}
+	if client.connector <= 0 {
+		client.connector = 1
+	}
+	if client.idTag == "" {
+		client.idTag = defaultIdTag
+	}
+	return client
+}
+
+func (o ocppClient) chargePoint() (*ocpp.ChargePoint, error) {
+	if o.id == "" {
+		return nil, errors.New("No charge point id for OCPP car")
+	}
+	cp, ok := o.cs.ChargePoint(o.id)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Charge point %s is not connected", o.id))
+	}
+	return cp, nil
+}
+
+func (o ocppClient) getCarData(ctx context.Context, carID int64) (*carData, error) {
+	cp, err := o.chargePoint()
+	if err != nil {
+		return nil, err
+	}
+	con := cp.Connector(o.connector)
+	data := carData{
+		BatteryLevel: o.c.BatteryLevel,
+		Longitude:    o.c.Longitude,
+		Latitude:     o.c.Latitude,
+		ChargeLimit:  o.c.ChargeLimit,
+		IsCharging:   con.Status == ocpp.Charging,
+		IsPluggedIn:  con.PluggedIn(),
+		ChargeAmps:   int32(con.Limit),
+	}
+	if data.ChargeLimit == 0 {
+		data.ChargeLimit = 100
+	}
+	current := 0.0
+	for _, i := range con.Current {
+		current = math.Max(current, i)
+		// Phases drawing less than an ampere are not in use.
+		if i >= 1 {
+			data.ChargerPhases++
+		}
+	}
+	data.ChargerActualCurrent = int32(math.Round(current))
+	if data.ChargerPhases > 0 {
+		data.ChargerVoltage = int32(math.Round(con.Voltage))
+	}
+	return &data, nil
+}
+
+// startCharging starts a transaction unless one is running already, the
+// car may have paused it when full.
+func (o ocppClient) startCharging(ctx context.Context, carID int64) error {
+	cp, err := o.chargePoint()
+	if err != nil {
+		return err
+	}
+	if cp.Connector(o.connector).TransactionID != 0 {
+		return nil
+	}
+	return cp.RemoteStart(ctx, o.connector, o.idTag)
+}
+
+func (o ocppClient) stopCharging(ctx context.Context, carID int64) error {
+	cp, err := o.chargePoint()
+	if err != nil {
+		return err
+	}
+	return cp.RemoteStop(ctx, o.connector)
+}
+
+func (o ocppClient) setChargingAmps(ctx context.Context, carID int64, amps int32) error {
+	cp, err := o.chargePoint()
+	if err != nil {
+		return err
+	}
+	return cp.SetCurrentLimit(ctx, o.connector, float64(amps))
+}
+
+// serveOCPP starts the central system that the chargers of OCPP cars connect
+// to on addr.
+func serveOCPP(addr string) (*ocpp.CentralSystem, *http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	cs := ocpp.NewCentralSystem()
+	srv := &http.Server{Handler: cs}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Printf("OCPP central system failed: %v", err)
+		}
+	}()
+	return cs, srv, nil
+}
@@ -0,0 +1,382 @@
+package ocpp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// CentralSystem accepts charge points connecting to a url ending in their
+// id, such as ws://host:8887/ocpp/CP1, and tracks the state of their
+// connectors. Any id tag is accepted.
+type CentralSystem struct {
+	// HeartbeatInterval in seconds is sent to charge points at boot.
+	HeartbeatInterval int
+
+	mu     sync.Mutex
+	points map[string]*ChargePoint
+	nextTx int
+}
+
+func NewCentralSystem() *CentralSystem {
+	return &CentralSystem{HeartbeatInterval: 300, points: map[string]*ChargePoint{}}
+}
+
+// ChargePoint returns the connected charge point with id.
+func (cs *CentralSystem) ChargePoint(id string) (*ChargePoint, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cp, ok := cs.points[id]
+	return cp, ok
+}
+
+// ChargePoints returns the ids of the connected charge points.
+func (cs *CentralSystem) ChargePoints() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	ids := []string{}
+	for id := range cs.points {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (cs *CentralSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := path.Base(r.URL.Path)
+	if id == "/" || id == "." {
+		http.NotFound(w, r)
+		return
+	}
+	s := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			for _, p := range config.Protocol {
+				if p == Subprotocol {
+					config.Protocol = []string{Subprotocol}
+					return nil
+				}
+			}
+			return fmt.Errorf("unsupported subprotocols %v", config.Protocol)
+		},
+		Handler: func(ws *websocket.Conn) {
+			cs.serve(id, ws)
+		},
+	}
+	s.ServeHTTP(w, r)
+}
+
+// serve runs the connection of a charge point, which replaces an earlier
+// connection with the same id.
+func (cs *CentralSystem) serve(id string, ws *websocket.Conn) {
+	cp := &ChargePoint{ID: id, cs: cs, connectors: map[int]*Connector{}}
+	cp.e = newEndpoint(ws, cp.handle)
+
+	cs.mu.Lock()
+	old := cs.points[id]
+	cs.points[id] = cp
+	cs.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	cp.e.run()
+
+	cs.mu.Lock()
+	if cs.points[id] == cp {
+		delete(cs.points, id)
+	}
+	cs.mu.Unlock()
+}
+
+func (cs *CentralSystem) transactionID() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.nextTx++
+	return cs.nextTx
+}
+
+// Connector is the state of a connector as last reported by its charge
+// point. Power is in W, energy in Wh, current in A and voltage in V.
+type Connector struct {
+	Status        string
+	ErrorCode     string
+	TransactionID int
+	Power         float64
+	Energy        float64
+	Current       [3]float64
+	Voltage       float64
+	// Limit is the current limit set by the central system, zero if none.
+	Limit   float64
+	Updated time.Time
+}
+
+// PluggedIn tells if a vehicle is connected.
+func (c Connector) PluggedIn() bool {
+	switch c.Status {
+	case Preparing, Charging, SuspendedEV, SuspendedEVSE, Finishing:
+		return true
+	}
+	return false
+}
+
+// ChargePoint is a connected charge point.
+type ChargePoint struct {
+	ID string
+
+	cs *CentralSystem
+	e  *endpoint
+
+	mu         sync.Mutex
+	info       BootNotificationRequest
+	connectors map[int]*Connector
+}
+
+// Info returns what the charge point sent at boot.
+func (cp *ChargePoint) Info() BootNotificationRequest {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.info
+}
+
+// Connector returns the state of connector id, connector 0 is the charge
+// point as a whole.
+func (cp *ChargePoint) Connector(id int) Connector {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if c, ok := cp.connectors[id]; ok {
+		return *c
+	}
+	return Connector{}
+}
+
+// Done is closed when the charge point disconnects.
+func (cp *ChargePoint) Done() <-chan struct{} {
+	return cp.e.done
+}
+
+func (cp *ChargePoint) Close() error {
+	return cp.e.close()
+}
+
+// RemoteStart asks the charge point to start a transaction on connector
+// with idTag.
+func (cp *ChargePoint) RemoteStart(ctx context.Context, connector int, idTag string) error {
+	var conf StatusConfirmation
+	req := RemoteStartTransactionRequest{ConnectorID: connector, IdTag: idTag}
+	if err := cp.e.call(ctx, RemoteStartTransaction, req, &conf); err != nil {
+		return err
+	}
+	if conf.Status != Accepted {
+		return fmt.Errorf("remote start on connector %d %s", connector, strings.ToLower(conf.Status))
+	}
+	return nil
+}
+
+// RemoteStop asks the charge point to stop the transaction on connector.
+func (cp *ChargePoint) RemoteStop(ctx context.Context, connector int) error {
+	tx := cp.Connector(connector).TransactionID
+	if tx == 0 {
+		return fmt.Errorf("no transaction on connector %d", connector)
+	}
+	var conf StatusConfirmation
+	if err := cp.e.call(ctx, RemoteStopTransaction, RemoteStopTransactionRequest{TransactionID: tx}, &conf); err != nil {
+		return err
+	}
+	if conf.Status != Accepted {
+		return fmt.Errorf("remote stop of transaction %d %s", tx, strings.ToLower(conf.Status))
+	}
+	return nil
+}
+
+// SetCurrentLimit limits the current of connector to amps on each phase. The
+// limit applies to the running transaction, or to the next ones if there is
+// none.
+func (cp *ChargePoint) SetCurrentLimit(ctx context.Context, connector int, amps float64) error {
+	profile := ChargingProfile{
+		ChargingProfileID:      1,
+		ChargingProfilePurpose: "TxDefaultProfile",
+		ChargingProfileKind:    "Relative",
+		ChargingSchedule: ChargingSchedule{
+			ChargingRateUnit:       "A",
+			ChargingSchedulePeriod: []ChargingSchedulePeriod{{StartPeriod: 0, Limit: amps}},
+		},
+	}
+	if tx := cp.Connector(connector).TransactionID; tx != 0 {
+		profile.ChargingProfileID = 2
+		profile.ChargingProfilePurpose = "TxProfile"
+		profile.TransactionID = tx
+	}
+	var conf StatusConfirmation
+	req := SetChargingProfileRequest{ConnectorID: connector, CsChargingProfiles: profile}
+	if err := cp.e.call(ctx, SetChargingProfile, req, &conf); err != nil {
+		return err
+	}
+	if conf.Status != Accepted {
+		return fmt.Errorf("charging profile for connector %d %s", connector, strings.ToLower(conf.Status))
+	}
+	cp.mu.Lock()
+	cp.connector(connector).Limit = amps
+	cp.mu.Unlock()
+	return nil
+}
+
+// connector returns connector id, creating it if needed. cp.mu must be held.
+func (cp *ChargePoint) connector(id int) *Connector {
+	c, ok := cp.connectors[id]
+	if !ok {
+		c = &Connector{}
+		cp.connectors[id] = c
+	}
+	return c
+}
+
+func (cp *ChargePoint) handle(action string, payload json.RawMessage) (interface{}, error) {
+	now := time.Now().UTC()
+	switch action {
+	case BootNotification:
+		var req BootNotificationRequest
+		if err := decodePayload(payload, &req); err != nil {
+			return nil, err
+		}
+		cp.mu.Lock()
+		cp.info = req
+		cp.mu.Unlock()
+		return BootNotificationConfirmation{CurrentTime: now, Interval: cp.cs.HeartbeatInterval, Status: Accepted}, nil
+	case Heartbeat:
+		return HeartbeatConfirmation{CurrentTime: now}, nil
+	case Authorize:
+		return AuthorizeConfirmation{IdTagInfo: IdTagInfo{Status: Accepted}}, nil
+	case StatusNotification:
+		var req StatusNotificationRequest
+		if err := decodePayload(payload, &req); err != nil {
+			return nil, err
+		}
+		cp.mu.Lock()
+		c := cp.connector(req.ConnectorID)
+		c.Status = req.Status
+		c.ErrorCode = req.ErrorCode
+		c.Updated = now
+		cp.mu.Unlock()
+		return StatusNotificationConfirmation{}, nil
+	case MeterValues:
+		var req MeterValuesRequest
+		if err := decodePayload(payload, &req); err != nil {
+			return nil, err
+		}
+		cp.mu.Lock()
+		c := cp.connector(req.ConnectorID)
+		if req.TransactionID != nil && c.TransactionID == 0 {
+			c.TransactionID = *req.TransactionID
+		}
+		for _, mv := range req.MeterValue {
+			c.sample(mv.SampledValue)
+		}
+		c.Updated = now
+		cp.mu.Unlock()
+		return MeterValuesConfirmation{}, nil
+	case StartTransaction:
+		var req StartTransactionRequest
+		if err := decodePayload(payload, &req); err != nil {
+			return nil, err
+		}
+		tx := cp.cs.transactionID()
+		cp.mu.Lock()
+		c := cp.connector(req.ConnectorID)
+		c.TransactionID = tx
+		c.Energy = float64(req.MeterStart)
+		c.Updated = now
+		cp.mu.Unlock()
+		return StartTransactionConfirmation{IdTagInfo: IdTagInfo{Status: Accepted}, TransactionID: tx}, nil
+	case StopTransaction:
+		var req StopTransactionRequest
+		if err := decodePayload(payload, &req); err != nil {
+			return nil, err
+		}
+		cp.mu.Lock()
+		for _, c := range cp.connectors {
+			if c.TransactionID == req.TransactionID {
+				c.TransactionID = 0
+				c.Energy = float64(req.MeterStop)
+				c.Power = 0
+				c.Current = [3]float64{}
+				c.Updated = now
+			}
+		}
+		cp.mu.Unlock()
+		return StopTransactionConfirmation{IdTagInfo: &IdTagInfo{Status: Accepted}}, nil
+	}
+	return nil, &CallError{Code: NotImplemented, Description: fmt.Sprintf("%s is not implemented", action)}
+}
+
+func decodePayload(payload json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(payload, v); err != nil {
+		return &CallError{Code: FormationViolation, Description: err.Error()}
+	}
+	return nil
+}
+
+// sample updates the connector with the sampled values it tracks. Values in
+// kW and kWh are converted, power of single phases is summed when there is
+// no total.
+func (c *Connector) sample(values []SampledValue) {
+	power := 0.0
+	phasePower := 0.0
+	hasPower := false
+	for _, v := range values {
+		value, err := strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(v.Unit, "k") {
+			value *= 1000
+		}
+		switch v.Measurand {
+		case "", EnergyActiveImport:
+			if v.Phase == "" {
+				c.Energy = value
+			}
+		case PowerActiveImport:
+			hasPower = true
+			if v.Phase == "" {
+				power = value
+			} else {
+				phasePower += value
+			}
+		case CurrentImport:
+			if i := phaseIndex(v.Phase); i >= 0 {
+				c.Current[i] = value
+			}
+		case Voltage:
+			if i := phaseIndex(v.Phase); i >= 0 && (i == 0 || c.Voltage == 0) {
+				c.Voltage = value
+			}
+		}
+	}
+	if hasPower {
+		if power == 0 {
+			power = phasePower
+		}
+		c.Power = power
+	}
+}
+
+// phaseIndex returns the index of phase, such as L2 or L2-N, values without a
+// phase are taken as L1. Phase to phase values are -1.
+func phaseIndex(phase string) int {
+	switch phase {
+	case "", "L1", "L1-N":
+		return 0
+	case "L2", "L2-N":
+		return 1
+	case "L3", "L3-N":
+		return 2
+	}
+	return -1
+}
@@ -0,0 +1,170 @@
+package ocpp
+
+import "time"
+
+// Actions used by the central system and the simulator.
+const (
+	Authorize              = "Authorize"
+	BootNotification       = "BootNotification"
+	Heartbeat              = "Heartbeat"
+	MeterValues            = "MeterValues"
+	StartTransaction       = "StartTransaction"
+	StatusNotification     = "StatusNotification"
+	StopTransaction        = "StopTransaction"
+	RemoteStartTransaction = "RemoteStartTransaction"
+	RemoteStopTransaction  = "RemoteStopTransaction"
+	SetChargingProfile     = "SetChargingProfile"
+)
+
+// Statuses of a connector.
+const (
+	Available     = "Available"
+	Preparing     = "Preparing"
+	Charging      = "Charging"
+	SuspendedEV   = "SuspendedEV"
+	SuspendedEVSE = "SuspendedEVSE"
+	Finishing     = "Finishing"
+	Reserved      = "Reserved"
+	Unavailable   = "Unavailable"
+	Faulted       = "Faulted"
+)
+
+// Statuses of requests and id tags.
+const (
+	Accepted = "Accepted"
+	Rejected = "Rejected"
+)
+
+// Measurands of the sampled values that are tracked.
+const (
+	PowerActiveImport  = "Power.Active.Import"
+	CurrentImport      = "Current.Import"
+	EnergyActiveImport = "Energy.Active.Import.Register"
+	Voltage            = "Voltage"
+)
+
+type BootNotificationRequest struct {
+	ChargePointVendor       string `json:"chargePointVendor"`
+	ChargePointModel        string `json:"chargePointModel"`
+	ChargePointSerialNumber string `json:"chargePointSerialNumber,omitempty"`
+	FirmwareVersion         string `json:"firmwareVersion,omitempty"`
+}
+
+type BootNotificationConfirmation struct {
+	CurrentTime time.Time `json:"currentTime"`
+	Interval    int       `json:"interval"`
+	Status      string    `json:"status"`
+}
+
+type HeartbeatRequest struct{}
+
+type HeartbeatConfirmation struct {
+	CurrentTime time.Time `json:"currentTime"`
+}
+
+type StatusNotificationRequest struct {
+	ConnectorID int        `json:"connectorId"`
+	ErrorCode   string     `json:"errorCode"`
+	Status      string     `json:"status"`
+	Timestamp   *time.Time `json:"timestamp,omitempty"`
+}
+
+type StatusNotificationConfirmation struct{}
+
+type SampledValue struct {
+	Value     string `json:"value"`
+	Context   string `json:"context,omitempty"`
+	Measurand string `json:"measurand,omitempty"`
+	Phase     string `json:"phase,omitempty"`
+	Unit      string `json:"unit,omitempty"`
+}
+
+type MeterValue struct {
+	Timestamp    time.Time      `json:"timestamp"`
+	SampledValue []SampledValue `json:"sampledValue"`
+}
+
+type MeterValuesRequest struct {
+	ConnectorID   int          `json:"connectorId"`
+	TransactionID *int         `json:"transactionId,omitempty"`
+	MeterValue    []MeterValue `json:"meterValue"`
+}
+
+type MeterValuesConfirmation struct{}
+
+type IdTagInfo struct {
+	Status string `json:"status"`
+}
+
+type AuthorizeRequest struct {
+	IdTag string `json:"idTag"`
+}
+
+type AuthorizeConfirmation struct {
+	IdTagInfo IdTagInfo `json:"idTagInfo"`
+}
+
+type StartTransactionRequest struct {
+	ConnectorID int       `json:"connectorId"`
+	IdTag       string    `json:"idTag"`
+	MeterStart  int       `json:"meterStart"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+type StartTransactionConfirmation struct {
+	IdTagInfo     IdTagInfo `json:"idTagInfo"`
+	TransactionID int       `json:"transactionId"`
+}
+
+type StopTransactionRequest struct {
+	TransactionID int       `json:"transactionId"`
+	MeterStop     int       `json:"meterStop"`
+	Timestamp     time.Time `json:"timestamp"`
+	IdTag         string    `json:"idTag,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+}
+
+type StopTransactionConfirmation struct {
+	IdTagInfo *IdTagInfo `json:"idTagInfo,omitempty"`
+}
+
+type ChargingSchedulePeriod struct {
+	StartPeriod  int     `json:"startPeriod"`
+	Limit        float64 `json:"limit"`
+	NumberPhases int     `json:"numberPhases,omitempty"`
+}
+
+type ChargingSchedule struct {
+	ChargingRateUnit       string                   `json:"chargingRateUnit"`
+	ChargingSchedulePeriod []ChargingSchedulePeriod `json:"chargingSchedulePeriod"`
+}
+
+type ChargingProfile struct {
+	ChargingProfileID      int              `json:"chargingProfileId"`
+	TransactionID          int              `json:"transactionId,omitempty"`
+	StackLevel             int              `json:"stackLevel"`
+	ChargingProfilePurpose string           `json:"chargingProfilePurpose"`
+	ChargingProfileKind    string           `json:"chargingProfileKind"`
+	ChargingSchedule       ChargingSchedule `json:"chargingSchedule"`
+}
+
+type RemoteStartTransactionRequest struct {
+	ConnectorID     int              `json:"connectorId,omitempty"`
+	IdTag           string           `json:"idTag"`
+	ChargingProfile *ChargingProfile `json:"chargingProfile,omitempty"`
+}
+
+type RemoteStopTransactionRequest struct {
+	TransactionID int `json:"transactionId"`
+}
+
+type SetChargingProfileRequest struct {
+	ConnectorID        int             `json:"connectorId"`
+	CsChargingProfiles ChargingProfile `json:"csChargingProfiles"`
+}
+
+// StatusConfirmation is the confirmation of the remote start and stop and of
+// setting a charging profile.
+type StatusConfirmation struct {
+	Status string `json:"status"`
+}
@@ -0,0 +1,242 @@
+// Package ocpp implements the JSON flavour of OCPP 1.6 over WebSocket, a
+// central system that charge points connect to and a simulated charge point.
+package ocpp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Subprotocol is the WebSocket subprotocol of OCPP 1.6J.
+const Subprotocol = "ocpp1.6"
+
+// Message types of the OCPP-J framing.
+const (
+	callType       = 2
+	callResultType = 3
+	callErrorType  = 4
+)
+
+// Error codes of a CallError.
+const (
+	NotImplemented              = "NotImplemented"
+	NotSupported                = "NotSupported"
+	InternalError               = "InternalError"
+	ProtocolError               = "ProtocolError"
+	FormationViolation          = "FormationViolation"
+	GenericError                = "GenericError"
+	PropertyConstraintViolation = "PropertyConstraintViolation"
+)
+
+// CallError is the error returned by the other side for a call.
+type CallError struct {
+	Code        string
+	Description string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("ocpp %s: %s", e.Code, e.Description)
+}
+
+// message is a call, call result or call error.
+type message struct {
+	typ     int
+	id      string
+	action  string
+	payload json.RawMessage
+	err     *CallError
+}
+
+func decodeMessage(data []byte) (*message, error) {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid message with %d fields", len(fields))
+	}
+	m := message{}
+	if err := json.Unmarshal(fields[0], &m.typ); err != nil {
+		return nil, fmt.Errorf("invalid message type: %v", err)
+	}
+	if err := json.Unmarshal(fields[1], &m.id); err != nil {
+		return nil, fmt.Errorf("invalid message id: %v", err)
+	}
+	switch m.typ {
+	case callType:
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid call with %d fields", len(fields))
+		}
+		if err := json.Unmarshal(fields[2], &m.action); err != nil {
+			return nil, fmt.Errorf("invalid action: %v", err)
+		}
+		m.payload = fields[3]
+	case callResultType:
+		m.payload = fields[2]
+	case callErrorType:
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("invalid call error with %d fields", len(fields))
+		}
+		m.err = &CallError{}
+		if err := json.Unmarshal(fields[2], &m.err.Code); err != nil {
+			return nil, fmt.Errorf("invalid error code: %v", err)
+		}
+		if err := json.Unmarshal(fields[3], &m.err.Description); err != nil {
+			return nil, fmt.Errorf("invalid error description: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown message type %d", m.typ)
+	}
+	return &m, nil
+}
+
+// handler answers a call from the other side. Returning a *CallError sends
+// it as is, other errors are sent as an InternalError.
+type handler func(action string, payload json.RawMessage) (interface{}, error)
+
+// endpoint is one side of an OCPP-J connection. Calls from the other side are
+// handled in order by the read loop, so a handler must not make calls of its
+// own before it has returned. Only one call is outstanding at a time, as
+// OCPP requires.
+type endpoint struct {
+	ws     *websocket.Conn
+	handle handler
+
+	writeMu sync.Mutex
+	callMu  sync.Mutex
+
+	mu      sync.Mutex
+	next    int
+	pending map[string]chan *message
+	err     error
+	done    chan struct{}
+}
+
+func newEndpoint(ws *websocket.Conn, handle handler) *endpoint {
+	return &endpoint{
+		ws:      ws,
+		handle:  handle,
+		pending: map[string]chan *message{},
+		done:    make(chan struct{}),
+	}
+}
+
+// run reads messages until the connection fails or is closed.
+func (e *endpoint) run() {
+	var err error
+	for {
+		var data []byte
+		if err = websocket.Message.Receive(e.ws, &data); err != nil {
+			break
+		}
+		m, decodeErr := decodeMessage(data)
+		if decodeErr != nil {
+			// Without a message id there is nobody to answer.
+			continue
+		}
+		if m.typ == callType {
+			if err = e.answer(m); err != nil {
+				break
+			}
+			continue
+		}
+		e.mu.Lock()
+		ch, ok := e.pending[m.id]
+		delete(e.pending, m.id)
+		e.mu.Unlock()
+		if ok {
+			ch <- m
+		}
+	}
+	e.mu.Lock()
+	e.err = err
+	e.mu.Unlock()
+	e.ws.Close()
+	close(e.done)
+}
+
+func (e *endpoint) answer(m *message) error {
+	conf, err := e.handle(m.action, m.payload)
+	if err != nil {
+		callErr, ok := err.(*CallError)
+		if !ok {
+			callErr = &CallError{Code: InternalError, Description: err.Error()}
+		}
+		return e.send([]interface{}{callErrorType, m.id, callErr.Code, callErr.Description, struct{}{}})
+	}
+	return e.send([]interface{}{callResultType, m.id, conf})
+}
+
+func (e *endpoint) send(v []interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	return websocket.Message.Send(e.ws, string(data))
+}
+
+// call sends action with req and decodes the result into conf.
+func (e *endpoint) call(ctx context.Context, action string, req, conf interface{}) error {
+	e.callMu.Lock()
+	defer e.callMu.Unlock()
+
+	e.mu.Lock()
+	if e.err != nil || isClosed(e.done) {
+		e.mu.Unlock()
+		return fmt.Errorf("connection closed: %v", e.err)
+	}
+	e.next++
+	id := strconv.Itoa(e.next)
+	ch := make(chan *message, 1)
+	e.pending[id] = ch
+	e.mu.Unlock()
+
+	if err := e.send([]interface{}{callType, id, action, req}); err != nil {
+		e.mu.Lock()
+		delete(e.pending, id)
+		e.mu.Unlock()
+		return err
+	}
+	select {
+	case m := <-ch:
+		if m.err != nil {
+			return m.err
+		}
+		if conf == nil {
+			return nil
+		}
+		if err := json.Unmarshal(m.payload, conf); err != nil {
+			return fmt.Errorf("invalid %s result: %v", action, err)
+		}
+		return nil
+	case <-e.done:
+		return fmt.Errorf("connection closed during %s", action)
+	case <-ctx.Done():
+		e.mu.Lock()
+		delete(e.pending, id)
+		e.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (e *endpoint) close() error {
+	err := e.ws.Close()
+	<-e.done
+	return err
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
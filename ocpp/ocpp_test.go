@@ -0,0 +1,238 @@
+package ocpp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	m, err := decodeMessage([]byte(`[2,"19223201","BootNotification",{"chargePointVendor":"VendorX","chargePointModel":"SingleSocketCharger"}]`))
+	if err != nil {
+		t.Fatalf("Didnt expect error decoding call %v", err)
+	}
+	if m.typ != callType || m.id != "19223201" || m.action != BootNotification {
+		t.Fatalf("Unexpected call %+v", m)
+	}
+	var req BootNotificationRequest
+	if err := json.Unmarshal(m.payload, &req); err != nil || req.ChargePointVendor != "VendorX" {
+		t.Fatalf("Unexpected payload %s", m.payload)
+	}
+
+	m, err = decodeMessage([]byte(`[3,"19223201",{"status":"Accepted"}]`))
+	if err != nil {
+		t.Fatalf("Didnt expect error decoding call result %v", err)
+	}
+	if m.typ != callResultType || string(m.payload) != `{"status":"Accepted"}` {
+		t.Fatalf("Unexpected call result %+v", m)
+	}
+
+	m, err = decodeMessage([]byte(`[4,"162376037","NotSupported","SetDisplayMessageRequest not implemented",{}]`))
+	if err != nil {
+		t.Fatalf("Didnt expect error decoding call error %v", err)
+	}
+	if m.typ != callErrorType || m.err.Code != NotSupported {
+		t.Fatalf("Unexpected call error %+v", m)
+	}
+
+	for _, data := range []string{`{}`, `[2,"1"]`, `[5,"1",{}]`, `[2,"1","Heartbeat"]`, `[4,"1","GenericError"]`} {
+		if _, err := decodeMessage([]byte(data)); err == nil {
+			t.Errorf("Expected error decoding %s", data)
+		}
+	}
+}
+
+func TestConnectorSample(t *testing.T) {
+	c := Connector{}
+	c.sample([]SampledValue{
+		{Value: "7.36", Measurand: PowerActiveImport, Unit: "kW"},
+		{Value: "1250.5", Unit: "Wh"},
+		{Value: "10.1", Measurand: CurrentImport, Phase: "L1"},
+		{Value: "10.2", Measurand: CurrentImport, Phase: "L2"},
+		{Value: "10.3", Measurand: CurrentImport, Phase: "L3"},
+		{Value: "229", Measurand: Voltage, Phase: "L1-N"},
+		{Value: "401", Measurand: Voltage, Phase: "L1-L2"},
+		{Value: "232", Measurand: Voltage, Phase: "L2-N"},
+	})
+	if c.Power != 7360 || c.Energy != 1250.5 || c.Current != [3]float64{10.1, 10.2, 10.3} || c.Voltage != 229 {
+		t.Fatalf("Unexpected connector %+v", c)
+	}
+
+	c.sample([]SampledValue{
+		{Value: "2300", Measurand: PowerActiveImport, Phase: "L1"},
+		{Value: "2310", Measurand: PowerActiveImport, Phase: "L2"},
+	})
+	if c.Power != 4610 {
+		t.Fatalf("Expected power of the phases summed but was %f", c.Power)
+	}
+}
+
+func newTestSystem(t *testing.T) (*CentralSystem, *httptest.Server) {
+	cs := NewCentralSystem()
+	return cs, httptest.NewServer(cs)
+}
+
+func wsURL(server *httptest.Server, id string) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ocpp/" + id
+}
+
+func TestCentralSystem(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cs, server := newTestSystem(t)
+	defer server.Close()
+
+	sim, err := DialSimulator(ctx, wsURL(server, "CP1"))
+	if err != nil {
+		t.Fatalf("Failed to connect simulator %v", err)
+	}
+	defer sim.Close()
+
+	cp, ok := cs.ChargePoint("CP1")
+	if !ok {
+		t.Fatalf("Expected CP1 to be connected, got %v", cs.ChargePoints())
+	}
+	if cp.Info().ChargePointVendor != "Simulator" {
+		t.Fatalf("Unexpected boot notification %+v", cp.Info())
+	}
+	if c := cp.Connector(1); c.Status != Available || c.PluggedIn() {
+		t.Fatalf("Unexpected connector %+v", c)
+	}
+
+	if err := cp.RemoteStart(ctx, 1, "tag"); err == nil {
+		t.Fatalf("Expected remote start without a vehicle to be rejected")
+	}
+	if err := cp.RemoteStop(ctx, 1); err == nil {
+		t.Fatalf("Expected remote stop without a transaction to fail")
+	}
+
+	if err := sim.PlugIn(ctx); err != nil {
+		t.Fatalf("Failed to plug in %v", err)
+	}
+	if err := cp.SetCurrentLimit(ctx, 1, 10); err != nil {
+		t.Fatalf("Failed to set current limit %v", err)
+	}
+	if err := cp.RemoteStart(ctx, 1, "tag"); err != nil {
+		t.Fatalf("Failed to start %v", err)
+	}
+	if err := sim.Wait(); err != nil {
+		t.Fatalf("Simulator failed to start %v", err)
+	}
+	c := cp.Connector(1)
+	if c.Status != Charging || c.TransactionID != sim.TransactionID() || c.TransactionID == 0 {
+		t.Fatalf("Unexpected connector %+v", c)
+	}
+	if c.Power != 6900 || c.Current != [3]float64{10, 10, 10} || c.Voltage != 230 || c.Limit != 10 {
+		t.Fatalf("Unexpected meter values %+v", c)
+	}
+
+	if err := cp.SetCurrentLimit(ctx, 1, 6); err != nil {
+		t.Fatalf("Failed to set current limit %v", err)
+	}
+	if err := sim.Wait(); err != nil {
+		t.Fatalf("Simulator failed to send meter values %v", err)
+	}
+	if c := cp.Connector(1); c.Current != [3]float64{6, 6, 6} || c.Limit != 6 {
+		t.Fatalf("Expected 6 A on each phase %+v", c)
+	}
+
+	if err := cp.RemoteStop(ctx, 1); err != nil {
+		t.Fatalf("Failed to stop %v", err)
+	}
+	if err := sim.Wait(); err != nil {
+		t.Fatalf("Simulator failed to stop %v", err)
+	}
+	c = cp.Connector(1)
+	if c.Status != Finishing || c.TransactionID != 0 || c.Power != 0 || !c.PluggedIn() {
+		t.Fatalf("Unexpected connector after stop %+v", c)
+	}
+
+	if err := sim.Unplug(ctx); err != nil {
+		t.Fatalf("Failed to unplug %v", err)
+	}
+	if c := cp.Connector(1); c.Status != Available {
+		t.Fatalf("Unexpected connector after unplug %+v", c)
+	}
+
+	sim.Close()
+	select {
+	case <-cp.Done():
+	case <-ctx.Done():
+		t.Fatalf("Charge point not disconnected")
+	}
+	if _, ok := cs.ChargePoint("CP1"); ok {
+		t.Fatalf("Expected CP1 to be removed")
+	}
+}
+
+func TestCentralSystemReconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cs, server := newTestSystem(t)
+	defer server.Close()
+
+	first, err := DialSimulator(ctx, wsURL(server, "CP1"))
+	if err != nil {
+		t.Fatalf("Failed to connect simulator %v", err)
+	}
+	defer first.Close()
+	old, _ := cs.ChargePoint("CP1")
+	second, err := DialSimulator(ctx, wsURL(server, "CP1"))
+	if err != nil {
+		t.Fatalf("Failed to connect simulator %v", err)
+	}
+	defer second.Close()
+
+	select {
+	case <-old.Done():
+	case <-ctx.Done():
+		t.Fatalf("Expected the first connection to be closed")
+	}
+	if cp, ok := cs.ChargePoint("CP1"); !ok || cp == old {
+		t.Fatalf("Expected the second connection to replace the first")
+	}
+}
+
+func TestCentralSystemErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, server := newTestSystem(t)
+	defer server.Close()
+
+	config, err := websocket.NewConfig(wsURL(server, "CP1"), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := websocket.DialConfig(config); err == nil {
+		t.Fatalf("Expected connection without the ocpp subprotocol to fail")
+	}
+
+	config.Protocol = []string{Subprotocol}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("Failed to connect %v", err)
+	}
+	e := newEndpoint(ws, func(string, json.RawMessage) (interface{}, error) {
+		return nil, &CallError{Code: NotImplemented}
+	})
+	go e.run()
+	defer e.close()
+
+	err = e.call(ctx, "DataTransfer", struct{}{}, nil)
+	if callErr, ok := err.(*CallError); !ok || callErr.Code != NotImplemented {
+		t.Fatalf("Expected NotImplemented got %v", err)
+	}
+	err = e.call(ctx, StatusNotification, map[string]string{"connectorId": "one"}, nil)
+	if callErr, ok := err.(*CallError); !ok || callErr.Code != FormationViolation {
+		t.Fatalf("Expected FormationViolation got %v", err)
+	}
+	var conf HeartbeatConfirmation
+	if err := e.call(ctx, Heartbeat, HeartbeatRequest{}, &conf); err != nil || conf.CurrentTime.IsZero() {
+		t.Fatalf("Unexpected heartbeat %+v %v", conf, err)
+	}
+}
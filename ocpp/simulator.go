@@ -0,0 +1,316 @@
+package ocpp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// simulatorTimeout bounds the calls the simulator makes after answering the
+// central system.
+const simulatorTimeout = 10 * time.Second
+
+// Simulator is a charge point with a single connector. A vehicle plugged in
+// with PlugIn charges at the current limit, up to MaxCurrent, while there is
+// a transaction. What the charge point does after accepting a request from
+// the central system, such as starting the transaction, happens in the
+// background and is waited for with Wait.
+type Simulator struct {
+	Voltage    float64
+	Phases     int
+	MaxCurrent float64
+
+	e  *endpoint
+	wg sync.WaitGroup
+
+	mu            sync.Mutex
+	status        string
+	transactionID int
+	limit         float64
+	energy        float64
+	metered       time.Time
+	err           error
+}
+
+// DialSimulator connects a simulated charge point to the central system at
+// rawurl, such as ws://localhost:8887/ocpp/CP1, and boots it.
+func DialSimulator(ctx context.Context, rawurl string) (*Simulator, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	config, err := websocket.NewConfig(rawurl, "http://"+u.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	config.Protocol = []string{Subprotocol}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	s := &Simulator{Voltage: 230, Phases: 3, MaxCurrent: 16, status: Available}
+	s.e = newEndpoint(ws, s.handle)
+	go s.e.run()
+
+	var boot BootNotificationConfirmation
+	req := BootNotificationRequest{ChargePointVendor: "Simulator", ChargePointModel: "Simulator"}
+	if err := s.e.call(ctx, BootNotification, req, &boot); err != nil {
+		s.e.close()
+		return nil, err
+	}
+	if boot.Status != Accepted {
+		s.e.close()
+		return nil, fmt.Errorf("boot notification %s", boot.Status)
+	}
+	if err := s.notify(ctx, Available); err != nil {
+		s.e.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Status returns the status of the connector.
+func (s *Simulator) Status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// TransactionID returns the running transaction, zero if there is none.
+func (s *Simulator) TransactionID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.transactionID
+}
+
+// Limit returns the current limit set by the central system, zero if none.
+func (s *Simulator) Limit() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit
+}
+
+// Current returns the current the vehicle charges with on each phase.
+func (s *Simulator) Current() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current()
+}
+
+func (s *Simulator) current() float64 {
+	if s.status != Charging {
+		return 0
+	}
+	if s.limit > 0 && s.limit < s.MaxCurrent {
+		return s.limit
+	}
+	return s.MaxCurrent
+}
+
+// PlugIn connects a vehicle.
+func (s *Simulator) PlugIn(ctx context.Context) error {
+	return s.notify(ctx, Preparing)
+}
+
+// Unplug disconnects the vehicle, stopping its transaction.
+func (s *Simulator) Unplug(ctx context.Context) error {
+	if err := s.stopTransaction(ctx, "EVDisconnected"); err != nil {
+		return err
+	}
+	return s.notify(ctx, Available)
+}
+
+// SendMeterValues reports the power, current, voltage and energy of the
+// connector.
+func (s *Simulator) SendMeterValues(ctx context.Context) error {
+	s.mu.Lock()
+	now := time.Now().UTC()
+	current := s.current()
+	power := current * s.Voltage * float64(s.Phases)
+	if !s.metered.IsZero() {
+		s.energy += power * now.Sub(s.metered).Hours()
+	}
+	s.metered = now
+	values := []SampledValue{
+		{Value: format(power), Measurand: PowerActiveImport, Unit: "W"},
+		{Value: format(s.energy), Measurand: EnergyActiveImport, Unit: "Wh"},
+	}
+	phases := []string{"L1", "L2", "L3"}
+	for i := 0; i < s.Phases && i < len(phases); i++ {
+		values = append(values,
+			SampledValue{Value: format(current), Measurand: CurrentImport, Phase: phases[i], Unit: "A"},
+			SampledValue{Value: format(s.Voltage), Measurand: Voltage, Phase: phases[i] + "-N", Unit: "V"})
+	}
+	req := MeterValuesRequest{ConnectorID: 1, MeterValue: []MeterValue{{Timestamp: now, SampledValue: values}}}
+	if s.transactionID != 0 {
+		tx := s.transactionID
+		req.TransactionID = &tx
+	}
+	s.mu.Unlock()
+	return s.e.call(ctx, MeterValues, req, &MeterValuesConfirmation{})
+}
+
+// Wait waits for what the simulator does in the background and returns the
+// first error of it.
+func (s *Simulator) Wait() error {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.err
+	s.err = nil
+	return err
+}
+
+func (s *Simulator) Close() error {
+	s.wg.Wait()
+	return s.e.close()
+}
+
+func (s *Simulator) notify(ctx context.Context, status string) error {
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+	req := StatusNotificationRequest{ConnectorID: 1, ErrorCode: "NoError", Status: status}
+	return s.e.call(ctx, StatusNotification, req, &StatusNotificationConfirmation{})
+}
+
+func (s *Simulator) startTransaction(ctx context.Context, idTag string) error {
+	s.mu.Lock()
+	req := StartTransactionRequest{ConnectorID: 1, IdTag: idTag, MeterStart: int(s.energy), Timestamp: time.Now().UTC()}
+	s.mu.Unlock()
+	var conf StartTransactionConfirmation
+	if err := s.e.call(ctx, StartTransaction, req, &conf); err != nil {
+		return err
+	}
+	if conf.IdTagInfo.Status != Accepted {
+		return fmt.Errorf("id tag %s %s", idTag, conf.IdTagInfo.Status)
+	}
+	s.mu.Lock()
+	s.transactionID = conf.TransactionID
+	s.mu.Unlock()
+	if err := s.notify(ctx, Charging); err != nil {
+		return err
+	}
+	return s.SendMeterValues(ctx)
+}
+
+func (s *Simulator) stopTransaction(ctx context.Context, reason string) error {
+	s.mu.Lock()
+	tx := s.transactionID
+	s.transactionID = 0
+	req := StopTransactionRequest{TransactionID: tx, MeterStop: int(s.energy), Timestamp: time.Now().UTC(), Reason: reason}
+	s.mu.Unlock()
+	if tx == 0 {
+		return nil
+	}
+	if err := s.e.call(ctx, StopTransaction, req, &StopTransactionConfirmation{}); err != nil {
+		return err
+	}
+	return s.notify(ctx, Finishing)
+}
+
+// background runs f after the answer to the central system has been sent.
+func (s *Simulator) background(f func(ctx context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), simulatorTimeout)
+		defer cancel()
+		if err := f(ctx); err != nil {
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = err
+			}
+			s.mu.Unlock()
+		}
+	}()
+}
+
+func (s *Simulator) handle(action string, payload json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch action {
+	case RemoteStartTransaction:
+		var req RemoteStartTransactionRequest
+		if err := decodePayload(payload, &req); err != nil {
+			return nil, err
+		}
+		if s.transactionID != 0 || s.status != Preparing {
+			return StatusConfirmation{Status: Rejected}, nil
+		}
+		if req.ChargingProfile != nil {
+			s.setProfile(*req.ChargingProfile)
+		}
+		s.background(func(ctx context.Context) error {
+			return s.startTransaction(ctx, req.IdTag)
+		})
+		return StatusConfirmation{Status: Accepted}, nil
+	case RemoteStopTransaction:
+		var req RemoteStopTransactionRequest
+		if err := decodePayload(payload, &req); err != nil {
+			return nil, err
+		}
+		if s.transactionID == 0 || req.TransactionID != s.transactionID {
+			return StatusConfirmation{Status: Rejected}, nil
+		}
+		s.background(func(ctx context.Context) error {
+			return s.stopTransaction(ctx, "Remote")
+		})
+		return StatusConfirmation{Status: Accepted}, nil
+	case SetChargingProfile:
+		var req SetChargingProfileRequest
+		if err := decodePayload(payload, &req); err != nil {
+			return nil, err
+		}
+		if !s.setProfile(req.CsChargingProfiles) {
+			return StatusConfirmation{Status: Rejected}, nil
+		}
+		if s.status == Charging {
+			s.background(s.SendMeterValues)
+		}
+		return StatusConfirmation{Status: Accepted}, nil
+	}
+	return nil, &CallError{Code: NotImplemented, Description: fmt.Sprintf("%s is not implemented", action)}
+}
+
+// setProfile takes the limit of the first period of profile. s.mu must be
+// held.
+func (s *Simulator) setProfile(profile ChargingProfile) bool {
+	periods := profile.ChargingSchedule.ChargingSchedulePeriod
+	if len(periods) == 0 {
+		return false
+	}
+	limit := periods[0].Limit
+	switch profile.ChargingSchedule.ChargingRateUnit {
+	case "A":
+	case "W":
+		limit /= s.Voltage * float64(s.Phases)
+	default:
+		return false
+	}
+	s.limit = limit
+	return true
+}
+
+func format(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
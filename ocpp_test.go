@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stelund/solarchargetesla/ocpp"
+)
+
+func TestOCPPClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cs := ocpp.NewCentralSystem()
+	server := httptest.NewServer(cs)
+	defer server.Close()
+
+	c := car{Vendor: "OCPP", ChargePointId: "garage", BatteryLevel: 40, Longitude: 18.1, Latitude: 59.3}
+	if _, err := (realApp{}).createCarClient(c); err == nil {
+		t.Fatalf("Expected error without a central system")
+	}
+	cc, err := (realApp{ocpp: cs}).createCarClient(c)
+	if err != nil {
+		t.Fatalf("Didnt expect error creating client %v", err)
+	}
+	if _, err := cc.getCarData(ctx, 0); err == nil {
+		t.Fatalf("Expected error before the charge point connects")
+	}
+
+	sim, err := ocpp.DialSimulator(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/ocpp/garage")
+	if err != nil {
+		t.Fatalf("Failed to connect simulator %v", err)
+	}
+	defer sim.Close()
+	if err := sim.PlugIn(ctx); err != nil {
+		t.Fatalf("Failed to plug in %v", err)
+	}
+
+	data, err := cc.getCarData(ctx, 0)
+	if err != nil {
+		t.Fatalf("Didnt expect error reading car data %v", err)
+	}
+	if *data != (carData{BatteryLevel: 40, Longitude: 18.1, Latitude: 59.3, ChargeLimit: 100, IsPluggedIn: true}) {
+		t.Fatalf("Unexpected car data %+v", *data)
+	}
+
+	if err := cc.setChargingAmps(ctx, 0, 8); err != nil {
+		t.Fatalf("Failed to set charging amps %v", err)
+	}
+	if err := cc.startCharging(ctx, 0); err != nil {
+		t.Fatalf("Failed to start charging %v", err)
+	}
+	if err := sim.Wait(); err != nil {
+		t.Fatalf("Simulator failed %v", err)
+	}
+	// A second start while the transaction runs does nothing.
+	if err := cc.startCharging(ctx, 0); err != nil {
+		t.Fatalf("Failed to start charging again %v", err)
+	}
+	data, err = cc.getCarData(ctx, 0)
+	if err != nil {
+		t.Fatalf("Didnt expect error reading car data %v", err)
+	}
+	if !data.IsCharging || data.ChargeAmps != 8 || data.ChargerActualCurrent != 8 || data.ChargerPhases != 3 || data.ChargerVoltage != 230 {
+		t.Fatalf("Unexpected car data while charging %+v", *data)
+	}
+
+	if err := cc.stopCharging(ctx, 0); err != nil {
+		t.Fatalf("Failed to stop charging %v", err)
+	}
+	if err := sim.Wait(); err != nil {
+		t.Fatalf("Simulator failed %v", err)
+	}
+	data, err = cc.getCarData(ctx, 0)
+	if err != nil {
+		t.Fatalf("Didnt expect error reading car data %v", err)
+	}
+	if data.IsCharging || !data.IsPluggedIn || data.ChargerPhases != 0 {
+		t.Fatalf("Unexpected car data after stop %+v", *data)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/stelund/solarchargetesla/dsmr"
+)
+
+// p1Timeout bounds the wait for a complete telegram, DSMR 4 meters send one
+// every ten seconds.
+const p1Timeout = 30 * time.Second
+
+// p1Meter reads DSMR telegrams from the P1 port of a smart meter. A serial
+// device has to be set up beforehand, such as with
+// stty -F /dev/ttyUSB0 115200 raw.
+type p1Meter struct {
+	address string
+}
+
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+func (p p1Meter) open(ctx context.Context) (io.ReadCloser, error) {
+	if strings.HasPrefix(p.address, "/") {
+		return os.Open(p.address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", p.address)
+}
+
+func (p p1Meter) getGridReading(ctx context.Context) (*gridReading, error) {
+	conn, err := p.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(p1Timeout)
+	}
+	if d, ok := conn.(deadliner); ok {
+		d.SetReadDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	t, err := dsmr.NewReader(conn).Read()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	r, err := t.Reading()
+	if err != nil {
+		return nil, err
+	}
+	reading := gridReading{GridImport: r.Import, GridExport: r.Export}
+	for i := range r.PhaseCurrent {
+		reading.PhaseCurrent[i] = r.PhaseCurrent[i]
+		// DSMR currents are unsigned, exported phases are negative.
+		if r.PhaseExport[i] > r.PhaseImport[i] {
+			reading.PhaseCurrent[i] = -r.PhaseCurrent[i]
+		}
+	}
+	return &reading, nil
+}
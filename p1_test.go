@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const p1Telegram = "/KFM5KAIFA-METER\r\n" +
+	"\r\n" +
+	"1-3:0.2.8(42)\r\n" +
+	"0-0:1.0.0(210501230010S)\r\n" +
+	"0-0:96.1.1(4530303235303030303537353930333134)\r\n" +
+	"1-0:1.8.1(001581.123*kWh)\r\n" +
+	"1-0:1.8.2(001435.706*kWh)\r\n" +
+	"1-0:2.8.1(000000.000*kWh)\r\n" +
+	"1-0:2.8.2(000000.000*kWh)\r\n" +
+	"0-0:96.14.0(0001)\r\n" +
+	"1-0:1.7.0(00.702*kW)\r\n" +
+	"1-0:2.7.0(00.000*kW)\r\n" +
+	"0-0:96.7.21(00006)\r\n" +
+	"0-0:96.7.9(00003)\r\n" +
+	"1-0:99.97.0(1)(0-0:96.7.19)(000101000001W)(2147483647*s)\r\n" +
+	"1-0:32.32.0(00000)\r\n" +
+	"1-0:32.36.0(00000)\r\n" +
+	"0-0:96.13.1()\r\n" +
+	"0-0:96.13.0()\r\n" +
+	"1-0:31.7.0(003*A)\r\n" +
+	"1-0:21.7.0(00.702*kW)\r\n" +
+	"1-0:22.7.0(00.000*kW)\r\n" +
+	"!11F7\r\n"
+
+// newSer2net serves data to each connection, like ser2net forwarding a P1
+// port.
+func newSer2net(t *testing.T, data string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, data)
+				// Keep the connection open like a serial port.
+				time.Sleep(time.Second)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestP1GetGridReading(t *testing.T) {
+	ln := newSer2net(t, p1Telegram[300:]+p1Telegram)
+	defer ln.Close()
+
+	m := p1Meter{address: ln.Addr().String()}
+	r, err := m.getGridReading(context.Background())
+	if err != nil {
+		t.Fatalf("Didnt expect error reading grid meter %v", err)
+	}
+	if *r != (gridReading{GridImport: 702, PhaseCurrent: [3]float64{3, 0, 0}}) {
+		t.Fatalf("Unexpected reading %+v", *r)
+	}
+}
+
+func TestP1Timeout(t *testing.T) {
+	ln := newSer2net(t, p1Telegram[:100])
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	m := p1Meter{address: ln.Addr().String()}
+	if _, err := m.getGridReading(ctx); err == nil {
+		t.Fatalf("Expected error without complete telegram")
+	}
+}
+
+type testGridMeter struct {
+	r gridReading
+}
+
+func (m testGridMeter) getGridReading(ctx context.Context) (*gridReading, error) {
+	return &m.r, nil
+}
+
+func TestMeteredPowerFlow(t *testing.T) {
+	tests := []struct {
+		production float64
+		r          gridReading
+		want       powerFlow
+	}{
+		{production: 3000, r: gridReading{GridExport: 2000}, want: powerFlow{Production: 3000, Consumption: 1000, GridExport: 2000, PhaseMetered: true}},
+		{production: 0, r: gridReading{GridImport: 702}, want: powerFlow{Consumption: 702, GridImport: 702, PhaseMetered: true}},
+		{production: 0, r: gridReading{GridImport: 702, PhaseCurrent: [3]float64{3, -1, 0}}, want: powerFlow{Consumption: 702, GridImport: 702, PhaseCurrents: [3]float64{3, -1, 0}, PhaseMetered: true}},
+	}
+
+	for _, test := range tests {
+		flow, err := meteredPowerFlow(testSolarVendor{solarPower: test.production}, testGridMeter{test.r}, context.Background())
+		if err != nil {
+			t.Fatalf("Didnt expect error %v", err)
+		}
+		if *flow != test.want {
+			t.Fatalf("Want %+v got %+v", test.want, *flow)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stelund/solarchargetesla/tariff"
+)
+
+// planHorizon is how far ahead prices are loaded.
+const planHorizon = 48 * time.Hour
+
+type tariffPeriod struct {
+	From  string  `firestore:"from"`
+	To    string  `firestore:"to"`
+	Price float64 `firestore:"price"`
+}
+
+// planSlot is a period in which a car is to be charged from the grid.
+type planSlot struct {
+	Start time.Time `firestore:"start"`
+	End   time.Time `firestore:"end"`
+	Price float64   `firestore:"price"`
+}
+
+func (p planSlot) String() string {
+	return fmt.Sprintf("%s-%s %.2f", p.Start.Format("2006-01-02 15:04"), p.End.Format("15:04"), p.Price)
+}
+
+func (c car) inPlan(now time.Time) bool {
+	for _, p := range c.ChargePlan {
+		if !now.Before(p.Start) && now.Before(p.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c car) planString() string {
+	slots := make([]string, len(c.ChargePlan))
+	for i, p := range c.ChargePlan {
+		slots[i] = p.String()
+	}
+	return strings.Join(slots, ", ")
+}
+
+func samePlan(a []planSlot, b []planSlot) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Start.Equal(b[i].Start) || !a[i].End.Equal(b[i].End) || a[i].Price != b[i].Price {
+			return false
+		}
+	}
+	return true
+}
+
+// planGridCharge picks the cheapest hours before car c's ready by time in
+// which to charge it from the grid to its minimum state of charge. The
+// energy the solar forecast expects to be available until then is not
+// planned for.
+func planGridCharge(s site, c car, prices []tariff.Price, now time.Time) []planSlot {
+	if c.ReadyBy == "" || c.BatteryLevel >= c.MinSoC {
+		return nil
+	}
+	deadline, err := nextReadyBy(s, c.ReadyBy, now)
+	if err != nil {
+		return nil
+	}
+	energy := c.energyTo(c.MinSoC)
+	if f := s.forecast(now); s.Forecast && f.Scale > 0 {
+		energy -= f.Surplus(s.availablePower(c)-s.SolarPower, now, deadline)
+	}
+	if energy <= 0 {
+		return nil
+	}
+	plan := []planSlot{}
+	for _, p := range tariff.Cheapest(prices, now, deadline, gridChargeDuration(c, energy)) {
+		plan = append(plan, planSlot{Start: p.Start.UTC(), End: p.End.UTC(), Price: p.Price})
+	}
+	return plan
+}
+
+// planCharging updates the charge plans of the cars at sites with a tariff
+// and returns the cars with their new plans.
+func planCharging(a solarChargeTesla, sites []site, cars []car, ctx context.Context) []car {
+	now := time.Now().UTC()
+	planned := make([]car, len(cars))
+	copy(planned, cars)
+	for _, s := range sites {
+		source, err := a.createTariff(s)
+		if err != nil {
+			fmt.Printf("Failed to create tariff for site %s: %v\n", s.Name, err)
+			continue
+		}
+		if source == nil {
+			continue
+		}
+		prices, err := source.Prices(ctx, now, now.Add(planHorizon))
+		if err != nil {
+			fmt.Printf("Failed to load prices for site %s: %v\n", s.Name, err)
+			continue
+		}
+		for i, c := range planned {
+			if !atSite(s, c) {
+				continue
+			}
+			plan := planGridCharge(s, c, prices, now)
+			if samePlan(plan, c.ChargePlan) {
+				continue
+			}
+			planned[i].ChargePlan = plan
+			err := updateCar(a, c, ctx, fields{"chargePlan": plan})
+			if err != nil {
+				fmt.Printf("Failed to store plan for car %d: %v\n", c.CarID, err)
+			}
+		}
+	}
+	return planned
+}
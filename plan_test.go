@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stelund/solarchargetesla/tariff"
+)
+
+func hourlyPrices(from time.Time, costs ...float64) []tariff.Price {
+	prices := []tariff.Price{}
+	for h, c := range costs {
+		prices = append(prices, tariff.Price{Start: from.Add(time.Duration(h) * time.Hour), End: from.Add(time.Duration(h+1) * time.Hour), Price: c})
+	}
+	return prices
+}
+
+func TestPlanGridCharge(t *testing.T) {
+	evening := time.Date(2021, 3, 1, 22, 0, 0, 0, time.UTC)
+	// 22:00 to 07:00
+	prices := hourlyPrices(evening, 1.0, 0.8, 0.5, 0.4, 0.3, 0.6, 0.7, 0.9, 1.2, 1.5)
+	// 10 kWh at 16 A three phase is about 54 minutes, plus margin.
+	c := car{BatteryLevel: 40, MinSoC: 60, ReadyBy: "07:00", BatteryCapacity: 50, ChargerPhases: 3, IsPluggedIn: true}
+
+	plan := planGridCharge(site{}, c, prices, evening)
+	if len(plan) != 2 || plan[0].Start.Hour() != 1 || plan[1].Start.Hour() != 2 {
+		t.Fatalf("Expected the two cheapest hours but got %v+", plan)
+	}
+	if c.inPlan(evening) {
+		t.Fatalf("Car without plan should not be in plan")
+	}
+	c.ChargePlan = plan
+	if !c.inPlan(plan[0].Start.Add(10*time.Minute)) || c.inPlan(evening) {
+		t.Fatalf("Unexpected in plan for %v+", plan)
+	}
+
+	c.BatteryLevel = 60
+	if plan := planGridCharge(site{}, c, prices, evening); len(plan) != 0 {
+		t.Fatalf("Expected no plan when minimum is reached but got %v+", plan)
+	}
+}
+
+func TestDecideChargePlan(t *testing.T) {
+	evening := time.Date(2021, 3, 1, 22, 0, 0, 0, time.UTC)
+	c := car{BatteryLevel: 40, ChargeLimit: 80, MinSoC: 60, ReadyBy: "07:00", IsPluggedIn: true,
+		ChargePlan: []planSlot{{Start: evening.Add(3 * time.Hour), End: evening.Add(4 * time.Hour), Price: 0.3}}}
+
+	d := decideCharge(site{}, c, 0, evening)
+	if d.action != actionNone {
+		t.Fatalf("Expected to wait for the cheap hour but got %s (%s)", d.action, d.reason)
+	}
+	d = decideCharge(site{}, c, 0, evening.Add(3*time.Hour+time.Minute))
+	if d.action != actionStart || !d.byGrid {
+		t.Fatalf("Expected to charge from grid in the cheap hour but got %s (%s)", d.action, d.reason)
+	}
+	// Passed the latest start, the plan was not enough.
+	d = decideCharge(site{}, c, 0, evening.Add(8*time.Hour))
+	if d.action != actionStart || !d.byGrid {
+		t.Fatalf("Expected to charge from grid when out of time but got %s (%s)", d.action, d.reason)
+	}
+}
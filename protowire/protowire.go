@@ -0,0 +1,194 @@
+// Package protowire encodes and decodes the protocol buffer wire format for
+// the few messages of Tesla's protocols, without generated code.
+package protowire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Wire types.
+const (
+	Varint  = 0
+	Fixed64 = 1
+	Bytes   = 2
+	Fixed32 = 5
+)
+
+// AppendVarint appends v as a varint.
+func AppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// AppendTag appends the key of a field.
+func AppendTag(b []byte, num int, wire int) []byte {
+	return AppendVarint(b, uint64(num)<<3|uint64(wire))
+}
+
+// AppendUint appends a varint field, zero is the default and left out.
+func AppendUint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return AppendVarint(AppendTag(b, num, Varint), v)
+}
+
+// AppendFixed32 appends a fixed32 field, zero is left out.
+func AppendFixed32(b []byte, num int, v uint32) []byte {
+	if v == 0 {
+		return b
+	}
+	b = AppendTag(b, num, Fixed32)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// AppendDouble appends a double field, zero is left out.
+func AppendDouble(b []byte, num int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = AppendTag(b, num, Fixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+// AppendBytes appends a bytes or string field, empty is the default and left
+// out.
+func AppendBytes(b []byte, num int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	return AppendMessage(b, num, v)
+}
+
+// AppendMessage appends an embedded message, also when it is empty as that
+// still selects a member of a oneof.
+func AppendMessage(b []byte, num int, m []byte) []byte {
+	b = AppendVarint(AppendTag(b, num, Bytes), uint64(len(m)))
+	return append(b, m...)
+}
+
+// Field is a decoded field, U holds the value of a varint or fixed field and
+// B the bytes of a length delimited one.
+type Field struct {
+	Num  int
+	Wire int
+	U    uint64
+	B    []byte
+}
+
+// Fields are the decoded fields of a message. The last one wins when a field
+// is repeated, as for a scalar field on the wire.
+type Fields []Field
+
+func readVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("truncated varint")
+}
+
+// Parse decodes the fields of a message.
+func Parse(b []byte) (Fields, error) {
+	var fs Fields
+	for len(b) > 0 {
+		tag, n, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		f := Field{Num: int(tag >> 3), Wire: int(tag & 7)}
+		switch f.Wire {
+		case Varint:
+			f.U, n, err = readVarint(b)
+			if err != nil {
+				return nil, err
+			}
+		case Fixed64:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("truncated fixed64 field %d", f.Num)
+			}
+			f.U, n = binary.LittleEndian.Uint64(b), 8
+		case Fixed32:
+			if len(b) < 4 {
+				return nil, fmt.Errorf("truncated fixed32 field %d", f.Num)
+			}
+			f.U, n = uint64(binary.LittleEndian.Uint32(b)), 4
+		case Bytes:
+			l, m, err := readVarint(b)
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(b)-m) < l {
+				return nil, fmt.Errorf("truncated field %d", f.Num)
+			}
+			f.B, n = b[m:m+int(l)], m+int(l)
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d of field %d", f.Wire, f.Num)
+		}
+		b = b[n:]
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+// Get returns the last field num.
+func (fs Fields) Get(num int) (Field, bool) {
+	for i := len(fs) - 1; i >= 0; i-- {
+		if fs[i].Num == num {
+			return fs[i], true
+		}
+	}
+	return Field{}, false
+}
+
+// All returns every occurrence of the repeated field num.
+func (fs Fields) All(num int) []Field {
+	var all []Field
+	for _, f := range fs {
+		if f.Num == num {
+			all = append(all, f)
+		}
+	}
+	return all
+}
+
+// Has tells if field num is present.
+func (fs Fields) Has(num int) bool {
+	_, ok := fs.Get(num)
+	return ok
+}
+
+// Uint returns a varint or fixed field, zero when missing.
+func (fs Fields) Uint(num int) uint64 {
+	f, _ := fs.Get(num)
+	return f.U
+}
+
+// Double returns a double field, zero when missing.
+func (fs Fields) Double(num int) float64 {
+	return math.Float64frombits(fs.Uint(num))
+}
+
+// Bytes returns a length delimited field, nil when missing.
+func (fs Fields) Bytes(num int) []byte {
+	f, _ := fs.Get(num)
+	return f.B
+}
+
+// Message parses an embedded message, a missing one is empty.
+func (fs Fields) Message(num int) (Fields, error) {
+	return Parse(fs.Bytes(num))
+}
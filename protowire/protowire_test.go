@@ -0,0 +1,41 @@
+package protowire
+
+import "testing"
+
+func TestWire(t *testing.T) {
+	var b []byte
+	b = AppendUint(b, 1, 300)
+	b = AppendBytes(b, 2, []byte("abc"))
+	b = AppendFixed32(b, 3, 0xdeadbeef)
+	b = AppendMessage(b, 4, nil)
+	fs, err := Parse(b)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	if fs.Uint(1) != 300 || string(fs.Bytes(2)) != "abc" || fs.Uint(3) != 0xdeadbeef || !fs.Has(4) || fs.Has(5) {
+		t.Fatalf("Unexpected fields %+v", fs)
+	}
+	if _, err := Parse(b[:len(b)-3]); err == nil {
+		t.Fatalf("Expected error for a truncated message")
+	}
+}
+
+func TestRepeatedAndDouble(t *testing.T) {
+	var b []byte
+	b = AppendMessage(b, 1, AppendDouble(nil, 1, 59.33))
+	b = AppendMessage(b, 1, AppendDouble(nil, 1, -18.07))
+	fs, err := Parse(b)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	all := fs.All(1)
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 repeated fields got %d", len(all))
+	}
+	for i, want := range []float64{59.33, -18.07} {
+		m, err := Parse(all[i].B)
+		if err != nil || m.Double(1) != want {
+			t.Fatalf("Expected %v got %v %v", want, m.Double(1), err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// defaultMaxWakes is how many times a day a car is woken unless set.
+const defaultMaxWakes = 6
+
+// sleepingCar is a car client that can tell the state of the car, online,
+// asleep or offline, without waking it, and wake it.
+type sleepingCar interface {
+	vehicleState(ctx context.Context, carID int64) (string, error)
+	wake(ctx context.Context, carID int64) error
+}
+
+func (t teslaClient) vehicleState(ctx context.Context, carID int64) (string, error) {
+	return getCarState(ctx, t.apiClient, carID)
+}
+
+func (t teslaClient) wake(ctx context.Context, carID int64) error {
+	return wakeCar(ctx, t.apiClient, carID)
+}
+
+func (c car) maxWakes() int {
+	if c.MaxWakesPerDay == 0 {
+		return defaultMaxWakes
+	}
+	return c.MaxWakesPerDay
+}
+
+// canWake tells if the car has wakes left today.
+func (c car) canWake(now time.Time) bool {
+	wakes := c.Wakes
+	if c.WakeDay != now.UTC().Format("2006-01-02") {
+		wakes = 0
+	}
+	return wakes < c.maxWakes()
+}
+
+// countWake counts a wake against today's budget.
+func (c *car) countWake(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+	if c.WakeDay != day {
+		c.WakeDay = day
+		c.Wakes = 0
+	}
+	c.Wakes++
+}
+
+// wakeNeeded tells if charging of a sleeping car depends on fresh data, which
+// is when it was last seen plugged in at a site that has solar power to
+// spare or when it is due to charge from the grid.
+func wakeNeeded(sites []site, c car, now time.Time) bool {
+	if !c.IsPluggedIn {
+		return false
+	}
+	for _, s := range sites {
+		if !atSite(s, c) {
+			continue
+		}
+		if _, ok := decideGridCharge(s, c, now); ok {
+			return true
+		}
+		if s.availablePower(c) > s.StartChargeThreshold && c.ChargeLimit-c.BatteryLevel > startChargeDiff {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSleeping reads the state of car c without waking it and tells if its
+// data should be read. A sleeping car is woken for that, which counts against
+// its budget, the car is never woken elsewhere. A car left asleep is not
+// charging.
+func checkSleeping(app solarChargeTesla, sc sleepingCar, sites []site, c car, now time.Time, ctx context.Context) (car, bool) {
+	state, err := sc.vehicleState(ctx, c.CarID)
+	if err != nil {
+		fmt.Printf("Failed to read state of %s: %v\n", c.Name, err)
+		return c, false
+	}
+	if state == "online" {
+		c.State = state
+		return c, true
+	}
+	if wakeNeeded(sites, c, now) && c.canWake(now) {
+		c.countWake(now)
+		if err := updateCar(app, c, ctx, fields{"wakes": c.Wakes, "wakeDay": c.WakeDay}); err != nil {
+			fmt.Printf("Failed to store wakes: %v\n", err)
+		}
+		if err := sc.wake(ctx, c.CarID); err != nil {
+			fmt.Printf("Failed to wake %s: %v\n", c.Name, err)
+			return c, false
+		}
+		c.State = "online"
+		return c, true
+	}
+	c.State = state
+	c.IsCharging = false
+	c.IsChargingBySolar = false
+	c.IsChargingByGrid = false
+	err = updateCar(app, c, ctx, fields{
+		"state":             c.State,
+		"isCharging":        false,
+		"isChargingBySolar": false,
+		"isChargingByGrid":  false,
+	})
+	if err != nil {
+		fmt.Printf("Failed to store state: %v\n", err)
+	}
+	return c, false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// sleepyCar is a car that reports its state and refuses commands unless it
+// is online, like teslaClient.
+type sleepyCar struct {
+	state    string
+	reads    *int
+	wakes    *int
+	commands *int
+}
+
+func (s sleepyCar) vehicleState(ctx context.Context, carID int64) (string, error) {
+	return s.state, nil
+}
+
+func (s sleepyCar) wake(ctx context.Context, carID int64) error {
+	if s.wakes != nil {
+		*s.wakes++
+	}
+	return nil
+}
+
+func (s sleepyCar) getCarData(ctx context.Context, carID int64) (*carData, error) {
+	*s.reads++
+	return &carData{BatteryLevel: 50, ChargeLimit: 80, IsPluggedIn: true, Latitude: 59.3, Longitude: 18.1}, nil
+}
+
+// command counts a command sent to a car that is online.
+func (s sleepyCar) command() error {
+	if s.state != "online" {
+		return errVehicleOffline
+	}
+	if s.commands != nil {
+		*s.commands++
+	}
+	return nil
+}
+
+func (s sleepyCar) startCharging(ctx context.Context, carID int64) error {
+	return s.command()
+}
+
+func (s sleepyCar) stopCharging(ctx context.Context, carID int64) error {
+	return s.command()
+}
+
+func (s sleepyCar) setChargingAmps(ctx context.Context, carID int64, amps int32) error {
+	return s.command()
+}
+
+type sleepyApp struct {
+	*testApp
+	car sleepyCar
+}
+
+func (a sleepyApp) createCarClient(c car) (carClient, error) {
+	return a.car, nil
+}
+
+func TestWakeBudget(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	c := car{MaxWakesPerDay: 2}
+	for i := 0; i < 2; i++ {
+		if !c.canWake(now) {
+			t.Fatalf("Expected wake %d to be allowed", i+1)
+		}
+		c.countWake(now)
+	}
+	if c.canWake(now) {
+		t.Fatalf("Expected the budget to be spent")
+	}
+	if !c.canWake(now.Add(24 * time.Hour)) {
+		t.Fatalf("Expected a new budget the next day")
+	}
+	c.countWake(now.Add(24 * time.Hour))
+	if c.Wakes != 1 || c.WakeDay != "2021-05-02" {
+		t.Fatalf("Expected the wakes to be counted from the new day got %d %s", c.Wakes, c.WakeDay)
+	}
+	if (car{MaxWakesPerDay: -1}).canWake(now) {
+		t.Fatalf("Expected a negative budget to never wake")
+	}
+	if (car{}).maxWakes() != defaultMaxWakes {
+		t.Fatalf("Expected the default budget")
+	}
+}
+
+func TestWakeNeeded(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := site{Latitude: 59.3, Longitude: 18.1, GridMetered: true, GridExport: 3000, StartChargeThreshold: 1000}
+	home := car{Latitude: 59.3, Longitude: 18.1, IsPluggedIn: true, BatteryLevel: 50, ChargeLimit: 80}
+	tests := []struct {
+		name string
+		s    site
+		c    car
+		want bool
+	}{
+		{name: "surplus", s: s, c: home, want: true},
+		{name: "not plugged in", s: s, c: car{Latitude: 59.3, Longitude: 18.1, BatteryLevel: 50, ChargeLimit: 80}, want: false},
+		{name: "away", s: s, c: car{Latitude: 57.7, Longitude: 11.9, IsPluggedIn: true, BatteryLevel: 50, ChargeLimit: 80}, want: false},
+		{name: "no surplus", s: site{Latitude: 59.3, Longitude: 18.1, GridMetered: true, GridImport: 500, StartChargeThreshold: 1000}, c: home, want: false},
+		{name: "at limit", s: s, c: car{Latitude: 59.3, Longitude: 18.1, IsPluggedIn: true, BatteryLevel: 80, ChargeLimit: 80}, want: false},
+		{name: "planned grid charge", s: site{Latitude: 59.3, Longitude: 18.1}, c: car{Latitude: 59.3, Longitude: 18.1, IsPluggedIn: true, BatteryLevel: 20, MinSoC: 50, ReadyBy: "07:00", ChargePlan: []planSlot{{Start: now.Add(-time.Hour), End: now.Add(time.Hour)}}}, want: true},
+	}
+	for _, test := range tests {
+		if got := wakeNeeded([]site{test.s}, test.c, now); got != test.want {
+			t.Fatalf("Expected %v for %s got %v", test.want, test.name, got)
+		}
+	}
+}
+
+func TestReadCarsSleeping(t *testing.T) {
+	ctx := context.Background()
+	s := site{Latitude: 59.3, Longitude: 18.1, GridMetered: true, GridExport: 3000, StartChargeThreshold: 1000}
+	tests := []struct {
+		name      string
+		state     string
+		c         car
+		wantReads int
+		wantWakes int
+	}{
+		{name: "online", state: "online", c: car{}, wantReads: 1},
+		{name: "asleep away", state: "asleep", c: car{Latitude: 57.7, Longitude: 11.9, IsPluggedIn: true, IsCharging: true, BatteryLevel: 50, ChargeLimit: 80}},
+		{name: "asleep with surplus", state: "asleep", c: car{Latitude: 59.3, Longitude: 18.1, IsPluggedIn: true, BatteryLevel: 50, ChargeLimit: 80}, wantReads: 1, wantWakes: 1},
+		{name: "budget spent", state: "asleep", c: car{Latitude: 59.3, Longitude: 18.1, IsPluggedIn: true, BatteryLevel: 50, ChargeLimit: 80, MaxWakesPerDay: 1, Wakes: 1, WakeDay: time.Now().UTC().Format("2006-01-02")}, wantWakes: 1},
+	}
+	for _, test := range tests {
+		reads, wakes := 0, 0
+		app := sleepyApp{testApp: createTestApp(ctx, 0), car: sleepyCar{state: test.state, reads: &reads, wakes: &wakes}}
+		test.c.documentId = "car1"
+		if err := app.st.setCar(ctx, test.c); err != nil {
+			t.Fatalf("Failed to store car %v", err)
+		}
+		cars, err := readCars(app, []site{s}, ctx)
+		if err != nil {
+			t.Fatalf("Didnt expect error %v", err)
+		}
+		stored, _ := app.st.getCar(ctx, "car1")
+		if reads != test.wantReads || stored.Wakes != test.wantWakes {
+			t.Fatalf("Expected %d reads and %d wakes for %s got %d and %d", test.wantReads, test.wantWakes, test.name, reads, stored.Wakes)
+		}
+		if wakes != stored.Wakes-test.c.Wakes {
+			t.Fatalf("Expected each counted wake to wake the car for %s got %d", test.name, wakes)
+		}
+		if test.wantReads == 0 && (stored.State != test.state || stored.IsCharging || cars[0].IsCharging) {
+			t.Fatalf("Expected a sleeping car that is not charging for %s got %+v", test.name, stored)
+		}
+		if test.wantReads == 1 && stored.State != "online" {
+			t.Fatalf("Expected an online car for %s got %s", test.name, stored.State)
+		}
+	}
+}
+
+func TestChargerControlSleeping(t *testing.T) {
+	reads := 0
+	charger := testCarData{data: &carData{IsPluggedIn: true, ChargeAmps: 16}}
+	cc := chargerControl{car: sleepyCar{state: "asleep", reads: &reads}, charger: charger, c: car{BatteryLevel: 40, ChargeLimit: 90}}
+	data, err := cc.getCarData(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	if reads != 0 || data.BatteryLevel != 40 || data.ChargeLimit != 90 || !data.IsPluggedIn {
+		t.Fatalf("Expected the stored data without waking the car got %d reads and %+v", reads, data)
+	}
+}
+
+func TestSleepingCarNotCommanded(t *testing.T) {
+	ctx := context.Background()
+	s := site{documentId: "site1", Latitude: 59.3, Longitude: 18.1, SolarPower: 5000, GridMetered: true, GridExport: 5000, StartChargeThreshold: 1000}
+	// The stored data is plugged in, under its limit and at a site with
+	// surplus, but today's wakes are spent.
+	c := car{documentId: "car1", Latitude: 59.3, Longitude: 18.1, IsPluggedIn: true, BatteryLevel: 50, ChargeLimit: 80,
+		ChargerVoltage: 230, ChargerPhases: 1, MaxWakesPerDay: 1, Wakes: 1, WakeDay: time.Now().UTC().Format("2006-01-02")}
+	tests := []struct {
+		name         string
+		state        string
+		wantCommands bool
+	}{
+		{name: "asleep", state: "asleep"},
+		// Woken by the owner since it was last read asleep.
+		{name: "woken", state: "online", wantCommands: true},
+	}
+	for _, test := range tests {
+		reads, wakes, commands := 0, 0, 0
+		app := sleepyApp{testApp: createTestApp(ctx, 0), car: sleepyCar{state: test.state, reads: &reads, wakes: &wakes, commands: &commands}}
+		app.st.setSite(ctx, s)
+		c.State = "asleep"
+		c.LastUpdated = time.Now().UTC()
+		if err := app.st.setCar(ctx, c); err != nil {
+			t.Fatalf("Failed to store car %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			cars, err := readCars(app, []site{s}, ctx)
+			if err != nil {
+				t.Fatalf("Didnt expect error %v", err)
+			}
+			investigate(app, []site{s}, cars, ctx)
+		}
+		stored, _ := app.st.getCar(ctx, "car1")
+		if reads != 0 || wakes != 0 || stored.Wakes != 1 {
+			t.Fatalf("Expected the car to not be woken for %s got %d reads, %d wakes and %+v", test.name, reads, wakes, stored)
+		}
+		if (commands > 0) != test.wantCommands || stored.IsCharging != test.wantCommands {
+			t.Fatalf("Expected commands %v for %s got %d and %+v", test.wantCommands, test.name, commands, stored)
+		}
+	}
+}
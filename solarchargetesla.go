@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
@@ -8,16 +9,27 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
-	"cloud.google.com/go/firestore"
+	"github.com/stelund/solarchargetesla/ocpp"
+	"github.com/stelund/solarchargetesla/tariff"
+	"github.com/stelund/solarchargetesla/telemetry"
+	"github.com/stelund/solarchargetesla/vehiclecommand"
 	"github.com/umahmood/haversine"
-	"google.golang.org/api/iterator"
 )
 
 const startChargeDiff int32 = 5
 
+const (
+	defaultMinChargeAmps  int32   = 5
+	defaultChargerVoltage float64 = 230
+	// kWh
+	defaultBatteryCapacity float64 = 75
+)
+
 type site struct {
 	Name                 string    `firestore:"name"`
 	Vendor               string    `firestore:"vendor"`
@@ -29,6 +41,72 @@ type site struct {
 	StopChargeThreshold  float64   `firestore:"stopChargeThreshold"`
 	Longitude            float64   `firestore:"longitude"`
 	Latitude             float64   `firestore:"latitude"`
+	Consumption          float64   `firestore:"consumption"`
+	GridImport           float64   `firestore:"gridImport"`
+	GridExport           float64   `firestore:"gridExport"`
+	GridMetered          bool      `firestore:"gridMetered"`
+
+	// Hysteresis, power has to be above or below a threshold for a number
+	// of samples and minutes before charging is started or stopped.
+	SustainedSamples int           `firestore:"sustainedSamples"`
+	SustainedMinutes int           `firestore:"sustainedMinutes"`
+	MinChargeMinutes int           `firestore:"minChargeMinutes"`
+	MinPauseMinutes  int           `firestore:"minPauseMinutes"`
+	PowerSamples     []powerSample `firestore:"powerSamples"`
+
+	// Forecasting of the production to avoid short charging sessions.
+	Forecast          bool          `firestore:"forecast"`
+	MinSessionMinutes int           `firestore:"minSessionMinutes"`
+	ProductionSamples []powerSample `firestore:"productionSamples"`
+
+	// IANA time zone used for the cars' ready by times.
+	TimeZone string `firestore:"timeZone"`
+
+	// Tariff is fixed, with the prices of TariffPeriods and TariffDefault,
+	// or spot with prices loaded from TariffURL.
+	Tariff        string         `firestore:"tariff"`
+	TariffURL     string         `firestore:"tariffUrl"`
+	TariffPeriods []tariffPeriod `firestore:"tariffPeriods"`
+	TariffDefault float64        `firestore:"tariffDefault"`
+
+	// Seconds between reads of the site's power, an hour unless set.
+	PollSeconds int `firestore:"pollSeconds"`
+	// Host name or address, with an optional port, of inverters with a
+	// local api.
+	Host string `firestore:"host"`
+	// Modbus unit id of SunSpec inverters, 1 unless set.
+	UnitId int `firestore:"unitId"`
+
+	// Home Assistant to read the sensors of the HomeAssistant vendor from,
+	// and to publish the decisions to. Grid power is positive when
+	// importing, consumption is optional.
+	HomeAssistantURL   string `firestore:"homeAssistantUrl"`
+	HomeAssistantToken string `firestore:"homeAssistantToken"`
+	ProductionEntity   string `firestore:"productionEntity"`
+	GridEntity         string `firestore:"gridEntity"`
+	ConsumptionEntity  string `firestore:"consumptionEntity"`
+
+	// MQTT broker to read the power of the MQTT vendor from, and to publish
+	// the cars' state and decisions to under MQTTPrefix.
+	MQTTBroker      string    `firestore:"mqttBroker"`
+	MQTTUsername    string    `firestore:"mqttUsername"`
+	MQTTPassword    string    `firestore:"mqttPassword"`
+	MQTTPrefix      string    `firestore:"mqttPrefix"`
+	MQTTProduction  mqttValue `firestore:"mqttProduction"`
+	MQTTGrid        mqttValue `firestore:"mqttGrid"`
+	MQTTConsumption mqttValue `firestore:"mqttConsumption"`
+
+	// P1 port of the smart meter at the grid connection, a serial device
+	// such as /dev/ttyUSB0 or the host:port of ser2net. The vendor then
+	// only reads the production.
+	GridMeter string `firestore:"gridMeter"`
+
+	// Rating of the main fuse in amperes, charging is limited so that no
+	// phase exceeds it. PhaseCurrents are the latest currents at the grid
+	// connection, negative when exporting, when read from a meter.
+	MainFuseAmps  float64   `firestore:"mainFuseAmps"`
+	PhaseCurrents []float64 `firestore:"phaseCurrents"`
+	documentId    string
 }
 
 type car struct {
@@ -37,6 +115,7 @@ type car struct {
 	CarID             int64     `firestore:"carId"`
 	AccessToken       string    `firestore:"accessToken"`
 	RefreshToken      string    `firestore:"refreshToken"`
+	TokenExpiry       time.Time `firestore:"tokenExpiry"`
 	LastUpdated       time.Time `firestore:"lastUpdated"`
 	BatteryLevel      int32     `firestore:"batteryLevel"`
 	ChargeLimit       int32     `firestore:"chargeLimit"`
@@ -45,7 +124,91 @@ type car struct {
 	IsCharging        bool      `firestore:"isCharging"`
 	IsPluggedIn       bool      `firestore:"isPluggedIn"`
 	IsChargingBySolar bool      `firestore:"isChargingBySolar"`
-	documentId        string
+	Priority          int       `firestore:"priority"`
+	BatteryCapacity   float64   `firestore:"batteryCapacity"`
+
+	LastChargeTransition time.Time `firestore:"lastChargeTransition"`
+
+	// Charge from the grid if needed to reach MinSoC by the time of day
+	// ReadyBy, such as 07:00.
+	MinSoC           int32  `firestore:"minSoc"`
+	ReadyBy          string `firestore:"readyBy"`
+	IsChargingByGrid bool   `firestore:"isChargingByGrid"`
+	// Cheapest hours to charge from the grid in, when the site has a tariff.
+	ChargePlan []planSlot `firestore:"chargePlan"`
+
+	ChargeAmps           int32 `firestore:"chargeAmps"`
+	MinChargeAmps        int32 `firestore:"minChargeAmps"`
+	MaxChargeAmps        int32 `firestore:"maxChargeAmps"`
+	ChargerActualCurrent int32 `firestore:"chargerActualCurrent"`
+	ChargerVoltage       int32 `firestore:"chargerVoltage"`
+	ChargerPhases        int32 `firestore:"chargerPhases"`
+
+	// Charging state as the car reports it, such as Disconnected, Stopped or
+	// Charging, with its charger power in kW, hours to full and kWh added.
+	// A car on a fast charger, such as a Supercharger, is not controlled.
+	ChargingState            string    `firestore:"chargingState"`
+	ChargerPower             int32     `firestore:"chargerPower"`
+	TimeToFullCharge         float64   `firestore:"timeToFullCharge"`
+	ChargeEnergyAdded        float64   `firestore:"chargeEnergyAdded"`
+	ScheduledChargingPending bool      `firestore:"scheduledChargingPending"`
+	ScheduledChargingStart   time.Time `firestore:"scheduledChargingStart"`
+	FastChargerPresent       bool      `firestore:"fastChargerPresent"`
+	// Shift state and speed in mph of the car, a driving car is not
+	// controlled.
+	ShiftState string  `firestore:"shiftState"`
+	Speed      float64 `firestore:"speed"`
+
+	// Seconds between reads of the car's data, an hour unless set.
+	PollSeconds int `firestore:"pollSeconds"`
+	// State of the car, online, asleep or offline, when its api tells it
+	// without waking the car. A sleeping car is woken at most MaxWakesPerDay
+	// times, 6 unless set and never if negative, counted in Wakes on the
+	// date WakeDay.
+	State          string `firestore:"state"`
+	MaxWakesPerDay int    `firestore:"maxWakesPerDay"`
+	Wakes          int    `firestore:"wakes"`
+	WakeDay        string `firestore:"wakeDay"`
+	// Home Assistant entity overriding the controller, with the state auto,
+	// off, solar or grid.
+	OverrideEntity string `firestore:"overrideEntity"`
+
+	// Wall charger of the OCPP vendor, the connector is 1 unless set and
+	// transactions are started with the id tag solarchargetesla unless set.
+	ChargePointId string `firestore:"chargePointId"`
+	ConnectorId   int    `firestore:"connectorId"`
+	IdTag         string `firestore:"idTag"`
+
+	// Wall charger to charge through, go-e, Easee, Wallbox or OCPP, when
+	// the car has no api or it is unavailable. The car's api, if Vendor is
+	// set, is still read. ChargerHost is the address of a go-e, ChargerId
+	// the serial number of an Easee or Wallbox, logged in to with
+	// ChargerUsername and ChargerPassword. OCPP chargers use ChargePointId.
+	ChargerVendor   string `firestore:"chargerVendor"`
+	ChargerHost     string `firestore:"chargerHost"`
+	ChargerId       string `firestore:"chargerId"`
+	ChargerUsername string `firestore:"chargerUsername"`
+	ChargerPassword string `firestore:"chargerPassword"`
+
+	// Tesla api of the car, the owner api unless TeslaAPI is fleet. The
+	// Fleet API is called in FleetRegion, na, eu or cn, and addresses the
+	// car by its VIN. Its tokens are refreshed with the client id of the
+	// application in TESLA_CLIENT_ID.
+	TeslaAPI    string `firestore:"teslaApi"`
+	FleetRegion string `firestore:"fleetRegion"`
+	VIN         string `firestore:"vin"`
+
+	// Commands of a Fleet API car are sent to CommandProxy when set, a
+	// locally run proxy that signs them. With SignedCommands they are signed
+	// here instead, with the key in TESLA_COMMAND_KEY enrolled in the car.
+	CommandProxy   string `firestore:"commandProxy"`
+	SignedCommands bool   `firestore:"signedCommands"`
+
+	// Telemetry server streaming the data of a Tesla, read instead of
+	// polling the car when set. It is connected to with the token in
+	// TELEMETRY_TOKEN.
+	TelemetryURL string `firestore:"telemetryUrl"`
+	documentId   string
 }
 
 func SolarChargeTesla(w http.ResponseWriter, r *http.Request) {
@@ -67,189 +230,904 @@ func SolarChargeTesla(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "state: idle")
 	}
 
-	cars, err := readCars(app, ctx)
+	cars, err := readCars(app, sites, ctx)
 	if err != nil {
 		log.Fatalf("Failed to read cars: %v", err)
 	}
 
+	cars = planCharging(app, sites, cars, ctx)
 	charging := investigate(app, sites, cars, ctx)
 	fmt.Fprintf(w, "charging: %s", html.EscapeString(strconv.Itoa(charging)))
+	for _, c := range cars {
+		if len(c.ChargePlan) > 0 {
+			fmt.Fprintf(w, "\nplan %s: %s", html.EscapeString(c.Name), html.EscapeString(c.planString()))
+		}
+	}
 }
 
 func main() {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	app := createApp(ctx)
 	defer app.close()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "daemon":
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+			go func() {
+				sig := <-signals
+				log.Printf("Received %v, shutting down", sig)
+				cancel()
+			}()
+			if addr := os.Getenv("OCPP_ADDR"); addr != "" {
+				cs, srv, err := serveOCPP(addr)
+				if err != nil {
+					log.Fatalf("Failed to start OCPP central system: %v", err)
+				}
+				defer srv.Close()
+				app.ocpp = cs
+			}
+			runDaemon(app, ctx)
+			return
+		case "login":
+			if len(os.Args) != 3 {
+				log.Fatalf("usage: %s login <car document id>", os.Args[0])
+			}
+			p := terminalPrompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+			token, vehicle, err := loginTesla(ctx, p, "", "")
+			if err != nil {
+				log.Fatalf("Failed to log in: %v", err)
+			}
+			err = storeLogin(app, os.Args[2], token, vehicle, ctx)
+			if err != nil {
+				log.Fatalf("Failed to store car: %v", err)
+			}
+			fmt.Printf("Stored %s as car %s\n", vehicle.DisplayName, os.Args[2])
+			return
+		case "keygen":
+			if len(os.Args) != 3 {
+				log.Fatalf("usage: %s keygen <private key file>", os.Args[0])
+			}
+			public, err := generateCommandKey(os.Args[2])
+			if err != nil {
+				log.Fatalf("Failed to generate key: %v", err)
+			}
+			fmt.Printf("Host the public key at https://<domain>/.well-known/appspecific/com.tesla.3p.public-key.pem\n\n%s", public)
+			return
+		case "enroll":
+			if len(os.Args) != 4 {
+				log.Fatalf("usage: %s enroll <car document id> <domain>", os.Args[0])
+			}
+			c, err := app.getStore().getCar(ctx, os.Args[2])
+			if err != nil {
+				log.Fatalf("Failed to read car: %v", err)
+			}
+			if c.TeslaAPI != "fleet" {
+				log.Fatalf("Signed commands need the Fleet API, set teslaApi to fleet")
+			}
+			c.SignedCommands = true
+			// Creating the client sets up the car's signer.
+			if _, err := app.createVehicleClient(c); err != nil {
+				log.Fatalf("Failed to create client: %v", err)
+			}
+			in := bufio.NewReader(os.Stdin)
+			if err := enrollCommandKey(ctx, in, os.Stdout, os.Args[3], app.signers[c.documentId]); err != nil {
+				log.Fatalf("Failed to enroll key: %v", err)
+			}
+			if err := updateCar(app, c, ctx, fields{"signedCommands": true}); err != nil {
+				log.Fatalf("Failed to store car: %v", err)
+			}
+			fmt.Printf("Key enrolled, commands to %s are signed\n", c.Name)
+			return
+		case "fleet-register":
+			if len(os.Args) != 4 {
+				log.Fatalf("usage: %s fleet-register <region> <domain>", os.Args[0])
+			}
+			baseURL, err := teslaFleetURL(os.Args[2])
+			if err != nil {
+				log.Fatal(err)
+			}
+			token, err := partnerToken(ctx, "", os.Getenv("TESLA_CLIENT_ID"), os.Getenv("TESLA_CLIENT_SECRET"), baseURL)
+			if err != nil {
+				log.Fatalf("Failed to get partner token: %v", err)
+			}
+			if err := registerPartner(ctx, baseURL, token, os.Args[3]); err != nil {
+				log.Fatalf("Failed to register: %v", err)
+			}
+			fmt.Printf("Registered %s in %s\n", os.Args[3], os.Args[2])
+			return
+		default:
+			log.Fatalf("Unknown command %s", os.Args[1])
+		}
+	}
+
 	sites, err := readSites(app, ctx)
 	if err != nil {
 		log.Fatalf("Failed to read sites: %v", err)
 	}
 	fmt.Printf("sites %v\n", sites)
-	cars, err := readCars(app, ctx)
+	cars, err := readCars(app, sites, ctx)
 	if err != nil {
 		log.Fatalf("Failed to read cars: %v", err)
 	}
 	fmt.Printf("cars %v\n", cars)
 }
 
+// chargerVoltage returns the voltage reported by the charger. A car that is
+// not charging reports a few volts so then a nominal voltage is assumed.
+func (c car) chargerVoltage() float64 {
+	if c.ChargerVoltage < 100 {
+		return defaultChargerVoltage
+	}
+	return float64(c.ChargerVoltage)
+}
+
+func (c car) chargerPhases() float64 {
+	if c.ChargerPhases < 1 {
+		return 1
+	}
+	return float64(c.ChargerPhases)
+}
+
+func (c car) minChargeAmps() int32 {
+	if c.MinChargeAmps <= 0 {
+		return defaultMinChargeAmps
+	}
+	return c.MinChargeAmps
+}
+
+// chargingPower is the power the car currently draws from the charger.
+func (c car) chargingPower() float64 {
+	return float64(c.ChargerActualCurrent) * c.chargerVoltage() * c.chargerPhases()
+}
+
+// availablePower returns the power car c can use without importing from the
+// grid. Sites without a grid meter only know the solar production.
+func (s site) availablePower(c car) float64 {
+	if !s.GridMetered {
+		return s.SolarPower
+	}
+	power := s.GridExport - s.GridImport
+	if c.IsCharging {
+		power += c.chargingPower()
+	}
+	return power
+}
+
+// chargingAmps calculates the current to request from the car so that it
+// consumes power watts, limited by the car's configured min and max amps.
+func chargingAmps(power float64, c car) int32 {
+	amps := int32(power / (c.chargerVoltage() * c.chargerPhases()))
+	minAmps := c.minChargeAmps()
+	if amps < minAmps {
+		amps = minAmps
+	}
+	if c.MaxChargeAmps > 0 && amps > c.MaxChargeAmps {
+		amps = c.MaxChargeAmps
+	}
+	return amps
+}
+
+func setChargeAmps(a solarChargeTesla, client carClient, c car, amps int32, ctx context.Context) error {
+	if amps == c.ChargeAmps {
+		return nil
+	}
+	err := client.setChargingAmps(ctx, c.CarID, amps)
+	if err != nil {
+		return err
+	}
+	return updateCar(a, c, ctx, fields{"chargeAmps": amps})
+}
+
 func startStopCharge(a solarChargeTesla, s site, c car, ctx context.Context) error {
+	return chargeWithPower(a, s, c, s.availablePower(c), 1, ctx)
+}
+
+// chargeWithPower starts, stops or adjusts the charging of car c given that
+// it may use power watts. The user's override is followed, the current is
+// limited by the site's main fuse, shared by shares cars, and the decision
+// published when the site has a publisher.
+func chargeWithPower(a solarChargeTesla, s site, c car, power float64, shares int, ctx context.Context) error {
 	client, err := a.createCarClient(c)
 	if err != nil {
 		return err
 	}
-	if !c.IsCharging && c.IsPluggedIn && s.SolarPower > s.StartChargeThreshold {
-		if c.ChargeLimit-c.BatteryLevel > startChargeDiff {
-			err := client.startCharging(c.CarID)
-			if err != nil {
-				return err
-			}
-			return setIsChargingBySolar(a, c, ctx)
+	pub, err := a.createPublisher(s)
+	if err != nil {
+		fmt.Printf("Failed to create publisher for site %s: %v\n", s.Name, err)
+	}
+	mode := overrideAuto
+	if pub != nil {
+		mode, err = pub.override(ctx, c)
+		if err != nil {
+			fmt.Printf("Failed to read override for car %d: %v\n", c.CarID, err)
+		}
+	}
+	now := time.Now().UTC()
+	d := decideOverride(mode, s, c, power, now)
+	if limit, ok := fuseLimit(s, c, shares); ok {
+		d = limitToFuse(c, d, limit)
+	}
+	err = applyDecision(a, client, c, d, now, ctx)
+	if pub != nil {
+		if err := pub.publish(ctx, c, mode, d); err != nil {
+			fmt.Printf("Failed to publish decision for car %d: %v\n", c.CarID, err)
+		}
+	}
+	return err
+}
+
+// applyDecision starts, stops or adjusts the charging of car c.
+func applyDecision(a solarChargeTesla, client carClient, c car, d decision, now time.Time, ctx context.Context) error {
+	switch d.action {
+	case actionStart:
+		err := client.startCharging(ctx, c.CarID)
+		if err != nil {
+			return err
+		}
+		err = setChargeAmps(a, client, c, d.amps, ctx)
+		if err != nil {
+			return err
+		}
+		if d.byGrid {
+			return setIsChargingByGrid(a, c, now, ctx)
+		}
+		return setIsChargingBySolar(a, c, now, ctx)
+	case actionStop:
+		err := client.stopCharging(ctx, c.CarID)
+		if err != nil {
+			return err
+		}
+		return updateCar(a, c, ctx, fields{
+			"isCharging":           false,
+			"isChargingBySolar":    false,
+			"isChargingByGrid":     false,
+			"lastChargeTransition": now,
+		})
+	case actionAdjust:
+		err := setChargeAmps(a, client, c, d.amps, ctx)
+		if err != nil {
+			return err
+		}
+		if d.byGrid != c.IsChargingByGrid {
+			return updateCar(a, c, ctx, fields{
+				"isChargingBySolar": !d.byGrid,
+				"isChargingByGrid":  d.byGrid,
+			})
 		}
-	} else if c.IsChargingBySolar && c.IsCharging && s.SolarPower < s.StopChargeThreshold {
-		return client.stopCharging(c.CarID)
 	}
 	return nil
 }
 
+func atSite(s site, c car) bool {
+	siteCoord := haversine.Coord{Lat: s.Latitude, Lon: s.Longitude}
+	carCoord := haversine.Coord{Lat: c.Latitude, Lon: c.Longitude}
+	_, km := haversine.Distance(siteCoord, carCoord)
+	return km < 0.01
+}
+
+// driving tells if the car was last seen driving. It is only taken to have
+// parked once it is read again, it may have been leaving.
+func (c car) driving() bool {
+	return c.Speed > 0 || c.ShiftState == "D" || c.ShiftState == "R" || c.ShiftState == "N"
+}
+
+// controllable tells if the charging of the car is left to the controller,
+// not while it drives or charges at a fast charger.
+func (c car) controllable() bool {
+	return !c.driving() && !c.FastChargerPresent
+}
+
+// carsAtSite returns the cars at a site whose charging is controlled.
+func carsAtSite(s site, cars []car) []car {
+	cs := []car{}
+	for _, c := range cars {
+		if atSite(s, c) && c.controllable() {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
 func investigate(a solarChargeTesla, sites []site, cars []car, ctx context.Context) int {
 	charging := 0
 	for _, s := range sites {
-		siteCoord := haversine.Coord{Lat: s.Latitude, Lon: s.Longitude}
-		for _, c := range cars {
-			carCoord := haversine.Coord{Lat: c.Latitude, Lon: c.Longitude}
-			_, km := haversine.Distance(siteCoord, carCoord)
-			if km < 0.01 {
-				err := startStopCharge(a, s, c, ctx)
-				if err != nil {
-					fmt.Printf("Error for car %d: %v+", c.CarID, err)
-				}
+		atSite := carsAtSite(s, cars)
+		s, err := recordPowerSample(a, s, atSite, ctx)
+		if err != nil {
+			fmt.Printf("Failed to record power sample for site %s: %v\n", s.Name, err)
+		}
+		shares := fuseShares(atSite)
+		for _, al := range allocatePower(s, atSite) {
+			err := chargeWithPower(a, s, al.c, al.power, shares, ctx)
+			if err != nil {
+				fmt.Printf("Error for car %d: %v+", al.c.CarID, err)
 			}
 		}
 	}
 	return charging
 }
 
+// powerFlow is a snapshot of a site's power in watts. Grid import and export
+// are both positive, at most one of them is non zero. The phase currents are
+// in amperes, negative when exporting, and only set when PhaseMetered.
+type powerFlow struct {
+	Production    float64
+	Consumption   float64
+	GridImport    float64
+	GridExport    float64
+	PhaseCurrents [3]float64
+	PhaseMetered  bool
+}
+
 type solarClient interface {
-	getCurrentPower() (float64, error)
+	getCurrentPower(ctx context.Context) (float64, error)
+	getPowerFlow(ctx context.Context) (*powerFlow, error)
 }
 
 type carClient interface {
-	getCarData(CarID int64) (*carData, error)
-	startCharging(CarID int64) error
-	stopCharging(CarID int64) error
+	getCarData(ctx context.Context, CarID int64) (*carData, error)
+	startCharging(ctx context.Context, CarID int64) error
+	stopCharging(ctx context.Context, CarID int64) error
+	setChargingAmps(ctx context.Context, CarID int64, amps int32) error
+}
+
+// decisionPublisher publishes the decisions for the cars at a site and lets
+// the user override them.
+type decisionPublisher interface {
+	override(ctx context.Context, c car) (string, error)
+	publish(ctx context.Context, c car, override string, d decision) error
+}
+
+// publishers publishes to several publishers, the first override that is
+// not auto is followed.
+type publishers []decisionPublisher
+
+func (ps publishers) override(ctx context.Context, c car) (string, error) {
+	for _, p := range ps {
+		mode, err := p.override(ctx, c)
+		if err != nil {
+			return overrideAuto, err
+		}
+		if mode != overrideAuto {
+			return mode, nil
+		}
+	}
+	return overrideAuto, nil
+}
+
+func (ps publishers) publish(ctx context.Context, c car, override string, d decision) error {
+	var first error
+	for _, p := range ps {
+		if err := p.publish(ctx, c, override, d); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// gridReading is the power at the grid connection in watts, import and
+// export are both positive, and the current of each phase in amperes,
+// negative when exporting.
+type gridReading struct {
+	GridImport   float64
+	GridExport   float64
+	PhaseCurrent [3]float64
+}
+
+type gridMeter interface {
+	getGridReading(ctx context.Context) (*gridReading, error)
+}
+
+// meteredPowerFlow combines the production of a site with the power at the
+// grid connection read by a separate meter.
+func meteredPowerFlow(sar solarClient, meter gridMeter, ctx context.Context) (*powerFlow, error) {
+	production, err := sar.getCurrentPower(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reading, err := meter.getGridReading(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &powerFlow{
+		Production:    production,
+		Consumption:   production + reading.GridImport - reading.GridExport,
+		GridImport:    reading.GridImport,
+		GridExport:    reading.GridExport,
+		PhaseCurrents: reading.PhaseCurrent,
+		PhaseMetered:  true,
+	}, nil
 }
 
 type solarChargeTesla interface {
 	createSolarClient(site) (solarClient, error)
 	createCarClient(car) (carClient, error)
+	createTariff(site) (tariff.Source, error)
+	createPublisher(site) (decisionPublisher, error)
+	createGridMeter(site) (gridMeter, error)
 	close() error
-	getFirestoreClient() *firestore.Client
+	getStore() store
 }
 
 type realApp struct {
-	fc *firestore.Client
+	st      store
+	tokens  map[string]*teslaTokenSource
+	mqtt    map[string]*mqttSite
+	ocpp    *ocpp.CentralSystem
+	logins  map[string]*chargerLogin
+	signers map[string]*vehiclecommand.Client
+	streams map[string]*telemetry.Stream
 }
 
 func createApp(ctx context.Context) *realApp {
-	projectID := os.Getenv("GCP_PROJECT_ID")
-
-	if projectID == "" {
-		projectID = "default"
-	}
-
-	client, err := firestore.NewClient(ctx, projectID)
+	st, err := createStore(ctx)
 	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+		log.Fatalf("Failed to create store: %v", err)
+	}
+	app := realApp{
+		st:      st,
+		tokens:  map[string]*teslaTokenSource{},
+		mqtt:    map[string]*mqttSite{},
+		logins:  map[string]*chargerLogin{},
+		signers: map[string]*vehiclecommand.Client{},
+		streams: map[string]*telemetry.Stream{},
 	}
-	app := realApp{fc: client}
 	return &app
 }
 
 func (a realApp) createSolarClient(s site) (solarClient, error) {
 	if s.Vendor == "SolarEdge" {
 		return solarEdgeClient{siteId: s.SiteId, apiKey: s.ApiKey}, nil
+	} else if s.Vendor == "Fronius" {
+		return froniusClient{host: s.Host}, nil
+	} else if s.Vendor == "Enphase" {
+		return enphaseClient{host: s.Host, token: s.ApiKey}, nil
+	} else if s.Vendor == "SunSpec" {
+		return sunspecClient{host: s.Host, unitID: byte(s.UnitId)}, nil
+	} else if s.Vendor == "HomeAssistant" {
+		return newHomeAssistantClient(s), nil
+	} else if s.Vendor == "MQTT" {
+		return a.mqttSite(s), nil
 	}
 	return nil, errors.New(fmt.Sprintf("Unknown site vendor %s", s.Vendor))
 }
 
+// createTariff returns the site's tariff, or nil if it has none.
+func (a realApp) createTariff(s site) (tariff.Source, error) {
+	switch s.Tariff {
+	case "":
+		return nil, nil
+	case "fixed":
+		schedule := tariff.Schedule{Default: s.TariffDefault, Location: s.location()}
+		for _, p := range s.TariffPeriods {
+			schedule.Periods = append(schedule.Periods, tariff.Period{From: p.From, To: p.To, Price: p.Price})
+		}
+		return schedule, nil
+	case "spot":
+		return tariff.Spot{URL: s.TariffURL}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown tariff %s", s.Tariff))
+}
+
+// createPublisher returns the site's decision publisher, or nil if it has
+// none.
+func (a realApp) createPublisher(s site) (decisionPublisher, error) {
+	ps := publishers{}
+	if s.HomeAssistantURL != "" {
+		ps = append(ps, newHomeAssistantClient(s))
+	}
+	if s.MQTTBroker != "" {
+		ps = append(ps, a.mqttSite(s))
+	}
+	switch len(ps) {
+	case 0:
+		return nil, nil
+	case 1:
+		return ps[0], nil
+	}
+	return ps, nil
+}
+
+// createGridMeter returns the site's grid meter, or nil if it has none.
+func (a realApp) createGridMeter(s site) (gridMeter, error) {
+	if s.GridMeter == "" {
+		return nil, nil
+	}
+	return p1Meter{address: s.GridMeter}, nil
+}
+
+// mqttSite returns the mqtt connection of site s. It is kept by the app so
+// the latest values of the topics are at hand.
+func (a realApp) mqttSite(s site) *mqttSite {
+	config := siteMQTTConfig(s)
+	if m, ok := a.mqtt[s.documentId]; ok {
+		if m.config == config {
+			return m
+		}
+		m.close()
+	}
+	m := newMQTTSite(config)
+	a.mqtt[s.documentId] = m
+	return m
+}
+
 func (a realApp) createCarClient(c car) (carClient, error) {
-	if c.Vendor == "Tesla" {
-		return teslaClient{apiClient: teslaAPIClient{accessToken: c.AccessToken}}, nil
+	if c.ChargerVendor == "" {
+		return a.createVehicleClient(c)
+	}
+	charger, err := a.createChargerClient(c)
+	if err != nil {
+		return nil, err
+	}
+	cc := chargerControl{charger: charger, c: c}
+	if c.Vendor != "" {
+		cc.car, err = a.createVehicleClient(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+func (a realApp) createChargerClient(c car) (carClient, error) {
+	if c.ChargerVendor == "go-e" {
+		return goeClient{host: c.ChargerHost}, nil
+	} else if c.ChargerVendor == "Easee" {
+		return easeeClient{baseURL: easeeBaseURL, id: c.ChargerId, username: c.ChargerUsername, password: c.ChargerPassword, login: a.chargerLogin(c)}, nil
+	} else if c.ChargerVendor == "Wallbox" {
+		return wallboxClient{baseURL: wallboxBaseURL, id: c.ChargerId, username: c.ChargerUsername, password: c.ChargerPassword, login: a.chargerLogin(c), c: c}, nil
+	} else if c.ChargerVendor == "OCPP" {
+		if a.ocpp == nil {
+			return nil, errors.New("No OCPP central system, run the daemon with OCPP_ADDR")
+		}
+		return newOCPPClient(a.ocpp, c), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown charger vendor %s", c.ChargerVendor))
+}
+
+// chargerLogin returns the charger cloud login of a car.
+func (a realApp) chargerLogin(c car) *chargerLogin {
+	if l, ok := a.logins[c.documentId]; ok {
+		return l
+	}
+	l := &chargerLogin{}
+	if a.logins != nil {
+		a.logins[c.documentId] = l
+	}
+	return l
+}
+
+// createVehicleClient returns the client of a car's api. A Tesla with a
+// telemetry server is read from its stream and only commanded through the
+// api.
+func (a realApp) createVehicleClient(c car) (carClient, error) {
+	cc, err := a.createPolledClient(c)
+	if err != nil || c.Vendor != "Tesla" || c.TelemetryURL == "" {
+		return cc, err
+	}
+	s, err := a.telemetryStream(c)
+	if err != nil {
+		fmt.Printf("Failed to connect to the telemetry of %s, polling it: %v\n", c.Name, err)
+		return cc, nil
+	}
+	return telemetryClient{stream: s, vin: c.VIN, cmd: cc}, nil
+}
+
+// createPolledClient returns the client that reads a car by calling its api.
+func (a realApp) createPolledClient(c car) (carClient, error) {
+	if c.Vendor == "Tesla" && c.TeslaAPI == "fleet" {
+		baseURL, err := teslaFleetURL(c.FleetRegion)
+		if err != nil {
+			return nil, err
+		}
+		fc := &teslaFleetClient{
+			tokens:     a.teslaTokens(c),
+			baseURL:    baseURL,
+			commandURL: c.CommandProxy,
+			carID:      c.CarID,
+			vin:        c.VIN,
+			onRegion: func(ctx context.Context, region string) error {
+				return updateCar(a, c, ctx, fields{"fleetRegion": region})
+			},
+		}
+		tc := teslaClient{apiClient: fc}
+		if c.SignedCommands {
+			signer, err := a.commandSigner(c, fc)
+			if err != nil {
+				return nil, err
+			}
+			tc.signer = signer
+		}
+		return tc, nil
+	} else if c.Vendor == "Tesla" {
+		return teslaClient{apiClient: teslaAPIClient{tokens: a.teslaTokens(c)}}, nil
+	} else if c.Vendor == "OCPP" {
+		if a.ocpp == nil {
+			return nil, errors.New("No OCPP central system, run the daemon with OCPP_ADDR")
+		}
+		return newOCPPClient(a.ocpp, c), nil
 	}
 	return nil, errors.New(fmt.Sprintf("Unknown car vendor %s", c.Vendor))
 }
 
-func (a realApp) getFirestoreClient() *firestore.Client {
-	return a.fc
+// commandSigner returns the signer of a car. It is kept so the session with
+// the car is reused between commands.
+func (a realApp) commandSigner(c car, cac carAPIClient) (*vehiclecommand.Client, error) {
+	if s, ok := a.signers[c.documentId]; ok {
+		return s, nil
+	}
+	key, err := loadCommandKey(os.Getenv("TESLA_COMMAND_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	s, err := vehiclecommand.NewClient(key, c.VIN, signedCommandTransport(cac, c.CarID))
+	if err != nil {
+		return nil, err
+	}
+	if a.signers != nil {
+		a.signers[c.documentId] = s
+	}
+	return s, nil
+}
+
+// teslaTokens returns the token source of a car. It is shared by all clients
+// of the car so a rotated refresh token is not used twice.
+func (a realApp) teslaTokens(c car) *teslaTokenSource {
+	if ts, ok := a.tokens[c.documentId]; ok {
+		return ts
+	}
+	ts := &teslaTokenSource{
+		token: teslaToken{
+			AccessToken:  c.AccessToken,
+			RefreshToken: c.RefreshToken,
+			Expiry:       c.TokenExpiry,
+		},
+		onRefresh: func(ctx context.Context, t teslaToken) error {
+			return updateCar(a, c, ctx, fields{
+				"accessToken":  t.AccessToken,
+				"refreshToken": t.RefreshToken,
+				"tokenExpiry":  t.Expiry,
+			})
+		},
+	}
+	if c.TeslaAPI == "fleet" {
+		ts.authURL = teslaFleetAuthURL
+		ts.clientID = os.Getenv("TESLA_CLIENT_ID")
+		if baseURL, err := teslaFleetURL(c.FleetRegion); err == nil {
+			ts.audience = baseURL
+		}
+	}
+	a.tokens[c.documentId] = ts
+	return ts
+}
+
+func (a realApp) getStore() store {
+	return a.st
 }
 
 func (a realApp) close() error {
-	return a.fc.Close()
+	for _, m := range a.mqtt {
+		m.close()
+	}
+	for _, s := range a.streams {
+		s.Close()
+	}
+	return a.st.close()
 }
 
 func readSites(app solarChargeTesla, ctx context.Context) ([]site, error) {
-	fs := app.getFirestoreClient()
-	iter := fs.Collection("sites").Documents(ctx)
+	stored, err := app.getStore().listSites(ctx)
+	if err != nil {
+		return nil, err
+	}
 	sites := []site{}
-	for {
-		snap, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, err
+	for _, s := range stored {
+		now := time.Now().UTC()
+		due := pollDue(s.LastUpdated, s.pollInterval(), now)
+		if !due && s.overloaded() {
+			// Only the local grid meter is read until the load is lowered,
+			// the vendor's api may be rate limited.
+			meter, err := app.createGridMeter(s)
+			if err == nil && meter != nil {
+				sites = append(sites, readGridMeter(app, s, meter, ctx))
+				continue
+			}
+			due = pollDue(s.LastUpdated, overloadedVendorInterval, now)
 		}
-		var s site
-		snap.DataTo(&s)
-		if time.Now().UTC().After(s.LastUpdated.Add(time.Hour * 1)) {
+		if due {
 			sar, err := app.createSolarClient(s)
 			if err != nil {
-				log.Fatalf("Failed to create site client: %v", err)
+				fmt.Printf("Failed to create site client: %v\n", err)
+				sites = append(sites, s)
+				continue
+			}
+			meter, err := app.createGridMeter(s)
+			if err != nil {
+				fmt.Printf("Failed to create grid meter: %v\n", err)
+			}
+			var flow *powerFlow
+			if meter != nil {
+				flow, err = meteredPowerFlow(sar, meter, ctx)
+			} else {
+				flow, err = sar.getPowerFlow(ctx)
 			}
-			power, err := sar.getCurrentPower()
 			if err == nil {
+				s.SolarPower = flow.Production
+				s.Consumption = flow.Consumption
+				s.GridImport = flow.GridImport
+				s.GridExport = flow.GridExport
+				s.PhaseCurrents = nil
+				if flow.PhaseMetered {
+					s.PhaseCurrents = append([]float64{}, flow.PhaseCurrents[:]...)
+				}
+				s.GridMetered = true
+				s.LastUpdated = time.Now().UTC()
+			} else if power, err := sar.getCurrentPower(ctx); err == nil {
 				s.SolarPower = power
+				s.PhaseCurrents = nil
+				s.GridMetered = false
 				s.LastUpdated = time.Now().UTC()
 			}
-			snap.Ref.Set(ctx, s)
+			err = app.getStore().setSite(ctx, s)
+			if err != nil {
+				fmt.Printf("Failed to store site: %v\n", err)
+			}
 		}
 		sites = append(sites, s)
 	}
 	return sites, nil
 }
 
-func setIsChargingBySolar(app solarChargeTesla, c car, ctx context.Context) error {
-	doc := app.getFirestoreClient().Collection("cars").Doc(c.documentId)
-	_, err := doc.Update(ctx, []firestore.Update{{Path: "isChargingBySolar", Value: true}})
-	return err
+func updateCar(app solarChargeTesla, c car, ctx context.Context, f fields) error {
+	return app.getStore().updateCar(ctx, c.documentId, f)
+}
+
+// storeLogin saves the tokens and the id of the logged in vehicle to the car
+// document, creating it if needed.
+func storeLogin(app solarChargeTesla, documentId string, t *teslaToken, v *vehiclesData, ctx context.Context) error {
+	f := fields{
+		"name":         v.DisplayName,
+		"vendor":       "Tesla",
+		"carId":        v.ID,
+		"vin":          v.VIN,
+		"accessToken":  t.AccessToken,
+		"refreshToken": t.RefreshToken,
+		"tokenExpiry":  t.Expiry,
+	}
+	err := app.getStore().updateCar(ctx, documentId, f)
+	if err != errNotFound {
+		return err
+	}
+	c := car{documentId: documentId}
+	if err := setFields(&c, f); err != nil {
+		return err
+	}
+	return app.getStore().setCar(ctx, c)
+}
+
+func carDataUpdates(c car) fields {
+	return fields{
+		"batteryLevel":         c.BatteryLevel,
+		"longitude":            c.Longitude,
+		"latitude":             c.Latitude,
+		"lastUpdated":          c.LastUpdated,
+		"chargeLimit":          c.ChargeLimit,
+		"isCharging":           c.IsCharging,
+		"isPluggedIn":          c.IsPluggedIn,
+		"isChargingBySolar":    c.IsChargingBySolar,
+		"isChargingByGrid":     c.IsChargingByGrid,
+		"chargeAmps":           c.ChargeAmps,
+		"maxChargeAmps":        c.MaxChargeAmps,
+		"chargerActualCurrent": c.ChargerActualCurrent,
+		"chargerVoltage":       c.ChargerVoltage,
+		"chargerPhases":        c.ChargerPhases,
+		"state":                c.State,
+
+		"chargingState":            c.ChargingState,
+		"chargerPower":             c.ChargerPower,
+		"timeToFullCharge":         c.TimeToFullCharge,
+		"chargeEnergyAdded":        c.ChargeEnergyAdded,
+		"scheduledChargingPending": c.ScheduledChargingPending,
+		"scheduledChargingStart":   c.ScheduledChargingStart,
+		"fastChargerPresent":       c.FastChargerPresent,
+		"shiftState":               c.ShiftState,
+		"speed":                    c.Speed,
+	}
 }
 
-func readCars(app solarChargeTesla, ctx context.Context) ([]car, error) {
-	iter := app.getFirestoreClient().Collection("cars").Documents(ctx)
+// setIsChargingBySolar marks car c as charging by solar power. It is also
+// marked as charging until its data is read again, so that it is not started
+// twice in between.
+func setIsChargingBySolar(app solarChargeTesla, c car, at time.Time, ctx context.Context) error {
+	return updateCar(app, c, ctx, fields{
+		"isCharging":           true,
+		"isChargingBySolar":    true,
+		"lastChargeTransition": at,
+	})
+}
+
+func setIsChargingByGrid(app solarChargeTesla, c car, at time.Time, ctx context.Context) error {
+	return updateCar(app, c, ctx, fields{
+		"isCharging":           true,
+		"isChargingByGrid":     true,
+		"lastChargeTransition": at,
+	})
+}
+
+func updateSite(app solarChargeTesla, s site, ctx context.Context, f fields) error {
+	return app.getStore().updateSite(ctx, s.documentId, f)
+}
+
+// readGridMeter updates the grid import, export and phase currents of site s
+// from its meter, keeping the production last read from its vendor.
+func readGridMeter(app solarChargeTesla, s site, meter gridMeter, ctx context.Context) site {
+	reading, err := meter.getGridReading(ctx)
+	if err != nil {
+		fmt.Printf("Failed to read grid meter of site %s: %v\n", s.Name, err)
+		return s
+	}
+	s.GridImport = reading.GridImport
+	s.GridExport = reading.GridExport
+	s.Consumption = s.SolarPower + reading.GridImport - reading.GridExport
+	s.PhaseCurrents = append([]float64{}, reading.PhaseCurrent[:]...)
+	err = updateSite(app, s, ctx, fields{
+		"gridImport":    s.GridImport,
+		"gridExport":    s.GridExport,
+		"consumption":   s.Consumption,
+		"phaseCurrents": s.PhaseCurrents,
+	})
+	if err != nil {
+		fmt.Printf("Failed to store site: %v\n", err)
+	}
+	return s
+}
+
+// recordPowerSample stores the power available to the cars at site s each
+// time the site has been read.
+func recordPowerSample(app solarChargeTesla, s site, cars []car, ctx context.Context) (site, error) {
+	samples := s.addPowerSample(sitePower(s, cars), s.LastUpdated)
+	if len(samples) == len(s.PowerSamples) && samples[len(samples)-1] == s.PowerSamples[len(s.PowerSamples)-1] {
+		return s, nil
+	}
+	s.PowerSamples = samples
+	updates := fields{"powerSamples": samples}
+	if s.Forecast {
+		s.ProductionSamples = s.addProductionSample(s.SolarPower, s.LastUpdated)
+		updates["productionSamples"] = s.ProductionSamples
+	}
+	return s, updateSite(app, s, ctx, updates)
+}
+
+// readCars reads the cars that are due. A car that sleeps is left asleep
+// with its last known data unless charging it at one of the sites depends on
+// fresh data and it has wakes left today.
+func readCars(app solarChargeTesla, sites []site, ctx context.Context) ([]car, error) {
+	stored, err := app.getStore().listCars(ctx)
+	if err != nil {
+		return nil, err
+	}
 	cars := []car{}
-	for {
-		snap, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		var c car
-		err = snap.DataTo(&c)
-		if err != nil {
-			return nil, err
-		}
-		if c.LastUpdated.IsZero() || time.Now().UTC().After(c.LastUpdated.Add(time.Hour*1)) {
+	for _, c := range stored {
+		now := time.Now().UTC()
+		if pollDue(c.LastUpdated, c.pollInterval(), now) {
 			fmt.Printf("Updating %v+", c.LastUpdated)
 			cc, err := app.createCarClient(c)
 			if err != nil {
 				fmt.Printf("Failed to create tesla client: %v\n", err)
 				continue
 			}
-			carData, err := cc.getCarData(c.CarID)
+			if sc, ok := cc.(sleepingCar); ok {
+				c, ok = checkSleeping(app, sc, sites, c, now, ctx)
+				if !ok {
+					cars = append(cars, c)
+					continue
+				}
+			}
+			carData, err := cc.getCarData(ctx, c.CarID)
 			if err == nil {
 				c.BatteryLevel = carData.BatteryLevel
 				c.Longitude = carData.Longitude
@@ -258,11 +1136,36 @@ func readCars(app solarChargeTesla, ctx context.Context) ([]car, error) {
 				c.ChargeLimit = carData.ChargeLimit
 				c.IsCharging = carData.IsCharging
 				c.IsPluggedIn = carData.IsPluggedIn
+				c.ChargeAmps = carData.ChargeAmps
+				c.ChargerActualCurrent = carData.ChargerActualCurrent
+				if carData.MaxChargeAmps > 0 && c.MaxChargeAmps == 0 {
+					c.MaxChargeAmps = carData.MaxChargeAmps
+				}
+				if carData.ChargerPhases > 0 {
+					c.ChargerVoltage = carData.ChargerVoltage
+					c.ChargerPhases = carData.ChargerPhases
+				}
+				c.ChargingState = carData.ChargingState
+				c.ChargerPower = carData.ChargerPower
+				c.TimeToFullCharge = carData.TimeToFullCharge
+				c.ChargeEnergyAdded = carData.ChargeEnergyAdded
+				c.ScheduledChargingPending = carData.ScheduledChargingPending
+				c.ScheduledChargingStart = carData.ScheduledChargingStart
+				c.FastChargerPresent = carData.FastChargerPresent
+				c.ShiftState = carData.ShiftState
+				c.Speed = carData.Speed
 				if !carData.IsCharging {
 					c.IsChargingBySolar = false
+					c.IsChargingByGrid = false
+				}
+				// Only the car data is written, the tokens might have been
+				// refreshed while fetching it.
+				err = updateCar(app, c, ctx, carDataUpdates(c))
+				if err != nil {
+					fmt.Printf("Failed to store car data: %v\n", err)
 				}
-				c.documentId = snap.Ref.ID
-				snap.Ref.Set(ctx, c)
+			} else if errors.Is(err, errTeslaUnauthorized) || errors.Is(err, errTeslaForbidden) {
+				fmt.Printf("Tesla rejected the tokens of %s, log in again: %v\n", c.Name, err)
 			} else {
 				fmt.Printf("Failed to read tesla battery level: %v\n", err)
 			}
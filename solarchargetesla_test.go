@@ -4,47 +4,50 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"os"
 	"testing"
 	"time"
 
-	"cloud.google.com/go/firestore"
+	"github.com/stelund/solarchargetesla/tariff"
 )
 
 type testApp struct {
-	fc                *firestore.Client
+	st                *memoryStore
 	s                 *testSolarVendor
 	initialSolarPower float64
+	consumption       float64
 }
 
 func createTestApp(ctx context.Context, initialSolarPower float64) *testApp {
-	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
-		log.Fatal("No firestore emulator running, start with:\ngcloud beta emulators firestore start")
-	}
-
-	client, err := firestore.NewClient(ctx, "test")
-	if err != nil {
-		log.Fatalf("firebase.NewClient err: %v", err)
-	}
-
 	return &testApp{
-		fc:                client,
+		st:                newMemoryStore(),
 		initialSolarPower: initialSolarPower,
 	}
 }
 
+// testSolarVendor is a site producing solarPower while the house uses
+// consumption, the difference is exported or imported at the grid.
 type testSolarVendor struct {
-	solarPower float64
+	solarPower  float64
+	consumption float64
 }
 
-func (s testSolarVendor) getCurrentPower() (float64, error) {
+func (s testSolarVendor) getCurrentPower(ctx context.Context) (float64, error) {
 	return s.solarPower, nil
 }
 
+func (s testSolarVendor) getPowerFlow(ctx context.Context) (*powerFlow, error) {
+	flow := powerFlow{Production: s.solarPower, Consumption: s.consumption}
+	if s.solarPower > s.consumption {
+		flow.GridExport = s.solarPower - s.consumption
+	} else {
+		flow.GridImport = s.consumption - s.solarPower
+	}
+	return &flow, nil
+}
+
 func (a testApp) createSolarClient(s site) (solarClient, error) {
 	if s.Vendor == "TestSolarVendor" {
-		a.s = &testSolarVendor{a.initialSolarPower}
+		a.s = &testSolarVendor{solarPower: a.initialSolarPower, consumption: a.consumption}
 		return a.s, nil
 	}
 	return nil, errors.New(fmt.Sprintf("Unknown site vendor %s", s.Vendor))
@@ -52,34 +55,53 @@ func (a testApp) createSolarClient(s site) (solarClient, error) {
 
 type testCarVendor struct{}
 
-func (c testCarVendor) getCarData(CarID int64) (*carData, error) {
+func (c testCarVendor) getCarData(ctx context.Context, CarID int64) (*carData, error) {
 	return nil, nil
 }
 
-func (c testCarVendor) stopCharging(CarID int64) error {
+func (c testCarVendor) stopCharging(ctx context.Context, CarID int64) error {
 	if CarID == 3456 {
 		return errors.New("stopCharging")
 	}
 	return nil
 }
 
-func (c testCarVendor) startCharging(CarID int64) error {
+func (c testCarVendor) startCharging(ctx context.Context, CarID int64) error {
 	if CarID == 3456 {
 		return errors.New("startCharging")
 	}
 	return nil
 }
 
+func (c testCarVendor) setChargingAmps(ctx context.Context, CarID int64, amps int32) error {
+	if CarID == 3456 {
+		return errors.New("setChargingAmps")
+	}
+	return nil
+}
+
 func (a testApp) createCarClient(c car) (carClient, error) {
 	return testCarVendor{}, nil
 }
 
-func (a testApp) getFirestoreClient() *firestore.Client {
-	return a.fc
+func (a testApp) createTariff(s site) (tariff.Source, error) {
+	return nil, nil
+}
+
+func (a testApp) createPublisher(s site) (decisionPublisher, error) {
+	return nil, nil
+}
+
+func (a testApp) createGridMeter(s site) (gridMeter, error) {
+	return nil, nil
+}
+
+func (a testApp) getStore() store {
+	return a.st
 }
 
 func (a testApp) close() error {
-	return a.fc.Close()
+	return a.st.close()
 }
 
 /*func TestSolarChargeTesla(t *testing.T) {
@@ -110,8 +132,8 @@ func (a testApp) close() error {
  */
 
 func setupTestSite(a *testApp, ctx context.Context, solarPower float64, lastUpdated time.Time) {
-	d := a.fc.Doc("sites/site1")
-	d.Set(ctx, site{
+	a.st.setSite(ctx, site{
+		documentId:  "site1",
 		Name:        "Test",
 		Vendor:      "TestSolarVendor",
 		SiteId:      123,
@@ -153,9 +175,40 @@ func TestReadSites(t *testing.T) {
 	}
 }
 
+func TestReadSitesPowerFlow(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		consumption   float64
+		wantExport    float64
+		wantImport    float64
+		wantAvailable float64
+	}{
+		{consumption: 1200.0, wantExport: 2800.0, wantAvailable: 2800.0},
+		{consumption: 4500.0, wantImport: 500.0, wantAvailable: -500.0},
+	}
+
+	for _, test := range tests {
+		app := createTestApp(ctx, 4000.0)
+		app.consumption = test.consumption
+		setupTestSite(app, ctx, 0, time.Time{})
+		sites, err := readSites(app, ctx)
+		if err != nil {
+			t.Fatalf("Failed with err %v", err)
+		}
+		s := sites[0]
+		if !s.GridMetered || s.GridExport != test.wantExport || s.GridImport != test.wantImport {
+			t.Fatalf("Want export %f and import %f got %+v", test.wantExport, test.wantImport, s)
+		}
+		if power := s.availablePower(car{}); power != test.wantAvailable {
+			t.Fatalf("Want %f available got %f", test.wantAvailable, power)
+		}
+		app.close()
+	}
+}
+
 func setupTestCar(a *testApp, ctx context.Context, solarPower float64, lastUpdated time.Time) {
-	d := a.fc.Doc("sites/site1")
-	d.Set(ctx, site{
+	a.st.setSite(ctx, site{
+		documentId:  "site1",
 		Name:        "Test",
 		Vendor:      "TestSolarVendor",
 		SiteId:      123,
@@ -183,7 +236,8 @@ func TestStartStopCharge(t *testing.T) {
 
 		{c: car{CarID: 3456, IsCharging: false, BatteryLevel: 40, ChargeLimit: 70, IsPluggedIn: true}, s: site{SolarPower: 400.0, StartChargeThreshold: 500.0}, want: "nil"},
 
-		{c: car{CarID: 3456, IsCharging: true, ChargeLimit: 70, IsChargingBySolar: true}, s: site{SolarPower: 1000.0, StopChargeThreshold: 500.0}, want: "nil"},
+		{c: car{CarID: 3456, IsCharging: true, ChargeLimit: 70, IsChargingBySolar: true}, s: site{SolarPower: 1000.0, StopChargeThreshold: 500.0}, want: "setChargingAmps"},
+		{c: car{CarID: 3456, IsCharging: true, ChargeLimit: 70, IsChargingBySolar: true, ChargeAmps: 5}, s: site{SolarPower: 1000.0, StopChargeThreshold: 500.0}, want: "nil"},
 		{c: car{CarID: 3456, IsCharging: true, ChargeLimit: 70, IsChargingBySolar: true}, s: site{SolarPower: 400.0, StopChargeThreshold: 500.0}, want: "stopCharging"},
 
 		// too little solar will stop charging
@@ -204,18 +258,80 @@ func TestStartStopCharge(t *testing.T) {
 	}
 
 	c := car{CarID: 1, IsCharging: false, BatteryLevel: 40, ChargeLimit: 70, IsPluggedIn: true, documentId: "document-id"}
-	d := app.fc.Doc("cars/document-id")
-	d.Set(ctx, c);
+	app.st.setCar(ctx, c);
 	err := startStopCharge(app, site{SolarPower: 1000.0, StartChargeThreshold: 500.0}, c, ctx)
 	if err != nil {
 		t.Fatalf("Testing setIsChargingBySolar err: %v+", err)
 	}
-	snap, err := d.Get(ctx)
-	err = snap.DataTo(&c)
+	c, err = app.st.getCar(ctx, "document-id")
 	if err != nil {
 		t.Fatalf("Testing setIsChargingBySolar err: %v+", err)
 	}
 	if (c.IsChargingBySolar != true) {
 		t.Fatalf("IsChargingBySolar %v should have been set to true", c.IsChargingBySolar)
 	}
+	if c.ChargeAmps != 5 {
+		t.Fatalf("ChargeAmps %d should have been set to 5", c.ChargeAmps)
+	}
+}
+
+func TestChargingAmps(t *testing.T) {
+	tests := []struct {
+		power float64
+		c     car
+		want  int32
+	}{
+		{power: 2300.0, c: car{}, want: 10},
+		{power: 2300.0, c: car{ChargerVoltage: 2, ChargerPhases: 0}, want: 10},
+		{power: 11000.0, c: car{ChargerVoltage: 230, ChargerPhases: 3}, want: 15},
+		{power: 11000.0, c: car{ChargerVoltage: 230, ChargerPhases: 3, MaxChargeAmps: 10}, want: 10},
+		{power: 500.0, c: car{}, want: 5},
+		{power: 500.0, c: car{MinChargeAmps: 1}, want: 2},
+	}
+
+	for _, test := range tests {
+		amps := chargingAmps(test.power, test.c)
+		if amps != test.want {
+			t.Errorf("Want %d amps got %d for %f W and car %v+", test.want, amps, test.power, test.c)
+		}
+	}
+}
+
+func TestAvailablePower(t *testing.T) {
+	tests := []struct {
+		s    site
+		c    car
+		want float64
+	}{
+		{s: site{SolarPower: 3000.0}, c: car{}, want: 3000.0},
+		{s: site{SolarPower: 3000.0, GridMetered: true, GridExport: 1000.0}, c: car{}, want: 1000.0},
+		{s: site{SolarPower: 3000.0, GridMetered: true, GridImport: 500.0}, c: car{}, want: -500.0},
+		{s: site{SolarPower: 5000.0, GridMetered: true, GridExport: 200.0}, c: car{IsCharging: true, ChargerActualCurrent: 10, ChargerVoltage: 230, ChargerPhases: 1}, want: 2500.0},
+		{s: site{SolarPower: 5000.0, GridMetered: true, GridImport: 300.0}, c: car{IsCharging: true, ChargerActualCurrent: 6, ChargerVoltage: 230, ChargerPhases: 3}, want: 3840.0},
+	}
+
+	for _, test := range tests {
+		power := test.s.availablePower(test.c)
+		if power != test.want {
+			t.Errorf("Want %f got %f for site %v+ and car %v+", test.want, power, test.s, test.c)
+		}
+	}
+}
+
+func TestCarsAtSite(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := site{Latitude: 59.3, Longitude: 18.1}
+	cars := []car{
+		{Name: "parked", Latitude: 59.3, Longitude: 18.1, ShiftState: "P", LastUpdated: now},
+		{Name: "away", Latitude: 57.7, Longitude: 11.9, LastUpdated: now},
+		{Name: "reversing", Latitude: 59.3, Longitude: 18.1, ShiftState: "R", LastUpdated: now},
+		{Name: "rolling", Latitude: 59.3, Longitude: 18.1, Speed: 3, LastUpdated: now.Add(-time.Minute)},
+		{Name: "supercharging", Latitude: 59.3, Longitude: 18.1, FastChargerPresent: true, LastUpdated: now},
+		// Seen driving at the site a while ago, it may have been leaving.
+		{Name: "leaving", Latitude: 59.3, Longitude: 18.1, ShiftState: "D", Speed: 5, LastUpdated: now.Add(-10 * time.Minute)},
+	}
+	cs := carsAtSite(s, cars)
+	if len(cs) != 1 || cs[0].Name != "parked" {
+		t.Fatalf("Expected the parked car got %+v", cs)
+	}
 }
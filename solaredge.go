@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
+const solarEdgeBaseURL = "https://monitoringapi.solaredge.com"
+
 type CurrentPower struct {
 	Power float64 `json:"power"`
 }
@@ -40,27 +44,65 @@ type OverviewResponse struct {
 	SitesOverviews SitesOverviews `json:"sitesOverviews"`
 }
 
+type PowerFlowConnection struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type PowerFlowElement struct {
+	Status       string  `json:"status"`
+	CurrentPower float64 `json:"currentPower"`
+}
+
+type SiteCurrentPowerFlow struct {
+	Unit        string                `json:"unit"`
+	Connections []PowerFlowConnection `json:"connections"`
+	Grid        *PowerFlowElement     `json:"GRID"`
+	Load        *PowerFlowElement     `json:"LOAD"`
+	PV          *PowerFlowElement     `json:"PV"`
+}
+
+type PowerFlowResponse struct {
+	SiteCurrentPowerFlow SiteCurrentPowerFlow `json:"siteCurrentPowerFlow"`
+}
+
 type solarEdgeClient struct {
-	apiKey string
-	siteId int
+	apiKey  string
+	siteId  int
+	baseURL string
 }
 
-func (s solarEdgeClient) getCurrentPower() (float64, error) {
-	var o OverviewResponse
-	v := url.Values{}
-	v.Set("api_key", s.apiKey)
-	u := url.URL{
-		Scheme:   "https",
-		Host:     "monitoringapi.solaredge.com",
-		Path:     fmt.Sprintf("sites/%d/overview", s.siteId),
-		RawQuery: v.Encode(),
+func (s solarEdgeClient) get(ctx context.Context, path string, v interface{}) error {
+	baseURL := s.baseURL
+	if baseURL == "" {
+		baseURL = solarEdgeBaseURL
 	}
-	resp, err := http.Get(u.String())
+	u, err := url.Parse(baseURL)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	q := url.Values{}
+	q.Set("api_key", s.apiKey)
+	u.Path = path
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
-	err = json.NewDecoder(resp.Body).Decode(&o)
+	if resp.StatusCode >= 400 {
+		return errors.New(fmt.Sprintf("Status code %d when fetching %s", resp.StatusCode, path))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s solarEdgeClient) getCurrentPower(ctx context.Context) (float64, error) {
+	var o OverviewResponse
+	err := s.get(ctx, fmt.Sprintf("/sites/%d/overview", s.siteId), &o)
 	if err != nil {
 		return 0, err
 	}
@@ -69,3 +111,36 @@ func (s solarEdgeClient) getCurrentPower() (float64, error) {
 	}
 	return o.SitesOverviews.SiteEnergyList[0].SiteOverview.CurrentPower.Power, nil
 }
+
+// getPowerFlow reads the current power flow between the panels, the
+// household load and the grid. The direction to or from the grid is only
+// given by the connections list.
+func (s solarEdgeClient) getPowerFlow(ctx context.Context) (*powerFlow, error) {
+	var r PowerFlowResponse
+	err := s.get(ctx, fmt.Sprintf("/site/%d/currentPowerFlow", s.siteId), &r)
+	if err != nil {
+		return nil, err
+	}
+	f := r.SiteCurrentPowerFlow
+	if f.Grid == nil || f.Load == nil {
+		return nil, errors.New("No grid meter in power flow")
+	}
+	scale := 1.0
+	if strings.EqualFold(f.Unit, "kW") {
+		scale = 1000.0
+	}
+	flow := powerFlow{
+		Consumption: f.Load.CurrentPower * scale,
+	}
+	if f.PV != nil {
+		flow.Production = f.PV.CurrentPower * scale
+	}
+	for _, c := range f.Connections {
+		if strings.EqualFold(c.From, "GRID") {
+			flow.GridImport = f.Grid.CurrentPower * scale
+		} else if strings.EqualFold(c.To, "GRID") {
+			flow.GridExport = f.Grid.CurrentPower * scale
+		}
+	}
+	return &flow, nil
+}
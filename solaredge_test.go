@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newSolarEdgeServer(t *testing.T, path string, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			w.WriteHeader(404)
+			return
+		}
+		if r.URL.Query().Get("api_key") != "abcdefgh" {
+			w.WriteHeader(403)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestSolarEdgeGetCurrentPower(t *testing.T) {
+	ts := newSolarEdgeServer(t, "/sites/123/overview", `{
+		"sitesOverviews": {
+			"count": 1,
+			"siteEnergyList": [{
+				"siteId": 123,
+				"siteOverview": {
+					"lastUpdateTime": "2021-03-01 12:00:00",
+					"lifeTimeData": {"energy": 761985.75},
+					"lastYearData": {"energy": 761985.75},
+					"lastMonthData": {"energy": 492736.7},
+					"lastDayData": {"energy": 1327.3641},
+					"currentPower": {"power": 3412.5},
+					"measuredBy": "INVERTER"
+				}
+			}]
+		}
+	}`)
+	defer ts.Close()
+
+	c := solarEdgeClient{apiKey: "abcdefgh", siteId: 123, baseURL: ts.URL}
+	power, err := c.getCurrentPower(context.Background())
+	if err != nil {
+		t.Fatalf("Didnt expect error fetching current power %v", err)
+	}
+	if power != 3412.5 {
+		t.Fatalf("Expected power 3412.5 but was %f", power)
+	}
+}
+
+func TestSolarEdgeGetPowerFlow(t *testing.T) {
+	tests := []struct {
+		connections string
+		want        powerFlow
+	}{
+		{
+			connections: `[{"from": "PV", "to": "Load"}, {"from": "LOAD", "to": "Grid"}]`,
+			want:        powerFlow{Production: 4200.0, Consumption: 1300.0, GridExport: 2900.0},
+		},
+		{
+			connections: `[{"from": "PV", "to": "Load"}, {"from": "GRID", "to": "Load"}]`,
+			want:        powerFlow{Production: 4200.0, Consumption: 1300.0, GridImport: 2900.0},
+		},
+	}
+
+	for _, test := range tests {
+		ts := newSolarEdgeServer(t, "/site/123/currentPowerFlow", fmt.Sprintf(`{
+			"siteCurrentPowerFlow": {
+				"updateRefreshRate": 3,
+				"unit": "kW",
+				"connections": %s,
+				"GRID": {"status": "Active", "currentPower": 2.9},
+				"LOAD": {"status": "Active", "currentPower": 1.3},
+				"PV": {"status": "Active", "currentPower": 4.2}
+			}
+		}`, test.connections))
+
+		c := solarEdgeClient{apiKey: "abcdefgh", siteId: 123, baseURL: ts.URL}
+		flow, err := c.getPowerFlow(context.Background())
+		ts.Close()
+		if err != nil {
+			t.Fatalf("Didnt expect error fetching power flow %v", err)
+		}
+		if *flow != test.want {
+			t.Errorf("Expected flow %v+ but was %v+", test.want, *flow)
+		}
+	}
+}
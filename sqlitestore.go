@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps sites and cars as json documents in a SQLite database,
+// for running without any cloud services.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// Writes are serialized by SQLite anyway, a single connection avoids
+	// busy errors between transactions.
+	db.SetMaxOpenConns(1)
+	for _, table := range []string{"sites", "cars"} {
+		_, err = db.Exec("CREATE TABLE IF NOT EXISTS " + table + " (id TEXT PRIMARY KEY, data TEXT NOT NULL)")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func decodeDocument(data string, v interface{}) error {
+	var f map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &f); err != nil {
+		return err
+	}
+	converted := fields{}
+	for name, value := range f {
+		converted[name] = value
+	}
+	return setFields(v, converted)
+}
+
+func (ss *sqliteStore) list(ctx context.Context, table string, each func(id string, data string) error) error {
+	rows, err := ss.db.QueryContext(ctx, "SELECT id, data FROM "+table+" ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		if err := each(id, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (ss *sqliteStore) listSites(ctx context.Context) ([]site, error) {
+	sites := []site{}
+	err := ss.list(ctx, "sites", func(id string, data string) error {
+		s := site{documentId: id}
+		if err := decodeDocument(data, &s); err != nil {
+			return err
+		}
+		sites = append(sites, s)
+		return nil
+	})
+	return sites, err
+}
+
+func (ss *sqliteStore) listCars(ctx context.Context) ([]car, error) {
+	cars := []car{}
+	err := ss.list(ctx, "cars", func(id string, data string) error {
+		c := car{documentId: id}
+		if err := decodeDocument(data, &c); err != nil {
+			return err
+		}
+		cars = append(cars, c)
+		return nil
+	})
+	return cars, err
+}
+
+func (ss *sqliteStore) get(ctx context.Context, table string, id string, v interface{}) error {
+	var data string
+	err := ss.db.QueryRowContext(ctx, "SELECT data FROM "+table+" WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return decodeDocument(data, v)
+}
+
+func (ss *sqliteStore) getSite(ctx context.Context, id string) (site, error) {
+	s := site{documentId: id}
+	err := ss.get(ctx, "sites", id, &s)
+	return s, err
+}
+
+func (ss *sqliteStore) getCar(ctx context.Context, id string) (car, error) {
+	c := car{documentId: id}
+	err := ss.get(ctx, "cars", id, &c)
+	return c, err
+}
+
+func (ss *sqliteStore) set(ctx context.Context, table string, id string, v interface{}) error {
+	data, err := json.Marshal(toFields(v))
+	if err != nil {
+		return err
+	}
+	_, err = ss.db.ExecContext(ctx, "INSERT OR REPLACE INTO "+table+" (id, data) VALUES (?, ?)", id, string(data))
+	return err
+}
+
+func (ss *sqliteStore) setSite(ctx context.Context, s site) error {
+	return ss.set(ctx, "sites", s.documentId, s)
+}
+
+func (ss *sqliteStore) setCar(ctx context.Context, c car) error {
+	return ss.set(ctx, "cars", c.documentId, c)
+}
+
+// update reads, changes and writes a document in one transaction.
+func (ss *sqliteStore) update(ctx context.Context, table string, id string, v interface{}, f fields) error {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var data string
+	err = tx.QueryRowContext(ctx, "SELECT data FROM "+table+" WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := decodeDocument(data, v); err != nil {
+		return err
+	}
+	if err := setFields(v, f); err != nil {
+		return err
+	}
+	b, err := json.Marshal(toFields(v))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE "+table+" SET data = ? WHERE id = ?", string(b), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ss *sqliteStore) updateSite(ctx context.Context, id string, f fields) error {
+	return ss.update(ctx, "sites", id, &site{}, f)
+}
+
+func (ss *sqliteStore) updateCar(ctx context.Context, id string, f fields) error {
+	return ss.update(ctx, "cars", id, &car{}, f)
+}
+
+func (ss *sqliteStore) close() error {
+	return ss.db.Close()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+var errNotFound = errors.New("Document not found")
+
+// fields maps document field names, as given by the firestore struct tags,
+// to values.
+type fields map[string]interface{}
+
+// store keeps the sites and cars. Documents are identified by their
+// documentId, updates of fields are atomic.
+type store interface {
+	listSites(ctx context.Context) ([]site, error)
+	listCars(ctx context.Context) ([]car, error)
+	getSite(ctx context.Context, id string) (site, error)
+	getCar(ctx context.Context, id string) (car, error)
+	setSite(ctx context.Context, s site) error
+	setCar(ctx context.Context, c car) error
+	updateSite(ctx context.Context, id string, f fields) error
+	updateCar(ctx context.Context, id string, f fields) error
+	close() error
+}
+
+// createStore creates the store selected by the STORE environment variable,
+// firestore unless set.
+func createStore(ctx context.Context) (store, error) {
+	switch os.Getenv("STORE") {
+	case "", "firestore":
+		projectID := os.Getenv("GCP_PROJECT_ID")
+		if projectID == "" {
+			projectID = "default"
+		}
+		return newFirestoreStore(ctx, projectID)
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "solarchargetesla.db"
+		}
+		return newSQLiteStore(path)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown store %s", os.Getenv("STORE")))
+}
+
+func fieldName(f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("firestore"), ",")[0]
+	if tag == "-" || f.PkgPath != "" {
+		return ""
+	}
+	if tag == "" {
+		return f.Name
+	}
+	return tag
+}
+
+// toFields returns the stored fields of a site or car, or a pointer to one.
+func toFields(v interface{}) fields {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	f := fields{}
+	for i := 0; i < rv.NumField(); i++ {
+		if name := fieldName(rv.Type().Field(i)); name != "" {
+			f[name] = rv.Field(i).Interface()
+		}
+	}
+	return f
+}
+
+// setFields sets the fields f of the site or car pointed to by v. Values are
+// converted through json, so f can also hold json.RawMessage.
+func setFields(v interface{}, f fields) error {
+	rv := reflect.ValueOf(v).Elem()
+	index := map[string]int{}
+	for i := 0; i < rv.NumField(); i++ {
+		if name := fieldName(rv.Type().Field(i)); name != "" {
+			index[name] = i
+		}
+	}
+	for name, value := range f {
+		i, ok := index[name]
+		if !ok {
+			return errors.New(fmt.Sprintf("Unknown field %s", name))
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		field := rv.Field(i)
+		field.Set(reflect.Zero(field.Type()))
+		err = json.Unmarshal(b, field.Addr().Interface())
+		if err != nil {
+			return errors.New(fmt.Sprintf("Field %s: %v", name, err))
+		}
+	}
+	return nil
+}
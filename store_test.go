@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, st store) {
+	ctx := context.Background()
+	defer st.close()
+
+	if _, err := st.getSite(ctx, "missing"); err != errNotFound {
+		t.Fatalf("Want errNotFound for missing site got %v", err)
+	}
+	if _, err := st.getCar(ctx, "missing"); err != errNotFound {
+		t.Fatalf("Want errNotFound for missing car got %v", err)
+	}
+	if err := st.updateCar(ctx, "missing", fields{"chargeAmps": 5}); err != errNotFound {
+		t.Fatalf("Want errNotFound updating missing car got %v", err)
+	}
+
+	lastUpdated := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	err := st.setSite(ctx, site{documentId: "site1", Name: "Test", SiteId: 123, SolarPower: 800.0, LastUpdated: lastUpdated})
+	if err != nil {
+		t.Fatalf("setSite err: %v", err)
+	}
+	err = st.setSite(ctx, site{documentId: "site2", Name: "Other"})
+	if err != nil {
+		t.Fatalf("setSite err: %v", err)
+	}
+	err = st.updateSite(ctx, "site1", fields{
+		"solarPower":   1200.0,
+		"powerSamples": []powerSample{{Time: lastUpdated, Power: 1200.0}},
+	})
+	if err != nil {
+		t.Fatalf("updateSite err: %v", err)
+	}
+	sites, err := st.listSites(ctx)
+	if err != nil {
+		t.Fatalf("listSites err: %v", err)
+	}
+	if len(sites) != 2 {
+		t.Fatalf("Want 2 sites got %v", sites)
+	}
+	s, err := st.getSite(ctx, "site1")
+	if err != nil {
+		t.Fatalf("getSite err: %v", err)
+	}
+	if s.documentId != "site1" || s.Name != "Test" || s.SiteId != 123 || s.SolarPower != 1200.0 {
+		t.Fatalf("Unexpected site %+v", s)
+	}
+	if !s.LastUpdated.Equal(lastUpdated) {
+		t.Fatalf("Want lastUpdated %v got %v", lastUpdated, s.LastUpdated)
+	}
+	if len(s.PowerSamples) != 1 || s.PowerSamples[0].Power != 1200.0 {
+		t.Fatalf("Unexpected power samples %v", s.PowerSamples)
+	}
+
+	err = st.setCar(ctx, car{documentId: "car1", CarID: 1, AccessToken: "access", BatteryLevel: 40, ChargeLimit: 70})
+	if err != nil {
+		t.Fatalf("setCar err: %v", err)
+	}
+	err = st.updateCar(ctx, "car1", fields{"batteryLevel": 50, "isChargingBySolar": true, "chargeAmps": int32(8)})
+	if err != nil {
+		t.Fatalf("updateCar err: %v", err)
+	}
+	c, err := st.getCar(ctx, "car1")
+	if err != nil {
+		t.Fatalf("getCar err: %v", err)
+	}
+	if c.documentId != "car1" || c.AccessToken != "access" || c.ChargeLimit != 70 {
+		t.Fatalf("Update changed other fields %+v", c)
+	}
+	if c.BatteryLevel != 50 || !c.IsChargingBySolar || c.ChargeAmps != 8 {
+		t.Fatalf("Update not stored %+v", c)
+	}
+	cars, err := st.listCars(ctx)
+	if err != nil {
+		t.Fatalf("listCars err: %v", err)
+	}
+	if len(cars) != 1 || cars[0].documentId != "car1" {
+		t.Fatalf("Unexpected cars %v", cars)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, newMemoryStore())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solarchargetesla")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := newSQLiteStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("newSQLiteStore err: %v", err)
+	}
+	testStore(t, st)
+}
+
+func TestFirestoreStore(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("No firestore emulator running, start with:\ngcloud beta emulators firestore start")
+	}
+	st, err := newFirestoreStore(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("newFirestoreStore err: %v", err)
+	}
+	testStore(t, st)
+}
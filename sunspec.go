@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"math"
+
+	"github.com/stelund/solarchargetesla/sunspec"
+)
+
+// sunspecClient reads an inverter, and the meter at the grid connection if
+// the same unit has one, over Modbus TCP. Power is read within a second.
+type sunspecClient struct {
+	host   string
+	unitID byte
+}
+
+func (s sunspecClient) open(ctx context.Context) (*sunspec.Device, error) {
+	unitID := s.unitID
+	if unitID == 0 {
+		unitID = 1
+	}
+	return sunspec.Open(ctx, s.host, unitID)
+}
+
+func (s sunspecClient) getCurrentPower(ctx context.Context) (float64, error) {
+	d, err := s.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+	inv, err := d.Inverter(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return inv.Power, nil
+}
+
+// getPowerFlow follows the SunSpec convention, the meter's power is positive
+// when importing from the grid.
+func (s sunspecClient) getPowerFlow(ctx context.Context) (*powerFlow, error) {
+	d, err := s.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	inv, err := d.Inverter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.Meter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	flow := powerFlow{
+		Production:  inv.Power,
+		Consumption: inv.Power + m.Power,
+	}
+	if m.Power > 0 {
+		flow.GridImport = m.Power
+	} else {
+		flow.GridExport = -m.Power
+	}
+	if m.PhaseCurrent != [3]float64{} {
+		flow.PhaseMetered = true
+		for i, a := range m.PhaseCurrent {
+			// The meter's currents are unsigned, exported phases are
+			// negative.
+			flow.PhaseCurrents[i] = math.Abs(a)
+			if m.PhasePower[i] < 0 {
+				flow.PhaseCurrents[i] = -flow.PhaseCurrents[i]
+			}
+		}
+	}
+	return &flow, nil
+}
@@ -0,0 +1,170 @@
+// Package sunspec reads SunSpec devices, such as inverters and meters, over
+// Modbus TCP.
+package sunspec
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPort is the Modbus TCP port.
+	DefaultPort = "502"
+	// DefaultTimeout of requests when the context has no deadline.
+	DefaultTimeout = 5 * time.Second
+
+	readHoldingRegisters = 0x03
+	// maxRegisters is the most registers read by one request.
+	maxRegisters = 125
+)
+
+// ModbusError is an exception returned by the device.
+type ModbusError struct {
+	Function  byte
+	Exception byte
+}
+
+func (e ModbusError) Error() string {
+	return fmt.Sprintf("modbus exception %d for function %d", e.Exception, e.Function)
+}
+
+// Client is a Modbus TCP client for one unit. Requests are serialized, it is
+// safe for concurrent use.
+type Client struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	unitID byte
+	txID   uint16
+}
+
+// Dial connects to the unit at address, a host with an optional port.
+func Dial(ctx context.Context, address string, unitID byte) (*Client, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultPort)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, unitID: unitID}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// ReadHoldingRegisters reads count registers starting at addr.
+func (c *Client) ReadHoldingRegisters(ctx context.Context, addr uint16, count uint16) ([]uint16, error) {
+	registers := make([]uint16, 0, count)
+	for count > 0 {
+		n := count
+		if n > maxRegisters {
+			n = maxRegisters
+		}
+		r, err := c.readHoldingRegisters(ctx, addr, n)
+		if err != nil {
+			return nil, err
+		}
+		registers = append(registers, r...)
+		addr += n
+		count -= n
+	}
+	return registers, nil
+}
+
+func (c *Client) readHoldingRegisters(ctx context.Context, addr uint16, count uint16) ([]uint16, error) {
+	pdu := make([]byte, 5)
+	pdu[0] = readHoldingRegisters
+	binary.BigEndian.PutUint16(pdu[1:], addr)
+	binary.BigEndian.PutUint16(pdu[3:], count)
+	resp, err := c.request(ctx, pdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || int(resp[1]) != 2*int(count) || len(resp) != 2+2*int(count) {
+		return nil, errors.New("sunspec: short read holding registers response")
+	}
+	registers := make([]uint16, count)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(resp[2+2*i:])
+	}
+	return registers, nil
+}
+
+// request sends a pdu and returns the response pdu. A cancelled ctx aborts
+// the request.
+func (c *Client) request(ctx context.Context, pdu []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	c.txID++
+	frame := make([]byte, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], c.txID)
+	binary.BigEndian.PutUint16(frame[2:], 0)
+	binary.BigEndian.PutUint16(frame[4:], uint16(1+len(pdu)))
+	frame[6] = c.unitID
+	copy(frame[7:], pdu)
+	if _, err := c.conn.Write(frame); err != nil {
+		return nil, c.contextErr(ctx, err)
+	}
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			return nil, c.contextErr(ctx, err)
+		}
+		length := binary.BigEndian.Uint16(header[4:])
+		// The unit id, the function and at least the exception code or
+		// byte count.
+		if length < 3 || length > 254 {
+			return nil, errors.New("sunspec: invalid response length")
+		}
+		resp := make([]byte, length-1)
+		if _, err := io.ReadFull(c.conn, resp); err != nil {
+			return nil, c.contextErr(ctx, err)
+		}
+		if binary.BigEndian.Uint16(header[0:]) != c.txID {
+			// A late response to an earlier, timed out, request.
+			continue
+		}
+		if resp[0] == pdu[0]|0x80 {
+			return nil, ModbusError{Function: pdu[0], Exception: resp[1]}
+		}
+		if resp[0] != pdu[0] {
+			return nil, errors.New("sunspec: unexpected function in response")
+		}
+		return resp, nil
+	}
+}
+
+func (c *Client) contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
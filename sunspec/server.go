@@ -0,0 +1,149 @@
+package sunspec
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+const illegalDataAddress = 0x02
+
+// Server is a minimal Modbus TCP server that serves holding registers. It
+// stands in for a device in tests.
+type Server struct {
+	mu        sync.Mutex
+	registers map[uint16]uint16
+	conns     map[net.Conn]bool
+	ln        net.Listener
+	wg        sync.WaitGroup
+}
+
+// NewServer listens on address, such as "127.0.0.1:0", and serves until
+// closed.
+func NewServer(address string) (*Server, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{registers: map[uint16]uint16{}, conns: map[net.Conn]bool{}, ln: ln}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr is the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes its connections.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// SetRegisters sets the registers starting at addr.
+func (s *Server) SetRegisters(addr uint16, values []uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range values {
+		s.registers[addr+uint16(i)] = v
+	}
+}
+
+// ModelBlock is a model served by the server, Data holds its points.
+type ModelBlock struct {
+	ID   uint16
+	Data []uint16
+}
+
+// SetModels lays out a SunSpec register map at base with the models and
+// the end marker.
+func (s *Server) SetModels(base uint16, models ...ModelBlock) {
+	r := []uint16{Marker[0], Marker[1]}
+	for _, m := range models {
+		r = append(r, m.ID, uint16(len(m.Data)))
+		r = append(r, m.Data...)
+	}
+	r = append(r, EndID, 0)
+	s.SetRegisters(base, r)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			conn.Close()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint16(header[4:])
+		if length < 2 {
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		resp := s.respond(pdu)
+		frame := make([]byte, 7+len(resp))
+		copy(frame, header[:4])
+		binary.BigEndian.PutUint16(frame[4:], uint16(1+len(resp)))
+		frame[6] = header[6]
+		copy(frame[7:], resp)
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// respond reads holding registers, other functions and registers that are
+// not set are answered with exceptions.
+func (s *Server) respond(pdu []byte) []byte {
+	if pdu[0] != readHoldingRegisters || len(pdu) != 5 {
+		return []byte{pdu[0] | 0x80, 0x01}
+	}
+	addr := binary.BigEndian.Uint16(pdu[1:])
+	count := binary.BigEndian.Uint16(pdu[3:])
+	if count == 0 || count > maxRegisters {
+		return []byte{pdu[0] | 0x80, 0x03}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := []byte{pdu[0], byte(2 * count)}
+	for i := uint16(0); i < count; i++ {
+		v, ok := s.registers[addr+i]
+		if !ok {
+			return []byte{pdu[0] | 0x80, illegalDataAddress}
+		}
+		resp = append(resp, byte(v>>8), byte(v))
+	}
+	return resp
+}
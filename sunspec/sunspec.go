@@ -0,0 +1,252 @@
+package sunspec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// BaseAddresses are where devices place the SunSpec register map, tried in
+// order.
+var BaseAddresses = []uint16{40000, 0, 50000}
+
+// Marker is the "SunS" identifier at the base address.
+var Marker = [2]uint16{0x5375, 0x6e53}
+
+// EndID marks the end of the model list.
+const EndID = 0xffff
+
+// Model ids.
+const (
+	CommonID             = 1
+	InverterSinglePhase  = 101
+	InverterSplitPhase   = 102
+	InverterThreePhase   = 103
+	MeterSinglePhase     = 201
+	MeterSplitPhase      = 202
+	MeterWyeThreePhase   = 203
+	MeterDeltaThreePhase = 204
+)
+
+// maxModels bounds the discovery of a device with a broken model list.
+const maxModels = 64
+
+// Model is a model found on the device. Addr is the address of its first
+// point, after the id and length registers.
+type Model struct {
+	ID     uint16
+	Addr   uint16
+	Length uint16
+}
+
+// Common is the common model, identifying the device.
+type Common struct {
+	Manufacturer string
+	Model        string
+	Version      string
+	SerialNumber string
+}
+
+// Inverter is read from an integer inverter model, 101 to 103. Power is in
+// watts, current in amperes, energy in watt hours.
+type Inverter struct {
+	Power     float64
+	Current   float64
+	Frequency float64
+	Energy    float64
+	State     uint16
+}
+
+// Meter is read from an integer meter model, 201 to 204. SunSpec meters
+// report power as positive when importing, that is power delivered to the
+// site. Phases missing on the meter are zero.
+type Meter struct {
+	Power        float64
+	PhasePower   [3]float64
+	PhaseCurrent [3]float64
+	Frequency    float64
+}
+
+// Device is a SunSpec device with its discovered models.
+type Device struct {
+	Client *Client
+	Models []Model
+}
+
+// Open connects to the unit at address and discovers its models.
+func Open(ctx context.Context, address string, unitID byte) (*Device, error) {
+	c, err := Dial(ctx, address, unitID)
+	if err != nil {
+		return nil, err
+	}
+	models, err := Discover(ctx, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &Device{Client: c, Models: models}, nil
+}
+
+// Close closes the connection to the device.
+func (d *Device) Close() error {
+	return d.Client.Close()
+}
+
+// Discover finds the SunSpec base address and walks the list of models.
+func Discover(ctx context.Context, c *Client) ([]Model, error) {
+	for _, base := range BaseAddresses {
+		r, err := c.ReadHoldingRegisters(ctx, base, 2)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var me ModbusError
+		if errors.As(err, &me) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if r[0] != Marker[0] || r[1] != Marker[1] {
+			continue
+		}
+		return walkModels(ctx, c, base+2)
+	}
+	return nil, errors.New("sunspec: no SunSpec marker found")
+}
+
+func walkModels(ctx context.Context, c *Client, addr uint16) ([]Model, error) {
+	models := []Model{}
+	for i := 0; i < maxModels; i++ {
+		r, err := c.ReadHoldingRegisters(ctx, addr, 2)
+		if err != nil {
+			return nil, err
+		}
+		if r[0] == EndID {
+			return models, nil
+		}
+		models = append(models, Model{ID: r[0], Addr: addr + 2, Length: r[1]})
+		addr += 2 + r[1]
+	}
+	return nil, errors.New("sunspec: no end of model list")
+}
+
+// Find returns the first of the device's models with one of ids.
+func (d *Device) Find(ids ...uint16) (Model, bool) {
+	for _, m := range d.Models {
+		for _, id := range ids {
+			if m.ID == id {
+				return m, true
+			}
+		}
+	}
+	return Model{}, false
+}
+
+func (d *Device) read(ctx context.Context, minLength uint16, ids ...uint16) ([]uint16, error) {
+	m, ok := d.Find(ids...)
+	if !ok {
+		return nil, fmt.Errorf("sunspec: no model %v", ids)
+	}
+	if m.Length < minLength {
+		return nil, fmt.Errorf("sunspec: model %d is too short", m.ID)
+	}
+	return d.Client.ReadHoldingRegisters(ctx, m.Addr, minLength)
+}
+
+// Common reads the common model.
+func (d *Device) Common(ctx context.Context) (Common, error) {
+	r, err := d.read(ctx, 64, CommonID)
+	if err != nil {
+		return Common{}, err
+	}
+	return Common{
+		Manufacturer: decodeString(r[0:16]),
+		Model:        decodeString(r[16:32]),
+		Version:      decodeString(r[40:48]),
+		SerialNumber: decodeString(r[48:64]),
+	}, nil
+}
+
+// Inverter reads the inverter model.
+func (d *Device) Inverter(ctx context.Context) (Inverter, error) {
+	r, err := d.read(ctx, 37, InverterSinglePhase, InverterSplitPhase, InverterThreePhase)
+	if err != nil {
+		return Inverter{}, err
+	}
+	inv := Inverter{
+		Current:   scaled(int16Value(r[0]), r[4]),
+		Power:     scaled(int16Value(r[12]), r[13]),
+		Frequency: scaled(uint16Value(r[14]), r[15]),
+		Energy:    scaled(acc32Value(r[22], r[23]), r[24]),
+		State:     r[36],
+	}
+	return inv, nil
+}
+
+// Meter reads the meter model.
+func (d *Device) Meter(ctx context.Context) (Meter, error) {
+	r, err := d.read(ctx, 21, MeterSinglePhase, MeterSplitPhase, MeterWyeThreePhase, MeterDeltaThreePhase)
+	if err != nil {
+		return Meter{}, err
+	}
+	m := Meter{
+		Power:     scaled(int16Value(r[16]), r[20]),
+		Frequency: scaled(int16Value(r[14]), r[15]),
+	}
+	for i := 0; i < 3; i++ {
+		m.PhaseCurrent[i] = scaled(int16Value(r[1+i]), r[4])
+		m.PhasePower[i] = scaled(int16Value(r[17+i]), r[20])
+	}
+	return m, nil
+}
+
+// Values that are not implemented read as NaN, and as zero once scaled.
+func int16Value(r uint16) float64 {
+	if r == 0x8000 {
+		return math.NaN()
+	}
+	return float64(int16(r))
+}
+
+func uint16Value(r uint16) float64 {
+	if r == 0xffff {
+		return math.NaN()
+	}
+	return float64(r)
+}
+
+func acc32Value(hi uint16, lo uint16) float64 {
+	return float64(uint32(hi)<<16 | uint32(lo))
+}
+
+// scaled applies the scale factor sf, a power of ten.
+func scaled(v float64, sf uint16) float64 {
+	if math.IsNaN(v) || sf == 0x8000 {
+		return 0
+	}
+	e := int(int16(sf))
+	if e < 0 {
+		return v / math.Pow10(-e)
+	}
+	return v * math.Pow10(e)
+}
+
+func decodeString(r []uint16) string {
+	b := make([]byte, 0, 2*len(r))
+	for _, v := range r {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return strings.TrimRight(string(b), "\x00 ")
+}
+
+// EncodeString encodes s into n registers, padded with zeros.
+func EncodeString(s string, n int) []uint16 {
+	b := make([]byte, 2*n)
+	copy(b, s)
+	r := make([]uint16, n)
+	for i := range r {
+		r[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return r
+}
@@ -0,0 +1,232 @@
+package sunspec
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func commonBlock() ModelBlock {
+	data := []uint16{}
+	data = append(data, EncodeString("SolarEdge", 16)...)
+	data = append(data, EncodeString("SE5000H", 16)...)
+	data = append(data, EncodeString("", 8)...)
+	data = append(data, EncodeString("0004.0013.0025", 8)...)
+	data = append(data, EncodeString("7E1234AB", 16)...)
+	data = append(data, 1, 0x8000)
+	return ModelBlock{ID: CommonID, Data: data}
+}
+
+func inverterBlock(id uint16, power int16, powerSF int16) ModelBlock {
+	data := make([]uint16, 50)
+	data[0] = 2153 // A
+	data[4] = uint16(0xfffe)
+	data[12] = uint16(power)
+	data[13] = uint16(powerSF)
+	data[14] = 50012
+	data[15] = uint16(0xfffd)
+	data[22] = 0x0001
+	data[23] = 0x86a0 // 100000
+	data[24] = 1
+	data[36] = 4 // MPPT
+	return ModelBlock{ID: id, Data: data}
+}
+
+func meterBlock(id uint16, power int16, phasePower [3]int16) ModelBlock {
+	data := make([]uint16, 105)
+	data[1] = 512
+	data[2] = 498
+	data[3] = 0x8000
+	data[4] = uint16(0xfffe)
+	data[14] = 5001
+	data[15] = uint16(0xfffe)
+	data[16] = uint16(power)
+	for i, p := range phasePower {
+		data[17+i] = uint16(p)
+	}
+	data[20] = 1
+	return ModelBlock{ID: id, Data: data}
+}
+
+func newTestServer(t *testing.T) *Server {
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start server %v", err)
+	}
+	return s
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		base uint16
+	}{
+		{base: 40000},
+		{base: 0},
+		{base: 50000},
+	}
+
+	for _, test := range tests {
+		s := newTestServer(t)
+		s.SetModels(test.base, commonBlock(), inverterBlock(InverterThreePhase, 3412, 0), meterBlock(MeterWyeThreePhase, -150, [3]int16{-50, -60, -40}))
+		d, err := Open(ctx, s.Addr(), 1)
+		if err != nil {
+			t.Fatalf("Failed to open device at base %d: %v", test.base, err)
+		}
+		want := []Model{
+			{ID: CommonID, Addr: test.base + 4, Length: 66},
+			{ID: InverterThreePhase, Addr: test.base + 72, Length: 50},
+			{ID: MeterWyeThreePhase, Addr: test.base + 124, Length: 105},
+		}
+		if len(d.Models) != len(want) {
+			t.Fatalf("Want models %v got %v", want, d.Models)
+		}
+		for i := range want {
+			if d.Models[i] != want[i] {
+				t.Fatalf("Want models %v got %v", want, d.Models)
+			}
+		}
+		d.Close()
+		s.Close()
+	}
+}
+
+func TestOpenWithoutSunSpec(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.SetRegisters(40000, []uint16{1, 2})
+	if _, err := Open(context.Background(), s.Addr(), 1); err == nil {
+		t.Fatalf("Expected error for device without SunSpec marker")
+	}
+}
+
+func TestModels(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	defer s.Close()
+	s.SetModels(40000, commonBlock(), inverterBlock(InverterSinglePhase, 3412, -1), meterBlock(MeterSinglePhase, -1502, [3]int16{-1502, 0, 0}))
+	d, err := Open(ctx, s.Addr(), 1)
+	if err != nil {
+		t.Fatalf("Failed to open device %v", err)
+	}
+	defer d.Close()
+
+	c, err := d.Common(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read common model %v", err)
+	}
+	if c != (Common{Manufacturer: "SolarEdge", Model: "SE5000H", Version: "0004.0013.0025", SerialNumber: "7E1234AB"}) {
+		t.Fatalf("Unexpected common model %+v", c)
+	}
+
+	inv, err := d.Inverter(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read inverter model %v", err)
+	}
+	if inv.Power != 341.2 || inv.Current != 21.53 || inv.Frequency != 50.012 || inv.Energy != 1000000 || inv.State != 4 {
+		t.Fatalf("Unexpected inverter %+v", inv)
+	}
+
+	m, err := d.Meter(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read meter model %v", err)
+	}
+	if m.Power != -15020 || m.PhasePower != [3]float64{-15020, 0, 0} || m.Frequency != 50.01 {
+		t.Fatalf("Unexpected meter %+v", m)
+	}
+	if m.PhaseCurrent != [3]float64{5.12, 4.98, 0} {
+		t.Fatalf("Unexpected phase currents %v", m.PhaseCurrent)
+	}
+}
+
+func TestMissingModel(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	defer s.Close()
+	s.SetModels(40000, commonBlock(), inverterBlock(InverterSinglePhase, 3412, 0))
+	d, err := Open(ctx, s.Addr(), 1)
+	if err != nil {
+		t.Fatalf("Failed to open device %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Meter(ctx); err == nil {
+		t.Fatalf("Expected error reading missing meter model")
+	}
+}
+
+func TestReadHoldingRegisters(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	defer s.Close()
+	values := make([]uint16, 300)
+	for i := range values {
+		values[i] = uint16(i)
+	}
+	s.SetRegisters(100, values)
+
+	c, err := Dial(ctx, s.Addr(), 1)
+	if err != nil {
+		t.Fatalf("Failed to dial %v", err)
+	}
+	defer c.Close()
+	r, err := c.ReadHoldingRegisters(ctx, 100, 300)
+	if err != nil {
+		t.Fatalf("Failed to read registers %v", err)
+	}
+	for i, v := range r {
+		if v != uint16(i) {
+			t.Fatalf("Register %d is %d", i, v)
+		}
+	}
+
+	_, err = c.ReadHoldingRegisters(ctx, 1000, 2)
+	if me, ok := err.(ModbusError); !ok || me.Exception != illegalDataAddress {
+		t.Fatalf("Expected illegal data address exception got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.ReadHoldingRegisters(cancelled, 100, 2); err != context.Canceled {
+		t.Fatalf("Expected cancelled read got %v", err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, err := c.ReadHoldingRegisters(timeout, 100, 2); err != nil {
+		t.Fatalf("Failed to read registers after cancelled read %v", err)
+	}
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, 12)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		// An exception without its code.
+		conn.Write([]byte{request[0], request[1], 0, 0, 0, 2, request[6], readHoldingRegisters | 0x80})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, l.Addr().String(), 1)
+	if err != nil {
+		t.Fatalf("Failed to dial %v", err)
+	}
+	defer c.Close()
+	if _, err := c.ReadHoldingRegisters(ctx, 100, 2); err == nil || err.Error() != "sunspec: invalid response length" {
+		t.Fatalf("Expected invalid response length got %v", err)
+	}
+}
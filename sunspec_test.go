@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stelund/solarchargetesla/sunspec"
+)
+
+func newSunSpecServer(t *testing.T, meterPower int16) *sunspec.Server {
+	s, err := sunspec.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start modbus server %v", err)
+	}
+	common := sunspec.ModelBlock{ID: sunspec.CommonID, Data: make([]uint16, 66)}
+	inverter := sunspec.ModelBlock{ID: sunspec.InverterThreePhase, Data: make([]uint16, 50)}
+	inverter.Data[12] = 3412
+	meter := sunspec.ModelBlock{ID: sunspec.MeterWyeThreePhase, Data: make([]uint16, 105)}
+	meter.Data[16] = uint16(meterPower)
+	s.SetModels(40000, common, inverter, meter)
+	return s
+}
+
+func TestSunSpecGetCurrentPower(t *testing.T) {
+	s := newSunSpecServer(t, 0)
+	defer s.Close()
+
+	c := sunspecClient{host: s.Addr()}
+	power, err := c.getCurrentPower(context.Background())
+	if err != nil {
+		t.Fatalf("Didnt expect error fetching current power %v", err)
+	}
+	if power != 3412 {
+		t.Fatalf("Expected power 3412 but was %f", power)
+	}
+}
+
+func TestSunSpecGetPowerFlow(t *testing.T) {
+	tests := []struct {
+		meterPower int16
+		want       powerFlow
+	}{
+		{meterPower: -2000, want: powerFlow{Production: 3412, Consumption: 1412, GridExport: 2000}},
+		{meterPower: 500, want: powerFlow{Production: 3412, Consumption: 3912, GridImport: 500}},
+	}
+
+	for _, test := range tests {
+		s := newSunSpecServer(t, test.meterPower)
+		c := sunspecClient{host: s.Addr(), unitID: 1}
+		flow, err := c.getPowerFlow(context.Background())
+		s.Close()
+		if err != nil {
+			t.Fatalf("Didnt expect error fetching power flow %v", err)
+		}
+		if *flow != test.want {
+			t.Fatalf("Expected %+v but was %+v", test.want, *flow)
+		}
+	}
+}
+
+func TestSunSpecPhaseCurrents(t *testing.T) {
+	s, err := sunspec.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start modbus server %v", err)
+	}
+	defer s.Close()
+	common := sunspec.ModelBlock{ID: sunspec.CommonID, Data: make([]uint16, 66)}
+	inverter := sunspec.ModelBlock{ID: sunspec.InverterThreePhase, Data: make([]uint16, 50)}
+	meter := sunspec.ModelBlock{ID: sunspec.MeterWyeThreePhase, Data: make([]uint16, 105)}
+	// 12.5 A imported on L1 and 3.1 A exported on L2.
+	meter.Data[1] = 125
+	meter.Data[2] = 31
+	meter.Data[4] = 0xffff
+	meter.Data[17] = 2875
+	meter.Data[18] = uint16(0xffff - 713 + 1)
+	s.SetModels(40000, common, inverter, meter)
+
+	c := sunspecClient{host: s.Addr(), unitID: 1}
+	flow, err := c.getPowerFlow(context.Background())
+	if err != nil {
+		t.Fatalf("Didnt expect error fetching power flow %v", err)
+	}
+	if !flow.PhaseMetered || flow.PhaseCurrents != [3]float64{12.5, -3.1, 0} {
+		t.Fatalf("Unexpected phase currents %+v", *flow)
+	}
+}
@@ -0,0 +1,207 @@
+// Package tariff provides energy prices from fixed time of use schedules or
+// from day-ahead spot prices, and picks the cheapest hours to charge in.
+package tariff
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Price of energy per kWh between Start and End.
+type Price struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Price float64   `json:"price"`
+}
+
+// Source gives the prices of the hours overlapping from and to.
+type Source interface {
+	Prices(ctx context.Context, from time.Time, to time.Time) ([]Price, error)
+}
+
+// Period of a time of use schedule. From and To are times of day such as
+// 22:00, a period may wrap midnight.
+type Period struct {
+	From  string
+	To    string
+	Price float64
+}
+
+// Schedule is a fixed time of use tariff. Hours not in any period cost
+// Default.
+type Schedule struct {
+	Periods  []Period
+	Default  float64
+	Location *time.Location
+}
+
+func minuteOfDay(tod string) (int, error) {
+	t, err := time.Parse("15:04", tod)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %s: %v", tod, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (p Period) covers(minute int) (bool, error) {
+	from, err := minuteOfDay(p.From)
+	if err != nil {
+		return false, err
+	}
+	to, err := minuteOfDay(p.To)
+	if err != nil {
+		return false, err
+	}
+	if from <= to {
+		return minute >= from && minute < to, nil
+	}
+	return minute >= from || minute < to, nil
+}
+
+// Prices returns hourly prices of the schedule.
+func (s Schedule) Prices(ctx context.Context, from time.Time, to time.Time) ([]Price, error) {
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	// Truncate works on absolute time, the hours start on the wall clock of
+	// zones with half hour offsets too.
+	local := from.In(loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, loc)
+	prices := []Price{}
+	for t := start; t.Before(to); t = t.Add(time.Hour) {
+		price := s.Default
+		minute := t.Hour()*60 + t.Minute()
+		for _, p := range s.Periods {
+			covers, err := p.covers(minute)
+			if err != nil {
+				return nil, err
+			}
+			if covers {
+				price = p.Price
+				break
+			}
+		}
+		prices = append(prices, Price{Start: t, End: t.Add(time.Hour), Price: price})
+	}
+	return prices, nil
+}
+
+// Spot loads day-ahead prices from URL. The prices are either a JSON list of
+// objects with start, end and price, or CSV with the same columns and a
+// header row. Times are in RFC 3339.
+type Spot struct {
+	URL    string
+	Client *http.Client
+}
+
+// Prices fetches the spot prices and returns those overlapping from and to.
+func (s Spot) Prices(ctx context.Context, from time.Time, to time.Time) ([]Price, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("status code %d when fetching spot prices", resp.StatusCode)
+	}
+	var prices []Price
+	if strings.Contains(resp.Header.Get("Content-Type"), "csv") || strings.HasSuffix(s.URL, ".csv") {
+		prices, err = parseCSV(resp.Body)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&prices)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing spot prices: %v", err)
+	}
+	overlapping := []Price{}
+	for _, p := range prices {
+		if p.End.After(from) && p.Start.Before(to) {
+			overlapping = append(overlapping, p)
+		}
+	}
+	sort.Slice(overlapping, func(i, j int) bool { return overlapping[i].Start.Before(overlapping[j].Start) })
+	return overlapping, nil
+}
+
+func parseCSV(r io.Reader) ([]Price, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	prices := []Price{}
+	for i, record := range records {
+		if i == 0 {
+			continue
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("expected start, end and price on line %d", i+1)
+		}
+		start, err := time.Parse(time.RFC3339, strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, err
+		}
+		end, err := time.Parse(time.RFC3339, strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, err
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, Price{Start: start, End: end, Price: price})
+	}
+	return prices, nil
+}
+
+// Cheapest picks the cheapest prices between from and to that together last
+// at least d. Prices are cut to from and to, and the result is ordered by
+// time. When the prices do not cover d all of them are returned.
+func Cheapest(prices []Price, from time.Time, to time.Time, d time.Duration) []Price {
+	candidates := []Price{}
+	for _, p := range prices {
+		if !p.End.After(from) || !p.Start.Before(to) {
+			continue
+		}
+		if p.Start.Before(from) {
+			p.Start = from
+		}
+		if p.End.After(to) {
+			p.End = to
+		}
+		candidates = append(candidates, p)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Price != candidates[j].Price {
+			return candidates[i].Price < candidates[j].Price
+		}
+		return candidates[i].Start.Before(candidates[j].Start)
+	})
+	picked := []Price{}
+	var total time.Duration
+	for _, p := range candidates {
+		if total >= d {
+			break
+		}
+		picked = append(picked, p)
+		total += p.End.Sub(p.Start)
+	}
+	sort.Slice(picked, func(i, j int) bool { return picked[i].Start.Before(picked[j].Start) })
+	return picked
+}
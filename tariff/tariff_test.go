@@ -0,0 +1,128 @@
+package tariff
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSchedulePrices(t *testing.T) {
+	s := Schedule{
+		Periods: []Period{
+			{From: "22:00", To: "06:00", Price: 0.5},
+			{From: "16:00", To: "19:00", Price: 2.0},
+		},
+		Default: 1.0,
+	}
+	from := time.Date(2021, 3, 1, 20, 30, 0, 0, time.UTC)
+	prices, err := s.Prices(context.Background(), from, from.Add(12*time.Hour))
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	if len(prices) != 13 {
+		t.Fatalf("Expected 13 hours but got %d", len(prices))
+	}
+	want := map[int]float64{20: 1.0, 21: 1.0, 22: 0.5, 23: 0.5, 0: 0.5, 5: 0.5, 6: 1.0, 8: 1.0}
+	for _, p := range prices {
+		if w, ok := want[p.Start.Hour()]; ok && p.Price != w {
+			t.Errorf("Want %f at %v got %f", w, p.Start, p.Price)
+		}
+	}
+
+	// Hours start on the wall clock in zones with half hour offsets.
+	s.Location = time.FixedZone("IST", 5*3600+1800)
+	prices, err = s.Prices(context.Background(), from, from.Add(3*time.Hour))
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	for _, p := range prices {
+		if p.Start.Minute() != 0 {
+			t.Errorf("Expected the hour to start on the wall clock got %v", p.Start)
+		}
+	}
+	if first := prices[0]; first.Start.Hour() != 2 || first.Price != 0.5 {
+		t.Errorf("Expected the night price from 02:00 got %+v", first)
+	}
+
+	s = Schedule{Periods: []Period{{From: "22", To: "06:00"}}}
+	if _, err := s.Prices(context.Background(), from, from.Add(time.Hour)); err == nil {
+		t.Errorf("Expected error for invalid period")
+	}
+}
+
+func TestSpotPrices(t *testing.T) {
+	day := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		path        string
+		contentType string
+		body        string
+	}{
+		{path: "/prices.json", contentType: "application/json", body: func() string {
+			body := "["
+			for h := 0; h < 24; h++ {
+				if h > 0 {
+					body += ","
+				}
+				body += fmt.Sprintf(`{"start": "%s", "end": "%s", "price": %d}`,
+					day.Add(time.Duration(h)*time.Hour).Format(time.RFC3339),
+					day.Add(time.Duration(h+1)*time.Hour).Format(time.RFC3339), h)
+			}
+			return body + "]"
+		}()},
+		{path: "/prices.csv", contentType: "text/csv", body: func() string {
+			body := "start,end,price\n"
+			for h := 23; h >= 0; h-- {
+				body += fmt.Sprintf("%s,%s,%d\n",
+					day.Add(time.Duration(h)*time.Hour).Format(time.RFC3339),
+					day.Add(time.Duration(h+1)*time.Hour).Format(time.RFC3339), h)
+			}
+			return body
+		}()},
+	}
+
+	for _, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != test.path {
+				w.WriteHeader(404)
+				return
+			}
+			w.Header().Set("Content-Type", test.contentType)
+			fmt.Fprint(w, test.body)
+		}))
+		prices, err := Spot{URL: ts.URL + test.path}.Prices(context.Background(), day.Add(2*time.Hour+30*time.Minute), day.Add(6*time.Hour))
+		ts.Close()
+		if err != nil {
+			t.Fatalf("%s: didnt expect error %v", test.path, err)
+		}
+		if len(prices) != 4 || prices[0].Price != 2 || prices[3].Price != 5 {
+			t.Fatalf("%s: unexpected prices %v+", test.path, prices)
+		}
+	}
+}
+
+func TestCheapest(t *testing.T) {
+	day := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	costs := []float64{5, 3, 1, 2, 4, 1}
+	prices := []Price{}
+	for h, c := range costs {
+		prices = append(prices, Price{Start: day.Add(time.Duration(h) * time.Hour), End: day.Add(time.Duration(h+1) * time.Hour), Price: c})
+	}
+
+	picked := Cheapest(prices, day, day.Add(6*time.Hour), 150*time.Minute)
+	if len(picked) != 3 || picked[0].Start.Hour() != 2 || picked[1].Start.Hour() != 3 || picked[2].Start.Hour() != 5 {
+		t.Fatalf("Unexpected cheapest hours %v+", picked)
+	}
+
+	picked = Cheapest(prices, day.Add(2*time.Hour+30*time.Minute), day.Add(5*time.Hour), time.Hour)
+	if len(picked) != 2 || !picked[0].Start.Equal(day.Add(2*time.Hour+30*time.Minute)) || picked[1].Start.Hour() != 3 {
+		t.Fatalf("Expected the cut hour and the next cheapest %v+", picked)
+	}
+
+	picked = Cheapest(prices, day, day.Add(6*time.Hour), 10*time.Hour)
+	if len(picked) != 6 {
+		t.Fatalf("Expected all hours when they are not enough %v+", picked)
+	}
+}
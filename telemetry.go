@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/stelund/solarchargetesla/telemetry"
+)
+
+// telemetryDialTimeout is how long connecting to a telemetry server may
+// take before the car is polled instead.
+const telemetryDialTimeout = 10 * time.Second
+
+// telemetryClient reads the data of a car from its telemetry stream, which
+// never wakes the car. Commands are sent by the car's api client.
+type telemetryClient struct {
+	stream *telemetry.Stream
+	vin    string
+	cmd    carClient
+}
+
+func (t telemetryClient) getCarData(ctx context.Context, carID int64) (*carData, error) {
+	select {
+	case <-t.stream.Done():
+		return nil, t.stream.Err()
+	default:
+	}
+	v, ok := t.stream.Vehicle(t.vin)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No telemetry of %s yet", t.vin))
+	}
+	return telemetryCarData(v), nil
+}
+
+func (t telemetryClient) startCharging(ctx context.Context, carID int64) error {
+	return t.cmd.startCharging(ctx, carID)
+}
+
+func (t telemetryClient) stopCharging(ctx context.Context, carID int64) error {
+	return t.cmd.stopCharging(ctx, carID)
+}
+
+func (t telemetryClient) setChargingAmps(ctx context.Context, carID int64, amps int32) error {
+	return t.cmd.setChargingAmps(ctx, carID, amps)
+}
+
+// telemetryCarData is the car data of the streamed values of a vehicle.
+func telemetryCarData(v telemetry.Vehicle) *carData {
+	return &carData{
+		BatteryLevel: int32(v.BatteryLevel),
+		Longitude:    v.Location.Longitude,
+		Latitude:     v.Location.Latitude,
+		ChargeLimit:  int32(v.ChargeLimitSoc),
+		IsCharging:   isCharging(v.ChargeState, int32(v.ChargerActualCurrent)),
+		IsPluggedIn:  v.ChargeState != "" && v.ChargeState != "Disconnected",
+
+		ChargeAmps:           int32(v.ChargeCurrentRequest),
+		ChargerActualCurrent: int32(v.ChargerActualCurrent),
+		ChargerVoltage:       int32(v.ChargerVoltage),
+		ChargerPhases:        int32(v.ChargerPhases),
+
+		ChargingState: v.ChargeState,
+		ShiftState:    v.Gear,
+		Speed:         v.Speed,
+	}
+}
+
+// telemetryUpdates are the fields of a car written when its telemetry is
+// streamed.
+func telemetryUpdates(v telemetry.Vehicle) fields {
+	d := telemetryCarData(v)
+	f := fields{
+		"batteryLevel":         d.BatteryLevel,
+		"longitude":            d.Longitude,
+		"latitude":             d.Latitude,
+		"lastUpdated":          v.Updated,
+		"chargeLimit":          d.ChargeLimit,
+		"isCharging":           d.IsCharging,
+		"isPluggedIn":          d.IsPluggedIn,
+		"chargeAmps":           d.ChargeAmps,
+		"chargerActualCurrent": d.ChargerActualCurrent,
+		"chargingState":        d.ChargingState,
+		"shiftState":           d.ShiftState,
+		"speed":                d.Speed,
+	}
+	if d.ChargerPhases > 0 {
+		f["chargerVoltage"] = d.ChargerVoltage
+		f["chargerPhases"] = d.ChargerPhases
+	}
+	return f
+}
+
+// telemetryStream returns the telemetry stream of a car, connecting to its
+// server if there is none or the last one ended. Streamed values are
+// written to the car as they arrive.
+func (a realApp) telemetryStream(c car) (*telemetry.Stream, error) {
+	if s, ok := a.streams[c.documentId]; ok {
+		select {
+		case <-s.Done():
+			fmt.Printf("Telemetry of %s ended: %v\n", c.Name, s.Err())
+		default:
+			return s, nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryDialTimeout)
+	defer cancel()
+	s, err := telemetry.Dial(ctx, c.TelemetryURL, os.Getenv("TELEMETRY_TOKEN"), nil, func(v telemetry.Vehicle) {
+		if v.VIN != c.VIN {
+			return
+		}
+		if err := updateCar(a, c, context.Background(), telemetryUpdates(v)); err != nil {
+			fmt.Printf("Failed to store telemetry of %s: %v\n", c.Name, err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if a.streams != nil {
+		a.streams[c.documentId] = s
+	}
+	return s, nil
+}
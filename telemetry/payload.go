@@ -0,0 +1,169 @@
+// Package telemetry consumes the fleet telemetry of Tesla vehicles, protobuf
+// payloads streamed over WebSocket, and keeps the latest values of each
+// vehicle. A fake server streams payloads for tests.
+package telemetry
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/stelund/solarchargetesla/protowire"
+)
+
+// Field keys of the telemetry stream.
+const (
+	FieldChargeState          = 2
+	FieldVehicleSpeed         = 4
+	FieldGear                 = 10
+	FieldLocation             = 21
+	FieldBatteryLevel         = 42
+	FieldChargeLimitSoc       = 43
+	FieldChargeCurrentRequest = 44
+	FieldChargerActualCurrent = 45
+	FieldChargerVoltage       = 46
+	FieldChargerPhases        = 47
+)
+
+// Members of the Value oneof.
+const (
+	valueString   = 1
+	valueInt      = 2
+	valueLong     = 3
+	valueFloat    = 4
+	valueDouble   = 5
+	valueBoolean  = 6
+	valueLocation = 7
+)
+
+// Location is a position in degrees.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Datum is the value of a field, a string, int64, float64, bool or Location.
+type Datum struct {
+	Field int
+	Value interface{}
+}
+
+// Payload is a set of fields of a vehicle sent at once.
+type Payload struct {
+	VIN       string
+	CreatedAt time.Time
+	Data      []Datum
+}
+
+// marshalValue encodes a Value, a zero value is kept as it selects the
+// member of the oneof.
+func marshalValue(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return protowire.AppendMessage(nil, valueString, []byte(v)), nil
+	case int64:
+		return protowire.AppendVarint(protowire.AppendTag(nil, valueLong, protowire.Varint), uint64(v)), nil
+	case int:
+		return marshalValue(int64(v))
+	case float64:
+		b := protowire.AppendTag(nil, valueDouble, protowire.Fixed64)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+		return append(b, buf[:]...), nil
+	case bool:
+		var u uint64
+		if v {
+			u = 1
+		}
+		return protowire.AppendVarint(protowire.AppendTag(nil, valueBoolean, protowire.Varint), u), nil
+	case Location:
+		var l []byte
+		l = protowire.AppendDouble(l, 1, v.Latitude)
+		l = protowire.AppendDouble(l, 2, v.Longitude)
+		return protowire.AppendMessage(nil, valueLocation, l), nil
+	}
+	return nil, fmt.Errorf("unsupported value %T", v)
+}
+
+// Marshal encodes the payload.
+func (p Payload) Marshal() ([]byte, error) {
+	var b []byte
+	for _, d := range p.Data {
+		v, err := marshalValue(d.Value)
+		if err != nil {
+			return nil, err
+		}
+		datum := protowire.AppendUint(nil, 1, uint64(d.Field))
+		datum = protowire.AppendMessage(datum, 2, v)
+		b = protowire.AppendMessage(b, 1, datum)
+	}
+	if !p.CreatedAt.IsZero() {
+		var ts []byte
+		ts = protowire.AppendUint(ts, 1, uint64(p.CreatedAt.Unix()))
+		ts = protowire.AppendUint(ts, 2, uint64(p.CreatedAt.Nanosecond()))
+		b = protowire.AppendMessage(b, 2, ts)
+	}
+	return protowire.AppendBytes(b, 3, []byte(p.VIN)), nil
+}
+
+func parseValue(b []byte) (interface{}, error) {
+	fs, err := protowire.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(fs) == 0 {
+		return nil, nil
+	}
+	f := fs[len(fs)-1]
+	switch f.Num {
+	case valueString:
+		return string(f.B), nil
+	case valueInt:
+		return int64(int32(f.U)), nil
+	case valueLong:
+		return int64(f.U), nil
+	case valueFloat:
+		return float64(math.Float32frombits(uint32(f.U))), nil
+	case valueDouble:
+		return math.Float64frombits(f.U), nil
+	case valueBoolean:
+		return f.U != 0, nil
+	case valueLocation:
+		l, err := protowire.Parse(f.B)
+		if err != nil {
+			return nil, err
+		}
+		return Location{Latitude: l.Double(1), Longitude: l.Double(2)}, nil
+	}
+	// Values of other types are not used.
+	return nil, nil
+}
+
+// ParsePayload decodes a payload.
+func ParsePayload(b []byte) (*Payload, error) {
+	fs, err := protowire.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	p := Payload{VIN: string(fs.Bytes(3))}
+	if fs.Has(2) {
+		ts, err := fs.Message(2)
+		if err != nil {
+			return nil, err
+		}
+		p.CreatedAt = time.Unix(int64(ts.Uint(1)), int64(ts.Uint(2))).UTC()
+	}
+	for _, f := range fs.All(1) {
+		datum, err := protowire.Parse(f.B)
+		if err != nil {
+			return nil, err
+		}
+		v, err := parseValue(datum.Bytes(2))
+		if err != nil {
+			return nil, fmt.Errorf("parsing field %d: %w", datum.Uint(1), err)
+		}
+		p.Data = append(p.Data, Datum{Field: int(datum.Uint(1)), Value: v})
+	}
+	return &p, nil
+}
@@ -0,0 +1,75 @@
+package telemetry
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Server is a fake telemetry server that streams the payloads passed to Send
+// to every connected client. Clients have to present Token when it is set.
+type Server struct {
+	Token string
+
+	mu    sync.Mutex
+	conns map[*websocket.Conn]bool
+}
+
+// NewServer creates a server without clients.
+func NewServer(token string) *Server {
+	return &Server{Token: token, conns: map[*websocket.Conn]bool{}}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	websocket.Handler(s.serve).ServeHTTP(w, r)
+}
+
+func (s *Server) serve(ws *websocket.Conn) {
+	s.mu.Lock()
+	s.conns[ws] = true
+	s.mu.Unlock()
+	// Clients send nothing, reading notices when they go away.
+	var discard []byte
+	for websocket.Message.Receive(ws, &discard) == nil {
+	}
+	s.mu.Lock()
+	delete(s.conns, ws)
+	s.mu.Unlock()
+}
+
+// Clients is the number of connected clients.
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Send streams a payload to the clients.
+func (s *Server) Send(p Payload) error {
+	b, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ws := range s.conns {
+		if err := websocket.Message.Send(ws, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close disconnects the clients.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ws := range s.conns {
+		ws.Close()
+	}
+}
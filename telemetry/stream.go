@@ -0,0 +1,216 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Vehicle holds the latest values streamed for a vehicle. Fields that were
+// never streamed are zero.
+type Vehicle struct {
+	VIN                  string
+	ChargeState          string
+	BatteryLevel         float64
+	ChargeLimitSoc       float64
+	ChargeCurrentRequest float64
+	ChargerActualCurrent float64
+	ChargerVoltage       float64
+	ChargerPhases        float64
+	Location             Location
+	Speed                float64
+	Gear                 string
+	Updated              time.Time
+}
+
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// apply updates the vehicle with the fields of a payload.
+func (v *Vehicle) apply(p *Payload) {
+	for _, d := range p.Data {
+		if s, ok := d.Value.(string); ok {
+			switch d.Field {
+			case FieldChargeState:
+				v.ChargeState = s
+			case FieldGear:
+				v.Gear = s
+			}
+		} else if l, ok := d.Value.(Location); ok && d.Field == FieldLocation {
+			v.Location = l
+		} else if n, ok := number(d.Value); ok {
+			switch d.Field {
+			case FieldBatteryLevel:
+				v.BatteryLevel = n
+			case FieldChargeLimitSoc:
+				v.ChargeLimitSoc = n
+			case FieldChargeCurrentRequest:
+				v.ChargeCurrentRequest = n
+			case FieldChargerActualCurrent:
+				v.ChargerActualCurrent = n
+			case FieldChargerVoltage:
+				v.ChargerVoltage = n
+			case FieldChargerPhases:
+				v.ChargerPhases = n
+			case FieldVehicleSpeed:
+				v.Speed = n
+			}
+		}
+	}
+	v.Updated = p.CreatedAt
+	if v.Updated.IsZero() {
+		v.Updated = time.Now().UTC()
+	}
+}
+
+// Stream is a connection to a telemetry server. The payloads it receives are
+// applied to the vehicles and passed to onUpdate.
+type Stream struct {
+	ws       *websocket.Conn
+	onUpdate func(Vehicle)
+
+	mu       sync.Mutex
+	vehicles map[string]Vehicle
+	err      error
+	done     chan struct{}
+}
+
+// defaultPorts are the ports of the schemes when the url has none.
+var defaultPorts = map[string]string{"ws": "80", "wss": "443"}
+
+// dialAddress is the host and port to connect to for a ws or wss url.
+func dialAddress(u *url.URL) (string, error) {
+	port, ok := defaultPorts[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// Dial connects to the telemetry server at rawurl, a ws or wss url,
+// authorized with token when set. A wss server is verified with tlsConfig,
+// or the system roots if nil. onUpdate, if not nil, is called with a vehicle
+// each time it is updated. The ctx bounds connecting, including the
+// WebSocket handshake.
+func Dial(ctx context.Context, rawurl string, token string, tlsConfig *tls.Config, onUpdate func(Vehicle)) (*Stream, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	address, err := dialAddress(u)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+		origin = "https://" + u.Host
+	}
+	config, err := websocket.NewConfig(rawurl, origin)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if token != "" {
+		config.Header.Set("Authorization", "Bearer "+token)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	s := &Stream{ws: ws, onUpdate: onUpdate, vehicles: map[string]Vehicle{}, done: make(chan struct{})}
+	go s.run()
+	return s, nil
+}
+
+func (s *Stream) run() {
+	var err error
+	for {
+		var data []byte
+		if err = websocket.Message.Receive(s.ws, &data); err != nil {
+			break
+		}
+		p, perr := ParsePayload(data)
+		if perr != nil || p.VIN == "" {
+			// A bad payload is skipped, the next one may be fine.
+			continue
+		}
+		s.mu.Lock()
+		v := s.vehicles[p.VIN]
+		v.VIN = p.VIN
+		v.apply(p)
+		s.vehicles[p.VIN] = v
+		s.mu.Unlock()
+		if s.onUpdate != nil {
+			s.onUpdate(v)
+		}
+	}
+	s.mu.Lock()
+	s.err = fmt.Errorf("telemetry stream closed: %w", err)
+	s.mu.Unlock()
+	close(s.done)
+}
+
+// Vehicle returns the latest values of a vehicle.
+func (s *Stream) Vehicle(vin string) (Vehicle, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vehicles[vin]
+	return v, ok
+}
+
+// Done is closed when the stream ends.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err is why the stream ended.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the stream.
+func (s *Stream) Close() error {
+	return s.ws.Close()
+}
@@ -0,0 +1,158 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testVIN = "5YJ3E1EA7KF000001"
+
+func TestPayload(t *testing.T) {
+	p := Payload{
+		VIN:       testVIN,
+		CreatedAt: time.Date(2021, 5, 1, 12, 0, 0, 500, time.UTC),
+		Data: []Datum{
+			{Field: FieldChargeState, Value: "Charging"},
+			{Field: FieldBatteryLevel, Value: 55.5},
+			{Field: FieldChargerPhases, Value: int64(3)},
+			{Field: FieldGear, Value: ""},
+			{Field: FieldLocation, Value: Location{Latitude: 59.3, Longitude: 18.1}},
+		},
+	}
+	b, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	parsed, err := ParsePayload(b)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	if !reflect.DeepEqual(*parsed, p) {
+		t.Fatalf("Expected %+v got %+v", p, *parsed)
+	}
+	if _, err := (Payload{Data: []Datum{{Field: FieldGear, Value: []int{1}}}}).Marshal(); err == nil {
+		t.Fatalf("Expected error for an unsupported value")
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	server := NewServer("secret")
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+	ws := "ws" + strings.TrimPrefix(hs.URL, "http")
+
+	if _, err := Dial(ctx, ws, "wrong", nil, nil); err == nil {
+		t.Fatalf("Expected error for a wrong token")
+	}
+
+	updates := make(chan Vehicle, 2)
+	s, err := Dial(ctx, ws, "secret", nil, func(v Vehicle) { updates <- v })
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	waitFor(t, "the client to connect", func() bool { return server.Clients() == 1 })
+
+	at := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	server.Send(Payload{VIN: testVIN, CreatedAt: at, Data: []Datum{
+		{Field: FieldChargeState, Value: "Charging"},
+		{Field: FieldBatteryLevel, Value: 55.0},
+		{Field: FieldChargerActualCurrent, Value: int64(16)},
+	}})
+	// Fields left out keep their values.
+	server.Send(Payload{VIN: testVIN, CreatedAt: at.Add(time.Minute), Data: []Datum{
+		{Field: FieldBatteryLevel, Value: 56.0},
+	}})
+	<-updates
+	v := <-updates
+	want := Vehicle{VIN: testVIN, ChargeState: "Charging", BatteryLevel: 56, ChargerActualCurrent: 16, Updated: at.Add(time.Minute)}
+	if v != want {
+		t.Fatalf("Expected %+v got %+v", want, v)
+	}
+	if got, ok := s.Vehicle(testVIN); !ok || got != want {
+		t.Fatalf("Expected %+v got %+v", want, got)
+	}
+	if _, ok := s.Vehicle("5YJ3E1EA7KF000002"); ok {
+		t.Fatalf("Expected no values of another vehicle")
+	}
+
+	server.Close()
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the stream to end")
+	}
+	if s.Err() == nil {
+		t.Fatalf("Expected why the stream ended")
+	}
+}
+
+func TestDialAddress(t *testing.T) {
+	tests := []struct {
+		rawurl string
+		want   string
+	}{
+		{rawurl: "wss://telemetry.example.com/stream", want: "telemetry.example.com:443"},
+		{rawurl: "ws://telemetry.example.com/stream", want: "telemetry.example.com:80"},
+		{rawurl: "wss://telemetry.example.com:8443/stream", want: "telemetry.example.com:8443"},
+		{rawurl: "ws://[::1]/stream", want: "[::1]:80"},
+		{rawurl: "https://telemetry.example.com"},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.rawurl)
+		got, err := dialAddress(u)
+		if test.want == "" && err == nil {
+			t.Fatalf("Expected error for %s", test.rawurl)
+		}
+		if got != test.want {
+			t.Fatalf("Expected %s for %s got %s %v", test.want, test.rawurl, got, err)
+		}
+	}
+}
+
+func TestStreamTLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server := NewServer("secret")
+	hs := httptest.NewTLSServer(server)
+	defer hs.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+	wss := "wss" + strings.TrimPrefix(hs.URL, "https")
+
+	if _, err := Dial(ctx, wss, "secret", nil, nil); err == nil {
+		t.Fatalf("Expected error for an untrusted certificate")
+	}
+	if _, err := Dial(ctx, "ws"+strings.TrimPrefix(hs.URL, "https"), "secret", nil, nil); err == nil {
+		t.Fatalf("Expected error speaking cleartext to a TLS server")
+	}
+
+	updates := make(chan Vehicle, 1)
+	s, err := Dial(ctx, wss, "secret", &tls.Config{RootCAs: roots}, func(v Vehicle) { updates <- v })
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	defer s.Close()
+	waitFor(t, "the client to connect", func() bool { return server.Clients() == 1 })
+	server.Send(Payload{VIN: testVIN, Data: []Datum{{Field: FieldBatteryLevel, Value: 70.0}}})
+	if v := <-updates; v.BatteryLevel != 70 {
+		t.Fatalf("Expected the streamed battery level got %+v", v)
+	}
+}
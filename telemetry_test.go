@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stelund/solarchargetesla/telemetry"
+)
+
+func TestTelemetryClient(t *testing.T) {
+	ctx := context.Background()
+	server := telemetry.NewServer("secret")
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+	os.Setenv("TELEMETRY_TOKEN", "secret")
+	defer os.Unsetenv("TELEMETRY_TOKEN")
+
+	st := newMemoryStore()
+	a := realApp{st: st, tokens: map[string]*teslaTokenSource{}, streams: map[string]*telemetry.Stream{}}
+	defer a.close()
+	c := car{Name: "Tesla", Vendor: "Tesla", VIN: "5YJ3E1EA7KF000001", TelemetryURL: "ws" + strings.TrimPrefix(hs.URL, "http"), documentId: "car1"}
+	if err := st.setCar(ctx, c); err != nil {
+		t.Fatalf("Failed to store car %v", err)
+	}
+	cc, err := a.createCarClient(c)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	tc, ok := cc.(telemetryClient)
+	if !ok {
+		t.Fatalf("Expected a telemetry client got %T", cc)
+	}
+	if _, ok := cc.(sleepingCar); ok {
+		t.Fatalf("Expected reading the telemetry to never wake the car")
+	}
+	if _, err := cc.getCarData(ctx, 1); err == nil {
+		t.Fatalf("Expected error before any telemetry")
+	}
+
+	for i := 0; i < 200 && server.Clients() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Send(telemetry.Payload{VIN: c.VIN, CreatedAt: time.Now().UTC(), Data: []telemetry.Datum{
+		{Field: telemetry.FieldChargeState, Value: "Charging"},
+		{Field: telemetry.FieldBatteryLevel, Value: 61.0},
+		{Field: telemetry.FieldChargeLimitSoc, Value: int64(80)},
+		{Field: telemetry.FieldChargerActualCurrent, Value: int64(10)},
+		{Field: telemetry.FieldChargerVoltage, Value: int64(230)},
+		{Field: telemetry.FieldChargerPhases, Value: int64(3)},
+		{Field: telemetry.FieldLocation, Value: telemetry.Location{Latitude: 59.3, Longitude: 18.1}},
+	}})
+
+	// The car is written as the telemetry arrives.
+	var stored car
+	for i := 0; i < 200; i++ {
+		stored, _ = st.getCar(ctx, "car1")
+		if stored.BatteryLevel == 61 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stored.BatteryLevel != 61 || !stored.IsCharging || !stored.IsPluggedIn || stored.ChargerPhases != 3 || stored.Latitude != 59.3 {
+		t.Fatalf("Expected the streamed values to be stored got %+v", stored)
+	}
+
+	data, err := tc.getCarData(ctx, 1)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	if data.BatteryLevel != 61 || data.ChargeLimit != 80 || data.ChargerActualCurrent != 10 || data.ChargerVoltage != 230 || data.Longitude != 18.1 {
+		t.Fatalf("Expected the streamed values got %+v", data)
+	}
+
+	// The stream is kept between cycles.
+	cc, _ = a.createCarClient(c)
+	if cc.(telemetryClient).stream != tc.stream {
+		t.Fatalf("Expected the stream to be reused")
+	}
+
+	// Without a telemetry server the car is polled.
+	c.TelemetryURL = "ws://127.0.0.1:1"
+	c.documentId = "car2"
+	cc, err = a.createCarClient(c)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	if _, ok := cc.(teslaClient); !ok {
+		t.Fatalf("Expected the car to be polled got %T", cc)
+	}
+}
+
+func TestTelemetryCarData(t *testing.T) {
+	tests := []struct {
+		state       string
+		current     float64
+		wantPlugged bool
+		wantCharge  bool
+	}{
+		{state: "", wantPlugged: false, wantCharge: false},
+		{state: "Disconnected", wantPlugged: false, wantCharge: false},
+		{state: "Stopped", wantPlugged: true, wantCharge: false},
+		{state: "Charging", wantPlugged: true, wantCharge: true},
+		{state: "Starting", current: 6, wantPlugged: true, wantCharge: true},
+	}
+	for _, test := range tests {
+		d := telemetryCarData(telemetry.Vehicle{ChargeState: test.state, ChargerActualCurrent: test.current})
+		if d.IsPluggedIn != test.wantPlugged || d.IsCharging != test.wantCharge {
+			t.Fatalf("Expected plugged in %v and charging %v for %q got %+v", test.wantPlugged, test.wantCharge, test.state, d)
+		}
+	}
+}
@@ -1,20 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/stelund/solarchargetesla/vehiclecommand"
 )
 
 type vehiclesData struct {
-	ID        int64  `json:"id"`
-	VehicleID int64  `json:"vehicle_id"`
-	State     string `json:"state"`
-	InService bool   `json:"in_service"`
+	ID          int64  `json:"id"`
+	VehicleID   int64  `json:"vehicle_id"`
+	VIN         string `json:"vin"`
+	DisplayName string `json:"display_name"`
+	State       string `json:"state"`
+	InService   bool   `json:"in_service"`
 }
 
 type vehiclesDataResponse struct {
@@ -76,7 +82,7 @@ type driveStates struct {
 	NativeType              string  `json:"native_type"`
 	Power                   int32   `json:"power"`
 	ShiftState              string  `json:"shift_state"`
-	Speed                   string  `json:"speed"`
+	Speed                   float64 `json:"speed"`
 	Timestamp               int64   `json:"timestamp"`
 }
 
@@ -91,32 +97,104 @@ type vehicleDataResponse struct {
 	Car teslaCarData `json:"response"`
 }
 
+const teslaOwnerAPIURL = "https://owner-api.teslamotors.com"
+
 type teslaAPIClient struct {
-	accessToken string
+	tokens  *teslaTokenSource
+	baseURL string
 }
 
 type carAPIClient interface {
-	makeRequest(string, string) (*http.Response, error)
-	sleep(time.Duration)
+	makeRequest(context.Context, string, string, interface{}) (*http.Response, error)
+	sleep(context.Context, time.Duration) error
 }
 
-func (t teslaAPIClient) makeRequest(method string, path string) (*http.Response, error) {
-	client := &http.Client{}
-	u := url.URL{
-		Scheme: "https",
-		Host:   "owner-api.teslamotors.com",
-		Path:   path,
+// makeRequest calls the owner api. A non nil body is sent json encoded. A
+// request rejected as unauthorized is retried once with a refreshed token,
+// error statuses are returned as a *teslaAPIError.
+func (t teslaAPIClient) makeRequest(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	baseURL := t.baseURL
+	if baseURL == "" {
+		baseURL = teslaOwnerAPIURL
+	}
+	return teslaRequest(ctx, t, t.tokens, method, baseURL, path, nil, body)
+}
+
+// teslaRequest sends a request to the owner api or the Fleet API, sleeping
+// with cac when rate limited for a short while.
+func teslaRequest(ctx context.Context, cac carAPIClient, tokens *teslaTokenSource, method string, baseURL string, path string, query url.Values, body interface{}) (*http.Response, error) {
+	resp, err := doTeslaRequest(ctx, tokens, method, baseURL, path, query, body)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && tokens.canRefresh() {
+		resp.Body.Close()
+		if err := tokens.refresh(ctx); err != nil {
+			return &http.Response{}, err
+		}
+		resp, err = doTeslaRequest(ctx, tokens, method, baseURL, path, query, body)
+	}
+	if err != nil {
+		return &http.Response{}, err
+	}
+	apiErr := teslaResponseError(resp)
+	if apiErr == nil {
+		return resp, nil
+	}
+	if apiErr.StatusCode != http.StatusTooManyRequests || apiErr.RetryAfter > maxTeslaRetryAfter {
+		return &http.Response{}, apiErr
 	}
-	req, err := http.NewRequest(method, u.String(), nil)
+	if err := cac.sleep(ctx, apiErr.RetryAfter); err != nil {
+		return &http.Response{}, err
+	}
+	resp, err = doTeslaRequest(ctx, tokens, method, baseURL, path, query, body)
 	if err != nil {
 		return &http.Response{}, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", t.accessToken))
+	if apiErr := teslaResponseError(resp); apiErr != nil {
+		return &http.Response{}, apiErr
+	}
+	return resp, nil
+}
+
+func doTeslaRequest(ctx context.Context, tokens *teslaTokenSource, method string, baseURL string, path string, query url.Values, body interface{}) (*http.Response, error) {
+	client := &http.Client{}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+	u.RawQuery = query.Encode()
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "encoding request body")
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := tokens.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
 	return client.Do(req)
 }
 
-func (t teslaAPIClient) sleep(d time.Duration) {
-	time.Sleep(d)
+// sleep waits for d, or returns early with an error when ctx is cancelled.
+func (t teslaAPIClient) sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 type wakeData struct {
@@ -132,11 +210,18 @@ type commandResponse struct {
 	Result bool   `json:"result"`
 }
 
-func wakeCar(cac carAPIClient, carID int64) error {
+func wakeCar(ctx context.Context, cac carAPIClient, carID int64) error {
 	var w wakeDataResponse
 	for i := 1; i < 15; i++ {
 		println("Waking car...")
-		resp, err := cac.makeRequest("POST", fmt.Sprintf("/api/1/vehicles/%d/wake_up", carID))
+		resp, err := cac.makeRequest(ctx, "POST", fmt.Sprintf("/api/1/vehicles/%d/wake_up", carID), nil)
+		if errors.Is(err, errVehicleOffline) {
+			// Still waking up.
+			if err := cac.sleep(ctx, 3*time.Second); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
 			return errors.Wrap(err, "posting to wake endpoint")
 		}
@@ -149,26 +234,36 @@ func wakeCar(cac carAPIClient, carID int64) error {
 		if w.Wake.State == "online" {
 			return nil
 		}
-		cac.sleep(3 * time.Second)
+		if err := cac.sleep(ctx, 3*time.Second); err != nil {
+			return err
+		}
 	}
 	return errors.New(fmt.Sprintf("Car is not waking. Still in state %s", w.Wake.State))
 }
 
-func getCarState(cac carAPIClient, carID int64) (string, error) {
-	resp, err := cac.makeRequest("GET", "/api/1/vehicles")
+func getVehicles(ctx context.Context, cac carAPIClient) ([]vehiclesData, error) {
+	resp, err := cac.makeRequest(ctx, "GET", "/api/1/vehicles", nil)
 	if err != nil {
-		return "", errors.Wrap(err, "fetching vehicles")
+		return nil, errors.Wrap(err, "fetching vehicles")
 	}
 	if resp.StatusCode >= 400 {
-		return "", errors.New(fmt.Sprintf("Status code %d when fetching vehicles", resp.StatusCode))
+		return nil, errors.New(fmt.Sprintf("Status code %d when fetching vehicles", resp.StatusCode))
 	}
 	defer resp.Body.Close()
 	var vr vehiclesDataResponse
 	err = json.NewDecoder(resp.Body).Decode(&vr)
 	if err != nil {
-		return "", errors.Wrap(err, "parsing vehicles")
+		return nil, errors.Wrap(err, "parsing vehicles")
+	}
+	return vr.Vehicles, nil
+}
+
+func getCarState(ctx context.Context, cac carAPIClient, carID int64) (string, error) {
+	vehicles, err := getVehicles(ctx, cac)
+	if err != nil {
+		return "", err
 	}
-	for _, v := range vr.Vehicles {
+	for _, v := range vehicles {
 		if v.ID == carID {
 			return v.State, nil
 		}
@@ -176,33 +271,70 @@ func getCarState(cac carAPIClient, carID int64) (string, error) {
 	return "", errors.New(fmt.Sprintf("Unable to find vehicle with id %d", carID))
 }
 
-func ensureAwake(cac carAPIClient, carID int64) error {
-	if state, err := getCarState(cac, carID); err != nil {
+// ensureOnline fails unless the car is online. Reading or commanding a car
+// that is asleep would wake it, it is only woken by checkSleeping which counts
+// the wake against the car's budget.
+func ensureOnline(ctx context.Context, cac carAPIClient, carID int64) error {
+	state, err := getCarState(ctx, cac, carID)
+	if err != nil {
 		return err
-	} else if state == "online" {
-		return nil
 	}
-	return wakeCar(cac, carID)
+	if state != "online" {
+		return errors.Wrap(errVehicleOffline, fmt.Sprintf("Car is %s", state))
+	}
+	return nil
 }
 
 type carData struct {
-	BatteryLevel int32
-	Longitude    float64
-	Latitude     float64
-	ChargeLimit  int32
-	IsCharging   bool
-	IsPluggedIn  bool
+	BatteryLevel         int32
+	Longitude            float64
+	Latitude             float64
+	ChargeLimit          int32
+	IsCharging           bool
+	IsPluggedIn          bool
+	ChargeAmps           int32
+	MaxChargeAmps        int32
+	ChargerActualCurrent int32
+	ChargerVoltage       int32
+	ChargerPhases        int32
+
+	// Charging state of the car, such as Disconnected, Stopped or Charging.
+	// Power is in kW, time to full in hours and energy added in kWh.
+	ChargingState            string
+	ChargerPower             int32
+	TimeToFullCharge         float64
+	ChargeEnergyAdded        float64
+	ScheduledChargingPending bool
+	ScheduledChargingStart   time.Time
+	FastChargerPresent       bool
+	// Shift state of the car, P, D, R or N and empty when parked, and its
+	// speed in mph.
+	ShiftState string
+	Speed      float64
 }
 
+// isCharging tells if a car charges, by its charging state when it reports
+// one.
+func isCharging(chargingState string, actualCurrent int32) bool {
+	if chargingState != "" {
+		return chargingState == "Charging" || chargingState == "Starting"
+	}
+	return actualCurrent > 0
+}
+
+// teslaClient controls a Tesla through an api client. Commands are signed
+// with the vehicle command protocol when it has a signer, newer cars refuse
+// unsigned ones.
 type teslaClient struct {
 	apiClient carAPIClient
+	signer    commandSigner
 }
 
-func (t teslaClient) getCarData(carID int64) (*carData, error) {
-	if err := ensureAwake(t.apiClient, carID); err != nil {
-		return nil, errors.Wrap(err, "waking car")
+func (t teslaClient) getCarData(ctx context.Context, carID int64) (*carData, error) {
+	if err := ensureOnline(ctx, t.apiClient, carID); err != nil {
+		return nil, err
 	}
-	resp, err := t.apiClient.makeRequest("GET", fmt.Sprintf("/api/1/vehicles/%d/vehicle_data", carID))
+	resp, err := t.apiClient.makeRequest(ctx, "GET", fmt.Sprintf("/api/1/vehicles/%d/vehicle_data", carID), nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "fetching vehicle_data")
 	}
@@ -217,16 +349,50 @@ func (t teslaClient) getCarData(carID int64) (*carData, error) {
 		Longitude:    v.Car.DriveState.Longitude,
 		Latitude:     v.Car.DriveState.Latitude,
 		ChargeLimit:  v.Car.ChargeState.ChargeLimitSoc,
-		IsCharging:   v.Car.ChargeState.ChargerActualCurrent > 0,
+		IsCharging:   isCharging(v.Car.ChargeState.ChargingState, v.Car.ChargeState.ChargerActualCurrent),
 		IsPluggedIn:  v.Car.ChargeState.ChargePortLatch == "Engaged",
+
+		ChargeAmps:           v.Car.ChargeState.ChargeCurrentRequest,
+		MaxChargeAmps:        v.Car.ChargeState.ChargeCurrentRequestMax,
+		ChargerActualCurrent: v.Car.ChargeState.ChargerActualCurrent,
+		ChargerVoltage:       v.Car.ChargeState.ChargerVoltage,
+		ChargerPhases:        v.Car.ChargeState.ChargerPhases,
+
+		ChargingState:            v.Car.ChargeState.ChargingState,
+		ChargerPower:             v.Car.ChargeState.ChargerPower,
+		TimeToFullCharge:         v.Car.ChargeState.TimeToFullCharge,
+		ChargeEnergyAdded:        v.Car.ChargeState.ChargeEnergyAdded,
+		ScheduledChargingPending: v.Car.ChargeState.ScheduledChargingPending,
+		ScheduledChargingStart:   unixTime(v.Car.ChargeState.ScheduledChargingStartTime),
+		FastChargerPresent:       v.Car.ChargeState.FastChargerPresent,
+		ShiftState:               v.Car.DriveState.ShiftState,
+		Speed:                    v.Car.DriveState.Speed,
 	}, nil
 }
 
-func (t teslaClient) command(carID int64, command string) error {
-	if err := ensureAwake(t.apiClient, carID); err != nil {
-		return errors.Wrap(err, "waking car")
+// unixTime is the time of seconds since the epoch, zero stays the zero time.
+func unixTime(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
 	}
-	resp, err := t.apiClient.makeRequest("POST", fmt.Sprintf("/api/1/vehicles/%d/command/%s", carID, command))
+	return time.Unix(seconds, 0).UTC()
+}
+
+type chargingAmpsRequest struct {
+	ChargingAmps int32 `json:"charging_amps"`
+}
+
+// command sends a REST command, or the signed action when the client has a
+// signer.
+func (t teslaClient) command(ctx context.Context, carID int64, command string, body interface{}, action []byte) error {
+	if err := ensureOnline(ctx, t.apiClient, carID); err != nil {
+		return err
+	}
+	if t.signer != nil {
+		err := t.signer.Execute(ctx, vehiclecommand.DomainInfotainment, action)
+		return errors.Wrap(err, fmt.Sprintf("sending signed command: %s", command))
+	}
+	resp, err := t.apiClient.makeRequest(ctx, "POST", fmt.Sprintf("/api/1/vehicles/%d/command/%s", carID, command), body)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("sending command: %s", command))
 	}
@@ -239,10 +405,14 @@ func (t teslaClient) command(carID int64, command string) error {
 	return nil
 }
 
-func (t teslaClient) startCharging(carID int64) error {
-	return t.command(carID, "charge_start")
+func (t teslaClient) startCharging(ctx context.Context, carID int64) error {
+	return t.command(ctx, carID, "charge_start", nil, vehiclecommand.ChargeStart())
+}
+
+func (t teslaClient) stopCharging(ctx context.Context, carID int64) error {
+	return t.command(ctx, carID, "charge_stop", nil, vehiclecommand.ChargeStop())
 }
 
-func (t teslaClient) stopCharging(carID int64) error {
-	return t.command(carID, "charge_stop")
+func (t teslaClient) setChargingAmps(ctx context.Context, carID int64, amps int32) error {
+	return t.command(ctx, carID, "set_charging_amps", chargingAmpsRequest{ChargingAmps: amps}, vehiclecommand.SetChargingAmps(amps))
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -15,11 +17,19 @@ type fakeResponse struct {
 	Body       string
 }
 
+type fakeRequest struct {
+	Method string
+	Path   string
+	Body   interface{}
+}
+
 type fakeTeslaClient struct {
 	Responses []fakeResponse
+	Requests  []fakeRequest
 }
 
-func (fta fakeTeslaClient) makeRequest(method string, path string) (*http.Response, error) {
+func (fta *fakeTeslaClient) makeRequest(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	fta.Requests = append(fta.Requests, fakeRequest{Method: method, Path: path, Body: body})
 	for _, r := range fta.Responses {
 		if r.Path == path {
 			body := ioutil.NopCloser(bytes.NewReader([]byte(r.Body)))
@@ -34,7 +44,9 @@ func (fta fakeTeslaClient) makeRequest(method string, path string) (*http.Respon
 	}, nil
 }
 
-func (t fakeTeslaClient) sleep(_ time.Duration) {}
+func (t *fakeTeslaClient) sleep(_ context.Context, _ time.Duration) error {
+	return nil
+}
 
 func TestWakeCar(t *testing.T) {
 	tests := []struct {
@@ -47,7 +59,7 @@ func TestWakeCar(t *testing.T) {
 
 	for _, test := range tests {
 		fta := &fakeTeslaClient{
-			[]fakeResponse{
+			Responses: []fakeResponse{
 				{
 					Path:       "/api/1/vehicles/1234/wake_up",
 					StatusCode: 200,
@@ -59,7 +71,7 @@ func TestWakeCar(t *testing.T) {
 				},
 			},
 		}
-		err := wakeCar(fta, 1234)
+		err := wakeCar(context.Background(), fta, 1234)
 		if test.isError && err == nil {
 			t.Errorf("Expected err but was %v+", err)
 		}
@@ -79,7 +91,7 @@ func TestGetCarState(t *testing.T) {
 
 	for _, test := range tests {
 		fta := &fakeTeslaClient{
-			[]fakeResponse{
+			Responses: []fakeResponse{
 				{
 					Path:       "/api/1/vehicles",
 					StatusCode: 200,
@@ -100,7 +112,7 @@ func TestGetCarState(t *testing.T) {
 				},
 			},
 		}
-		state, err := getCarState(fta, 1234)
+		state, err := getCarState(context.Background(), fta, 1234)
 		if err != nil {
 			t.Errorf("Didnt expect error fetching car state %v+", err)
 		}
@@ -122,7 +134,7 @@ func TestGetCarData(t *testing.T) {
 
 	for _, test := range tests {
 		fta := &fakeTeslaClient{
-			[]fakeResponse{
+			Responses: []fakeResponse{
 				{
 					Path:       "/api/1/vehicles",
 					StatusCode: 200,
@@ -339,7 +351,7 @@ func TestGetCarData(t *testing.T) {
 			},
 		}
 		cc := teslaClient{apiClient: fta}
-		carData, err := cc.getCarData(1234)
+		carData, err := cc.getCarData(context.Background(), 1234)
 		if err != nil {
 			t.Errorf("Didnt expect error fetching car data %v", err)
 		}
@@ -352,5 +364,89 @@ func TestGetCarData(t *testing.T) {
 		if test.latitude != carData.Latitude {
 			t.Errorf("Expected state %f but was %f", test.latitude, carData.Latitude)
 		}
+		if carData.ChargingState != "Charging" || !carData.IsCharging || carData.ChargerPower != 9 || carData.TimeToFullCharge != 2.75 || carData.ChargeEnergyAdded != 2.42 {
+			t.Errorf("Expected the charge state to be read but was %+v", carData)
+		}
+		if carData.ShiftState != "" || carData.Speed != 0 || carData.FastChargerPresent || !carData.ScheduledChargingStart.IsZero() {
+			t.Errorf("Expected a parked car on a wall charger but was %+v", carData)
+		}
+	}
+}
+
+func TestIsCharging(t *testing.T) {
+	tests := []struct {
+		state   string
+		current int32
+		want    bool
+	}{
+		{state: "Charging", want: true},
+		{state: "Starting", want: true},
+		{state: "Stopped", current: 16, want: false},
+		{state: "Complete", want: false},
+		{state: "", current: 16, want: true},
+		{state: "", want: false},
+	}
+	for _, test := range tests {
+		if got := isCharging(test.state, test.current); got != test.want {
+			t.Fatalf("Expected %v for %q at %d A got %v", test.want, test.state, test.current, got)
+		}
+	}
+}
+
+func TestSetChargingAmps(t *testing.T) {
+	fta := &fakeTeslaClient{
+		Responses: []fakeResponse{
+			{
+				Path:       "/api/1/vehicles",
+				StatusCode: 200,
+				Body:       `{"response": [{"id": 1234, "vehicle_id": 12341, "state": "online", "in_service": false}]}`,
+			},
+			{
+				Path:       "/api/1/vehicles/1234/command/set_charging_amps",
+				StatusCode: 200,
+				Body:       `{"response": {"reason": "", "result": true}}`,
+			},
+		},
+	}
+	cc := teslaClient{apiClient: fta}
+	err := cc.setChargingAmps(context.Background(), 1234, 12)
+	if err != nil {
+		t.Fatalf("Didnt expect error setting charging amps %v", err)
+	}
+	last := fta.Requests[len(fta.Requests)-1]
+	if last.Method != "POST" || last.Path != "/api/1/vehicles/1234/command/set_charging_amps" {
+		t.Fatalf("Unexpected request %v+", last)
+	}
+	if body, ok := last.Body.(chargingAmpsRequest); !ok || body.ChargingAmps != 12 {
+		t.Fatalf("Expected charging_amps 12 but body was %v+", last.Body)
+	}
+}
+
+func TestAsleepCarNotWoken(t *testing.T) {
+	fta := &fakeTeslaClient{
+		Responses: []fakeResponse{
+			{
+				Path:       "/api/1/vehicles",
+				StatusCode: 200,
+				Body:       `{"response": [{"id": 1234, "vehicle_id": 12341, "state": "asleep", "in_service": false}]}`,
+			},
+			{
+				Path:       "/api/1/vehicles/1234/wake_up",
+				StatusCode: 200,
+				Body:       `{"response": {"state": "online"}}`,
+			},
+		},
+	}
+	cc := teslaClient{apiClient: fta}
+	if err := cc.startCharging(context.Background(), 1234); !errors.Is(err, errVehicleOffline) {
+		t.Fatalf("Expected offline error got %v", err)
+	}
+	if _, err := cc.getCarData(context.Background(), 1234); !errors.Is(err, errVehicleOffline) {
+		t.Fatalf("Expected offline error got %v", err)
+	}
+	for _, r := range fta.Requests {
+		if r.Path != "/api/1/vehicles" {
+			t.Fatalf("Expected only the vehicles list to be read got %v+", r)
+		}
 	}
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	teslaAuthURL  = "https://auth.tesla.com"
+	teslaClientID = "ownerapi"
+	teslaScope    = "openid email offline_access"
+	teslaRedirect = "https://auth.tesla.com/void/callback"
+)
+
+// tokenExpiryMargin refreshes tokens a bit before they actually expire.
+const tokenExpiryMargin = 5 * time.Minute
+
+type teslaToken struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+}
+
+// teslaTokenSource hands out access tokens and exchanges the refresh token
+// when the access token has expired. Refreshed tokens are passed to
+// onRefresh so that they can be persisted, Tesla rotates refresh tokens.
+// Tokens of a third party application are refreshed with its clientID, for
+// the audience of its api, and keep the scopes they were granted, otherwise
+// they are the owner api's.
+type teslaTokenSource struct {
+	token     teslaToken
+	authURL   string
+	clientID  string
+	audience  string
+	onRefresh func(context.Context, teslaToken) error
+}
+
+func (ts *teslaTokenSource) expired() bool {
+	if ts.token.Expiry.IsZero() {
+		return false
+	}
+	return time.Now().Add(tokenExpiryMargin).After(ts.token.Expiry)
+}
+
+func (ts *teslaTokenSource) canRefresh() bool {
+	return ts.token.RefreshToken != ""
+}
+
+// accessToken returns a valid access token, refreshing it first if needed.
+func (ts *teslaTokenSource) accessToken(ctx context.Context) (string, error) {
+	if ts.expired() && ts.canRefresh() {
+		if err := ts.refresh(ctx); err != nil {
+			return "", err
+		}
+	}
+	return ts.token.AccessToken, nil
+}
+
+func (ts *teslaTokenSource) refresh(ctx context.Context) error {
+	v := url.Values{}
+	v.Set("grant_type", "refresh_token")
+	v.Set("refresh_token", ts.token.RefreshToken)
+	if ts.clientID != "" {
+		v.Set("client_id", ts.clientID)
+		if ts.audience != "" {
+			v.Set("audience", ts.audience)
+		}
+	} else {
+		v.Set("client_id", teslaClientID)
+		v.Set("scope", teslaScope)
+	}
+	token, err := requestToken(ctx, ts.authURL, v)
+	if err != nil {
+		return errors.Wrap(err, "refreshing access token")
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = ts.token.RefreshToken
+	}
+	ts.token = *token
+	if ts.onRefresh != nil {
+		if err := ts.onRefresh(ctx, ts.token); err != nil {
+			return errors.Wrap(err, "storing refreshed token")
+		}
+	}
+	return nil
+}
+
+// requestToken posts to the oauth2 token endpoint of the auth server.
+func requestToken(ctx context.Context, authURL string, v url.Values) (*teslaToken, error) {
+	if authURL == "" {
+		authURL = teslaAuthURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", authURL+"/oauth2/v3/token", strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, errors.New(fmt.Sprintf("Status code %d from token endpoint", resp.StatusCode))
+	}
+	var tr tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing token response")
+	}
+	if tr.AccessToken == "" {
+		return nil, errors.New("No access token in token response")
+	}
+	return &teslaToken{
+		AccessToken:  tr.AccessToken,
+		RefreshToken: tr.RefreshToken,
+		Expiry:       time.Now().UTC().Add(time.Duration(tr.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// loginPrompter lets the user log in with a browser and pick the vehicle
+// to control.
+type loginPrompter interface {
+	callbackURL(authorizeURL string) (string, error)
+	pickVehicle(vehicles []vehiclesData) (int, error)
+}
+
+type terminalPrompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p terminalPrompter) callbackURL(authorizeURL string) (string, error) {
+	fmt.Fprintf(p.out, "Open this url in a browser and log in:\n\n%s\n\n", authorizeURL)
+	fmt.Fprint(p.out, "Paste the url of the resulting Page Not Found page: ")
+	line, err := p.in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func (p terminalPrompter) pickVehicle(vehicles []vehiclesData) (int, error) {
+	for i, v := range vehicles {
+		fmt.Fprintf(p.out, "%d: %s %s id %d (%s)\n", i+1, v.DisplayName, v.VIN, v.ID, v.State)
+	}
+	if len(vehicles) == 1 {
+		return 0, nil
+	}
+	fmt.Fprint(p.out, "Pick vehicle: ")
+	line, err := p.in.ReadString('\n')
+	if err != nil && line == "" {
+		return 0, err
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || i < 1 || i > len(vehicles) {
+		return 0, errors.New(fmt.Sprintf("Invalid vehicle %s", strings.TrimSpace(line)))
+	}
+	return i - 1, nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b)[:n], nil
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// loginTesla performs the oauth2 authorization code flow with PKCE. The
+// login itself, including MFA, is done by the user in a browser after which
+// the callback url is pasted back. The vehicles of the account are listed
+// so the user can pick which one to control.
+func loginTesla(ctx context.Context, p loginPrompter, authURL string, apiURL string) (*teslaToken, *vehiclesData, error) {
+	if authURL == "" {
+		authURL = teslaAuthURL
+	}
+	verifier, err := randomString(86)
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err := randomString(20)
+	if err != nil {
+		return nil, nil, err
+	}
+	v := url.Values{}
+	v.Set("client_id", teslaClientID)
+	v.Set("code_challenge", codeChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+	v.Set("redirect_uri", teslaRedirect)
+	v.Set("response_type", "code")
+	v.Set("scope", teslaScope)
+	v.Set("state", state)
+	callback, err := p.callbackURL(authURL + "/oauth2/v3/authorize?" + v.Encode())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading callback url")
+	}
+	cu, err := url.Parse(callback)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parsing callback url")
+	}
+	if cu.Query().Get("state") != state {
+		return nil, nil, errors.New("State of callback url does not match")
+	}
+	code := cu.Query().Get("code")
+	if code == "" {
+		return nil, nil, errors.New("No code in callback url")
+	}
+
+	v = url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("client_id", teslaClientID)
+	v.Set("code", code)
+	v.Set("code_verifier", verifier)
+	v.Set("redirect_uri", teslaRedirect)
+	token, err := requestToken(ctx, authURL, v)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "exchanging code")
+	}
+
+	vehicles, err := getVehicles(ctx, teslaAPIClient{tokens: &teslaTokenSource{token: *token}, baseURL: apiURL})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(vehicles) == 0 {
+		return nil, nil, errors.New("No vehicles in account")
+	}
+	i, err := p.pickVehicle(vehicles)
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, &vehicles[i], nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTeslaAuthServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth2/v3/token" {
+			w.WriteHeader(404)
+			return
+		}
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh-1" {
+			w.WriteHeader(401)
+			return
+		}
+		fmt.Fprint(w, `{
+			"access_token": "access-2",
+			"refresh_token": "refresh-2",
+			"expires_in": 28800,
+			"token_type": "Bearer"
+		}`)
+	}))
+}
+
+func newTeslaAPIServer(t *testing.T, accessToken string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+accessToken {
+			w.WriteHeader(401)
+			return
+		}
+		fmt.Fprint(w, `{"response": [{"id": 1234, "vehicle_id": 12341, "state": "asleep", "in_service": false}]}`)
+	}))
+}
+
+func TestRefreshTokenOnUnauthorized(t *testing.T) {
+	auth := newTeslaAuthServer(t)
+	defer auth.Close()
+	api := newTeslaAPIServer(t, "access-2")
+	defer api.Close()
+
+	var stored teslaToken
+	ts := &teslaTokenSource{
+		token:   teslaToken{AccessToken: "access-1", RefreshToken: "refresh-1"},
+		authURL: auth.URL,
+		onRefresh: func(ctx context.Context, t teslaToken) error {
+			stored = t
+			return nil
+		},
+	}
+	state, err := getCarState(context.Background(), teslaAPIClient{tokens: ts, baseURL: api.URL}, 1234)
+	if err != nil {
+		t.Fatalf("Didnt expect error fetching car state %v", err)
+	}
+	if state != "asleep" {
+		t.Fatalf("Expected state asleep but was %s", state)
+	}
+	if stored.AccessToken != "access-2" || stored.RefreshToken != "refresh-2" {
+		t.Fatalf("Refreshed token was not stored %v+", stored)
+	}
+	if stored.Expiry.Before(time.Now().Add(7 * time.Hour)) {
+		t.Fatalf("Unexpected token expiry %v", stored.Expiry)
+	}
+}
+
+func TestRefreshExpiredToken(t *testing.T) {
+	auth := newTeslaAuthServer(t)
+	defer auth.Close()
+
+	ts := &teslaTokenSource{
+		token:   teslaToken{AccessToken: "access-1", RefreshToken: "refresh-1", Expiry: time.Now().Add(-time.Hour)},
+		authURL: auth.URL,
+	}
+	token, err := ts.accessToken(context.Background())
+	if err != nil {
+		t.Fatalf("Didnt expect error refreshing token %v", err)
+	}
+	if token != "access-2" {
+		t.Fatalf("Expected refreshed access token but was %s", token)
+	}
+
+	ts = &teslaTokenSource{
+		token:   teslaToken{AccessToken: "access-1", RefreshToken: "refresh-1", Expiry: time.Now().Add(time.Hour)},
+		authURL: auth.URL,
+	}
+	token, err = ts.accessToken(context.Background())
+	if err != nil || token != "access-1" {
+		t.Fatalf("Expected valid token to be used as is, was %s %v", token, err)
+	}
+}
+
+func TestRefreshTokenRejected(t *testing.T) {
+	auth := newTeslaAuthServer(t)
+	defer auth.Close()
+	api := newTeslaAPIServer(t, "access-2")
+	defer api.Close()
+
+	ts := &teslaTokenSource{
+		token:   teslaToken{AccessToken: "access-1", RefreshToken: "revoked"},
+		authURL: auth.URL,
+	}
+	_, err := getCarState(context.Background(), teslaAPIClient{tokens: ts, baseURL: api.URL}, 1234)
+	if err == nil {
+		t.Fatalf("Expected error when refresh token is rejected")
+	}
+}
+
+type fakePrompter struct {
+	challenge string
+	code      string
+	vehicle   int
+	vehicles  []vehiclesData
+}
+
+func (p *fakePrompter) callbackURL(authorizeURL string) (string, error) {
+	u, err := url.Parse(authorizeURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Query().Get("code_challenge_method") != "S256" {
+		return "", fmt.Errorf("unexpected challenge method %s", u.Query().Get("code_challenge_method"))
+	}
+	p.challenge = u.Query().Get("code_challenge")
+	return fmt.Sprintf("%s?code=%s&state=%s", teslaRedirect, p.code, u.Query().Get("state")), nil
+}
+
+func (p *fakePrompter) pickVehicle(vehicles []vehiclesData) (int, error) {
+	p.vehicles = vehicles
+	return p.vehicle, nil
+}
+
+func TestLoginTesla(t *testing.T) {
+	p := &fakePrompter{code: "code-1", vehicle: 1}
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/oauth2/v3/token" ||
+			r.PostForm.Get("grant_type") != "authorization_code" ||
+			r.PostForm.Get("code") != "code-1" ||
+			r.PostForm.Get("redirect_uri") != teslaRedirect ||
+			codeChallenge(r.PostForm.Get("code_verifier")) != p.challenge {
+			w.WriteHeader(400)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "access-1", "refresh_token": "refresh-1", "expires_in": 28800}`)
+	}))
+	defer auth.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-1" || r.URL.Path != "/api/1/vehicles" {
+			w.WriteHeader(401)
+			return
+		}
+		fmt.Fprint(w, `{"response": [
+			{"id": 1234, "vehicle_id": 12341, "vin": "5YJ3E1EA1JF000001", "display_name": "Nikola", "state": "online"},
+			{"id": 1235, "vehicle_id": 12351, "vin": "5YJ3E1EA1JF000002", "display_name": "Ada", "state": "asleep"}
+		]}`)
+	}))
+	defer api.Close()
+
+	token, vehicle, err := loginTesla(context.Background(), p, auth.URL, api.URL)
+	if err != nil {
+		t.Fatalf("Didnt expect error logging in %v", err)
+	}
+	if token.AccessToken != "access-1" || token.RefreshToken != "refresh-1" {
+		t.Fatalf("Unexpected token %v+", token)
+	}
+	if len(p.vehicles) != 2 {
+		t.Fatalf("Expected two vehicles to pick from but got %v+", p.vehicles)
+	}
+	if vehicle.ID != 1235 || vehicle.DisplayName != "Ada" {
+		t.Fatalf("Expected the picked vehicle but got %v+", vehicle)
+	}
+}
+
+func TestLoginTeslaStateMismatch(t *testing.T) {
+	p := terminalPrompter{
+		in:  bufio.NewReader(strings.NewReader(teslaRedirect + "?code=code-1&state=other\n")),
+		out: ioutil.Discard,
+	}
+	_, _, err := loginTesla(context.Background(), p, "http://127.0.0.1:0", "http://127.0.0.1:0")
+	if err == nil {
+		t.Fatalf("Expected error when state does not match")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/stelund/solarchargetesla/vehiclecommand"
+)
+
+// commandSigner sends actions signed with the vehicle command protocol.
+type commandSigner interface {
+	Execute(ctx context.Context, domain int, action []byte) error
+}
+
+type signedCommandRequest struct {
+	RoutableMessage string `json:"routable_message"`
+}
+
+type signedCommandResponse struct {
+	Response string `json:"response"`
+}
+
+// signedCommandTransport posts routable messages to the signed_command
+// endpoint of the Fleet API, which passes them on to the car.
+func signedCommandTransport(cac carAPIClient, carID int64) vehiclecommand.Transport {
+	return func(ctx context.Context, msg []byte) ([]byte, error) {
+		req := signedCommandRequest{RoutableMessage: base64.StdEncoding.EncodeToString(msg)}
+		resp, err := cac.makeRequest(ctx, "POST", fmt.Sprintf("/api/1/vehicles/%d/signed_command", carID), req)
+		if err != nil {
+			return nil, errors.Wrap(err, "posting signed command")
+		}
+		defer resp.Body.Close()
+		var r signedCommandResponse
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			return nil, errors.Wrap(err, "parsing signed command response")
+		}
+		return base64.StdEncoding.DecodeString(r.Response)
+	}
+}
+
+// loadCommandKey reads the private key that commands are signed with.
+func loadCommandKey(path string) (*ecdsa.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("No command key, set TESLA_COMMAND_KEY")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading command key")
+	}
+	return vehiclecommand.ParsePrivateKey(b)
+}
+
+// generateCommandKey writes a new private key to path and the public key,
+// which the application's domain has to host, to path.pub.
+func generateCommandKey(path string) ([]byte, error) {
+	key, err := vehiclecommand.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	private, err := vehiclecommand.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	public, err := vehiclecommand.MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(private); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return public, ioutil.WriteFile(path+".pub", public, 0644)
+}
+
+// enrollCommandKey has the user add the key of the application to the car
+// with the Tesla app, and confirms it by setting up a session with the car.
+func enrollCommandKey(ctx context.Context, in *bufio.Reader, out io.Writer, domain string, signer *vehiclecommand.Client) error {
+	fmt.Fprintf(out, "Open this link on the phone with the Tesla app, approve the key and tap the key card on the car:\n\n")
+	fmt.Fprintf(out, "https://tesla.com/_ak/%s\n\nPress enter when done: ", domain)
+	if _, err := in.ReadString('\n'); err != nil && err != io.EOF {
+		return err
+	}
+	return signer.Handshake(ctx, vehiclecommand.DomainInfotainment)
+}
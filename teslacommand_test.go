@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stelund/solarchargetesla/vehiclecommand"
+)
+
+const testVIN = "5YJ3E1EA7KF000001"
+
+// newFleetVehicle serves a fake vehicle that verifies signed commands and
+// records the other requests.
+func newFleetVehicle(t *testing.T, requests *[]string) (*vehiclecommand.Vehicle, *httptest.Server) {
+	v, err := vehiclecommand.NewVehicle(testVIN)
+	if err != nil {
+		t.Fatalf("Failed to create vehicle %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/1/vehicles":
+			fmt.Fprintf(w, `{"response": [{"id": 123, "vin": "%s", "state": "online"}], "count": 1}`, testVIN)
+		case "/api/1/vehicles/" + testVIN + "/signed_command":
+			v.ServeHTTP(w, r)
+		default:
+			*requests = append(*requests, r.URL.Path)
+			fmt.Fprint(w, `{"response": {"result": true, "reason": ""}}`)
+		}
+	}))
+	return v, server
+}
+
+func TestSignedCommands(t *testing.T) {
+	ctx := context.Background()
+	var requests []string
+	v, server := newFleetVehicle(t, &requests)
+	defer server.Close()
+
+	key, err := vehiclecommand.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key %v", err)
+	}
+	v.Enroll(vehiclecommand.PublicKeyBytes(&key.PublicKey))
+	fc := &teslaFleetClient{tokens: &teslaTokenSource{}, baseURL: server.URL, carID: 123, vin: testVIN}
+	signer, err := vehiclecommand.NewClient(key, testVIN, signedCommandTransport(fc, 123))
+	if err != nil {
+		t.Fatalf("Failed to create signer %v", err)
+	}
+	tc := teslaClient{apiClient: fc, signer: signer}
+
+	if err := tc.setChargingAmps(ctx, 123, 8); err != nil {
+		t.Fatalf("Failed to set current %v", err)
+	}
+	if err := tc.startCharging(ctx, 123); err != nil {
+		t.Fatalf("Failed to start %v", err)
+	}
+	if charging, amps := v.Charging(); !charging || amps != 8 {
+		t.Fatalf("Expected the vehicle to charge at 8 A got %v %d", charging, amps)
+	}
+	if err := tc.stopCharging(ctx, 123); err != nil {
+		t.Fatalf("Failed to stop %v", err)
+	}
+	if len(requests) != 0 {
+		t.Fatalf("Expected no unsigned commands got %v", requests)
+	}
+
+	// A key that is not enrolled is refused.
+	other, _ := vehiclecommand.GenerateKey()
+	signer, _ = vehiclecommand.NewClient(other, testVIN, signedCommandTransport(fc, 123))
+	tc.signer = signer
+	if err := tc.startCharging(ctx, 123); err == nil {
+		t.Fatalf("Expected error for a key that is not enrolled")
+	}
+}
+
+func TestCommandProxy(t *testing.T) {
+	var requests []string
+	_, server := newFleetVehicle(t, &requests)
+	defer server.Close()
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Path)
+		fmt.Fprint(w, `{"response": {"result": true, "reason": ""}}`)
+	}))
+	defer proxy.Close()
+
+	fc := &teslaFleetClient{tokens: &teslaTokenSource{}, baseURL: server.URL, commandURL: proxy.URL, carID: 123, vin: testVIN}
+	tc := teslaClient{apiClient: fc}
+	if err := tc.startCharging(context.Background(), 123); err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	want := "/api/1/vehicles/" + testVIN + "/command/charge_start"
+	if len(proxied) != 1 || proxied[0] != want || len(requests) != 0 {
+		t.Fatalf("Expected %s through the proxy got %v and %v", want, proxied, requests)
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commandkey")
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "private.pem")
+	public, err := generateCommandKey(path)
+	if err != nil {
+		t.Fatalf("Failed to generate key %v", err)
+	}
+	if !strings.Contains(string(public), "PUBLIC KEY") {
+		t.Fatalf("Expected a pem public key got %s", public)
+	}
+	if _, err := loadCommandKey(path); err != nil {
+		t.Fatalf("Failed to load key %v", err)
+	}
+	if _, err := generateCommandKey(path); err == nil {
+		t.Fatalf("Expected an existing key not to be overwritten")
+	}
+	if _, err := loadCommandKey(""); err == nil {
+		t.Fatalf("Expected error without a key")
+	}
+}
+
+func TestEnrollCommandKey(t *testing.T) {
+	var requests []string
+	v, server := newFleetVehicle(t, &requests)
+	defer server.Close()
+	key, _ := vehiclecommand.GenerateKey()
+	fc := &teslaFleetClient{tokens: &teslaTokenSource{}, baseURL: server.URL, carID: 123, vin: testVIN}
+	signer, _ := vehiclecommand.NewClient(key, testVIN, signedCommandTransport(fc, 123))
+
+	var out strings.Builder
+	err := enrollCommandKey(context.Background(), bufio.NewReader(strings.NewReader("\n")), &out, "example.com", signer)
+	if err != vehiclecommand.ErrKeyNotEnrolled {
+		t.Fatalf("Expected key not enrolled got %v", err)
+	}
+	if !strings.Contains(out.String(), "https://tesla.com/_ak/example.com") {
+		t.Fatalf("Expected the enrollment link got %s", out.String())
+	}
+	v.Enroll(vehiclecommand.PublicKeyBytes(&key.PublicKey))
+	if err := enrollCommandKey(context.Background(), bufio.NewReader(strings.NewReader("\n")), &out, "example.com", signer); err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+}
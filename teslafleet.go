@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Fleet API hosts of the regions, an account's vehicles are only reachable
+// in the region of the account.
+var teslaFleetURLs = map[string]string{
+	"na": "https://fleet-api.prd.na.vn.cloud.tesla.com",
+	"eu": "https://fleet-api.prd.eu.vn.cloud.tesla.com",
+	"cn": "https://fleet-api.prd.cn.vn.cloud.tesla.cn",
+}
+
+const (
+	teslaFleetAuthURL = "https://fleet-auth.prd.vn.cloud.tesla.com"
+	teslaFleetScope   = "openid vehicle_device_data vehicle_cmds vehicle_charging_cmds"
+)
+
+// maxTeslaRetryAfter is the longest a rate limited request is waited for
+// before it is retried, longer waits are left to the next cycle.
+const maxTeslaRetryAfter = 30 * time.Second
+
+// Errors of the owner api and the Fleet API, a *teslaAPIError wraps one of
+// them so the controller can tell them apart with errors.Is.
+var (
+	errTeslaUnauthorized  = errors.New("Tesla token rejected")
+	errTeslaForbidden     = errors.New("Tesla token lacks the scope or access to the vehicle")
+	errVehicleNotFound    = errors.New("Vehicle not found")
+	errVehicleOffline     = errors.New("Vehicle is offline or asleep")
+	errNotRegistered      = errors.New("Application is not registered in the region")
+	errIncorrectRegion    = errors.New("Account is in another region")
+	errRateLimited        = errors.New("Rate limited by Tesla")
+	errVehicleUnavailable = errors.New("Vehicle or Tesla api unavailable")
+	errTeslaAPI           = errors.New("Tesla api error")
+)
+
+// teslaAPIError is an error status from Tesla with the message of the body.
+// RetryAfter is set when rate limited.
+type teslaAPIError struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration
+	kind       error
+}
+
+func (e *teslaAPIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%v, status code %d", e.kind, e.StatusCode)
+	}
+	return fmt.Sprintf("%v, status code %d: %s", e.kind, e.StatusCode, e.Message)
+}
+
+func (e *teslaAPIError) Unwrap() error {
+	return e.kind
+}
+
+type teslaErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// teslaResponseError returns the error of a response with an error status,
+// closing its body, or nil.
+func teslaResponseError(resp *http.Response) *teslaAPIError {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+	defer resp.Body.Close()
+	e := teslaAPIError{StatusCode: resp.StatusCode}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		e.kind = errTeslaUnauthorized
+	case http.StatusForbidden:
+		e.kind = errTeslaForbidden
+	case http.StatusNotFound:
+		e.kind = errVehicleNotFound
+	case http.StatusRequestTimeout:
+		e.kind = errVehicleOffline
+	case http.StatusPreconditionFailed:
+		e.kind = errNotRegistered
+	case http.StatusMisdirectedRequest:
+		e.kind = errIncorrectRegion
+	case http.StatusTooManyRequests:
+		e.kind = errRateLimited
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	case http.StatusServiceUnavailable, 540:
+		e.kind = errVehicleUnavailable
+	default:
+		e.kind = errTeslaAPI
+	}
+	if b, err := ioutil.ReadAll(resp.Body); err == nil {
+		var r teslaErrorResponse
+		if json.Unmarshal(b, &r) == nil {
+			e.Message = strings.TrimSpace(r.Error + " " + r.ErrorDescription)
+		}
+	}
+	return &e
+}
+
+func teslaFleetURL(region string) (string, error) {
+	if region == "" {
+		region = "na"
+	}
+	u, ok := teslaFleetURLs[strings.ToLower(region)]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Unknown Fleet API region %s", region))
+	}
+	return u, nil
+}
+
+// teslaFleetClient calls the Fleet API in a region. The vehicle functions
+// address the car by id, as the owner api does, the client addresses it by
+// VIN instead when it has one. When the account turns out to be in another
+// region the region is looked up, passed to onRegion and used from then on.
+// Commands go to commandURL when set, a locally run command proxy that signs
+// them.
+type teslaFleetClient struct {
+	tokens     *teslaTokenSource
+	baseURL    string
+	commandURL string
+	carID      int64
+	vin        string
+	onRegion   func(ctx context.Context, region string) error
+}
+
+func (t *teslaFleetClient) makeRequest(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	if t.commandURL != "" && strings.Contains(path, "/command/") {
+		path, query := t.vehiclePath(path)
+		return teslaRequest(ctx, t, t.tokens, method, t.commandURL, path, query, body)
+	}
+	path, query := t.vehiclePath(path)
+	resp, err := teslaRequest(ctx, t, t.tokens, method, t.baseURL, path, query, body)
+	if !errors.Is(err, errIncorrectRegion) {
+		return resp, err
+	}
+	if err := t.discoverRegion(ctx); err != nil {
+		return &http.Response{}, err
+	}
+	return teslaRequest(ctx, t, t.tokens, method, t.baseURL, path, query, body)
+}
+
+// vehiclePath addresses the car by VIN. The location is only in the vehicle
+// data of the Fleet API when asked for.
+func (t *teslaFleetClient) vehiclePath(path string) (string, url.Values) {
+	prefix := fmt.Sprintf("/api/1/vehicles/%d", t.carID)
+	if t.vin != "" && (path == prefix || strings.HasPrefix(path, prefix+"/")) {
+		path = "/api/1/vehicles/" + t.vin + strings.TrimPrefix(path, prefix)
+	}
+	if strings.HasSuffix(path, "/vehicle_data") {
+		return path, url.Values{"endpoints": {"charge_state;drive_state;location_data"}}
+	}
+	return path, nil
+}
+
+type fleetRegion struct {
+	Region          string `json:"region"`
+	FleetAPIBaseURL string `json:"fleet_api_base_url"`
+}
+
+type fleetRegionResponse struct {
+	Region fleetRegion `json:"response"`
+}
+
+func (t *teslaFleetClient) discoverRegion(ctx context.Context) error {
+	resp, err := teslaRequest(ctx, t, t.tokens, "GET", t.baseURL, "/api/1/users/region", nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "fetching region")
+	}
+	defer resp.Body.Close()
+	var r fleetRegionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return errors.Wrap(err, "parsing region")
+	}
+	if r.Region.FleetAPIBaseURL == "" {
+		return errors.New("No Fleet API url for the account's region")
+	}
+	t.baseURL = r.Region.FleetAPIBaseURL
+	if t.onRegion != nil {
+		return t.onRegion(ctx, r.Region.Region)
+	}
+	return nil
+}
+
+func (t *teslaFleetClient) sleep(ctx context.Context, d time.Duration) error {
+	return teslaAPIClient{}.sleep(ctx, d)
+}
+
+// partnerToken is a token of the application itself, used to register it
+// in the regions.
+func partnerToken(ctx context.Context, authURL string, clientID string, clientSecret string, audience string) (*teslaToken, error) {
+	if authURL == "" {
+		authURL = teslaFleetAuthURL
+	}
+	v := url.Values{}
+	v.Set("grant_type", "client_credentials")
+	v.Set("client_id", clientID)
+	v.Set("client_secret", clientSecret)
+	v.Set("scope", teslaFleetScope)
+	v.Set("audience", audience)
+	return requestToken(ctx, authURL, v)
+}
+
+type partnerAccountRequest struct {
+	Domain string `json:"domain"`
+}
+
+// registerPartner registers the application with the domain that hosts its
+// public key in the region of baseURL, which is needed once before the
+// region's vehicles can be reached.
+func registerPartner(ctx context.Context, baseURL string, token *teslaToken, domain string) error {
+	ts := &teslaTokenSource{token: *token}
+	resp, err := teslaRequest(ctx, teslaAPIClient{}, ts, "POST", baseURL, "/api/1/partner_accounts", nil, partnerAccountRequest{Domain: domain})
+	if err != nil {
+		return errors.Wrap(err, "registering partner account")
+	}
+	resp.Body.Close()
+	return nil
+}
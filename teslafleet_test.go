@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTeslaResponseError(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{status: 401, want: errTeslaUnauthorized},
+		{status: 403, want: errTeslaForbidden},
+		{status: 404, want: errVehicleNotFound},
+		{status: 408, want: errVehicleOffline},
+		{status: 412, want: errNotRegistered},
+		{status: 421, want: errIncorrectRegion},
+		{status: 429, want: errRateLimited},
+		{status: 503, want: errVehicleUnavailable},
+		{status: 540, want: errVehicleUnavailable},
+		{status: 500, want: errTeslaAPI},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "12")
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, `{"error": "vehicle unavailable"}`)
+		}))
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Didnt expect error %v", err)
+		}
+		apiErr := teslaResponseError(resp)
+		server.Close()
+		if !errors.Is(apiErr, test.want) || apiErr.Message != "vehicle unavailable" {
+			t.Fatalf("Expected %v for status %d got %v", test.want, test.status, apiErr)
+		}
+		if test.status == 429 && apiErr.RetryAfter != 12*time.Second {
+			t.Fatalf("Expected retry after 12s got %v", apiErr.RetryAfter)
+		}
+	}
+}
+
+func TestTeslaFleetURL(t *testing.T) {
+	if u, _ := teslaFleetURL(""); u != teslaFleetURLs["na"] {
+		t.Fatalf("Expected na by default got %s", u)
+	}
+	if u, _ := teslaFleetURL("EU"); u != teslaFleetURLs["eu"] {
+		t.Fatalf("Expected eu got %s", u)
+	}
+	if _, err := teslaFleetURL("mars"); err == nil {
+		t.Fatalf("Expected error for an unknown region")
+	}
+}
+
+// fleetServer is a fake Fleet API of one region. Vehicles are only found in
+// the region of the account, other regions answer 421.
+type fleetServer struct {
+	region   string
+	account  string
+	other    string
+	limited  int
+	requests []string
+}
+
+func (f *fleetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(401)
+		return
+	}
+	if r.URL.Path == "/api/1/users/region" {
+		fmt.Fprintf(w, `{"response": {"region": "%s", "fleet_api_base_url": "%s"}}`, f.account, f.other)
+		return
+	}
+	if f.region != f.account {
+		w.WriteHeader(421)
+		return
+	}
+	if f.limited > 0 {
+		f.limited--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(429)
+		return
+	}
+	switch r.URL.Path {
+	case "/api/1/vehicles":
+		fmt.Fprint(w, `{"response": [{"id": 123, "vin": "5YJ3E1EA7KF000001", "state": "online"}], "count": 1}`)
+	case "/api/1/vehicles/5YJ3E1EA7KF000001/vehicle_data":
+		fmt.Fprint(w, `{"response": {"state": "online", "charge_state": {"battery_level": 64, "charge_limit_soc": 80}, "drive_state": {"latitude": 59.3, "longitude": 18.1}}}`)
+	case "/api/1/vehicles/5YJ3E1EA7KF000001/command/charge_start":
+		fmt.Fprint(w, `{"response": {"result": true, "reason": ""}}`)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestTeslaFleetClient(t *testing.T) {
+	eu := &fleetServer{region: "eu", account: "eu"}
+	euServer := httptest.NewServer(eu)
+	defer euServer.Close()
+	na := &fleetServer{region: "na", account: "eu", other: euServer.URL}
+	naServer := httptest.NewServer(na)
+	defer naServer.Close()
+
+	var stored string
+	fc := &teslaFleetClient{
+		tokens:  &teslaTokenSource{token: teslaToken{AccessToken: "token"}},
+		baseURL: naServer.URL,
+		carID:   123,
+		vin:     "5YJ3E1EA7KF000001",
+		onRegion: func(ctx context.Context, region string) error {
+			stored = region
+			return nil
+		},
+	}
+	tc := teslaClient{apiClient: fc}
+	data, err := tc.getCarData(context.Background(), 123)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	if data.BatteryLevel != 64 || data.Latitude != 59.3 {
+		t.Fatalf("Unexpected car data %+v", data)
+	}
+	if fc.baseURL != euServer.URL || stored != "eu" {
+		t.Fatalf("Expected the eu region to be used and stored got %s %s", fc.baseURL, stored)
+	}
+	want := "GET /api/1/vehicles/5YJ3E1EA7KF000001/vehicle_data?endpoints=charge_state%3Bdrive_state%3Blocation_data"
+	if len(eu.requests) == 0 || eu.requests[len(eu.requests)-1] != want {
+		t.Fatalf("Expected request %s got %v", want, eu.requests)
+	}
+
+	eu.limited = 1
+	if err := tc.startCharging(context.Background(), 123); err != nil {
+		t.Fatalf("Expected the rate limited command to be retried %v", err)
+	}
+	eu.limited = 2
+	if err := tc.startCharging(context.Background(), 123); !errors.Is(err, errRateLimited) {
+		t.Fatalf("Expected rate limited error got %v", err)
+	}
+}
+
+func TestTeslaOfflineError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(408)
+	}))
+	defer server.Close()
+	tc := teslaClient{apiClient: teslaAPIClient{tokens: &teslaTokenSource{}, baseURL: server.URL}}
+	if _, err := tc.getCarData(context.Background(), 1); !errors.Is(err, errVehicleOffline) {
+		t.Fatalf("Expected offline error got %v", err)
+	}
+}
+
+func TestRegisterPartner(t *testing.T) {
+	var domain partnerAccountRequest
+	var grant string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth2/v3/token":
+			r.ParseForm()
+			grant = r.Form.Get("grant_type") + " " + r.Form.Get("audience")
+			fmt.Fprint(w, `{"access_token": "partner", "expires_in": 3600}`)
+		case "/api/1/partner_accounts":
+			if r.Header.Get("Authorization") != "Bearer partner" {
+				w.WriteHeader(401)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&domain)
+			fmt.Fprint(w, `{"response": {}}`)
+		}
+	}))
+	defer server.Close()
+
+	token, err := partnerToken(context.Background(), server.URL, "id", "secret", server.URL)
+	if err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	if err := registerPartner(context.Background(), server.URL, token, "example.com"); err != nil {
+		t.Fatalf("Didnt expect error %v", err)
+	}
+	if grant != "client_credentials "+server.URL || domain.Domain != "example.com" {
+		t.Fatalf("Unexpected grant %s or domain %+v", grant, domain)
+	}
+}
+
+// recordingTransport answers every request with a token and records it.
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (rt *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.ParseForm()
+	rt.requests = append(rt.requests, r)
+	body := `{"access_token": "access-2", "refresh_token": "refresh-2", "expires_in": 28800}`
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(body)), Header: http.Header{}, Request: r}, nil
+}
+
+func TestFleetTokenRefresh(t *testing.T) {
+	rt := &recordingTransport{}
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = rt
+	defer func() { http.DefaultClient.Transport = transport }()
+	os.Setenv("TESLA_CLIENT_ID", "app")
+	defer os.Unsetenv("TESLA_CLIENT_ID")
+
+	a := realApp{st: newMemoryStore(), tokens: map[string]*teslaTokenSource{}}
+	c := car{TeslaAPI: "fleet", FleetRegion: "eu", AccessToken: "access-1", RefreshToken: "refresh-1", TokenExpiry: time.Now().Add(-time.Hour), documentId: "car1"}
+	a.st.setCar(context.Background(), c)
+	token, err := a.teslaTokens(c).accessToken(context.Background())
+	if err != nil || token != "access-2" {
+		t.Fatalf("Expected a refreshed token got %s %v", token, err)
+	}
+	if len(rt.requests) != 1 {
+		t.Fatalf("Expected one refresh got %d", len(rt.requests))
+	}
+	r := rt.requests[0]
+	if r.URL.Host != "fleet-auth.prd.vn.cloud.tesla.com" || r.URL.Path != "/oauth2/v3/token" {
+		t.Fatalf("Expected the refresh to be posted to the Fleet auth server got %s", r.URL)
+	}
+	if r.PostForm.Get("client_id") != "app" || r.PostForm.Get("audience") != teslaFleetURLs["eu"] || r.PostForm.Get("scope") != "" {
+		t.Fatalf("Unexpected refresh %v", r.PostForm)
+	}
+}
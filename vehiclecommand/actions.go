@@ -0,0 +1,105 @@
+package vehiclecommand
+
+import (
+	"fmt"
+
+	"github.com/stelund/solarchargetesla/protowire"
+)
+
+// Fields of the infotainment Action and VehicleAction messages.
+const (
+	actionVehicleAction            = 2
+	vehicleActionChargingStartStop = 6
+	vehicleActionSetChargingAmps   = 43
+)
+
+// Members of ChargingStartStopAction.
+const (
+	chargingStart = 2
+	chargingStop  = 5
+)
+
+func vehicleAction(num int, m []byte) []byte {
+	return protowire.AppendMessage(nil, actionVehicleAction, protowire.AppendMessage(nil, num, m))
+}
+
+// ChargeStart is the infotainment action that starts charging.
+func ChargeStart() []byte {
+	return vehicleAction(vehicleActionChargingStartStop, protowire.AppendMessage(nil, chargingStart, nil))
+}
+
+// ChargeStop is the infotainment action that stops charging.
+func ChargeStop() []byte {
+	return vehicleAction(vehicleActionChargingStartStop, protowire.AppendMessage(nil, chargingStop, nil))
+}
+
+// SetChargingAmps is the infotainment action that sets the charging current.
+func SetChargingAmps(amps int32) []byte {
+	return vehicleAction(vehicleActionSetChargingAmps, protowire.AppendUint(nil, 1, uint64(amps)))
+}
+
+// action is a decoded charging action.
+type action struct {
+	name string
+	amps int32
+}
+
+func parseAction(b []byte) (action, error) {
+	fs, err := protowire.Parse(b)
+	if err != nil {
+		return action{}, err
+	}
+	va, err := fs.Message(actionVehicleAction)
+	if err != nil {
+		return action{}, err
+	}
+	switch {
+	case va.Has(vehicleActionChargingStartStop):
+		ss, err := va.Message(vehicleActionChargingStartStop)
+		if err != nil {
+			return action{}, err
+		}
+		if ss.Has(chargingStart) {
+			return action{name: "charge_start"}, nil
+		} else if ss.Has(chargingStop) {
+			return action{name: "charge_stop"}, nil
+		}
+	case va.Has(vehicleActionSetChargingAmps):
+		amps, err := va.Message(vehicleActionSetChargingAmps)
+		if err != nil {
+			return action{}, err
+		}
+		return action{name: "set_charging_amps", amps: int32(amps.Uint(1))}, nil
+	}
+	return action{}, fmt.Errorf("unsupported action")
+}
+
+// actionResponse is the infotainment Response with the result of an action.
+func actionResponse(reason string) []byte {
+	var status []byte
+	if reason != "" {
+		status = protowire.AppendUint(status, 1, 1)
+		status = protowire.AppendMessage(status, 2, protowire.AppendBytes(nil, 1, []byte(reason)))
+	}
+	return protowire.AppendMessage(nil, 1, status)
+}
+
+// parseActionResponse returns the error of a refused action.
+func parseActionResponse(b []byte) error {
+	fs, err := protowire.Parse(b)
+	if err != nil {
+		return err
+	}
+	status, err := fs.Message(1)
+	if err != nil {
+		return err
+	}
+	if status.Uint(1) == 0 {
+		return nil
+	}
+	reason, err := status.Message(2)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("vehicle refused command: %s", reason.Bytes(1))
+}
@@ -0,0 +1,189 @@
+// Package vehiclecommand implements the signing side of Tesla's vehicle
+// command protocol. A session with a domain of the vehicle is set up with an
+// ECDH handshake, after which commands are authenticated with an HMAC over
+// their metadata and payload. A simulated vehicle verifies them.
+package vehiclecommand
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// expiry is how long a command stays valid, in the vehicle's clock.
+const expiry = 15 * time.Second
+
+// ErrKeyNotEnrolled is returned when the vehicle does not know the key.
+var ErrKeyNotEnrolled = errors.New("key is not enrolled in the vehicle")
+
+// Transport sends a routable message to the vehicle and returns its reply.
+type Transport func(ctx context.Context, msg []byte) ([]byte, error)
+
+// session is the state shared with one domain of the vehicle. The counter
+// is increased for each command and the vehicle's clock is tracked so the
+// commands can expire.
+type session struct {
+	key       []byte
+	epoch     []byte
+	counter   uint32
+	clockTime uint32
+	received  time.Time
+}
+
+// Client signs commands for one vehicle with a key enrolled in it. Sessions
+// are kept between commands and set up again when the vehicle asks for it,
+// after a reboot for example.
+type Client struct {
+	key     *ecdsa.PrivateKey
+	vin     string
+	send    Transport
+	address []byte
+
+	mu       sync.Mutex
+	sessions map[int]*session
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewClient creates a client for the vehicle with the VIN.
+func NewClient(key *ecdsa.PrivateKey, vin string, send Transport) (*Client, error) {
+	address, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{key: key, vin: vin, send: send, address: address, sessions: map[int]*session{}}, nil
+}
+
+// Handshake sets up a new session with a domain of the vehicle, which fails
+// with ErrKeyNotEnrolled until the key is enrolled.
+func (c *Client) Handshake(ctx context.Context, domain int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.handshake(ctx, domain)
+	return err
+}
+
+// Execute sends a signed action to a domain of the vehicle.
+func (c *Client) Execute(ctx context.Context, domain int, action []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		s, ok := c.sessions[domain]
+		if !ok {
+			var err error
+			if s, err = c.handshake(ctx, domain); err != nil {
+				return err
+			}
+		}
+		uuid, err := randomBytes(16)
+		if err != nil {
+			return err
+		}
+		s.counter++
+		expiresAt := s.clockTime + uint32((time.Since(s.received)+expiry)/time.Second)
+		msg := routableMessage{
+			to:      destination{domain: domain},
+			from:    destination{routingAddress: c.address},
+			payload: action,
+			signature: &signatureData{
+				signerPublicKey: PublicKeyBytes(&c.key.PublicKey),
+				epoch:           s.epoch,
+				counter:         s.counter,
+				expiresAt:       expiresAt,
+				tag:             commandTag(s.key, domain, c.vin, s.epoch, expiresAt, s.counter, action),
+			},
+			uuid: uuid,
+		}
+		reply, err := c.exchange(ctx, msg)
+		if err != nil {
+			return err
+		}
+		if reply.fault == FaultNone {
+			return parseActionResponse(reply.payload)
+		}
+		fault := &FaultError{Fault: reply.fault}
+		if !fault.resync() || attempt > 0 {
+			return fault
+		}
+		// The session is out of sync, the vehicle sends its current one.
+		delete(c.sessions, domain)
+		if len(reply.sessionInfo) > 0 {
+			if _, err := c.updateSession(domain, reply, uuid); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Client) handshake(ctx context.Context, domain int) (*session, error) {
+	challenge, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.exchange(ctx, routableMessage{
+		to:                 destination{domain: domain},
+		from:               destination{routingAddress: c.address},
+		sessionInfoRequest: PublicKeyBytes(&c.key.PublicKey),
+		challenge:          challenge,
+		uuid:               challenge,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply.fault != FaultNone {
+		return nil, &FaultError{Fault: reply.fault}
+	}
+	return c.updateSession(domain, reply, challenge)
+}
+
+func (c *Client) exchange(ctx context.Context, msg routableMessage) (*routableMessage, error) {
+	b, err := c.send(ctx, msg.marshal())
+	if err != nil {
+		return nil, err
+	}
+	reply, err := parseRoutableMessage(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing reply: %w", err)
+	}
+	if !bytes.Equal(reply.requestUUID, msg.uuid) {
+		return nil, fmt.Errorf("reply is to another message")
+	}
+	return reply, nil
+}
+
+// updateSession starts a session from the session info in a reply, which is
+// authenticated with the challenge that the reply answers.
+func (c *Client) updateSession(domain int, reply *routableMessage, challenge []byte) (*session, error) {
+	if len(reply.sessionInfo) == 0 {
+		return nil, fmt.Errorf("no session info in reply")
+	}
+	info, err := parseSessionInfo(reply.sessionInfo)
+	if err != nil {
+		return nil, fmt.Errorf("parsing session info: %w", err)
+	}
+	key, err := sharedKey(c.key, info.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if reply.signature == nil || !hmac.Equal(reply.signature.sessionInfoTag, sessionInfoTag(key, c.vin, challenge, reply.sessionInfo)) {
+		return nil, fmt.Errorf("session info is not authentic")
+	}
+	if info.status == sessionInfoKeyNotEnrolled {
+		return nil, ErrKeyNotEnrolled
+	}
+	s := &session{key: key, epoch: info.epoch, counter: info.counter, clockTime: info.clockTime, received: time.Now()}
+	c.sessions[domain] = s
+	return s, nil
+}
@@ -0,0 +1,127 @@
+package vehiclecommand
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+)
+
+// GenerateKey creates the P-256 key pair that commands are signed with. The
+// public key has to be enrolled in the vehicle.
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// MarshalPrivateKey encodes a private key as PEM.
+func MarshalPrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParsePrivateKey decodes a PEM private key.
+func ParsePrivateKey(b []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block in private key")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ec, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ec.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("private key is not a P-256 key")
+	}
+	return ec, nil
+}
+
+// MarshalPublicKey encodes a public key as PEM, the format that Tesla reads
+// from the domain of an application.
+func MarshalPublicKey(pub *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// PublicKeyBytes is the uncompressed point of a public key, which identifies
+// the key in messages.
+func PublicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	return elliptic.Marshal(elliptic.P256(), pub.X, pub.Y)
+}
+
+// sharedKey derives the session key shared with the owner of the public
+// key, the first 16 bytes of the SHA1 of the ECDH secret.
+func sharedKey(key *ecdsa.PrivateKey, public []byte) ([]byte, error) {
+	x, y := elliptic.Unmarshal(elliptic.P256(), public)
+	if x == nil {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	sx, _ := elliptic.P256().ScalarMult(x, y, key.D.Bytes())
+	secret := make([]byte, 32)
+	sx.FillBytes(secret)
+	sum := sha1.Sum(secret)
+	return sum[:16], nil
+}
+
+func subkey(key []byte, label string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+// metadata is the TLV encoded metadata that a tag authenticates along with
+// the payload.
+type metadata []byte
+
+func (m metadata) add(tag byte, v []byte) metadata {
+	m = append(m, tag, byte(len(v)))
+	return append(m, v...)
+}
+
+func (m metadata) addUint32(tag byte, v uint32) metadata {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return m.add(tag, b[:])
+}
+
+func (m metadata) tag(key []byte, payload []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(m)
+	h.Write([]byte{tagEnd})
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func commandTag(key []byte, domain int, vin string, epoch []byte, expiresAt uint32, counter uint32, payload []byte) []byte {
+	m := metadata{}.
+		add(tagSignatureType, []byte{signatureTypeHMACPersonalized}).
+		add(tagDomain, []byte{byte(domain)}).
+		add(tagPersonalization, []byte(vin)).
+		add(tagEpoch, epoch).
+		addUint32(tagExpiresAt, expiresAt).
+		addUint32(tagCounter, counter)
+	return m.tag(subkey(key, "authenticated command"), payload)
+}
+
+func sessionInfoTag(key []byte, vin string, challenge []byte, info []byte) []byte {
+	m := metadata{}.
+		add(tagSignatureType, []byte{signatureTypeHMAC}).
+		add(tagPersonalization, []byte(vin)).
+		add(tagChallenge, challenge)
+	return m.tag(subkey(key, "session info"), info)
+}
@@ -0,0 +1,268 @@
+package vehiclecommand
+
+import (
+	"fmt"
+
+	"github.com/stelund/solarchargetesla/protowire"
+)
+
+// Domains of a vehicle that messages are routed to. Charging is controlled
+// by the infotainment system, locks and wake up by vehicle security.
+const (
+	DomainVehicleSecurity = 2
+	DomainInfotainment    = 3
+)
+
+// Signature types, the type is part of the authenticated metadata. Commands
+// are authenticated with a personalized HMAC, session info with a plain
+// HMAC.
+const (
+	signatureTypeHMAC             = 6
+	signatureTypeHMACPersonalized = 8
+)
+
+// Tags of the authenticated metadata.
+const (
+	tagSignatureType   = 0
+	tagDomain          = 1
+	tagPersonalization = 2
+	tagEpoch           = 3
+	tagExpiresAt       = 4
+	tagCounter         = 5
+	tagChallenge       = 6
+	tagEnd             = 255
+)
+
+// Session info statuses.
+const (
+	sessionInfoOK             = 0
+	sessionInfoKeyNotEnrolled = 1
+)
+
+// Faults a vehicle reports for a message it refuses.
+const (
+	FaultNone                  = 0
+	FaultBusy                  = 1
+	FaultTimeout               = 2
+	FaultUnknownKeyID          = 3
+	FaultInactiveKey           = 4
+	FaultInvalidSignature      = 5
+	FaultInvalidTokenOrCounter = 6
+	FaultInsufficientPrivilege = 7
+	FaultInvalidDomains        = 8
+	FaultInvalidCommand        = 9
+	FaultDecoding              = 10
+	FaultInternal              = 11
+	FaultWrongPersonalization  = 12
+	FaultBadParameter          = 13
+	FaultIncorrectEpoch        = 15
+	FaultTimeExpired           = 17
+)
+
+var faultNames = map[int]string{
+	FaultBusy:                  "busy",
+	FaultTimeout:               "timeout",
+	FaultUnknownKeyID:          "unknown key, is it enrolled",
+	FaultInactiveKey:           "inactive key",
+	FaultInvalidSignature:      "invalid signature",
+	FaultInvalidTokenOrCounter: "invalid token or counter",
+	FaultInsufficientPrivilege: "insufficient privileges",
+	FaultInvalidDomains:        "invalid domain",
+	FaultInvalidCommand:        "invalid command",
+	FaultDecoding:              "decoding failed",
+	FaultInternal:              "internal error",
+	FaultWrongPersonalization:  "wrong vin",
+	FaultBadParameter:          "bad parameter",
+	FaultIncorrectEpoch:        "incorrect epoch",
+	FaultTimeExpired:           "message expired",
+}
+
+// FaultError is a fault reported by the vehicle.
+type FaultError struct {
+	Fault int
+}
+
+func (e *FaultError) Error() string {
+	if name, ok := faultNames[e.Fault]; ok {
+		return "vehicle refused message: " + name
+	}
+	return fmt.Sprintf("vehicle refused message: fault %d", e.Fault)
+}
+
+// resync tells if the fault is fixed by a new session, the vehicle sends its
+// session info along with these.
+func (e *FaultError) resync() bool {
+	return e.Fault == FaultInvalidTokenOrCounter || e.Fault == FaultIncorrectEpoch || e.Fault == FaultTimeExpired
+}
+
+// destination is either a domain of the vehicle or the routing address of
+// the sender that the response goes to.
+type destination struct {
+	domain         int
+	routingAddress []byte
+}
+
+func (d destination) marshal() []byte {
+	if len(d.routingAddress) > 0 {
+		return protowire.AppendBytes(nil, 2, d.routingAddress)
+	}
+	return protowire.AppendUint(nil, 1, uint64(d.domain))
+}
+
+type signatureData struct {
+	signerPublicKey []byte
+	epoch           []byte
+	counter         uint32
+	expiresAt       uint32
+	tag             []byte
+	sessionInfoTag  []byte
+}
+
+func (s signatureData) marshal() []byte {
+	b := protowire.AppendMessage(nil, 1, protowire.AppendBytes(nil, 1, s.signerPublicKey))
+	if len(s.sessionInfoTag) > 0 {
+		return protowire.AppendMessage(b, 6, protowire.AppendBytes(nil, 1, s.sessionInfoTag))
+	}
+	var h []byte
+	h = protowire.AppendBytes(h, 1, s.epoch)
+	h = protowire.AppendUint(h, 2, uint64(s.counter))
+	h = protowire.AppendFixed32(h, 3, s.expiresAt)
+	h = protowire.AppendBytes(h, 4, s.tag)
+	return protowire.AppendMessage(b, 8, h)
+}
+
+type sessionInfo struct {
+	counter   uint32
+	publicKey []byte
+	epoch     []byte
+	clockTime uint32
+	status    int
+}
+
+func (s sessionInfo) marshal() []byte {
+	var b []byte
+	b = protowire.AppendUint(b, 1, uint64(s.counter))
+	b = protowire.AppendBytes(b, 2, s.publicKey)
+	b = protowire.AppendBytes(b, 3, s.epoch)
+	b = protowire.AppendFixed32(b, 4, s.clockTime)
+	return protowire.AppendUint(b, 5, uint64(s.status))
+}
+
+func parseSessionInfo(b []byte) (sessionInfo, error) {
+	fs, err := protowire.Parse(b)
+	if err != nil {
+		return sessionInfo{}, err
+	}
+	return sessionInfo{
+		counter:   uint32(fs.Uint(1)),
+		publicKey: fs.Bytes(2),
+		epoch:     fs.Bytes(3),
+		clockTime: uint32(fs.Uint(4)),
+		status:    int(fs.Uint(5)),
+	}, nil
+}
+
+// routableMessage is the envelope of all messages to and from a vehicle.
+type routableMessage struct {
+	to                 destination
+	from               destination
+	payload            []byte
+	operationStatus    int
+	fault              int
+	signature          *signatureData
+	sessionInfoRequest []byte // public key of the sender
+	challenge          []byte
+	sessionInfo        []byte
+	requestUUID        []byte
+	uuid               []byte
+}
+
+func (m routableMessage) marshal() []byte {
+	var b []byte
+	b = protowire.AppendMessage(b, 6, m.to.marshal())
+	b = protowire.AppendMessage(b, 7, m.from.marshal())
+	b = protowire.AppendBytes(b, 10, m.payload)
+	if m.fault != FaultNone || m.operationStatus != 0 {
+		b = protowire.AppendMessage(b, 12, protowire.AppendUint(protowire.AppendUint(nil, 1, uint64(m.operationStatus)), 2, uint64(m.fault)))
+	}
+	if m.signature != nil {
+		b = protowire.AppendMessage(b, 13, m.signature.marshal())
+	}
+	if len(m.sessionInfoRequest) > 0 {
+		b = protowire.AppendMessage(b, 14, protowire.AppendBytes(protowire.AppendBytes(nil, 1, m.sessionInfoRequest), 2, m.challenge))
+	}
+	b = protowire.AppendBytes(b, 15, m.sessionInfo)
+	b = protowire.AppendBytes(b, 50, m.requestUUID)
+	return protowire.AppendBytes(b, 51, m.uuid)
+}
+
+func parseDestination(fs protowire.Fields, num int) (destination, error) {
+	d, err := fs.Message(num)
+	if err != nil {
+		return destination{}, err
+	}
+	return destination{domain: int(d.Uint(1)), routingAddress: d.Bytes(2)}, nil
+}
+
+func parseRoutableMessage(b []byte) (*routableMessage, error) {
+	fs, err := protowire.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	m := routableMessage{
+		payload:     fs.Bytes(10),
+		sessionInfo: fs.Bytes(15),
+		requestUUID: fs.Bytes(50),
+		uuid:        fs.Bytes(51),
+	}
+	if m.to, err = parseDestination(fs, 6); err != nil {
+		return nil, err
+	}
+	if m.from, err = parseDestination(fs, 7); err != nil {
+		return nil, err
+	}
+	status, err := fs.Message(12)
+	if err != nil {
+		return nil, err
+	}
+	m.operationStatus = int(status.Uint(1))
+	m.fault = int(status.Uint(2))
+	if fs.Has(13) {
+		sig, err := fs.Message(13)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := sig.Message(1)
+		if err != nil {
+			return nil, err
+		}
+		hmac, err := sig.Message(8)
+		if err != nil {
+			return nil, err
+		}
+		infoTag, err := sig.Message(6)
+		if err != nil {
+			return nil, err
+		}
+		m.signature = &signatureData{
+			signerPublicKey: signer.Bytes(1),
+			epoch:           hmac.Bytes(1),
+			counter:         uint32(hmac.Uint(2)),
+			expiresAt:       uint32(hmac.Uint(3)),
+			tag:             hmac.Bytes(4),
+			sessionInfoTag:  infoTag.Bytes(1),
+		}
+	}
+	if fs.Has(14) {
+		req, err := fs.Message(14)
+		if err != nil {
+			return nil, err
+		}
+		m.sessionInfoRequest = req.Bytes(1)
+		m.challenge = req.Bytes(2)
+		if len(m.sessionInfoRequest) == 0 {
+			return nil, fmt.Errorf("session info request without public key")
+		}
+	}
+	return &m, nil
+}
@@ -0,0 +1,209 @@
+package vehiclecommand
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// operationError is the operation status of a refused message.
+const operationError = 2
+
+// Vehicle is a simulated vehicle that verifies signed commands. Messages
+// from keys that are not enrolled, with a bad tag, a reused counter or past
+// their expiry are refused with the fault a vehicle reports. It serves the
+// signed_command endpoint of the Fleet API.
+type Vehicle struct {
+	vin   string
+	key   *ecdsa.PrivateKey
+	start time.Time
+
+	mu       sync.Mutex
+	epoch    []byte
+	enrolled map[string]uint32 // last counter by public key
+	charging bool
+	amps     int32
+}
+
+// NewVehicle creates a vehicle that is not charging, without enrolled keys.
+func NewVehicle(vin string) (*Vehicle, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	epoch, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	// The clock of a vehicle counts from the start of the epoch.
+	start := time.Now().Add(-time.Hour)
+	return &Vehicle{vin: vin, key: key, start: start, epoch: epoch, enrolled: map[string]uint32{}}, nil
+}
+
+// Enroll adds a public key, as tapping the key card does for a key request.
+func (v *Vehicle) Enroll(public []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.enrolled[string(public)]; !ok {
+		v.enrolled[string(public)] = 0
+	}
+}
+
+// Reboot starts a new epoch, which invalidates all sessions.
+func (v *Vehicle) Reboot() error {
+	epoch, err := randomBytes(16)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.epoch = epoch
+	v.start = time.Now()
+	for k := range v.enrolled {
+		v.enrolled[k] = 0
+	}
+	return nil
+}
+
+// Charging returns if the vehicle charges and its charging current.
+func (v *Vehicle) Charging() (bool, int32) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.charging, v.amps
+}
+
+func (v *Vehicle) clock() uint32 {
+	return uint32(time.Since(v.start) / time.Second)
+}
+
+// Handle answers a routable message.
+func (v *Vehicle) Handle(b []byte) ([]byte, error) {
+	m, err := parseRoutableMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	reply := routableMessage{to: m.from, from: destination{domain: m.to.domain}, requestUUID: m.uuid}
+	switch {
+	case m.to.domain != DomainInfotainment && m.to.domain != DomainVehicleSecurity:
+		reply.fault = FaultInvalidDomains
+	case len(m.sessionInfoRequest) > 0:
+		v.sessionInfo(&reply, m.sessionInfoRequest, m.uuid)
+	case m.signature == nil:
+		reply.fault = FaultInvalidSignature
+	default:
+		v.execute(&reply, m)
+	}
+	if reply.fault != FaultNone {
+		reply.operationStatus = operationError
+	}
+	return reply.marshal(), nil
+}
+
+// sessionInfo adds the session info of the vehicle for a public key to the
+// reply, authenticated with the challenge.
+func (v *Vehicle) sessionInfo(reply *routableMessage, public []byte, challenge []byte) {
+	key, err := sharedKey(v.key, public)
+	if err != nil {
+		reply.fault = FaultBadParameter
+		return
+	}
+	counter, ok := v.enrolled[string(public)]
+	info := sessionInfo{counter: counter, publicKey: PublicKeyBytes(&v.key.PublicKey), epoch: v.epoch, clockTime: v.clock()}
+	if !ok {
+		info.status = sessionInfoKeyNotEnrolled
+	}
+	reply.sessionInfo = info.marshal()
+	reply.signature = &signatureData{
+		signerPublicKey: info.publicKey,
+		sessionInfoTag:  sessionInfoTag(key, v.vin, challenge, reply.sessionInfo),
+	}
+}
+
+func (v *Vehicle) execute(reply *routableMessage, m *routableMessage) {
+	sig := m.signature
+	counter, ok := v.enrolled[string(sig.signerPublicKey)]
+	if !ok {
+		reply.fault = FaultUnknownKeyID
+		return
+	}
+	key, err := sharedKey(v.key, sig.signerPublicKey)
+	if err != nil {
+		reply.fault = FaultBadParameter
+		return
+	}
+	switch {
+	case !hmac.Equal(sig.tag, commandTag(key, m.to.domain, v.vin, sig.epoch, sig.expiresAt, sig.counter, m.payload)):
+		reply.fault = FaultInvalidSignature
+	case !bytes.Equal(sig.epoch, v.epoch):
+		reply.fault = FaultIncorrectEpoch
+	case sig.expiresAt < v.clock():
+		reply.fault = FaultTimeExpired
+	case sig.counter <= counter:
+		reply.fault = FaultInvalidTokenOrCounter
+	}
+	if reply.fault != FaultNone {
+		if reply.fault != FaultInvalidSignature {
+			v.sessionInfo(reply, sig.signerPublicKey, m.uuid)
+		}
+		return
+	}
+	v.enrolled[string(sig.signerPublicKey)] = sig.counter
+
+	a, err := parseAction(m.payload)
+	if err != nil {
+		reply.payload = actionResponse(err.Error())
+		return
+	}
+	switch a.name {
+	case "charge_start":
+		if v.charging {
+			reply.payload = actionResponse("is_charging")
+			return
+		}
+		v.charging = true
+	case "charge_stop":
+		if !v.charging {
+			reply.payload = actionResponse("not_charging")
+			return
+		}
+		v.charging = false
+	case "set_charging_amps":
+		v.amps = a.amps
+	}
+	reply.payload = actionResponse("")
+}
+
+type signedCommandRequest struct {
+	RoutableMessage string `json:"routable_message"`
+}
+
+type signedCommandResponse struct {
+	Response string `json:"response"`
+}
+
+// ServeHTTP answers a signed command posted to the Fleet API.
+func (v *Vehicle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req signedCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg, err := base64.StdEncoding.DecodeString(req.RoutableMessage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reply, err := v.Handle(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(signedCommandResponse{Response: base64.StdEncoding.EncodeToString(reply)})
+}
@@ -0,0 +1,202 @@
+package vehiclecommand
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+const testVIN = "5YJ3E1EA7KF000001"
+
+func newTestClient(t *testing.T, v *Vehicle, enroll bool) *Client {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key %v", err)
+	}
+	if enroll {
+		v.Enroll(PublicKeyBytes(&key.PublicKey))
+	}
+	c, err := NewClient(key, testVIN, func(ctx context.Context, msg []byte) ([]byte, error) {
+		return v.Handle(msg)
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client %v", err)
+	}
+	return c
+}
+
+func TestActions(t *testing.T) {
+	tests := []struct {
+		payload []byte
+		want    action
+	}{
+		{payload: ChargeStart(), want: action{name: "charge_start"}},
+		{payload: ChargeStop(), want: action{name: "charge_stop"}},
+		{payload: SetChargingAmps(13), want: action{name: "set_charging_amps", amps: 13}},
+	}
+	for _, test := range tests {
+		a, err := parseAction(test.payload)
+		if err != nil || a != test.want {
+			t.Fatalf("Expected %+v got %+v %v", test.want, a, err)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key %v", err)
+	}
+	b, err := MarshalPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key %v", err)
+	}
+	parsed, err := ParsePrivateKey(b)
+	if err != nil || parsed.D.Cmp(key.D) != 0 {
+		t.Fatalf("Expected the same key back %v", err)
+	}
+	if _, err := MarshalPublicKey(&key.PublicKey); err != nil {
+		t.Fatalf("Failed to marshal public key %v", err)
+	}
+	if _, err := ParsePrivateKey([]byte("not a key")); err == nil {
+		t.Fatalf("Expected error for an invalid key")
+	}
+}
+
+func TestExecute(t *testing.T) {
+	ctx := context.Background()
+	v, err := NewVehicle(testVIN)
+	if err != nil {
+		t.Fatalf("Failed to create vehicle %v", err)
+	}
+	c := newTestClient(t, v, true)
+
+	if err := c.Execute(ctx, DomainInfotainment, SetChargingAmps(10)); err != nil {
+		t.Fatalf("Failed to set current %v", err)
+	}
+	if err := c.Execute(ctx, DomainInfotainment, ChargeStart()); err != nil {
+		t.Fatalf("Failed to start %v", err)
+	}
+	if charging, amps := v.Charging(); !charging || amps != 10 {
+		t.Fatalf("Expected charging at 10 A got %v %d", charging, amps)
+	}
+	if err := c.Execute(ctx, DomainInfotainment, ChargeStart()); err == nil || err.Error() != "vehicle refused command: is_charging" {
+		t.Fatalf("Expected the vehicle to refuse starting again got %v", err)
+	}
+
+	// A new epoch is picked up from the session info the vehicle replies
+	// with.
+	if err := v.Reboot(); err != nil {
+		t.Fatalf("Failed to reboot %v", err)
+	}
+	if err := c.Execute(ctx, DomainInfotainment, ChargeStop()); err != nil {
+		t.Fatalf("Failed to stop after a reboot %v", err)
+	}
+	if charging, _ := v.Charging(); charging {
+		t.Fatalf("Expected charging to be stopped")
+	}
+}
+
+func TestVehicleRefuses(t *testing.T) {
+	ctx := context.Background()
+	v, err := NewVehicle(testVIN)
+	if err != nil {
+		t.Fatalf("Failed to create vehicle %v", err)
+	}
+
+	c := newTestClient(t, v, false)
+	if err := c.Handshake(ctx, DomainInfotainment); err != ErrKeyNotEnrolled {
+		t.Fatalf("Expected key not enrolled got %v", err)
+	}
+
+	c = newTestClient(t, v, true)
+	if err := c.Handshake(ctx, DomainInfotainment); err != nil {
+		t.Fatalf("Failed handshake %v", err)
+	}
+	s := c.sessions[DomainInfotainment]
+
+	// A signature for another vehicle.
+	c.vin = "5YJ3E1EA7KF000002"
+	var fault *FaultError
+	if err := c.Execute(ctx, DomainInfotainment, ChargeStart()); !errors.As(err, &fault) || fault.Fault != FaultInvalidSignature {
+		t.Fatalf("Expected invalid signature got %v", err)
+	}
+	c.vin = testVIN
+
+	// A replayed message.
+	msg := routableMessage{
+		to:      destination{domain: DomainInfotainment},
+		from:    destination{routingAddress: c.address},
+		payload: ChargeStart(),
+		signature: &signatureData{
+			signerPublicKey: PublicKeyBytes(&c.key.PublicKey),
+			epoch:           s.epoch,
+			counter:         s.counter + 10,
+			expiresAt:       s.clockTime + 10,
+			tag:             commandTag(s.key, DomainInfotainment, testVIN, s.epoch, s.clockTime+10, s.counter+10, ChargeStart()),
+		},
+		uuid: []byte("uuid"),
+	}
+	for i, want := range []int{FaultNone, FaultInvalidTokenOrCounter} {
+		b, err := v.Handle(msg.marshal())
+		if err != nil {
+			t.Fatalf("Didnt expect error %v", err)
+		}
+		reply, err := parseRoutableMessage(b)
+		if err != nil || reply.fault != want || !bytes.Equal(reply.requestUUID, msg.uuid) {
+			t.Fatalf("Expected fault %d for message %d got %+v %v", want, i, reply, err)
+		}
+	}
+
+	// An expired message.
+	msg.signature.counter += 10
+	msg.signature.expiresAt = s.clockTime - 10
+	msg.signature.tag = commandTag(s.key, DomainInfotainment, testVIN, s.epoch, msg.signature.expiresAt, msg.signature.counter, ChargeStart())
+	b, _ := v.Handle(msg.marshal())
+	if reply, err := parseRoutableMessage(b); err != nil || reply.fault != FaultTimeExpired || len(reply.sessionInfo) == 0 {
+		t.Fatalf("Expected an expired message with session info got %+v %v", reply, err)
+	}
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// TestTagLayout spells out the authenticated metadata of the protocol byte
+// by byte, the simulated vehicle shares the encoding of the client and
+// cannot catch a wrong tag or value.
+func TestTagLayout(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	challenge := []byte("fedcba9876543210")
+	info := []byte{0x08, 0x01}
+
+	// Signature type HMAC (6), the VIN and the challenge.
+	meta := append([]byte{0x00, 0x01, 0x06, 0x02, byte(len(testVIN))}, testVIN...)
+	meta = append(meta, 0x06, byte(len(challenge)))
+	meta = append(meta, challenge...)
+	want := hmacSHA256(hmacSHA256(key, []byte("session info")), meta, []byte{0xff}, info)
+	if got := sessionInfoTag(key, testVIN, challenge, info); !bytes.Equal(got, want) {
+		t.Fatalf("Expected session info tag %x got %x", want, got)
+	}
+
+	// Signature type HMAC personalized (8), the domain, the VIN, the epoch,
+	// the expiry and the counter.
+	epoch := []byte("epoch-0123456789")
+	payload := ChargeStart()
+	meta = []byte{0x00, 0x01, 0x08, 0x01, 0x01, DomainInfotainment, 0x02, byte(len(testVIN))}
+	meta = append(meta, testVIN...)
+	meta = append(meta, 0x03, byte(len(epoch)))
+	meta = append(meta, epoch...)
+	meta = append(meta, 0x04, 0x04, 0x00, 0x00, 0x01, 0x2c, 0x05, 0x04, 0x00, 0x00, 0x00, 0x07)
+	want = hmacSHA256(hmacSHA256(key, []byte("authenticated command")), meta, []byte{0xff}, payload)
+	if got := commandTag(key, DomainInfotainment, testVIN, epoch, 300, 7, payload); !bytes.Equal(got, want) {
+		t.Fatalf("Expected command tag %x got %x", want, got)
+	}
+}
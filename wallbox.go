@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+const wallboxBaseURL = "https://api.wall-box.com"
+
+// Remote actions of a Wallbox charger.
+const (
+	wallboxResume = 1
+	wallboxPause  = 2
+)
+
+type WallboxLoginResponse struct {
+	JWT string `json:"jwt"`
+}
+
+type WallboxConfigData struct {
+	MaxChargingCurrent int32 `json:"max_charging_current"`
+}
+
+// WallboxStatus is the part of a charger's status that is used, the power
+// is in kW.
+type WallboxStatus struct {
+	StatusID      int               `json:"status_id"`
+	ChargingPower float64           `json:"charging_power"`
+	ConfigData    WallboxConfigData `json:"config_data"`
+}
+
+type WallboxAction struct {
+	Action int `json:"action"`
+}
+
+type WallboxCurrent struct {
+	MaxChargingCurrent int32 `json:"maxChargingCurrent"`
+}
+
+// wallboxClient controls a Wallbox charger through the Wallbox cloud. The
+// charger only reports its power, the current is worked out with the
+// voltage and phases of car c.
+type wallboxClient struct {
+	baseURL  string
+	id       string
+	username string
+	password string
+	login    *chargerLogin
+	c        car
+}
+
+// wallboxCharging tells if a status is one of charging, and wallboxPluggedIn
+// if it is one with a car connected, such as paused, scheduled, waiting for
+// the car or in queue.
+func wallboxCharging(status int) bool {
+	return status >= 193 && status <= 195
+}
+
+func wallboxPluggedIn(status int) bool {
+	return (status >= 177 && status <= 196) || status == 210
+}
+
+func (w wallboxClient) authenticate(ctx context.Context) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", w.baseURL+"/auth/token/user", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.SetBasicAuth(w.username, w.password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", 0, errors.New(fmt.Sprintf("Status code %d when logging in to Wallbox", resp.StatusCode))
+	}
+	var r WallboxLoginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", 0, err
+	}
+	// The token is kept until it is rejected.
+	return r.JWT, 0, nil
+}
+
+func (w wallboxClient) request(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	if w.id == "" {
+		return errors.New("No charger id for Wallbox charger")
+	}
+	return w.login.authorized(ctx, w.authenticate, func(token string) error {
+		var reader io.Reader
+		if body != nil {
+			b, err := json.Marshal(body)
+			if err != nil {
+				return err
+			}
+			reader = bytes.NewReader(b)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, w.baseURL+path, reader)
+		if err != nil {
+			return err
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			return errChargerUnauthorized
+		}
+		if resp.StatusCode >= 400 {
+			return errors.New(fmt.Sprintf("Status code %d from Wallbox %s", resp.StatusCode, path))
+		}
+		if v == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	})
+}
+
+func (w wallboxClient) getCarData(ctx context.Context, carID int64) (*carData, error) {
+	var st WallboxStatus
+	err := w.request(ctx, "GET", fmt.Sprintf("/chargers/status/%s", w.id), nil, &st)
+	if err != nil {
+		return nil, err
+	}
+	data := carData{
+		IsCharging:  wallboxCharging(st.StatusID),
+		IsPluggedIn: wallboxPluggedIn(st.StatusID),
+		ChargeAmps:  st.ConfigData.MaxChargingCurrent,
+	}
+	if data.IsCharging {
+		current := st.ChargingPower * 1000 / (w.c.chargerVoltage() * w.c.chargerPhases())
+		data.ChargerActualCurrent = int32(math.Round(current))
+	}
+	return &data, nil
+}
+
+func (w wallboxClient) startCharging(ctx context.Context, carID int64) error {
+	return w.request(ctx, "POST", fmt.Sprintf("/v3/chargers/%s/remote-action", w.id), WallboxAction{Action: wallboxResume}, nil)
+}
+
+func (w wallboxClient) stopCharging(ctx context.Context, carID int64) error {
+	return w.request(ctx, "POST", fmt.Sprintf("/v3/chargers/%s/remote-action", w.id), WallboxAction{Action: wallboxPause}, nil)
+}
+
+func (w wallboxClient) setChargingAmps(ctx context.Context, carID int64, amps int32) error {
+	return w.request(ctx, "PUT", fmt.Sprintf("/v2/charger/%s", w.id), WallboxCurrent{MaxChargingCurrent: amps}, nil)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const wallboxChargingStatus = `{"status_id": 194, "charging_power": 7.36, "charging_speed": 0, "added_energy": 3.2, "config_data": {"max_charging_current": 16}}`
+
+const wallboxPausedStatus = `{"status_id": 182, "charging_power": 0, "config_data": {"max_charging_current": 10}}`
+
+const wallboxReadyStatus = `{"status_id": 161, "charging_power": 0, "config_data": {"max_charging_current": 10}}`
+
+type wallboxServer struct {
+	status  string
+	actions []int
+	current WallboxCurrent
+}
+
+func (s *wallboxServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/auth/token/user" {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user@example.com" || password != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		fmt.Fprint(w, `{"jwt": "token", "user_id": 1, "ttl": 1700000000000, "error": false, "status": 200}`)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(401)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/chargers/status/12345":
+		fmt.Fprint(w, s.status)
+	case r.Method == "POST" && r.URL.Path == "/v3/chargers/12345/remote-action":
+		var action WallboxAction
+		json.NewDecoder(r.Body).Decode(&action)
+		s.actions = append(s.actions, action.Action)
+		fmt.Fprint(w, `{"data": {}}`)
+	case r.Method == "PUT" && r.URL.Path == "/v2/charger/12345":
+		json.NewDecoder(r.Body).Decode(&s.current)
+		fmt.Fprint(w, `{"data": {}}`)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func newWallboxClient(url string, c car) wallboxClient {
+	return wallboxClient{baseURL: url, id: "12345", username: "user@example.com", password: "secret", login: &chargerLogin{}, c: c}
+}
+
+func TestWallboxGetCarData(t *testing.T) {
+	tests := []struct {
+		status string
+		c      car
+		want   carData
+	}{
+		{status: wallboxChargingStatus, c: car{ChargerVoltage: 230, ChargerPhases: 1}, want: carData{IsCharging: true, IsPluggedIn: true, ChargeAmps: 16, ChargerActualCurrent: 32}},
+		{status: wallboxChargingStatus, c: car{ChargerVoltage: 230, ChargerPhases: 3}, want: carData{IsCharging: true, IsPluggedIn: true, ChargeAmps: 16, ChargerActualCurrent: 11}},
+		{status: wallboxPausedStatus, want: carData{IsPluggedIn: true, ChargeAmps: 10}},
+		{status: wallboxReadyStatus, want: carData{ChargeAmps: 10}},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(&wallboxServer{status: test.status})
+		c := newWallboxClient(server.URL, test.c)
+		data, err := c.getCarData(context.Background(), 0)
+		server.Close()
+		if err != nil {
+			t.Fatalf("Didnt expect error reading Wallbox %v", err)
+		}
+		if *data != test.want {
+			t.Fatalf("Expected %+v but was %+v", test.want, *data)
+		}
+	}
+}
+
+func TestWallboxCommands(t *testing.T) {
+	ctx := context.Background()
+	fake := &wallboxServer{status: wallboxPausedStatus}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c := newWallboxClient(server.URL, car{})
+
+	if err := c.startCharging(ctx, 0); err != nil {
+		t.Fatalf("Failed to start %v", err)
+	}
+	if err := c.stopCharging(ctx, 0); err != nil {
+		t.Fatalf("Failed to stop %v", err)
+	}
+	if err := c.setChargingAmps(ctx, 0, 7); err != nil {
+		t.Fatalf("Failed to set current %v", err)
+	}
+	if fmt.Sprint(fake.actions) != "[1 2]" || fake.current.MaxChargingCurrent != 7 {
+		t.Fatalf("Unexpected actions %v and current %+v", fake.actions, fake.current)
+	}
+
+	c = newWallboxClient(server.URL, car{})
+	c.password = "wrong"
+	if err := c.startCharging(ctx, 0); err == nil {
+		t.Fatalf("Expected error with the wrong password")
+	}
+}